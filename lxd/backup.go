@@ -199,7 +199,7 @@ func backupCreate(s *state.State, args db.InstanceBackup, sourceInst instance.In
 		return fmt.Errorf("Error writing backup index file: %w", err)
 	}
 
-	err = pool.BackupInstance(sourceInst, tarWriter, b.OptimizedStorage(), !b.InstanceOnly(), version, nil)
+	err = pool.BackupInstance(sourceInst, tarWriter, b.OptimizedStorage(), !b.InstanceOnly(), version, op)
 	if err != nil {
 		return fmt.Errorf("Backup create: %w", err)
 	}
@@ -232,6 +232,14 @@ func backupCreate(s *state.State, args db.InstanceBackup, sourceInst instance.In
 	return nil
 }
 
+// backupCancellable returns whether a backup on the pool stops when its operation is cancelled.
+// Non-optimized backups are packed by the generic packer which checks the operation's context.
+func backupCancellable(pool storagePools.Pool, optimized bool) bool {
+	info := pool.Driver().Info()
+
+	return !optimized || !info.OptimizedBackups || info.OptimizedBackupsCancellable
+}
+
 // backupWriteIndex generates an index.yaml file and then writes it to the root of the backup tarball.
 func backupWriteIndex(sourceInst instance.Instance, pool storagePools.Pool, optimized bool, snapshots bool, version uint32, tarWriter *instancewriter.InstanceTarWriter) error {
 	// Indicate whether the driver will include a driver-specific optimized header.
@@ -260,6 +268,12 @@ func backupWriteIndex(sourceInst instance.Instance, pool storagePools.Pool, opti
 		return fmt.Errorf("Failed generating instance backup config: %w", err)
 	}
 
+	// Leave out the snapshots that aren't included in the backup.
+	partialHistory, err := pool.FilterBackupConfig(config)
+	if err != nil {
+		return fmt.Errorf("Failed filtering instance backup config: %w", err)
+	}
+
 	// Downgrade the config in case the old backup format was requested.
 	config, err = backup.ConvertFormat(config, version)
 	if err != nil {
@@ -274,6 +288,7 @@ func backupWriteIndex(sourceInst instance.Instance, pool storagePools.Pool, opti
 		OptimizedStorage: &optimized,
 		OptimizedHeader:  &poolDriverOptimizedHeader,
 		Config:           config,
+		PartialHistory:   partialHistory,
 	}
 
 	if snapshots {
@@ -393,7 +408,7 @@ func pruneExpiredInstanceBackups(ctx context.Context, s *state.State) error {
 	return nil
 }
 
-func volumeBackupCreate(s *state.State, args db.StoragePoolVolumeBackup, projectName string, poolName string, volumeName string, version uint32) error {
+func volumeBackupCreate(s *state.State, args db.StoragePoolVolumeBackup, projectName string, poolName string, volumeName string, version uint32, op *operations.Operation) error {
 	l := logger.AddContext(logger.Ctx{"project": projectName, "storage_volume": volumeName, "name": args.Name})
 	l.Debug("Volume backup started")
 	defer l.Debug("Volume backup finished")
@@ -512,7 +527,7 @@ func volumeBackupCreate(s *state.State, args db.StoragePoolVolumeBackup, project
 		return fmt.Errorf("Error writing backup index file: %w", err)
 	}
 
-	err = pool.BackupCustomVolume(projectName, volumeName, tarWriter, backupRow.OptimizedStorage, !backupRow.VolumeOnly, nil)
+	err = pool.BackupCustomVolume(projectName, volumeName, tarWriter, backupRow.OptimizedStorage, !backupRow.VolumeOnly, op)
 	if err != nil {
 		return fmt.Errorf("Backup create: %w", err)
 	}
@@ -556,6 +571,12 @@ func volumeBackupWriteIndex(projectName string, volumeName string, pool storageP
 		return fmt.Errorf("Failed generating volume backup config: %w", err)
 	}
 
+	// Leave out the snapshots that aren't included in the backup.
+	partialHistory, err := pool.FilterBackupConfig(config)
+	if err != nil {
+		return fmt.Errorf("Failed filtering volume backup config: %w", err)
+	}
+
 	customVol, err := config.CustomVolume()
 	if err != nil {
 		return fmt.Errorf("Failed getting the custom volume: %w", err)
@@ -575,6 +596,7 @@ func volumeBackupWriteIndex(projectName string, volumeName string, pool storageP
 		OptimizedHeader:  &poolDriverOptimizedHeader,
 		Type:             backupConfig.TypeCustom,
 		Config:           config,
+		PartialHistory:   partialHistory,
 	}
 
 	if snapshots {
@@ -36,6 +36,7 @@ type Info struct {
 	OptimizedHeader  *bool          `json:"optimized_header,omitempty" yaml:"optimized_header,omitempty"` // Optional field to handle older optimized backups that don't have this field.
 	Type             config.Type    `json:"type,omitempty" yaml:"type,omitempty"`                         // Type of backup.
 	Config           *config.Config `json:"config,omitempty" yaml:"config,omitempty"`                     // Equivalent of backup.yaml but embedded in index for quick retrieval.
+	PartialHistory   bool           `json:"partial_history,omitempty" yaml:"partial_history,omitempty"`   // Whether older snapshots were left out of the backup.
 }
 
 // GetInfo extracts backup information from a given ReadSeeker.
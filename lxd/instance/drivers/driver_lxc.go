@@ -5307,6 +5307,11 @@ func (d *lxc) MigrateSend(args instance.MigrateSendArgs) error {
 		return errors.New("No source migration types available")
 	}
 
+	// Content hash verification is opt-in, so only offer it when the migration requested it.
+	if args.VerifyContent {
+		poolMigrationTypes = migration.WithBTRFSContentHash(poolMigrationTypes)
+	}
+
 	// Convert the pool's migration type options to an offer header to target.
 	// Populate the Fs, ZfsFeatures and RsyncFeatures fields.
 	offerHeader := migration.TypesToHeader(poolMigrationTypes...)
@@ -5400,6 +5405,7 @@ func (d *lxc) MigrateSend(args instance.MigrateSendArgs) error {
 		VolumeOnly:         !args.Snapshots,
 		Info:               &migration.Info{Config: srcConfig},
 		ClusterMove:        args.ClusterMoveSourceName != "",
+		VerifyContent:      args.VerifyContent && slices.Contains(migrationTypes[0].Features, migration.BTRFSFeatureContentHash),
 	}
 
 	rootVol, err := volSourceArgs.Info.Config.RootVolume()
@@ -5422,11 +5428,12 @@ func (d *lxc) MigrateSend(args instance.MigrateSendArgs) error {
 	}
 
 	// If s.live is true or Criu is set to CRIUType_NONE rather than nil, it indicates that the source instance
-	// is running, and if we are doing a non-optimized transfer (i.e using rsync or raw block transfer) then we
-	// should do a two stage transfer to minimize downtime.
+	// is running, and if we are doing a non-optimized transfer (i.e using rsync or raw block transfer) or an
+	// optimized BTRFS transfer with pre-copy support then we should do a two stage transfer to minimize downtime.
 	instanceRunning := args.Live || (respHeader.Criu != nil && *respHeader.Criu == migration.CRIUType_NONE)
 	nonOptimizedMigration := volSourceArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || slices.Contains([]migration.MigrationFSType{migration.MigrationFSType_BLOCK_AND_RSYNC, migration.MigrationFSType_RBD_AND_RSYNC}, volSourceArgs.MigrationType.FSType)
-	if instanceRunning && nonOptimizedMigration {
+	btrfsMultiSync := volSourceArgs.MigrationType.FSType == migration.MigrationFSType_BTRFS && slices.Contains(volSourceArgs.MigrationType.Features, migration.BTRFSFeatureMultiSync)
+	if instanceRunning && (nonOptimizedMigration || btrfsMultiSync) {
 		// Indicate this info to the storage driver so that it can alter its behaviour if needed.
 		volSourceArgs.MultiSync = true
 	}
@@ -5490,6 +5497,11 @@ func (d *lxc) MigrateSend(args instance.MigrateSendArgs) error {
 			return err
 		}
 
+		// Clean up the storage driver state kept for the final sync if the migration fails before it.
+		if volSourceArgs.DataCleanup != nil {
+			defer volSourceArgs.DataCleanup()
+		}
+
 		d.logger.Debug("Finished storage migration phase")
 
 		if args.Live {
@@ -5920,7 +5932,8 @@ func (d *lxc) MigrateReceive(args instance.MigrateReceiveArgs) error {
 	// Extract the source's migration type and then match it against our pool's supported types and features.
 	// If a match is found the combined features list will be sent back to requester.
 	contentType := storagePools.InstanceContentType(d)
-	respTypes, err := migration.MatchTypes(offerHeader, storagePools.FallbackMigrationType(contentType), pool.MigrationTypes(contentType, args.Refresh, args.Snapshots))
+	// Content hash verification is accepted if the source requested it.
+	respTypes, err := migration.MatchTypes(offerHeader, storagePools.FallbackMigrationType(contentType), migration.WithBTRFSContentHash(pool.MigrationTypes(contentType, args.Refresh, args.Snapshots)))
 	if err != nil {
 		return err
 	}
@@ -6141,6 +6154,7 @@ func (d *lxc) MigrateReceive(args instance.MigrateReceiveArgs) error {
 			VolumeSize:            offerHeader.GetVolumeSize(), // Block size setting override.
 			VolumeOnly:            !args.Snapshots,
 			ClusterMoveSourceName: args.ClusterMoveSourceName,
+			VerifyContent:         slices.Contains(respTypes[0].Features, migration.BTRFSFeatureContentHash),
 		}
 
 		// At this point we have already figured out the parent container's root
@@ -6545,6 +6545,11 @@ func (d *qemu) MigrateSend(args instance.MigrateSendArgs) error {
 		return errors.New("No source migration types available")
 	}
 
+	// Content hash verification is opt-in, so only offer it when the migration requested it.
+	if args.VerifyContent {
+		poolMigrationTypes = migration.WithBTRFSContentHash(poolMigrationTypes)
+	}
+
 	// Convert the pool's migration type options to an offer header to target.
 	// Populate the Fs, ZfsFeatures and RsyncFeatures fields.
 	offerHeader := migration.TypesToHeader(poolMigrationTypes...)
@@ -6620,6 +6625,7 @@ func (d *qemu) MigrateSend(args instance.MigrateSendArgs) error {
 		VolumeOnly:         !args.Snapshots,
 		Info:               &migration.Info{Config: srcConfig},
 		ClusterMove:        args.ClusterMoveSourceName != "",
+		VerifyContent:      args.VerifyContent && slices.Contains(migrationTypes[0].Features, migration.BTRFSFeatureContentHash),
 	}
 
 	// Only send the snapshots that the target requests when refreshing.
@@ -7171,7 +7177,8 @@ func (d *qemu) MigrateReceive(args instance.MigrateReceiveArgs) error {
 	// Extract the source's migration type and then match it against our pool's supported types and features.
 	// If a match is found the combined features list will be sent back to requester.
 	contentType := storagePools.InstanceContentType(d)
-	respTypes, err := migration.MatchTypes(offerHeader, storagePools.FallbackMigrationType(contentType), pool.MigrationTypes(contentType, args.Refresh, args.Snapshots))
+	// Content hash verification is accepted if the source requested it.
+	respTypes, err := migration.MatchTypes(offerHeader, storagePools.FallbackMigrationType(contentType), migration.WithBTRFSContentHash(pool.MigrationTypes(contentType, args.Refresh, args.Snapshots)))
 	if err != nil {
 		return err
 	}
@@ -7369,6 +7376,7 @@ func (d *qemu) MigrateReceive(args instance.MigrateReceiveArgs) error {
 			VolumeSize:            offerHeader.GetVolumeSize(), // Block size setting override.
 			VolumeOnly:            !args.Snapshots,
 			ClusterMoveSourceName: args.ClusterMoveSourceName,
+			VerifyContent:         slices.Contains(respTypes[0].Features, migration.BTRFSFeatureContentHash),
 		}
 
 		// At this point we have already figured out the parent instances's root
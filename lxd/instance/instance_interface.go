@@ -244,6 +244,7 @@ type MigrateSendArgs struct {
 	MigrateArgs
 
 	AllowInconsistent bool
+	VerifyContent     bool
 }
 
 // MigrateReceiveArgs represent arguments for instance migration receive.
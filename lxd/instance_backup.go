@@ -26,6 +26,7 @@ import (
 	"github.com/canonical/lxd/lxd/project/limits"
 	"github.com/canonical/lxd/lxd/request"
 	"github.com/canonical/lxd/lxd/response"
+	storagePools "github.com/canonical/lxd/lxd/storage"
 	"github.com/canonical/lxd/lxd/util"
 	"github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/api"
@@ -378,8 +379,19 @@ func instanceBackupsPost(d *Daemon, r *http.Request) response.Response {
 
 	resources["backups"] = []api.URL{*api.NewURL().Path(version.APIVersion, "instances", name, "backups", backupName)}
 
+	pool, err := storagePools.LoadByInstance(s, inst)
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	// Cancelling the operation stops the backup through the operation's context if the driver checks it.
+	var onCancel func(op *operations.Operation) error
+	if backupCancellable(pool, req.OptimizedStorage) {
+		onCancel = func(op *operations.Operation) error { return nil }
+	}
+
 	op, err := operations.OperationCreate(r.Context(), s, projectName, operations.OperationClassTask,
-		operationtype.BackupCreate, resources, nil, backup, nil, nil)
+		operationtype.BackupCreate, resources, nil, backup, onCancel, nil)
 	if err != nil {
 		return response.InternalError(err)
 	}
@@ -35,6 +35,7 @@ type migrationFields struct {
 	// storage specific fields
 	volumeOnly        bool
 	allowInconsistent bool
+	verifyContent     bool
 }
 
 func (c *migrationFields) send(m proto.Message) error {
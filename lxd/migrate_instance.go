@@ -150,6 +150,7 @@ func (s *migrationSourceWs) Do(state *state.State, migrateOp *operations.Operati
 			ClusterMoveSourceName: s.clusterMoveSourceName,
 		},
 		AllowInconsistent: s.allowInconsistent,
+		VerifyContent:     s.verifyContent,
 	})
 	if err != nil {
 		l.Error("Failed migration on source", logger.Ctx{"err": err})
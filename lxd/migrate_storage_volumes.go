@@ -117,6 +117,11 @@ func (s *migrationSourceWs) DoStorage(state *state.State, projectName string, po
 		return errors.New("No source migration types available")
 	}
 
+	// Content hash verification is opt-in, so only offer it when the migration requested it.
+	if s.verifyContent {
+		poolMigrationTypes = migration.WithBTRFSContentHash(poolMigrationTypes)
+	}
+
 	// Convert the pool's migration type options to an offer header to target.
 	offerHeader := migration.TypesToHeader(poolMigrationTypes...)
 
@@ -168,6 +173,7 @@ func (s *migrationSourceWs) DoStorage(state *state.State, projectName string, po
 		ContentType:        customVol.ContentType,
 		Info:               &migration.Info{Config: srcConfig},
 		VolumeOnly:         s.volumeOnly,
+		VerifyContent:      s.verifyContent && slices.Contains(migrationTypes[0].Features, migration.BTRFSFeatureContentHash),
 	}
 
 	// Only send the snapshots that the target requests when refreshing.
@@ -304,7 +310,8 @@ func (c *migrationSink) DoStorage(state *state.State, projectName string, poolNa
 	// Extract the source's migration type and then match it against our pool's
 	// supported types and features. If a match is found the combined features list
 	// will be sent back to requester.
-	respTypes, err := migration.MatchTypes(offerHeader, storagePools.FallbackMigrationType(contentType), pool.MigrationTypes(contentType, c.refresh, !c.volumeOnly))
+	// Content hash verification is accepted if the source requested it.
+	respTypes, err := migration.MatchTypes(offerHeader, storagePools.FallbackMigrationType(contentType), migration.WithBTRFSContentHash(pool.MigrationTypes(contentType, c.refresh, !c.volumeOnly)))
 	if err != nil {
 		return err
 	}
@@ -335,6 +342,7 @@ func (c *migrationSink) DoStorage(state *state.State, projectName string, poolNa
 			ContentType:        req.ContentType,
 			Refresh:            args.refresh,
 			VolumeOnly:         args.volumeOnly,
+			VerifyContent:      slices.Contains(respTypes[0].Features, migration.BTRFSFeatureContentHash),
 		}
 
 		// A zero length Snapshots slice indicates volume only migration in
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"slices"
+	"time"
 
 	backupConfig "github.com/canonical/lxd/lxd/backup/config"
 	"github.com/canonical/lxd/lxd/operations"
@@ -54,13 +55,15 @@ type VolumeSourceArgs struct {
 	TrackProgress      bool
 	MultiSync          bool
 	FinalSync          bool
-	Data               any // Optional store to persist storage driver state between MultiSync phases.
+	Data               any    // Optional store to persist storage driver state between MultiSync phases.
+	DataCleanup        func() // Optional function to clean up the state in Data if the final sync isn't run.
 	ContentType        string
 	AllowInconsistent  bool
 	Refresh            bool
 	Info               *Info
 	VolumeOnly         bool
 	ClusterMove        bool
+	VerifyContent      bool
 }
 
 // VolumeTargetArgs represents the arguments needed to setup a volume migration sink.
@@ -79,6 +82,7 @@ type VolumeTargetArgs struct {
 	ContentType           string
 	VolumeOnly            bool
 	ClusterMoveSourceName string
+	VerifyContent         bool
 }
 
 // TypesToHeader converts one or more Types to a MigrationHeader. It uses the first type argument
@@ -133,6 +137,10 @@ func TypesToHeader(types ...Type) *MigrationHeader {
 				features.HeaderSubvolumes = &hasFeature
 			case BTRFSFeatureSubvolumeUUIDs:
 				features.HeaderSubvolumeUuids = &hasFeature
+			case BTRFSFeatureMultiSync:
+				features.MultiSync = &hasFeature
+			case BTRFSFeatureContentHash:
+				features.ContentHash = &hasFeature
 			}
 		}
 
@@ -255,7 +263,58 @@ func MatchTypes(offer *MigrationHeader, fallbackType MigrationFSType, ourTypes [
 	return matchedTypes, nil
 }
 
+// WithBTRFSContentHash returns a copy of types with the BTRFSFeatureContentHash feature added to any BTRFS type.
+// Content hash verification is opt-in, so storage drivers don't include it in their migration types. Instead the
+// source adds it to its offer when verification was requested and the target adds it to the types it matches the
+// offer against, so that the feature is only negotiated when both sides support it and the source asked for it.
+func WithBTRFSContentHash(types []Type) []Type {
+	result := make([]Type, 0, len(types))
+	for _, t := range types {
+		if t.FSType == MigrationFSType_BTRFS && !slices.Contains(t.Features, BTRFSFeatureContentHash) {
+			t.Features = append(slices.Clone(t.Features), BTRFSFeatureContentHash)
+		}
+
+		result = append(result, t)
+	}
+
+	return result
+}
+
 func progressWrapperRender(op *operations.Operation, key string, description string, progressInt int64, speedInt int64) {
+	progressRender(op, key, description, progressInt, speedInt, nil)
+}
+
+// progressThroughput computes the instantaneous throughput from the deltas between progress updates.
+type progressThroughput struct {
+	lastTotal int64
+	lastTime  time.Time
+}
+
+// update records the latest total and returns the current and average throughput in bytes per second.
+func (t *progressThroughput) update(total int64, average int64) map[string]int64 {
+	now := time.Now()
+
+	// Until there is a previous update, the average is the best estimate of the current throughput.
+	current := average
+	if !t.lastTime.IsZero() {
+		elapsed := now.Sub(t.lastTime).Seconds()
+		if elapsed > 0 {
+			current = int64(float64(total-t.lastTotal) / elapsed)
+		}
+	}
+
+	t.lastTotal = total
+	t.lastTime = now
+
+	return map[string]int64{
+		"current": current,
+		"average": average,
+	}
+}
+
+// progressRender updates the progress of key in the operation metadata.
+// If throughput is provided, the current and average throughput are also recorded under "<key>_throughput".
+func progressRender(op *operations.Operation, key string, description string, progressInt int64, speedInt int64, throughput *progressThroughput) {
 	meta := op.Metadata()
 	if meta == nil {
 		meta = make(map[string]any)
@@ -266,10 +325,17 @@ func progressWrapperRender(op *operations.Operation, key string, description str
 		progress = fmt.Sprintf("%s: %s (%s/s)", description, units.GetByteSizeString(progressInt, 2), units.GetByteSizeString(speedInt, 2))
 	}
 
-	if meta[key] != progress {
-		meta[key] = progress
-		_ = op.UpdateMetadata(meta)
+	if meta[key] == progress {
+		return
 	}
+
+	meta[key] = progress
+
+	if throughput != nil {
+		meta[key+"_throughput"] = throughput.update(progressInt, speedInt)
+	}
+
+	_ = op.UpdateMetadata(meta)
 }
 
 // ProgressReader reports the read progress.
@@ -317,13 +383,20 @@ func ProgressWriter(op *operations.Operation, key string, description string) fu
 }
 
 // ProgressTracker returns a migration I/O tracker.
+// Along with the progress, the current and average throughput in bytes per second are recorded in the
+// operation metadata under "<key>_throughput".
 func ProgressTracker(op *operations.Operation, key string, description string) *ioprogress.ProgressTracker {
-	progress := func(progressInt int64, speedInt int64) {
-		progressWrapperRender(op, key, description, progressInt, speedInt)
-	}
+	tracker := &ioprogress.ProgressTracker{}
+	throughput := &progressThroughput{}
+
+	tracker.Handler = func(progressInt int64, speedInt int64) {
+		// The progress is a percentage rather than a byte count if the length is known.
+		if tracker.Length > 0 {
+			progressWrapperRender(op, key, description, progressInt, speedInt)
+			return
+		}
 
-	tracker := &ioprogress.ProgressTracker{
-		Handler: progress,
+		progressRender(op, key, description, progressInt, speedInt, throughput)
 	}
 
 	return tracker
@@ -16,6 +16,12 @@ const BTRFSFeatureSubvolumes = "header_subvolumes"
 // BTRFSFeatureSubvolumeUUIDs indicates that the header will include subvolume UUIDs.
 const BTRFSFeatureSubvolumeUUIDs = "header_subvolume_uuids"
 
+// BTRFSFeatureMultiSync indicates a running volume can be sent in pre-copy rounds followed by a final sync.
+const BTRFSFeatureMultiSync = "multi_sync"
+
+// BTRFSFeatureContentHash indicates the source will send a content hash of the volume for the target to verify.
+const BTRFSFeatureContentHash = "content_hash"
+
 // ZFSFeatureMigrationHeader indicates a migration header will be sent/recv in data channel after index header.
 const ZFSFeatureMigrationHeader = "migration_header"
 
@@ -99,6 +105,14 @@ func (m *MigrationHeader) GetBtrfsFeaturesSlice() []string {
 		if m.BtrfsFeatures.HeaderSubvolumeUuids != nil && *m.BtrfsFeatures.HeaderSubvolumeUuids {
 			features = append(features, BTRFSFeatureSubvolumeUUIDs)
 		}
+
+		if m.BtrfsFeatures.MultiSync != nil && *m.BtrfsFeatures.MultiSync {
+			features = append(features, BTRFSFeatureMultiSync)
+		}
+
+		if m.BtrfsFeatures.ContentHash != nil && *m.BtrfsFeatures.ContentHash {
+			features = append(features, BTRFSFeatureContentHash)
+		}
 	}
 
 	return features
@@ -120,6 +120,9 @@ type Operation struct {
 	// Indicates if operation has finished.
 	finished cancel.Canceller
 
+	// Indicates if operation has been cancelled or has finished.
+	cancelled cancel.Canceller
+
 	// Locking for concurent access to the Operation
 	lock sync.Mutex
 
@@ -149,6 +152,7 @@ func OperationCreate(ctx context.Context, s *state.State, projectName string, op
 	op.url = "/" + version.APIVersion + "/operations/" + op.id
 	op.resources = opResources
 	op.finished = cancel.New()
+	op.cancelled = cancel.New()
 	op.state = s
 	op.logger = logger.AddContext(logger.Ctx{"operation": op.id, "project": op.projectName, "class": op.class.String(), "description": op.description})
 
@@ -245,6 +249,7 @@ func (op *Operation) done() {
 	op.onCancel = nil
 	op.onConnect = nil
 	op.finished.Cancel()
+	op.cancelled.Cancel()
 	op.lock.Unlock()
 
 	go func() {
@@ -296,6 +301,17 @@ func (op *Operation) Start() error {
 	if op.onRun != nil {
 		go func(op *Operation) {
 			err := op.onRun(op)
+
+			// Leave the status of an operation which has been cancelled while running as is.
+			op.lock.Lock()
+			cancelled := op.status == api.Cancelled
+			op.lock.Unlock()
+
+			if cancelled {
+				op.logger.Debug("Run of cancelled operation returned", logger.Ctx{"err": err})
+				return
+			}
+
 			if err != nil {
 				op.lock.Lock()
 				op.status = api.Failure
@@ -646,6 +662,12 @@ func (op *Operation) ExtendMetadata(metadata any) error {
 	return nil
 }
 
+// Context returns a context which is cancelled once the operation is cancelled or has finished.
+// Long running tasks of the operation can use it to stop early when the operation is cancelled.
+func (op *Operation) Context() context.Context {
+	return op.cancelled
+}
+
 // ID returns the operation ID.
 func (op *Operation) ID() string {
 	return op.id
@@ -3333,6 +3333,9 @@ func (b *lxdBackend) BackupInstance(inst instance.Instance, tarWriter *instancew
 		}
 	}
 
+	// Leave out the snapshots that the driver excludes from backups, as is done for the backup index.
+	snapNames, _ = b.driver.FilterBackupSnapshots(vol, snapNames)
+
 	volCopy := drivers.NewVolumeCopy(vol, sourceSnapshots...)
 
 	err = b.driver.BackupVolume(volCopy, tarWriter, optimized, snapNames, op)
@@ -4280,6 +4283,18 @@ func (b *lxdBackend) EnsureImage(fingerprint string, op *operations.Operation) e
 				return fmt.Errorf("Failed deleting leftover/partially unpacked image volume: %w", err)
 			}
 		}
+	} else if imgDBVol != nil && b.driver.Info().Name == "btrfs" && shared.PathExists(imgVol.MountPath()) {
+		// The btrfs driver reports a volume whose fill was interrupted (such as by LXD exiting unexpectedly
+		// during an image unpack) as missing while it's still on disk, and removes it when the volume is
+		// created again. Its record was left behind too, so remove it before unpacking the image again.
+		l.Warn("Deleting record of partially unpacked image volume")
+		err = VolumeDBDelete(b, api.ProjectDefaultName, image.Fingerprint, drivers.VolumeTypeImage)
+		if err != nil {
+			return fmt.Errorf("Failed deleting record of partially unpacked image volume: %w", err)
+		}
+
+		imgDBVol = nil
+		imgVol = b.GetNewVolume(drivers.VolumeTypeImage, contentType, image.Fingerprint, nil)
 	}
 
 	volFiller := drivers.VolumeFiller{
@@ -7115,6 +7130,59 @@ func (b *lxdBackend) GenerateInstanceBackupConfig(inst instance.Instance, snapsh
 	return config, nil
 }
 
+// FilterBackupConfig removes the snapshots that the storage driver leaves out of backups of the volume from the
+// backup config, so that the backup index lists the same snapshots as the backup's content.
+// Returns whether older snapshots are left out, in which case the backup has a partial history.
+func (b *lxdBackend) FilterBackupConfig(config *backupConfig.Config) (bool, error) {
+	if len(config.Volumes) != 1 {
+		return false, errors.New("Backup config must contain exactly one volume")
+	}
+
+	volConfig := config.Volumes[0]
+	if len(volConfig.Snapshots) == 0 {
+		return false, nil
+	}
+
+	volDBType, err := cluster.StoragePoolVolumeTypeFromName(volConfig.Type)
+	if err != nil {
+		return false, err
+	}
+
+	contentDBType, err := cluster.StoragePoolVolumeContentTypeFromName(volConfig.ContentType)
+	if err != nil {
+		return false, err
+	}
+
+	volType := VolumeDBTypeToType(volDBType)
+
+	var volStorageName string
+	if volType == drivers.VolumeTypeCustom {
+		volStorageName = project.StorageVolume(volConfig.Project, volConfig.Name)
+	} else {
+		volStorageName = project.Instance(volConfig.Project, volConfig.Name)
+	}
+
+	vol := b.GetVolume(volType, VolumeDBContentTypeToContentType(contentDBType), volStorageName, volConfig.Config)
+
+	// Get the snapshot names in age order, oldest first, as passed to the storage driver on backup.
+	snapNames := make([]string, 0, len(volConfig.Snapshots))
+	for _, snap := range volConfig.Snapshots {
+		snapNames = append(snapNames, snap.Name)
+	}
+
+	snapNames, partialHistory := b.driver.FilterBackupSnapshots(vol, snapNames)
+
+	volConfig.Snapshots = slices.DeleteFunc(volConfig.Snapshots, func(snap *api.StorageVolumeSnapshot) bool {
+		return !slices.Contains(snapNames, snap.Name)
+	})
+
+	config.Snapshots = slices.DeleteFunc(config.Snapshots, func(snap *api.InstanceSnapshot) bool {
+		return !slices.Contains(snapNames, snap.Name)
+	})
+
+	return partialHistory, nil
+}
+
 // UpdateInstanceBackupFile writes the instance's config to the backup.yaml file on the storage device.
 func (b *lxdBackend) UpdateInstanceBackupFile(inst instance.Instance, snapshots bool, version uint32, op *operations.Operation) error {
 	l := b.logger.AddContext(logger.Ctx{"project": inst.Project().Name, "instance": inst.Name()})
@@ -7854,6 +7922,9 @@ func (b *lxdBackend) BackupCustomVolume(projectName string, volName string, tarW
 
 	vol := b.GetVolume(drivers.VolumeTypeCustom, drivers.ContentType(volume.ContentType), volStorageName, volume.Config)
 
+	// Leave out the snapshots that the driver excludes from backups, as is done for the backup index.
+	snapNames, _ = b.driver.FilterBackupSnapshots(vol, snapNames)
+
 	volCopy := drivers.NewVolumeCopy(vol, sourceSnapshots...)
 
 	err = b.driver.BackupVolume(volCopy, tarWriter, optimized, snapNames, op)
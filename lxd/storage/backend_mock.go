@@ -182,6 +182,11 @@ func (b *mockBackend) GenerateInstanceBackupConfig(inst instance.Instance, snaps
 	return nil, nil
 }
 
+// FilterBackupConfig ...
+func (b *mockBackend) FilterBackupConfig(config *backupConfig.Config) (bool, error) {
+	return false, nil
+}
+
 // UpdateInstanceBackupFile ...
 func (b *mockBackend) UpdateInstanceBackupFile(inst instance.Instance, snapshot bool, version uint32, op *operations.Operation) error {
 	return nil
@@ -7,7 +7,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -17,6 +19,7 @@ import (
 	"github.com/canonical/lxd/lxd/storage/filesystem"
 	"github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/api"
+	"github.com/canonical/lxd/shared/logger"
 	"github.com/canonical/lxd/shared/revert"
 	"github.com/canonical/lxd/shared/units"
 	"github.com/canonical/lxd/shared/validate"
@@ -27,6 +30,33 @@ var btrfsVersion string
 var btrfsLoaded bool
 var btrfsPropertyForce bool
 
+var btrfsKernelFeatures []string
+var btrfsKernelFeaturesMu sync.Mutex
+
+var btrfsTransientPaths = map[string]int{}
+var btrfsTransientPathsMu sync.Mutex
+
+var btrfsFillingPaths = map[string]int{}
+var btrfsFillingPathsMu sync.Mutex
+
+var btrfsQGroupTables = map[string]*btrfsQGroupTable{}
+var btrfsQGroupTablesMu sync.Mutex
+
+var btrfsFillSlots = map[string]*btrfsFillSemaphore{}
+var btrfsFillSlotsMu sync.Mutex
+
+var btrfsSnapshotSlots = map[string]time.Time{}
+var btrfsSnapshotSlotsMu sync.Mutex
+
+var btrfsMaintenance = map[string]string{}
+var btrfsMaintenanceMu sync.Mutex
+
+var btrfsEventSinks = map[string]func(BTRFSEvent){}
+var btrfsEventSinksMu sync.Mutex
+
+var btrfsVolumeReservations = map[string]int{}
+var btrfsVolumeReservationsMu sync.Mutex
+
 type btrfs struct {
 	common
 }
@@ -98,6 +128,7 @@ func (d *btrfs) Info() Info {
 		OptimizedImages:              true,
 		OptimizedBackups:             true,
 		OptimizedBackupHeader:        true,
+		OptimizedBackupsCancellable:  true,
 		PreservesInodes:              !d.state.OS.RunningInUserNS,
 		Remote:                       d.isRemote(),
 		VolumeTypes:                  []VolumeType{VolumeTypeBucket, VolumeTypeCustom, VolumeTypeImage, VolumeTypeContainer, VolumeTypeVM},
@@ -176,10 +207,22 @@ func (d *btrfs) Create() error {
 
 		revert.Add(func() { _ = os.Remove(d.config["source"]) })
 
-		// Format the file.
-		_, err = makeFSType(d.config["source"], "btrfs", &mkfsOptions{Label: d.name})
-		if err != nil {
-			return fmt.Errorf("Failed to format sparse file: %w", err)
+		if d.config["btrfs.seed"] != "" {
+			err = d.sproutSeed(d.config["source"])
+			if err != nil {
+				return err
+			}
+		} else {
+			// Format the file.
+			_, err = makeFSType(d.config["source"], "btrfs", &mkfsOptions{Label: d.name})
+			if err != nil {
+				return fmt.Errorf("Failed to format sparse file: %w", err)
+			}
+
+			err = d.createSubvolumePrefix(d.config["source"])
+			if err != nil {
+				return err
+			}
 		}
 	} else if shared.IsBlockdevPath(d.config["volatile.initial_source"]) {
 		// Make sure to use the block volumes `volatile.initial_source` here
@@ -196,10 +239,22 @@ func (d *btrfs) Create() error {
 			d.config["source.wipe"] = ""
 		}
 
-		// Format the block device.
-		_, err := makeFSType(d.config["volatile.initial_source"], "btrfs", &mkfsOptions{Label: d.name})
-		if err != nil {
-			return fmt.Errorf("Failed to format block device: %w", err)
+		if d.config["btrfs.seed"] != "" {
+			err := d.sproutSeed(d.config["volatile.initial_source"])
+			if err != nil {
+				return err
+			}
+		} else {
+			// Format the block device.
+			_, err := makeFSType(d.config["volatile.initial_source"], "btrfs", &mkfsOptions{Label: d.name})
+			if err != nil {
+				return fmt.Errorf("Failed to format block device: %w", err)
+			}
+
+			err = d.createSubvolumePrefix(d.config["volatile.initial_source"])
+			if err != nil {
+				return err
+			}
 		}
 
 		// Record the UUID as the source.
@@ -221,6 +276,14 @@ func (d *btrfs) Create() error {
 			d.config["source"] = d.config["volatile.initial_source"]
 		}
 	} else if d.config["source"] != "" {
+		if d.config["btrfs.subvolume_prefix"] != "" {
+			return errors.New("btrfs.subvolume_prefix can only be used with loop file or block device backed pools")
+		}
+
+		if d.config["btrfs.seed"] != "" {
+			return fmt.Errorf("btrfs.seed can only be used with loop file or block device backed pools: %w", ErrNotSupported)
+		}
+
 		hostPath := shared.HostPath(d.config["source"])
 		if d.isSubvolume(hostPath) {
 			// Existing btrfs subvolume.
@@ -351,6 +414,242 @@ func (d *btrfs) Validate(config map[string]string) error {
 		//  shortdesc: Mount options for block devices
 		//  scope: global
 		"btrfs.mount_options": validate.IsAny,
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.subvolume_prefix)
+		// When set, a subvolume with this name is created at the top level of the Btrfs file system
+		// and the storage pool is mounted from it, so all subvolumes of the pool are listed under this prefix.
+		// This can only be set when creating a loop file or block device backed storage pool.
+		// ---
+		//  type: string
+		//  shortdesc: Name of the top-level subvolume that holds the storage pool
+		//  scope: global
+		"btrfs.subvolume_prefix": validate.Optional(validate.IsDeviceName, validate.IsURLSegmentSafe),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.seed)
+		// Path to a block device or file holding a read-only Btrfs seed file system (see `btrfstune -S 1`)
+		// to use as the base of the storage pool. Instead of being formatted, the pool's loop file or block
+		// device is added to the seed file system as its writable device, so the pool starts with the
+		// content of the seed and all changes are written to the pool's device. The seed stays read-only
+		// and must remain available for the pool to be mounted.
+		// This can only be set when creating a loop file or block device backed storage pool.
+		// ---
+		//  type: string
+		//  shortdesc: Read-only seed file system the pool is based on
+		//  scope: local
+		"btrfs.seed": validate.Optional(validate.IsAbsFilePath),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.quota.simple)
+		// When enabled, quotas are enabled in simple quota (`squota`) mode, which avoids the accounting
+		// overhead of classic quota groups. Usage is then accounted to the subvolume that first wrote the data,
+		// so snapshots only report data written to them after they were taken.
+		// This requires kernel support and cannot be changed while quotas are enabled on the pool.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether to use simple quotas
+		//  scope: global
+		"btrfs.quota.simple": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.qgroup.parent)
+		// Higher level quota group (for example `1/100`) that the subvolumes of new empty volumes are made
+		// members of when they are created, so that their usage is accounted to it from the start. The quota
+		// group is created if needed. Volumes created as snapshots of other volumes, such as instances
+		// created from images, aren't added to it. This only has an effect while quotas are enabled.
+		// ---
+		//  type: string
+		//  shortdesc: Parent quota group of new volumes
+		//  scope: global
+		"btrfs.qgroup.parent": validate.Optional(func(value string) error {
+			_, _, err := btrfsParseParentQGroup(value)
+			return err
+		}),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.max_concurrent_fills)
+		// This limits how many volumes of the pool can be filled (for example unpacked from an image) at
+		// the same time. Further volume creations wait for a running fill to complete.
+		// Set to `0` for no limit.
+		// ---
+		//  type: integer
+		//  defaultdesc: `0`
+		//  shortdesc: Maximum number of volumes being filled concurrently
+		//  scope: global
+		"btrfs.max_concurrent_fills": validate.Optional(validate.IsUint32),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.max_volumes)
+		// This limits how many instance and custom volumes can be created on the pool.
+		// Snapshots and cached image volumes don't count towards the limit.
+		// Set to `0` for no limit.
+		// ---
+		//  type: integer
+		//  defaultdesc: `0`
+		//  shortdesc: Maximum number of volumes on the pool
+		//  scope: global
+		"btrfs.max_volumes": validate.Optional(validate.IsUint32),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.delete_mode)
+		// With `deferred`, deleting a volume or snapshot returns as soon as the subvolume is unlinked and its
+		// space is reclaimed in the background, which avoids I/O stalls when deleting large subvolumes.
+		// With `sync`, each deletion waits for the transaction to be committed so that the space is
+		// accounted as free when the deletion completes.
+		// ---
+		//  type: string
+		//  defaultdesc: `deferred`
+		//  shortdesc: How subvolumes are deleted (`deferred` or `sync`)
+		//  scope: global
+		"btrfs.delete_mode": validate.Optional(validate.IsOneOf("deferred", "sync")),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.snapshots.strict_cleanup)
+		// When enabled, failing to remove the snapshots directory of a volume after deleting its last snapshot
+		// or the volume itself fails the deletion. Otherwise the failure is only logged as a warning, as the
+		// snapshot or volume itself was removed.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether failing to remove a snapshots directory fails the deletion
+		//  scope: global
+		"btrfs.snapshots.strict_cleanup": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.snapshots.sync)
+		// When enabled and quotas are enabled on the pool, the file system is synced before each snapshot is
+		// taken. This writes out the pending data before the snapshot rather than in the same transaction,
+		// which spreads the qgroup accounting load when many snapshots are taken.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether to sync the file system before snapshots when quotas are enabled
+		//  scope: global
+		"btrfs.snapshots.sync": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.snapshots.pace_interval)
+		// Minimum number of milliseconds between the snapshots taken on the pool when quotas are enabled.
+		// Snapshots requested sooner wait for their turn, which smooths the metadata load of snapshot bursts.
+		// The maximum is `60000` (one minute).
+		// ---
+		//  type: integer
+		//  defaultdesc: `0`
+		//  shortdesc: Minimum time between snapshots on the pool when quotas are enabled
+		//  scope: global
+		"btrfs.snapshots.pace_interval": validate.Optional(validate.IsInRange(0, btrfsMaxSnapshotPaceInterval)),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.restore_method)
+		// With `replace`, restoring a snapshot replaces the volume with a new snapshot of it.
+		// With `diff`, only the files changed since the snapshot are restored in place, which keeps the
+		// identity of the volume's subvolume. Restores fall back to `replace` when the changes can't be
+		// determined reliably, for example for volumes with nested subvolumes or after an earlier restore.
+		// ---
+		//  type: string
+		//  defaultdesc: `replace`
+		//  shortdesc: How snapshots are restored (`replace` or `diff`)
+		//  scope: global
+		"btrfs.restore_method": validate.Optional(validate.IsOneOf("replace", "diff")),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.quota.defer_restore)
+		// When enabled, the quota of a volume restored from an optimized backup is only set once all of its
+		// snapshots and subvolumes have been restored, instead of as soon as the volume itself is in place.
+		// This speeds up restoring volumes with many snapshots and avoids hitting the limit during the restore.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether to defer setting the quota when restoring a backup
+		//  scope: global
+		"btrfs.quota.defer_restore": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.block.format)
+		// Set to `qcow2` to keep the root disk of VM image volumes in qcow2 format to save space.
+		// The disk is converted to raw when an instance is created from the image, which makes creating
+		// instances slower. Changing this only affects image volumes created afterwards.
+		// ---
+		//  type: string
+		//  defaultdesc: `raw`
+		//  shortdesc: Format of the root disk of VM image volumes (`raw` or `qcow2`)
+		//  scope: global
+		"btrfs.block.format": validate.Optional(validate.IsOneOf("raw", "qcow2")),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.restore.bandwidth_limit)
+		// This limits the rate at which volumes are received when restoring an optimized backup or
+		// receiving an optimized migration, to avoid starving running instances of disk I/O.
+		// Specify the value in bytes per second (various suffixes supported, see {ref}`instances-limit-units`).
+		// ---
+		//  type: string
+		//  shortdesc: Maximum rate at which restored volumes are received
+		//  scope: global
+		"btrfs.restore.bandwidth_limit": validate.Optional(validate.IsSize),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.migration.ioprio)
+		// I/O scheduling class and priority of the `btrfs send` and `btrfs receive` processes of
+		// optimized migrations, to reduce their impact on running instances. Set to `idle`, or to
+		// `best-effort` or `realtime` optionally followed by `:` and a level from `0` (highest) to `7`.
+		// ---
+		//  type: string
+		//  shortdesc: I/O priority of optimized migrations
+		//  scope: global
+		"btrfs.migration.ioprio": validate.Optional(func(value string) error {
+			_, err := btrfsIOPrioArgs(value)
+			return err
+		}),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.migration.nested_loop_rsync)
+		// When the pool is backed by a loop file which is itself on Btrfs inside a container, such as when
+		// LXD runs in a container on a Btrfs pool of another LXD, migrations and copies to other pools use
+		// `rsync` rather than `btrfs send` and `btrfs receive`, which aren't reliable there.
+		// Set to `false` to use optimized transfers anyway where they're known to work.
+		// ---
+		//  type: bool
+		//  defaultdesc: `true`
+		//  shortdesc: Whether to use `rsync` for transfers of nested loop pools
+		//  scope: global
+		"btrfs.migration.nested_loop_rsync": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.migration.header_timeout)
+		// Number of seconds to wait for the metadata header of an optimized migration before aborting it,
+		// so that a stalled source doesn't leave the migration hanging.
+		// ---
+		//  type: integer
+		//  defaultdesc: `300`
+		//  shortdesc: Timeout for receiving the header of optimized migrations
+		//  scope: global
+		"btrfs.migration.header_timeout": validate.Optional(validate.IsUint32),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.compression)
+		// Compression property set on the subvolume of each new volume, independently of the compression
+		// mount options of the pool. Set to `zstd`, `lzo` or `zlib` to compress new volumes even if the pool
+		// isn't mounted with compression, or to `none` to leave them uncompressed even if it is.
+		// Existing volumes aren't changed.
+		// ---
+		//  type: string
+		//  shortdesc: Default compression of new volumes
+		//  scope: global
+		"btrfs.compression": validate.Optional(validate.IsOneOf("zstd", "lzo", "zlib", "none")),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.compression.recompress)
+		// When enabled, volumes received through an optimized migration (such as a copy from another pool)
+		// get the compression set in {config:option}`storage-btrfs-pool-conf:btrfs.compression` and their data
+		// is rewritten with it, instead of keeping the compression of the source.
+		// Rewriting the data unshares it from the volume's snapshots, which keep their original data.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether to recompress migrated volumes
+		//  scope: global
+		"btrfs.compression.recompress": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.restore.writable_subvolumes)
+		// When enabled, the nested subvolumes of a volume restored from an optimized backup are left
+		// writable, even those that were read-only when the backup was taken. The restored volume then
+		// differs from the original one. Snapshots are still restored read-only.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether to restore nested subvolumes writable
+		//  scope: global
+		"btrfs.restore.writable_subvolumes": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.backup.working_dir)
+		// Directory in which the volume files of optimized backups are generated before being added to
+		// the backup, for example to keep them off the file system holding the pool.
+		// The directory must exist.
+		// ---
+		//  type: string
+		//  defaultdesc: the backups storage path
+		//  shortdesc: Working directory of optimized backups
+		//  scope: local
+		"btrfs.backup.working_dir": validate.Optional(validate.IsAbsFilePath),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.backup.working_dir_limit)
+		// Maximum space the volume files of an optimized backup can use in the working directory.
+		// Backups expected to need more fail before sending any volume, and backups exceeding it while
+		// running fail instead of filling the disk.
+		// ---
+		//  type: string
+		//  shortdesc: Maximum working space of optimized backups
+		//  scope: global
+		"btrfs.backup.working_dir_limit": validate.Optional(validate.IsSize),
+		// lxdmeta:generate(entities=storage-btrfs; group=pool-conf; key=btrfs.block.encryption.key_file)
+		// Path of the key file used to encrypt and open the disks of volumes with
+		// {config:option}`storage-btrfs-volume-conf:btrfs.block.encryption` enabled.
+		// ---
+		//  type: string
+		//  shortdesc: Key file of encrypted volumes
+		//  scope: local
+		"btrfs.block.encryption.key_file": validate.Optional(validate.IsAbsFilePath),
 	}
 
 	return d.validatePool(config, rules, nil)
@@ -358,6 +657,24 @@ func (d *btrfs) Validate(config map[string]string) error {
 
 // Update applies any driver changes required from a configuration change.
 func (d *btrfs) Update(changedConfig map[string]string) error {
+	_, ok := changedConfig["btrfs.subvolume_prefix"]
+	if ok {
+		return errors.New("btrfs.subvolume_prefix cannot be changed")
+	}
+
+	_, ok = changedConfig["btrfs.seed"]
+	if ok {
+		return errors.New("btrfs.seed cannot be changed")
+	}
+
+	_, ok = changedConfig["btrfs.quota.simple"]
+	if ok {
+		_, _, err := d.getQGroup(GetPoolMountPath(d.name))
+		if err != errBtrfsNoQuota {
+			return errors.New("btrfs.quota.simple cannot be changed while quotas are enabled")
+		}
+	}
+
 	// We only care about btrfs.mount_options.
 	val, ok := changedConfig["btrfs.mount_options"]
 	if ok {
@@ -424,6 +741,26 @@ func (d *btrfs) Update(changedConfig map[string]string) error {
 
 // Mount mounts the storage pool.
 func (d *btrfs) Mount() (bool, error) {
+	ourMount, err := d.mount()
+	if err != nil {
+		return false, err
+	}
+
+	// Remove any ephemeral snapshots left behind by a previous run. This is only done when mounting the pool
+	// as otherwise ephemeral snapshots of the current run may be in use.
+	if ourMount {
+		d.deleteEphemeralSnapshots()
+	}
+
+	if ourMount && d.nestedLoopRsync() {
+		d.logger.Warn("Pool loop file is on btrfs inside a container, using rsync rather than btrfs send/receive for transfers", logger.Ctx{"source": d.config["source"]})
+	}
+
+	return ourMount, nil
+}
+
+// mount mounts the storage pool if not already mounted.
+func (d *btrfs) mount() (bool, error) {
 	// Check if already mounted.
 	if filesystem.IsMountPoint(GetPoolMountPath(d.name)) {
 		return false, nil
@@ -486,6 +823,25 @@ func (d *btrfs) Mount() (bool, error) {
 		return true, nil
 	}
 
+	// The seed device needs to be known to the kernel for the pool's file system to be mounted.
+	if d.config["btrfs.seed"] != "" {
+		release, err := d.scanSeed()
+		if err != nil {
+			return false, err
+		}
+
+		defer release()
+	}
+
+	// Mount the pool from its prefix subvolume if configured.
+	if d.config["btrfs.subvolume_prefix"] != "" {
+		if mntOptions != "" {
+			mntOptions += ","
+		}
+
+		mntOptions += "subvol=" + d.config["btrfs.subvolume_prefix"]
+	}
+
 	// Handle traditional mounts.
 	err = TryMount(context.TODO(), mntSrc, mntDst, mntFilesystem, mntFlags, mntOptions)
 	if err != nil {
@@ -511,10 +867,224 @@ func (d *btrfs) GetResources() (*api.ResourcesStoragePool, error) {
 	return genericVFSGetResources(d)
 }
 
+// HealthCheck checks that the tools used by the driver are present and working and that the pool is mounted
+// as a writable Btrfs file system. The qemu-img tool is only required if the pool holds block volumes.
+// All failed checks are reported rather than only the first.
+func (d *btrfs) HealthCheck() error {
+	errs := []error{}
+
+	_, err := exec.LookPath("btrfs")
+	if err != nil {
+		errs = append(errs, errors.New(`Required tool "btrfs" is missing`))
+	} else {
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "--version")
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`Required tool "btrfs" isn't working: %w`, err))
+		}
+	}
+
+	_, err = exec.LookPath("chattr")
+	if err != nil {
+		errs = append(errs, errors.New(`Required tool "chattr" is missing`))
+	}
+
+	poolMountPath := GetPoolMountPath(d.name)
+
+	if !filesystem.IsMountPoint(poolMountPath) {
+		errs = append(errs, fmt.Errorf("Pool isn't mounted on %q", poolMountPath))
+	} else {
+		fsType, err := filesystem.Detect(poolMountPath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed detecting file system of %q: %w", poolMountPath, err))
+		} else if fsType != "btrfs" {
+			errs = append(errs, fmt.Errorf("Pool mount %q is %q rather than btrfs", poolMountPath, fsType))
+		}
+
+		err = unix.Access(poolMountPath, unix.W_OK)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Pool mount %q isn't writable: %w", poolMountPath, err))
+		}
+
+		vols, err := d.ListVolumes()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed listing volumes of pool %q: %w", d.name, err))
+		} else if slices.ContainsFunc(vols, func(vol Volume) bool { return vol.contentType == ContentTypeBlock }) {
+			_, err = exec.LookPath("qemu-img")
+			if err != nil {
+				errs = append(errs, errors.New(`Required tool "qemu-img" is missing`))
+			} else {
+				_, err = shared.RunCommandContext(context.TODO(), "qemu-img", "--version")
+				if err != nil {
+					errs = append(errs, fmt.Errorf(`Required tool "qemu-img" isn't working: %w`, err))
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Health check of pool %q failed: %w", d.name, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// GetEffectiveMountOptions returns the mount options the driver bases its decisions on, such as whether to
+// disable copy-on-write for block volumes. These are the configured options combined with those the file
+// system is actually mounted with.
+func (d *btrfs) GetEffectiveMountOptions() ([]string, error) {
+	mountinfo, err := filesystem.GetMountinfo(GetPoolMountPath(d.name))
+	if err != nil {
+		return nil, fmt.Errorf("Failed getting mount information of pool %q: %w", d.name, err)
+	}
+
+	return btrfsMountOptions(d.getMountOptions(), mountinfo[len(mountinfo)-1]), nil
+}
+
+// GetPendingReclaim returns the number of deleted subvolumes whose space hasn't been reclaimed yet, and how much
+// space they still use. Deleted subvolumes are cleaned up in the background so free space only rises gradually
+// after deletions. The space is only known with quotas enabled, otherwise -1 is returned for it.
+func (d *btrfs) GetPendingReclaim() (int, int64, error) {
+	poolMountPath := GetPoolMountPath(d.name)
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "list", "-d", poolMountPath)
+	if err != nil {
+		return 0, -1, fmt.Errorf("Failed listing deleted subvolumes of pool %q: %w", d.name, err)
+	}
+
+	subvolIDs := btrfsParseDeletedSubvolumes(output)
+	if len(subvolIDs) == 0 {
+		return 0, 0, nil
+	}
+
+	// Use the current usage rather than the cached table, as it changes while the cleaner runs.
+	output, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "show", "--raw", poolMountPath)
+	if err != nil {
+		return len(subvolIDs), -1, nil
+	}
+
+	qgroups := btrfsParseQGroupTable(output)
+
+	var size int64
+	for _, subvolID := range subvolIDs {
+		usage, ok := qgroups["0/"+subvolID]
+		if !ok {
+			return len(subvolIDs), -1, nil
+		}
+
+		size += usage.exclusive
+	}
+
+	return len(subvolIDs), size, nil
+}
+
+// WaitForPendingReclaim commits the pending deletions and waits for the space of all deleted subvolumes to be
+// reclaimed.
+func (d *btrfs) WaitForPendingReclaim() error {
+	poolMountPath := GetPoolMountPath(d.name)
+
+	_, err := shared.RunCommandContext(d.state.ShutdownCtx, "btrfs", "filesystem", "sync", poolMountPath)
+	if err != nil {
+		return fmt.Errorf("Failed syncing pool %q: %w", d.name, err)
+	}
+
+	_, err = shared.RunCommandContext(d.state.ShutdownCtx, "btrfs", "subvolume", "sync", poolMountPath)
+	if err != nil {
+		return fmt.Errorf("Failed waiting for deleted subvolumes of pool %q to be cleaned up: %w", d.name, err)
+	}
+
+	return nil
+}
+
+// Scrub reads all data and metadata of the pool and verifies their checksums, repairing what it can from
+// redundant copies. The progress is reported in the operation's metadata while the scrub runs, and the scrub
+// is cancelled if the operation is.
+func (d *btrfs) Scrub(op *operations.Operation) error {
+	poolMountPath := GetPoolMountPath(d.name)
+
+	return d.runMaintenance("scrub", []string{"scrub", "start", "-B", poolMountPath}, []string{"scrub", "status", poolMountPath}, btrfsParseScrubStatus, op)
+}
+
+// Balance rewrites all chunks of the pool, to spread them over its devices and reclaim partially used chunks.
+// The progress is reported in the operation's metadata while the balance runs, and the balance is cancelled
+// if the operation is.
+func (d *btrfs) Balance(op *operations.Operation) error {
+	poolMountPath := GetPoolMountPath(d.name)
+
+	return d.runMaintenance("balance", []string{"balance", "start", "--full-balance", poolMountPath}, []string{"balance", "status", poolMountPath}, btrfsParseBalanceStatus, op)
+}
+
+// VerifyQuotaConsistency returns whether the qgroup figures of the pool are consistent. Btrfs marks them as
+// inconsistent after some quota operations (such as assigning a qgroup to a parent) until a rescan completes,
+// during which the usage returned by GetVolumeUsage is unreliable. RescanQuota makes them consistent again.
+func (d *btrfs) VerifyQuotaConsistency(op *operations.Operation) (bool, error) {
+	if shared.IsTrue(d.config["btrfs.quota.simple"]) {
+		// Simple quotas account usage as it happens and never need rescanning.
+		return true, nil
+	}
+
+	ctx, cancel := d.operationContext(op)
+	defer cancel()
+
+	poolMountPath := GetPoolMountPath(d.name)
+
+	// Btrfs-progs warns about inconsistent qgroup data when showing them.
+	_, stderr, err := shared.RunCommandSplit(ctx, nil, nil, "btrfs", "qgroup", "show", poolMountPath)
+	if err != nil {
+		return false, fmt.Errorf("Failed getting quota groups of pool %q (quotas may be disabled): %w", d.name, err)
+	}
+
+	if btrfsQGroupDataInconsistent(stderr) {
+		return false, nil
+	}
+
+	// The figures aren't reliable either while a rescan is running.
+	output, err := shared.RunCommandContext(ctx, "btrfs", "quota", "rescan", "-s", poolMountPath)
+	if err != nil {
+		return false, fmt.Errorf("Failed getting quota rescan status of pool %q: %w", d.name, err)
+	}
+
+	return !btrfsQuotaRescanRunning(output), nil
+}
+
+// RescanQuota rescans the qgroups of the pool and waits for the rescan to complete, making their figures
+// consistent again. Returns ErrNotSupported if the pool uses simple quotas, which can't be rescanned.
+func (d *btrfs) RescanQuota(op *operations.Operation) error {
+	if shared.IsTrue(d.config["btrfs.quota.simple"]) {
+		return fmt.Errorf("Simple quotas can't be rescanned: %w", ErrNotSupported)
+	}
+
+	ctx, cancel := d.operationContext(op)
+	defer cancel()
+
+	_, err := shared.RunCommandContext(ctx, "btrfs", "quota", "rescan", "-w", GetPoolMountPath(d.name))
+	if err != nil {
+		return fmt.Errorf("Failed rescanning quotas of pool %q: %w", d.name, err)
+	}
+
+	d.invalidateQGroupTable()
+
+	return nil
+}
+
+// SetEventSink sets the function called with the lifecycle events of the volumes of the pool, for example to
+// trigger a replication once a snapshot is created. The sink is called synchronously once each operation is
+// done, so it must not block. Setting a nil sink stops the events.
+func (d *btrfs) SetEventSink(sink func(BTRFSEvent)) {
+	btrfsEventSinksMu.Lock()
+	defer btrfsEventSinksMu.Unlock()
+
+	if sink == nil {
+		delete(btrfsEventSinks, d.name)
+		return
+	}
+
+	btrfsEventSinks[d.name] = sink
+}
+
 // MigrationTypes returns the type of transfer methods to be used when doing migrations between pools in preference order.
 func (d *btrfs) MigrationTypes(contentType ContentType, refresh bool, copySnapshots bool) []migration.Type {
 	var rsyncFeatures []string
-	btrfsFeatures := []string{migration.BTRFSFeatureMigrationHeader, migration.BTRFSFeatureSubvolumes, migration.BTRFSFeatureSubvolumeUUIDs}
+	btrfsFeatures := []string{migration.BTRFSFeatureMigrationHeader, migration.BTRFSFeatureSubvolumes, migration.BTRFSFeatureSubvolumeUUIDs, migration.BTRFSFeatureMultiSync}
 
 	// Do not pass compression argument to rsync if the associated
 	// config key, that is rsync.compression, is set to false.
@@ -524,8 +1094,9 @@ func (d *btrfs) MigrationTypes(contentType ContentType, refresh bool, copySnapsh
 		rsyncFeatures = []string{"xattrs", "delete", "compress", "bidirectional"}
 	}
 
-	// Only offer rsync if running in an unprivileged container.
-	if d.state.OS.RunningInUserNS {
+	// Only offer rsync if running in an unprivileged container, or if the pool's loop file is itself on btrfs
+	// inside a container, where send/receive isn't reliable unless btrfs.migration.nested_loop_rsync is disabled.
+	if d.state.OS.RunningInUserNS || d.nestedLoopRsync() {
 		var transportType migration.MigrationFSType
 
 		if IsContentBlock(contentType) {
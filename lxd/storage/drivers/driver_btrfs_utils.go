@@ -4,525 +4,4715 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 	"unsafe"
 
 	"github.com/google/uuid"
 	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v2"
 
+	"github.com/canonical/lxd/lxd/apparmor"
+	"github.com/canonical/lxd/lxd/archive"
 	"github.com/canonical/lxd/lxd/backup"
+	"github.com/canonical/lxd/lxd/instance/instancetype"
 	"github.com/canonical/lxd/lxd/linux"
+	"github.com/canonical/lxd/lxd/locking"
+	"github.com/canonical/lxd/lxd/migration"
+	"github.com/canonical/lxd/lxd/operations"
+	"github.com/canonical/lxd/lxd/rsync"
+	"github.com/canonical/lxd/lxd/storage/block"
+	"github.com/canonical/lxd/lxd/storage/filesystem"
 	"github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/api"
 	"github.com/canonical/lxd/shared/ioprogress"
 	"github.com/canonical/lxd/shared/logger"
 	"github.com/canonical/lxd/shared/revert"
+	"github.com/canonical/lxd/shared/units"
 )
 
 // Errors.
 var errBtrfsNoQuota = errors.New("Quotas disabled on filesystem")
 var errBtrfsNoQGroup = errors.New("Unable to find quota group")
 
+// errBtrfsSendStreamTruncated is returned when a btrfs send stream doesn't end with the END command.
+var errBtrfsSendStreamTruncated = errors.New("Btrfs send stream is truncated")
+
+// errBtrfsMaintenanceRunning is returned when starting a maintenance operation while another one is running.
+var errBtrfsMaintenanceRunning = errors.New("Maintenance operation already running")
+
 // btrfsISOVolSuffix suffix used for iso content type volumes.
 const btrfsISOVolSuffix = ".iso"
 
-// setReceivedUUID sets the "Received UUID" field on a subvolume with the given path using ioctl.
-func setReceivedUUID(path string, UUID string) error {
-	type btrfsIoctlReceivedSubvolArgs struct {
-		uuid [16]byte
-		_    [22]uint64 // padding
+// btrfsSysfsPath is the sysfs directory exposing btrfs kernel and filesystem information.
+const btrfsSysfsPath = "/sys/fs/btrfs"
+
+// btrfsEphemeralSnapshotPrefix is the prefix of the temporary directories holding ephemeral writable snapshots.
+const btrfsEphemeralSnapshotPrefix = "ephemeral."
+
+// btrfsNoCOWFlag is the FS_NOCOW_FL inode flag set by "chattr +C".
+const btrfsNoCOWFlag = 0x00800000
+
+// btrfsDefragBlockFileExtentSize is the target extent size used when defragmenting VM root disk files.
+// Large extents suit the large sequentially laid out disk images better than the default of 32MiB.
+const btrfsDefragBlockFileExtentSize = "256M"
+
+// btrfsQcow2DiskFile is the name of the root disk file of image volumes kept in qcow2 format.
+const btrfsQcow2DiskFile = "root.qcow2"
+
+// btrfsLUKSHeaderSize is the space reserved for the LUKS header at the start of the disk file of encrypted volumes.
+const btrfsLUKSHeaderSize = 16 * 1024 * 1024
+
+// btrfsBackupConcurrentSends is the maximum number of subvolumes of a volume sent concurrently for optimized backups.
+const btrfsBackupConcurrentSends = 4
+
+// btrfsMigrateConcurrentVolumes is the maximum number of volumes sent concurrently by MigrateVolumes.
+const btrfsMigrateConcurrentVolumes = 4
+
+// btrfsMigrationHeaderTimeout is the default of btrfs.migration.header_timeout.
+const btrfsMigrationHeaderTimeout = 5 * time.Minute
+
+// btrfsFillMarkerXattr is the extended attribute marking a volume whose fill hasn't completed yet.
+const btrfsFillMarkerXattr = "user.lxd.filling"
+
+// btrfsNoIncrementalXattr is the extended attribute marking a received subvolume whose received UUID couldn't
+// be set, holding the UUID it should have had.
+const btrfsNoIncrementalXattr = "user.lxd.no_incremental"
+
+// btrfsSnapshotLabelXattrPrefix is the prefix of the extended attributes holding snapshot labels.
+const btrfsSnapshotLabelXattrPrefix = "user.lxd.label."
+
+// btrfsQGroupTableTTL is how long the qgroup table of a pool is reused for usage queries.
+const btrfsQGroupTableTTL = 5 * time.Second
+
+// btrfsIoctlInoLookup is the BTRFS_IOC_INO_LOOKUP ioctl request number.
+const btrfsIoctlInoLookup = 0xd0009412
+
+// btrfsIoctlTreeSearch is the BTRFS_IOC_TREE_SEARCH ioctl request number.
+const btrfsIoctlTreeSearch = 0xd0009411
+
+// btrfsFirstFreeObjectID is the inode number of the root directory of every subvolume.
+const btrfsFirstFreeObjectID = 256
+
+// btrfsIoctlSubvolGetFlags is the BTRFS_IOC_SUBVOL_GETFLAGS ioctl request number.
+const btrfsIoctlSubvolGetFlags = 0x80089419
+
+// btrfsSubvolReadonly is the BTRFS_SUBVOL_RDONLY subvolume flag.
+const btrfsSubvolReadonly = 1 << 1
+
+// btrfsIoctlFiemap is the FS_IOC_FIEMAP ioctl request number.
+const btrfsIoctlFiemap = 0xc020660b
+
+// btrfsFiemapFlagSync is the FIEMAP_FLAG_SYNC flag which flushes the file's data before mapping its extents.
+const btrfsFiemapFlagSync = 1
+
+// btrfsFiemapExtentLast is the FIEMAP_EXTENT_LAST flag of the last extent of a file.
+const btrfsFiemapExtentLast = 1
+
+// btrfsFiemapExtentEncoded is the FIEMAP_EXTENT_ENCODED flag of compressed extents.
+const btrfsFiemapExtentEncoded = 0x8
+
+// btrfsMaxExtentSize is the largest size of an uncompressed btrfs extent.
+const btrfsMaxExtentSize = 128 * 1024 * 1024
+
+// btrfsFiemapBatchSize is the number of extents mapped per FS_IOC_FIEMAP call.
+const btrfsFiemapBatchSize = 256
+
+// btrfsSendStreamMagic is the magic string every btrfs send stream starts with.
+const btrfsSendStreamMagic = "btrfs-stream\x00"
+
+// btrfsSendStreamHeaderLen is the size of the btrfs send stream header (magic string and le32 version).
+const btrfsSendStreamHeaderLen = len(btrfsSendStreamMagic) + 4
+
+// btrfsSendCmdHeaderLen is the size of a btrfs send command header (le32 length, le16 command, le32 CRC).
+const btrfsSendCmdHeaderLen = 10
+
+// btrfsSendCmdEnd is the btrfs send command that terminates a complete stream.
+const btrfsSendCmdEnd = 21
+
+// btrfsSendCmdSnapshot is the btrfs send command that starts an incremental stream.
+const btrfsSendCmdSnapshot = 2
+
+// btrfsSendAttrCloneUUID is the btrfs send attribute holding the UUID of the parent of an incremental stream.
+const btrfsSendAttrCloneUUID = 20
+
+// btrfsSendStreamVerifier is an io.Writer which keeps track of the start and end of a btrfs send stream
+// so that it can be checked for completeness once the sending process has exited.
+type btrfsSendStreamVerifier struct {
+	head []byte
+	tail []byte
+	size int64
+}
+
+// Write records the stream header and the most recent command header sized chunk of the stream.
+func (v *btrfsSendStreamVerifier) Write(p []byte) (int, error) {
+	if len(v.head) < btrfsSendStreamHeaderLen {
+		n := min(btrfsSendStreamHeaderLen-len(v.head), len(p))
+		v.head = append(v.head, p[:n]...)
+	}
+
+	if len(p) >= btrfsSendCmdHeaderLen {
+		v.tail = append(v.tail[:0], p[len(p)-btrfsSendCmdHeaderLen:]...)
+	} else {
+		v.tail = append(v.tail, p...)
+		if len(v.tail) > btrfsSendCmdHeaderLen {
+			v.tail = append(v.tail[:0], v.tail[len(v.tail)-btrfsSendCmdHeaderLen:]...)
+		}
+	}
+
+	v.size += int64(len(p))
+
+	return len(p), nil
+}
+
+// Verify checks that the stream written so far starts with the btrfs send magic and ends with an empty END
+// command. A stream cut short (for example because btrfs send was killed) will not end with that command.
+func (v *btrfsSendStreamVerifier) Verify() error {
+	if v.size < int64(len(btrfsSendStreamMagic)+4+btrfsSendCmdHeaderLen) {
+		return fmt.Errorf("%w (only %d bytes written)", errBtrfsSendStreamTruncated, v.size)
+	}
+
+	if string(v.head[:len(btrfsSendStreamMagic)]) != btrfsSendStreamMagic {
+		return errors.New("Btrfs send stream has an invalid header")
+	}
+
+	cmdLen := binary.LittleEndian.Uint32(v.tail[0:4])
+	cmd := binary.LittleEndian.Uint16(v.tail[4:6])
+	if cmdLen != 0 || cmd != btrfsSendCmdEnd {
+		return fmt.Errorf("%w (missing end of stream marker after %d bytes)", errBtrfsSendStreamTruncated, v.size)
+	}
+
+	return nil
+}
+
+// Version returns the protocol version from the header of the stream, or 0 if the header wasn't written yet.
+func (v *btrfsSendStreamVerifier) Version() uint32 {
+	if len(v.head) < btrfsSendStreamHeaderLen {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(v.head[len(btrfsSendStreamMagic):])
+}
+
+// btrfsReadStreamParentUUID reads the start of the btrfs send stream from r and returns the UUID by which the
+// stream refers to its parent, which is empty if the stream isn't incremental. It also returns a reader which
+// yields the whole stream, including the part which was read.
+func btrfsReadStreamParentUUID(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, btrfsSendStreamHeaderLen+btrfsSendCmdHeaderLen)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed reading btrfs send stream header: %w", err)
+	}
+
+	if string(head[:len(btrfsSendStreamMagic)]) != btrfsSendStreamMagic {
+		return "", nil, errors.New("Btrfs send stream has an invalid header")
+	}
+
+	// The first command describes the subvolume being sent, which only holds a few small attributes.
+	cmdLen := binary.LittleEndian.Uint32(head[btrfsSendStreamHeaderLen : btrfsSendStreamHeaderLen+4])
+	cmd := binary.LittleEndian.Uint16(head[btrfsSendStreamHeaderLen+4 : btrfsSendStreamHeaderLen+6])
+	if cmdLen > 64*1024 {
+		return "", nil, fmt.Errorf("Btrfs send stream has an invalid first command length %d", cmdLen)
+	}
+
+	payload := make([]byte, cmdLen)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed reading btrfs send stream header: %w", err)
+	}
+
+	stream := io.MultiReader(bytes.NewReader(head), bytes.NewReader(payload), r)
+	if cmd != btrfsSendCmdSnapshot {
+		return "", stream, nil
+	}
+
+	// Attributes are encoded as le16 type, le16 length and the data.
+	for attrs := payload; len(attrs) >= 4; {
+		attrType := binary.LittleEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.LittleEndian.Uint16(attrs[2:4]))
+		attrs = attrs[4:]
+		if attrLen > len(attrs) {
+			break
+		}
+
+		if attrType == btrfsSendAttrCloneUUID {
+			parentUUID, err := uuid.FromBytes(attrs[:attrLen])
+			if err != nil {
+				return "", nil, fmt.Errorf("Btrfs send stream has an invalid parent UUID: %w", err)
+			}
+
+			return parentUUID.String(), stream, nil
+		}
+
+		attrs = attrs[attrLen:]
+	}
+
+	return "", nil, errors.New("Incremental btrfs send stream doesn't record its parent")
+}
+
+// btrfsRateLimitedReader is an io.Reader which keeps the average rate data is read at below limit bytes per second.
+type btrfsRateLimitedReader struct {
+	r     io.Reader
+	limit int64
+	start time.Time
+	read  int64
+}
+
+// Read reads from the underlying reader, sleeping as needed to stay below the rate limit.
+func (l *btrfsRateLimitedReader) Read(p []byte) (int, error) {
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+
+	// Read at most a second worth of data at a time so the pace stays even.
+	if int64(len(p)) > l.limit {
+		p = p[:l.limit]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+
+	// Wait until the data read so far is within the limit.
+	wait := time.Duration(float64(l.read)/float64(l.limit)*float64(time.Second)) - time.Since(l.start)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return n, err
+}
+
+// restoreReader wraps r in a rate limiter if btrfs.restore.bandwidth_limit is set.
+func (d *btrfs) restoreReader(r io.Reader) (io.Reader, error) {
+	if d.config["btrfs.restore.bandwidth_limit"] == "" {
+		return r, nil
+	}
+
+	limit, err := units.ParseByteSizeString(d.config["btrfs.restore.bandwidth_limit"])
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing btrfs.restore.bandwidth_limit: %w", err)
+	}
+
+	if limit <= 0 {
+		return r, nil
+	}
+
+	return &btrfsRateLimitedReader{r: r, limit: limit}, nil
+}
+
+// btrfsBackupWorkingSpace tracks the space used by the working files of an optimized backup.
+type btrfsBackupWorkingSpace struct {
+	path  string
+	limit int64 // No limit if 0.
+	used  atomic.Int64
+}
+
+// btrfsBackupWorkingSpaceWriter is an io.Writer which accounts the data written against a working space limit.
+type btrfsBackupWorkingSpaceWriter struct {
+	w       io.Writer
+	space   *btrfsBackupWorkingSpace
+	written int64
+}
+
+// Write writes to the underlying writer unless it would exceed the working space limit.
+func (w *btrfsBackupWorkingSpaceWriter) Write(p []byte) (int, error) {
+	if w.space.used.Add(int64(len(p))) > w.space.limit && w.space.limit > 0 {
+		w.space.Release(int64(len(p)))
+		return 0, fmt.Errorf("Backup working files in %q exceed btrfs.backup.working_dir_limit of %s", w.space.path, units.GetByteSizeStringIEC(w.space.limit, 2))
+	}
+
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	w.space.Release(int64(len(p) - n))
+
+	return n, err
+}
+
+// btrfsCountingWriter is an io.Writer which discards the data written to it and only counts its size.
+type btrfsCountingWriter struct {
+	written int64
+}
+
+// Write counts the data written.
+func (w *btrfsCountingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+
+	return len(p), nil
+}
+
+// BTRFSEventType is the type of a volume lifecycle event.
+type BTRFSEventType string
+
+// Volume lifecycle events.
+const (
+	BTRFSEventVolumeCreated     BTRFSEventType = "volume-created"
+	BTRFSEventVolumeDeleted     BTRFSEventType = "volume-deleted"
+	BTRFSEventVolumeRestored    BTRFSEventType = "volume-restored"
+	BTRFSEventSnapshotCreated   BTRFSEventType = "snapshot-created"
+	BTRFSEventMigrationStarted  BTRFSEventType = "migration-started"
+	BTRFSEventMigrationFinished BTRFSEventType = "migration-finished"
+	BTRFSEventBackupFinished    BTRFSEventType = "backup-finished"
+)
+
+// BTRFSEvent is a lifecycle event of a volume, emitted to the sink set with SetEventSink.
+type BTRFSEvent struct {
+	Type        BTRFSEventType
+	Pool        string
+	VolumeType  VolumeType
+	ContentType ContentType
+	Volume      string
+	Err         error // Error the operation failed with, nil if it succeeded.
+}
+
+// emitEvent calls the event sink of the pool, if any, with an event of the given type for vol.
+func (d *btrfs) emitEvent(eventType BTRFSEventType, vol Volume, err error) {
+	btrfsEventSinksMu.Lock()
+	sink := btrfsEventSinks[d.name]
+	btrfsEventSinksMu.Unlock()
+
+	if sink == nil {
+		return
+	}
+
+	sink(BTRFSEvent{Type: eventType, Pool: d.name, VolumeType: vol.volType, ContentType: vol.contentType, Volume: vol.name, Err: err})
+}
+
+// btrfsNopWriteCloser is an io.WriteCloser whose Close does nothing, to track the progress of writes to an io.Writer.
+type btrfsNopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing.
+func (btrfsNopWriteCloser) Close() error {
+	return nil
+}
+
+// Release returns the space of a removed working file of the given size.
+func (s *btrfsBackupWorkingSpace) Release(size int64) {
+	s.used.Add(-size)
+}
+
+// backupWorkingSpace returns the working space of an optimized backup, in btrfs.backup.working_dir if set.
+func (d *btrfs) backupWorkingSpace() (*btrfsBackupWorkingSpace, error) {
+	space := &btrfsBackupWorkingSpace{path: d.state.BackupsStoragePath()}
+
+	if d.config["btrfs.backup.working_dir"] != "" {
+		space.path = d.config["btrfs.backup.working_dir"]
+		if !shared.IsDir(space.path) {
+			return nil, fmt.Errorf("Backup working directory %q doesn't exist", space.path)
+		}
+	}
+
+	if d.config["btrfs.backup.working_dir_limit"] != "" {
+		limit, err := units.ParseByteSizeString(d.config["btrfs.backup.working_dir_limit"])
+		if err != nil {
+			return nil, fmt.Errorf("Failed parsing btrfs.backup.working_dir_limit: %w", err)
+		}
+
+		space.limit = limit
+	}
+
+	return space, nil
+}
+
+// btrfsBackupPeakSize estimates the largest working space needed at once by an optimized backup of the given
+// subvolumes. The subvolumes of each snapshot (and of the volume itself) are generated together and the ones
+// after the first are differences to the previous one. Returns 0 if the subvolume sizes are unknown.
+func btrfsBackupPeakSize(subvolumes []BTRFSSubVolume) int64 {
+	var peak int64
+	groups := 0
+
+	for start := 0; start < len(subvolumes); {
+		end := start + 1
+		for end < len(subvolumes) && subvolumes[end].Snapshot == subvolumes[start].Snapshot {
+			end++
+		}
+
+		size := btrfsMigrationSize(subvolumes[start:end], groups > 0)
+		if size <= 0 {
+			return 0
+		}
+
+		peak = max(peak, size)
+		groups++
+		start = end
+	}
+
+	return peak
+}
+
+// btrfsQGroupTable caches the usage of all qgroups of a pool, so that a burst of usage queries only needs to
+// run "btrfs qgroup show" once.
+type btrfsQGroupTable struct {
+	mu      sync.Mutex
+	expires time.Time
+	usage   map[string]btrfsQGroupUsage
+}
+
+// btrfsQGroupUsage is the usage of a qgroup.
+type btrfsQGroupUsage struct {
+	referenced int64 // Bytes referenced by the subvolume, including those shared with other subvolumes.
+	exclusive  int64 // Bytes only referenced by the subvolume.
+	limit      int64 // Limit on the referenced bytes, -1 if none (or not included in the output).
+}
+
+// btrfsSubvolumeID returns the ID of the subvolume at path without running any external command.
+func btrfsSubvolumeID(path string) (uint64, error) {
+	type btrfsIoctlInoLookupArgs struct {
+		treeID   uint64
+		objectID uint64
+		name     [4080]byte
 	}
 
 	f, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("Failed opening %s: %w", path, err)
+		return 0, fmt.Errorf("Failed opening %s: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	// A tree ID of 0 looks up the subvolume containing the file.
+	args := btrfsIoctlInoLookupArgs{objectID: btrfsFirstFreeObjectID}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), btrfsIoctlInoLookup, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return 0, fmt.Errorf("Failed looking up subvolume ID of %q: %w", path, unix.Errno(errno))
+	}
+
+	return args.treeID, nil
+}
+
+// btrfsSubvolumeChangedSince returns whether the tree of the subvolume at path has any items written in a
+// transaction after the given generation, including the running transaction.
+func btrfsSubvolumeChangedSince(path string, generation uint64) (bool, error) {
+	type btrfsIoctlSearchArgs struct {
+		treeID      uint64
+		minObjectID uint64
+		maxObjectID uint64
+		minOffset   uint64
+		maxOffset   uint64
+		minTransID  uint64
+		maxTransID  uint64
+		minType     uint32
+		maxType     uint32
+		nrItems     uint32
+		unused      uint32
+		unused1     [4]uint64
+		buf         [3992]byte
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed opening %s: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	// A tree ID of 0 searches the subvolume containing the file. One item is enough to know it changed.
+	args := btrfsIoctlSearchArgs{
+		maxObjectID: math.MaxUint64,
+		maxOffset:   math.MaxUint64,
+		minTransID:  generation + 1,
+		maxTransID:  math.MaxUint64,
+		maxType:     math.MaxUint8,
+		nrItems:     1,
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), btrfsIoctlTreeSearch, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return false, fmt.Errorf("Failed searching subvolume tree of %q: %w", path, unix.Errno(errno))
+	}
+
+	return args.nrItems > 0, nil
+}
+
+// btrfsExchangePaths atomically exchanges the files at the two paths, which must both exist.
+func btrfsExchangePaths(pathA string, pathB string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, pathA, unix.AT_FDCWD, pathB, unix.RENAME_EXCHANGE)
+	if err != nil {
+		return fmt.Errorf("Failed exchanging %q and %q: %w", pathA, pathB, err)
+	}
+
+	return nil
+}
+
+// btrfsSubvolumeReadonlyFlag returns whether the subvolume at path is readonly without running any external command.
+func btrfsSubvolumeReadonlyFlag(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed opening %s: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var flags uint64
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), btrfsIoctlSubvolGetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return false, fmt.Errorf("Failed getting subvolume flags of %q: %w", path, unix.Errno(errno))
+	}
+
+	return flags&btrfsSubvolReadonly != 0, nil
+}
+
+// btrfsExtent is an extent of a file as returned by FS_IOC_FIEMAP.
+type btrfsExtent struct {
+	physical uint64
+	length   uint64
+	flags    uint32
+}
+
+// btrfsFileExtents returns the extents of the file at path, in logical order, using FS_IOC_FIEMAP.
+func btrfsFileExtents(path string) ([]btrfsExtent, error) {
+	type fiemapExtent struct {
+		logical  uint64
+		physical uint64
+		length   uint64
+		_        [2]uint64
+		flags    uint32
+		_        [3]uint32
+	}
+
+	type fiemap struct {
+		start         uint64
+		length        uint64
+		flags         uint32
+		mappedExtents uint32
+		extentCount   uint32
+		_             uint32
+		extents       [btrfsFiemapBatchSize]fiemapExtent
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening %s: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var extents []btrfsExtent
+	var start uint64
+
+	for {
+		args := fiemap{start: start, length: math.MaxUint64 - start, flags: btrfsFiemapFlagSync, extentCount: btrfsFiemapBatchSize}
+
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), btrfsIoctlFiemap, uintptr(unsafe.Pointer(&args)))
+		if errno != 0 {
+			return nil, fmt.Errorf("Failed mapping extents of %q: %w", path, unix.Errno(errno))
+		}
+
+		if args.mappedExtents == 0 {
+			return extents, nil
+		}
+
+		for _, extent := range args.extents[:args.mappedExtents] {
+			extents = append(extents, btrfsExtent{physical: extent.physical, length: extent.length, flags: extent.flags})
+
+			if extent.flags&btrfsFiemapExtentLast != 0 {
+				return extents, nil
+			}
+		}
+
+		// Carry on after the last extent mapped so far.
+		last := args.extents[args.mappedExtents-1]
+		start = last.logical + last.length
+	}
+}
+
+// btrfsAllocatedBytes returns the number of bytes allocated to the file at path, as the sum of the lengths of
+// its extents.
+func btrfsAllocatedBytes(path string) (int64, error) {
+	extents, err := btrfsFileExtents(path)
+	if err != nil {
+		return -1, err
+	}
+
+	var allocated int64
+	for _, extent := range extents {
+		allocated += int64(extent.length)
+	}
+
+	return allocated, nil
+}
+
+// btrfsFragments returns the number of physically contiguous runs of extents and the minimum number of runs
+// the extents could be stored in. Compressed extents are limited to 128KiB, so runs of them aren't counted
+// as fragmented.
+func btrfsFragments(extents []btrfsExtent) (int, int) {
+	var runs int
+	var allocated uint64
+	var prevEnd uint64
+	prevEncoded := false
+
+	for i, extent := range extents {
+		encoded := extent.flags&btrfsFiemapExtentEncoded != 0
+		if i == 0 || (extent.physical != prevEnd && !(encoded && prevEncoded)) {
+			runs++
+		}
+
+		allocated += extent.length
+		prevEnd = extent.physical + extent.length
+		prevEncoded = encoded
+	}
+
+	if runs == 0 {
+		return 0, 0
+	}
+
+	minRuns := int((allocated + btrfsMaxExtentSize - 1) / btrfsMaxExtentSize)
+
+	return runs, max(minRuns, 1)
+}
+
+// btrfsFragmentation returns the fragmentation from the total number of runs of extents and the minimum number
+// of runs, between 0 (not fragmented) and 1 (every extent in a separate place).
+func btrfsFragmentation(runs int, minRuns int) float64 {
+	if runs <= minRuns {
+		return 0
+	}
+
+	return 1 - float64(minRuns)/float64(runs)
+}
+
+// btrfsParseQGroupTable parses the output of "btrfs qgroup show --raw" into a map of qgroup to usage.
+// The limits are only included if the output has them (with "-r").
+func btrfsParseQGroupTable(output string) map[string]btrfsQGroupUsage {
+	usage := map[string]btrfsQGroupUsage{}
+
+	for line := range strings.SplitSeq(output, "\n") {
+		// Use case-insensitive field title match because BTRFS tooling changed casing between versions.
+		if line == "" || strings.HasPrefix(strings.ToLower(line), "qgroupid") || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		// The BTRFS tooling changed the number of columns between versions so we only check for minimum.
+		if len(fields) < 3 {
+			continue
+		}
+
+		referenced, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		exclusive, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		// Without "-r" the fourth column (if any) is the path of the subvolume.
+		limit := int64(-1)
+		if len(fields) > 3 && fields[3] != "none" {
+			value, err := strconv.ParseInt(fields[3], 10, 64)
+			if err == nil {
+				limit = value
+			}
+		}
+
+		usage[fields[0]] = btrfsQGroupUsage{referenced: referenced, exclusive: exclusive, limit: limit}
+	}
+
+	return usage
+}
+
+// btrfsParseDeletedSubvolumes returns the IDs of the subvolumes in the output of "btrfs subvolume list -d".
+func btrfsParseDeletedSubvolumes(output string) []string {
+	subvolIDs := []string{}
+
+	for line := range strings.SplitSeq(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "ID" {
+			continue
+		}
+
+		subvolIDs = append(subvolIDs, fields[1])
+	}
+
+	return subvolIDs
+}
+
+// qgroupTable returns the shared qgroup table of the pool.
+func (d *btrfs) qgroupTable() *btrfsQGroupTable {
+	btrfsQGroupTablesMu.Lock()
+	defer btrfsQGroupTablesMu.Unlock()
+
+	table, ok := btrfsQGroupTables[d.name]
+	if !ok {
+		table = &btrfsQGroupTable{}
+		btrfsQGroupTables[d.name] = table
+	}
+
+	return table
+}
+
+// invalidateQGroupTable discards the cached qgroup table of the pool.
+func (d *btrfs) invalidateQGroupTable() {
+	table := d.qgroupTable()
+
+	table.mu.Lock()
+	table.expires = time.Time{}
+	table.usage = nil
+	table.mu.Unlock()
+}
+
+// btrfsQGroupDataInconsistent returns whether the error output of "btrfs qgroup show" warns that the qgroup
+// data is inconsistent.
+func btrfsQGroupDataInconsistent(stderr string) bool {
+	return strings.Contains(strings.ToLower(stderr), "qgroup data inconsistent")
+}
+
+// btrfsQuotaRescanRunning returns whether the output of "btrfs quota rescan -s" shows a running rescan.
+func btrfsQuotaRescanRunning(output string) bool {
+	return strings.Contains(output, "rescan operation running")
+}
+
+// getQGroupUsage returns the exclusive usage of the subvolume at path from the cached qgroup table of the pool.
+func (d *btrfs) getQGroupUsage(path string) (int64, error) {
+	usage, err := d.getQGroupSizes(path)
+	if err != nil {
+		return -1, err
+	}
+
+	return usage.exclusive, nil
+}
+
+// getQGroupSizes returns the usage of the subvolume at path from the cached qgroup table of the pool.
+// The table is refreshed once it is older than btrfsQGroupTableTTL. Concurrent callers wait for a single
+// refresh rather than each running "btrfs qgroup show".
+func (d *btrfs) getQGroupSizes(path string) (btrfsQGroupUsage, error) {
+	subvolID, err := btrfsSubvolumeID(path)
+	if err != nil {
+		return btrfsQGroupUsage{}, err
+	}
+
+	table := d.qgroupTable()
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if table.usage == nil || time.Now().After(table.expires) {
+		output, err := shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "show", "-r", "--raw", GetPoolMountPath(d.name))
+		if err != nil {
+			return btrfsQGroupUsage{}, errBtrfsNoQuota
+		}
+
+		table.usage = btrfsParseQGroupTable(output)
+		table.expires = time.Now().Add(btrfsQGroupTableTTL)
+	}
+
+	usage, ok := table.usage["0/"+strconv.FormatUint(subvolID, 10)]
+	if !ok {
+		return btrfsQGroupUsage{}, errBtrfsNoQGroup
+	}
+
+	return usage, nil
+}
+
+// deleteParentSnapshotDir removes the snapshots directory of a volume if it's empty. Failing to remove it is
+// only logged unless btrfs.snapshots.strict_cleanup is enabled, as it's called once the subvolume itself was
+// deleted and a leftover directory doesn't affect the volume.
+func (d *btrfs) deleteParentSnapshotDir(volType VolumeType, volName string) error {
+	err := deleteParentSnapshotDirIfEmpty(d.name, volType, volName)
+	if err != nil && !shared.IsTrue(d.config["btrfs.snapshots.strict_cleanup"]) {
+		d.logger.Warn("Failed removing snapshots directory", logger.Ctx{"name": volName, "err": err})
+		return nil
+	}
+
+	return err
+}
+
+// btrfsValidateBackupConversion checks whether a volume of the given type in an optimized backup can be
+// restored as vol. Other than restoring a volume as its own type, only restoring the config volume of a VM
+// as a custom filesystem volume is allowed.
+func btrfsValidateBackupConversion(srcVolType VolumeType, srcContentType ContentType, vol Volume) error {
+	if srcVolType == vol.volType && srcContentType == vol.contentType {
+		return nil
+	}
+
+	if srcVolType == VolumeTypeVM && srcContentType == ContentTypeFS && vol.volType == VolumeTypeCustom && vol.contentType == ContentTypeFS {
+		return nil
+	}
+
+	return fmt.Errorf("Restoring %s volume with content type %q as %s volume with content type %q: %w", srcVolType, srcContentType, vol.volType, vol.contentType, ErrNotSupported)
+}
+
+// snapshotsLock locks the creation and deletion of snapshots of a volume and returns the UnlockFunc.
+// This prevents concurrent requests from racing on the volume's snapshot directory.
+func (d *btrfs) snapshotsLock(volType VolumeType, contentType ContentType, volName string) (locking.UnlockFunc, error) {
+	return locking.Lock(context.TODO(), d.snapshotsLockName(volType, contentType, volName))
+}
+
+// snapshotsLockName returns the name of the lock taken by snapshotsLock.
+func (d *btrfs) snapshotsLockName(volType VolumeType, contentType ContentType, volName string) string {
+	return OperationLockName("VolumeSnapshots", d.name, volType, contentType, volName)
+}
+
+// btrfsEnvironInContainer returns whether the environment of the init process, as read from /proc/1/environ,
+// has the "container" variable container managers set.
+func btrfsEnvironInContainer(environ []byte) bool {
+	for entry := range bytes.SplitSeq(environ, []byte{0}) {
+		value, found := bytes.CutPrefix(entry, []byte("container="))
+		if found && len(value) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// btrfsInContainer returns whether LXD is running inside a container, privileged or not.
+var btrfsInContainer = sync.OnceValue(func() bool {
+	if shared.PathExists("/run/systemd/container") {
+		return true
+	}
+
+	environ, err := os.ReadFile("/proc/1/environ")
+	if err != nil {
+		return false
+	}
+
+	return btrfsEnvironInContainer(environ)
+})
+
+// nestedLoop returns whether the pool is backed by a loop file which is itself on btrfs inside a container, such
+// as when LXD runs in a container on a btrfs pool of another LXD. Send/receive isn't reliable there, even in
+// privileged containers where RunningInUserNS isn't set. Quotas aren't affected, as they are those of the
+// filesystem in the loop file rather than of the btrfs filesystem holding it.
+func (d *btrfs) nestedLoop() bool {
+	loopPath := loopFilePath(d.name)
+	if d.config["source"] != loopPath || !btrfsInContainer() {
+		return false
+	}
+
+	fsType, err := filesystem.Detect(filepath.Dir(loopPath))
+
+	return err == nil && fsType == "btrfs"
+}
+
+// nestedLoopRsync returns whether transfers use rsync rather than send/receive because the pool is a nested loop
+// (see nestedLoop), which can be turned off with btrfs.migration.nested_loop_rsync.
+func (d *btrfs) nestedLoopRsync() bool {
+	return !shared.IsFalse(d.config["btrfs.migration.nested_loop_rsync"]) && d.nestedLoop()
+}
+
+// btrfsSnapshotsDisabled returns whether snapshots of the volume are disabled by btrfs.snapshots.disable.
+func btrfsSnapshotsDisabled(vol Volume) bool {
+	return shared.IsTrue(vol.config["btrfs.snapshots.disable"])
+}
+
+// btrfsExpectReadonly returns whether the subvolume of the volume is expected to be read-only.
+func btrfsExpectReadonly(vol Volume) bool {
+	if vol.volType == VolumeTypeImage || vol.IsSnapshot() {
+		return true
+	}
+
+	return vol.volType == VolumeTypeCustom && vol.contentType == ContentTypeFS && shared.IsTrue(vol.config["btrfs.readonly"])
+}
+
+// volumeFrozen returns whether the volume was made read-only by FreezeVolume, that is whether its subvolume is
+// read-only although it isn't expected to be.
+func (d *btrfs) volumeFrozen(vol Volume) (bool, error) {
+	if btrfsExpectReadonly(vol) {
+		return false, nil
+	}
+
+	return btrfsSubvolumeReadonlyFlag(vol.MountPath())
+}
+
+// checkNotFrozen returns an error if the parent volume of the snapshot is frozen. The caller must hold the
+// snapshots lock of the volume.
+func (d *btrfs) checkNotFrozen(snapVol Volume) error {
+	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
+	parentVol := NewVolume(d, d.name, snapVol.volType, snapVol.contentType, parentName, snapVol.config, snapVol.poolConfig)
+
+	frozen, err := d.volumeFrozen(parentVol)
+	if err != nil {
+		return err
+	}
+
+	if frozen {
+		return fmt.Errorf("Cannot snapshot volume %q while it is frozen", parentName)
+	}
+
+	return nil
+}
+
+// lockFreeze takes the mount lock and the snapshots locks of the volume for FreezeVolume and ThawVolume. The
+// volume must not be mounted and no snapshot operation may be in progress, otherwise ErrInUse is returned.
+func (d *btrfs) lockFreeze(vol Volume, action string) (func(), error) {
+	revert := revert.New()
+	defer revert.Fail()
+
+	unlock, err := vol.MountLock()
+	if err != nil {
+		return nil, err
+	}
+
+	revert.Add(func() { unlock() })
+
+	if vol.MountInUse() {
+		return nil, fmt.Errorf("Cannot %s volume %q while it is in use: %w", action, vol.name, ErrInUse)
+	}
+
+	// The config and disk volumes of a VM share their subvolume, so the snapshots of both are locked.
+	contentTypes := []ContentType{vol.contentType}
+	if vol.volType == VolumeTypeVM {
+		contentTypes = []ContentType{ContentTypeFS, ContentTypeBlock}
+	}
+
+	for _, contentType := range contentTypes {
+		unlockSnapshots := locking.TryLock(d.snapshotsLockName(vol.volType, contentType, vol.name))
+		if unlockSnapshots == nil {
+			return nil, fmt.Errorf("Cannot %s volume %q while a snapshot operation is in progress: %w", action, vol.name, ErrInUse)
+		}
+
+		revert.Add(func() { unlockSnapshots() })
+	}
+
+	if !d.isSubvolume(vol.MountPath()) {
+		return nil, fmt.Errorf("Volume %q doesn't exist", vol.name)
+	}
+
+	cleanup := revert.Clone().Fail
+	revert.Success()
+
+	return cleanup, nil
+}
+
+// btrfsValidateSnapshotPattern validates a pattern of snapshot names as used by btrfs.backup.snapshot_exclude.
+func btrfsValidateSnapshotPattern(value string) error {
+	_, err := filepath.Match(value, "")
+	if err != nil {
+		return fmt.Errorf("Invalid snapshot name pattern %q: %w", value, err)
+	}
+
+	return nil
+}
+
+// btrfsFilterSnapshots returns the snapshot names which don't match the exclusion pattern, in the same order.
+func btrfsFilterSnapshots(snapshots []string, exclude string) []string {
+	if exclude == "" {
+		return snapshots
+	}
+
+	filtered := make([]string, 0, len(snapshots))
+	for _, snapName := range snapshots {
+		match, _ := filepath.Match(exclude, snapName)
+		if !match {
+			filtered = append(filtered, snapName)
+		}
+	}
+
+	return filtered
+}
+
+// btrfsLimitSnapshots returns the newest snapshot names up to the limit, in the same order. The snapshots
+// must be ordered from oldest to newest. An empty limit or a limit of 0 keeps all snapshots.
+func btrfsLimitSnapshots(snapshots []string, limit string) []string {
+	if limit == "" {
+		return snapshots
+	}
+
+	maxSnapshots, err := strconv.ParseUint(limit, 10, 32)
+	if err != nil || maxSnapshots == 0 || uint64(len(snapshots)) <= maxSnapshots {
+		return snapshots
+	}
+
+	return snapshots[len(snapshots)-int(maxSnapshots):]
+}
+
+// btrfsQuotaVolume returns the volume whose quota applies to the subvolume of vol, or false if it has none.
+// The block volume of a VM shares its subvolume with the VM's filesystem volume, whose quota also covers the
+// root disk file (see vmFilesystemQuotaSize), so that filesystem volume is returned. Other block volumes don't
+// have a quota limit applied to them.
+func btrfsQuotaVolume(vol Volume) (Volume, bool) {
+	if vol.contentType == ContentTypeFS {
+		return vol, true
+	}
+
+	if vol.volType == VolumeTypeVM && vol.contentType == ContentTypeBlock {
+		return vol.NewVMBlockFilesystemVolume(), true
+	}
+
+	return Volume{}, false
+}
+
+// vmFilesystemQuotaSize returns the qgroup limit needed to allow sizeBytes of data in the filesystem volume of
+// a VM. The VM's root disk file is stored in the same subvolume, so its size is added to exclude it from the
+// quota. All places applying a quota to the filesystem volume of a VM must use this.
+func vmFilesystemQuotaSize(volPath string, sizeBytes int64) (int64, error) {
+	rootBlockPath := filepath.Join(volPath, genericVolumeDiskFile)
+	if !shared.PathExists(rootBlockPath) {
+		return sizeBytes, nil
+	}
+
+	// Get the size of the VM image.
+	blockSize, err := block.DiskSizeBytes(rootBlockPath)
+	if err != nil {
+		return -1, err
+	}
+
+	return sizeBytes + blockSize, nil
+}
+
+// getQGroupLimit returns the qgroup of the subvolume at path and its referenced data limit.
+// The limit is -1 if none is set.
+func (d *btrfs) getQGroupLimit(path string) (string, int64, error) {
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "show", "-r", "-f", "--raw", path)
+	if err != nil {
+		return "", -1, errBtrfsNoQuota
+	}
+
+	for line := range strings.SplitSeq(output, "\n") {
+		// Use case-insensitive field title match because BTRFS tooling changed casing between versions.
+		if line == "" || strings.HasPrefix(strings.ToLower(line), "qgroupid") || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		if fields[3] == "none" {
+			return fields[0], -1, nil
+		}
+
+		limit, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return "", -1, fmt.Errorf("Failed parsing qgroup limit %q: %w", fields[3], err)
+		}
+
+		return fields[0], limit, nil
+	}
+
+	return "", -1, errBtrfsNoQGroup
+}
+
+// updateVMFilesystemQuota adjusts the quota of the filesystem volume of a VM after its root disk file was
+// resized by deltaBytes, so that the space available to the filesystem volume stays the same.
+func (d *btrfs) updateVMFilesystemQuota(volPath string, deltaBytes int64) error {
+	qgroup, limit, err := d.getQGroupLimit(volPath)
+	if err == errBtrfsNoQuota || err == errBtrfsNoQGroup {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Nothing to do if the filesystem volume has no quota.
+	if limit < 0 {
+		return nil
+	}
+
+	d.logger.Debug("Accounting for VM image file resize", logger.Ctx{"path": volPath, "oldLimit": limit, "newLimit": limit + deltaBytes})
+
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", strconv.FormatInt(limit+deltaBytes, 10), qgroup, volPath)
+	if err != nil {
+		return err
+	}
+
+	d.invalidateQGroupTable()
+
+	return nil
+}
+
+// setInitialQuota sets the quota of a filesystem volume whose subvolume was just created. With quotas enabled
+// the kernel creates the subvolume's qgroup along with it, without any limits, so its identifier is known from
+// the subvolume ID and only the referenced limit needs to be set. This saves the commands SetVolumeQuota runs
+// to find the qgroup and clear its other limits, which adds up when provisioning many volumes. Otherwise, such
+// as when quotas still need to be enabled, it falls back to SetVolumeQuota.
+func (d *btrfs) setInitialQuota(vol Volume, op *operations.Operation) error {
+	size := vol.ConfigSize()
+	sizeBytes, err := units.ParseByteSizeString(size)
+	if err != nil {
+		return err
+	}
+
+	volPath := vol.MountPath()
+
+	subvolID, err := btrfsSubvolumeID(volPath)
+	if err != nil {
+		return err
+	}
+
+	// A new qgroup has no limits to remove.
+	if sizeBytes <= 0 {
+		return nil
+	}
+
+	if vol.volType == VolumeTypeVM {
+		sizeBytes, err = vmFilesystemQuotaSize(volPath, sizeBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", strconv.FormatInt(sizeBytes, 10), "0/"+strconv.FormatUint(subvolID, 10), volPath)
+	if err != nil {
+		d.logger.Debug("Failed setting quota of new volume directly", logger.Ctx{"name": vol.name, "err": err})
+		return d.SetVolumeQuota(vol, size, false, op)
+	}
+
+	d.invalidateQGroupTable()
+
+	return nil
+}
+
+// btrfsFillSemaphore limits the number of fillers running concurrently on a pool. Its limit can be changed
+// while fillers are running, in which case further fillers wait until fewer than the new limit are running.
+type btrfsFillSemaphore struct {
+	mu      sync.Mutex
+	running int
+	limit   int
+	changed chan struct{} // Closed (and replaced) whenever a slot is released or the limit changes.
+}
+
+// notify wakes up the waiting fillers. The caller must hold s.mu.
+func (s *btrfsFillSemaphore) notify() {
+	if s.changed != nil {
+		close(s.changed)
+	}
+
+	s.changed = make(chan struct{})
+}
+
+// acquire waits until fewer than limit fillers are running (any number if limit is 0) and then takes a slot.
+// It returns an error if ctx is cancelled while waiting.
+func (s *btrfsFillSemaphore) acquire(ctx context.Context, limit int) error {
+	for {
+		s.mu.Lock()
+		if s.changed == nil || limit != s.limit {
+			s.limit = limit
+			s.notify()
+		}
+
+		if s.limit <= 0 || s.running < s.limit {
+			s.running++
+			s.mu.Unlock()
+			return nil
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release releases a slot taken by acquire.
+func (s *btrfsFillSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running--
+	s.notify()
+}
+
+// acquireFillSlot waits until fewer than btrfs.max_concurrent_fills fillers are running on the pool and
+// then takes a slot. The returned function releases the slot. The wait is interrupted if LXD shuts down or
+// op is cancelled.
+func (d *btrfs) acquireFillSlot(op *operations.Operation) (func(), error) {
+	limit, _ := strconv.Atoi(d.config["btrfs.max_concurrent_fills"])
+
+	// All fillers are counted, even without a limit, so that a limit set later applies to the running ones.
+	btrfsFillSlotsMu.Lock()
+	slots, ok := btrfsFillSlots[d.name]
+	if !ok {
+		slots = &btrfsFillSemaphore{}
+		btrfsFillSlots[d.name] = slots
+	}
+
+	btrfsFillSlotsMu.Unlock()
+
+	ctx, cancel := d.operationContext(op)
+	defer cancel()
+
+	err := slots.acquire(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Failed waiting to fill volume on pool %q: %w", d.name, err)
+	}
+
+	return slots.release, nil
+}
+
+// btrfsMaxSnapshotPaceInterval is the maximum of btrfs.snapshots.pace_interval in milliseconds.
+const btrfsMaxSnapshotPaceInterval = 60000
+
+// btrfsSnapshotSlot returns how long a snapshot requested at now must wait when the next snapshot of the pool
+// can only be taken at next, and when the snapshot after it can be taken.
+func btrfsSnapshotSlot(next time.Time, now time.Time, interval time.Duration) (time.Duration, time.Time) {
+	if next.Before(now) {
+		next = now
+	}
+
+	return next.Sub(now), next.Add(interval)
+}
+
+// throttleSnapshot reduces the load of taking a snapshot of the subvolume at path when quotas are enabled on
+// the pool. It waits until btrfs.snapshots.pace_interval passed since the previous snapshot of the pool and
+// syncs the file system if btrfs.snapshots.sync is enabled. Without quotas snapshots are cheap, so nothing is
+// done then. The wait is interrupted if LXD shuts down or op is cancelled.
+func (d *btrfs) throttleSnapshot(path string, op *operations.Operation) error {
+	interval, _ := strconv.Atoi(d.config["btrfs.snapshots.pace_interval"])
+	interval = min(interval, btrfsMaxSnapshotPaceInterval)
+	syncFS := shared.IsTrue(d.config["btrfs.snapshots.sync"])
+	if interval <= 0 && !syncFS {
+		return nil
+	}
+
+	_, err := d.getQGroupSizes(path)
+	if errors.Is(err, errBtrfsNoQuota) {
+		return nil
+	}
+
+	ctx, cancel := d.operationContext(op)
+	defer cancel()
+
+	if interval > 0 {
+		// Reserve the slot before waiting so that concurrent snapshots queue up behind each other.
+		btrfsSnapshotSlotsMu.Lock()
+		wait, next := btrfsSnapshotSlot(btrfsSnapshotSlots[d.name], time.Now(), time.Duration(interval)*time.Millisecond)
+		btrfsSnapshotSlots[d.name] = next
+		btrfsSnapshotSlotsMu.Unlock()
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return fmt.Errorf("Failed waiting to take snapshot on pool %q: %w", d.name, ctx.Err())
+		}
+	}
+
+	if syncFS {
+		_, err := shared.RunCommandContext(ctx, "btrfs", "filesystem", "sync", GetPoolMountPath(d.name))
+		if err != nil {
+			return fmt.Errorf("Failed syncing pool %q before snapshot: %w", d.name, err)
+		}
+	}
+
+	return nil
+}
+
+// operationContext returns a context which is cancelled when LXD shuts down or op is cancelled.
+// The returned function must be called to release the context once done.
+func (d *btrfs) operationContext(op *operations.Operation) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(d.state.ShutdownCtx)
+	if op == nil {
+		return ctx, cancel
+	}
+
+	stop := context.AfterFunc(op.Context(), cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// startMaintenance marks the pool as running the named maintenance operation, such as a balance or scrub.
+// These can't run concurrently on a file system, so an error is returned if another one is running already.
+// The returned function must be called once the operation is done.
+func (d *btrfs) startMaintenance(name string) (func(), error) {
+	btrfsMaintenanceMu.Lock()
+	defer btrfsMaintenanceMu.Unlock()
+
+	running, ok := btrfsMaintenance[d.name]
+	if ok {
+		return nil, fmt.Errorf("Cannot start %s on pool %q, %s is running: %w", name, d.name, running, errBtrfsMaintenanceRunning)
+	}
+
+	btrfsMaintenance[d.name] = name
+
+	return func() {
+		btrfsMaintenanceMu.Lock()
+		delete(btrfsMaintenance, d.name)
+		btrfsMaintenanceMu.Unlock()
+	}, nil
+}
+
+// MaintenanceStatus returns the name of the maintenance operation running on the pool, or empty if none is.
+func (d *btrfs) MaintenanceStatus() string {
+	btrfsMaintenanceMu.Lock()
+	defer btrfsMaintenanceMu.Unlock()
+
+	return btrfsMaintenance[d.name]
+}
+
+// btrfsMaintenanceProgressInterval is how often the progress of maintenance operations is updated.
+const btrfsMaintenanceProgressInterval = 10 * time.Second
+
+// btrfsMaintenanceProgress is the progress of a scrub or balance.
+type btrfsMaintenanceProgress struct {
+	percent   float64       // Percentage done, -1 if unknown.
+	remaining time.Duration // Estimated time left, -1 if unknown.
+}
+
+// btrfsPercentRegexp matches percentages such as "(11.00%)" or "80% left".
+var btrfsPercentRegexp = regexp.MustCompile(`([0-9]+(?:\.[0-9]+)?)%`)
+
+// btrfsParseDuration parses a duration in the "[<days>d ]<hours>:<minutes>:<seconds>" format of btrfs-progs.
+func btrfsParseDuration(value string) (time.Duration, error) {
+	var duration time.Duration
+
+	days, hms, found := strings.Cut(strings.TrimSpace(value), "d ")
+	if found {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return -1, fmt.Errorf("Invalid duration %q", value)
+		}
+
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		hms = days
+	}
+
+	parts := strings.Split(strings.TrimSpace(hms), ":")
+	if len(parts) != 3 {
+		return -1, fmt.Errorf("Invalid duration %q", value)
+	}
+
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.ParseUint(parts[i], 10, 32)
+		if err != nil {
+			return -1, fmt.Errorf("Invalid duration %q", value)
+		}
+
+		duration += time.Duration(n) * unit
+	}
+
+	return duration, nil
+}
+
+// btrfsParseScrubStatus returns the progress in the output of "btrfs scrub status". Figures which aren't
+// included in the output (as with older btrfs-progs versions) are reported as unknown.
+func btrfsParseScrubStatus(output string) btrfsMaintenanceProgress {
+	progress := btrfsMaintenanceProgress{percent: -1, remaining: -1}
+
+	for line := range strings.SplitSeq(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "bytes scrubbed":
+			// Value is "<size>  (<percentage>%)".
+			match := btrfsPercentRegexp.FindStringSubmatch(value)
+			if match != nil {
+				progress.percent, _ = strconv.ParseFloat(match[1], 64)
+			}
+
+		case "time left":
+			remaining, err := btrfsParseDuration(value)
+			if err == nil {
+				progress.remaining = remaining
+			}
+		}
+	}
+
+	return progress
+}
+
+// btrfsParseBalanceStatus returns the progress in the output of "btrfs balance status", which includes a line
+// like "2 out of about 10 chunks balanced (3 considered),  80% left". The time left isn't included.
+func btrfsParseBalanceStatus(output string) btrfsMaintenanceProgress {
+	progress := btrfsMaintenanceProgress{percent: -1, remaining: -1}
+
+	for line := range strings.SplitSeq(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[1] != "out" || fields[2] != "of" {
+			continue
+		}
+
+		match := btrfsPercentRegexp.FindStringSubmatch(line)
+		if match != nil {
+			left, err := strconv.ParseFloat(match[1], 64)
+			if err == nil {
+				progress.percent = 100 - left
+			}
+
+			break
+		}
+
+		// Otherwise work it out from the chunk counts.
+		done, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			break
+		}
+
+		total := fields[3]
+		if total == "about" {
+			total = fields[4]
+		}
+
+		chunks, err := strconv.ParseFloat(total, 64)
+		if err == nil && chunks > 0 {
+			progress.percent = min(100*done/chunks, 100)
+		}
+
+		break
+	}
+
+	return progress
+}
+
+// runMaintenance runs the btrfs command with args as the named maintenance operation on the pool, reporting its
+// progress as returned by the status command in the metadata of op. The time left is estimated from the time
+// elapsed when the status doesn't include it. If op is cancelled, the operation is cancelled.
+func (d *btrfs) runMaintenance(name string, args []string, statusArgs []string, parseStatus func(string) btrfsMaintenanceProgress, op *operations.Operation) error {
+	finish, err := d.startMaintenance(name)
+	if err != nil {
+		return err
+	}
+
+	defer finish()
+
+	ctx, cancel := d.operationContext(op)
+	defer cancel()
+
+	started := time.Now()
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := shared.RunCommandContext(ctx, "btrfs", args...)
+		done <- err
+	}()
+
+	ticker := time.NewTicker(btrfsMaintenanceProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				return nil
+			}
+
+			// Stopping the command doesn't necessarily stop the operation running in the kernel.
+			if ctx.Err() != nil {
+				_, _ = shared.RunCommandContext(context.Background(), "btrfs", name, "cancel", GetPoolMountPath(d.name))
+			}
+
+			return fmt.Errorf("Failed running %s on pool %q: %w", name, d.name, err)
+
+		case <-ticker.C:
+			if op == nil {
+				continue
+			}
+
+			output, err := shared.RunCommandContext(ctx, "btrfs", statusArgs...)
+			if err != nil {
+				continue
+			}
+
+			progress := parseStatus(output)
+			if progress.percent < 0 {
+				continue
+			}
+
+			if progress.remaining < 0 && progress.percent > 0 {
+				elapsed := time.Since(started)
+				progress.remaining = time.Duration(float64(elapsed) * (100 - progress.percent) / progress.percent)
+			}
+
+			status := fmt.Sprintf("%s: %.2f%%", name, progress.percent)
+			if progress.remaining >= 0 {
+				status = fmt.Sprintf("%s: %.2f%% (%s left)", name, progress.percent, progress.remaining.Round(time.Second))
+			}
+
+			_ = op.ExtendMetadata(map[string]any{"maintenance_progress": status})
+		}
+	}
+}
+
+// convertBlockFile converts the disk file at srcPath from srcFormat into a disk file of dstFormat at dstPath.
+// The source file is removed once converted.
+func (d *btrfs) convertBlockFile(srcPath string, srcFormat string, dstPath string, dstFormat string) error {
+	d.logger.Debug("Converting disk file", logger.Ctx{"srcPath": srcPath, "srcFormat": srcFormat, "dstPath": dstPath, "dstFormat": dstFormat})
+
+	cmd := []string{
+		"nice", "-n19", // Run with low priority to reduce CPU impact on other processes.
+		"qemu-img", "convert", "-f", srcFormat, "-O", dstFormat, srcPath, dstPath,
+	}
+
+	_, err := apparmor.QemuImg(d.state.OS, cmd, srcPath, dstPath, nil)
+	if err != nil {
+		_ = os.Remove(dstPath)
+		return fmt.Errorf("Failed converting %q to %s: %w", srcPath, dstFormat, err)
+	}
+
+	err = os.Remove(srcPath)
+	if err != nil {
+		return fmt.Errorf("Failed removing %q: %w", srcPath, err)
+	}
+
+	return nil
+}
+
+// volumeDiskPathFormat returns the path of the root disk file of a block volume along with its format, which is
+// qcow2 for image volumes kept in that format (see btrfs.block.format) and raw otherwise.
+func (d *btrfs) volumeDiskPathFormat(vol Volume) (string, string, error) {
+	if vol.volType == VolumeTypeImage && !btrfsEncrypted(vol) {
+		qcow2Path := filepath.Join(vol.MountPath(), btrfsQcow2DiskFile)
+		if shared.PathExists(qcow2Path) {
+			return qcow2Path, "qcow2", nil
+		}
+	}
+
+	diskPath, err := d.GetVolumeDiskPath(vol)
+	if err != nil {
+		return "", "", err
+	}
+
+	return diskPath, "raw", nil
+}
+
+// volumeDiskFile returns the path of the file holding the root disk of a block volume. Unlike GetVolumeDiskPath
+// this is the backing file rather than the decrypted device for encrypted volumes, so it reflects how the disk
+// is stored on the pool and is available without the volume being mounted.
+func (d *btrfs) volumeDiskFile(vol Volume) string {
+	qcow2Path := filepath.Join(vol.MountPath(), btrfsQcow2DiskFile)
+	if vol.volType == VolumeTypeImage && shared.PathExists(qcow2Path) {
+		return qcow2Path
+	}
+
+	return filepath.Join(vol.MountPath(), genericVolumeDiskFile)
+}
+
+// qcow2VirtualSize returns the size of the disk stored in the qcow2 file at path.
+func (d *btrfs) qcow2VirtualSize(path string) (int64, error) {
+	cmd := []string{"qemu-img", "info", "-f", "qcow2", "--output", "json", path}
+
+	out, err := apparmor.QemuImg(d.state.OS, cmd, path, "", nil)
+	if err != nil {
+		return -1, fmt.Errorf("Failed getting info of %q: %w", path, err)
+	}
+
+	imgInfo := struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}{}
+
+	err = json.Unmarshal([]byte(out), &imgInfo)
+	if err != nil {
+		return -1, fmt.Errorf("Failed decoding info of %q: %w", path, err)
+	}
+
+	return imgInfo.VirtualSize, nil
+}
+
+// btrfsEncrypted returns whether vol is a block volume stored in a LUKS container (see btrfs.block.encryption).
+func btrfsEncrypted(vol Volume) bool {
+	return IsContentBlock(vol.contentType) && shared.IsTrue(vol.config["btrfs.block.encryption"])
+}
+
+// luksMappingName returns the device mapper name of the decrypted device of an encrypted volume.
+func (d *btrfs) luksMappingName(vol Volume) string {
+	hash := sha256.Sum256([]byte(vol.MountPath()))
+	return "lxd-btrfs-" + hex.EncodeToString(hash[:8])
+}
+
+// luksKeyFile returns the key file of encrypted volumes. Returns ErrNotSupported if cryptsetup is unavailable.
+func (d *btrfs) luksKeyFile() (string, error) {
+	_, err := exec.LookPath("cryptsetup")
+	if err != nil {
+		return "", fmt.Errorf("Encrypted volumes require cryptsetup: %w", ErrNotSupported)
+	}
+
+	keyFile := d.config["btrfs.block.encryption.key_file"]
+	if keyFile == "" {
+		return "", errors.New("Encrypted volumes require btrfs.block.encryption.key_file to be set on the pool")
+	}
+
+	return keyFile, nil
+}
+
+// luksFormat creates the disk file of an encrypted volume as a LUKS container holding sizeBytes of data.
+func (d *btrfs) luksFormat(vol Volume, sizeBytes int64) error {
+	keyFile, err := d.luksKeyFile()
+	if err != nil {
+		return err
+	}
+
+	diskPath := filepath.Join(vol.MountPath(), genericVolumeDiskFile)
+
+	_, err = ensureVolumeBlockFile(vol, diskPath, sizeBytes+btrfsLUKSHeaderSize, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = shared.RunCommandContext(context.TODO(), "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--offset", strconv.Itoa(btrfsLUKSHeaderSize/512), "--key-file", keyFile, diskPath)
+	if err != nil {
+		return fmt.Errorf("Failed formatting %q as LUKS: %w", diskPath, err)
+	}
+
+	return nil
+}
+
+// luksOpen opens the decrypted device of an encrypted volume. Returns false if it was open already.
+func (d *btrfs) luksOpen(vol Volume) (bool, error) {
+	name := d.luksMappingName(vol)
+	if shared.PathExists(filepath.Join("/dev/mapper", name)) {
+		return false, nil
+	}
+
+	keyFile, err := d.luksKeyFile()
+	if err != nil {
+		return false, err
+	}
+
+	diskPath := filepath.Join(vol.MountPath(), genericVolumeDiskFile)
+
+	args := []string{"open", "--type", "luks2", "--key-file", keyFile}
+
+	// The disk file of a snapshot is in a readonly subvolume.
+	if vol.IsSnapshot() {
+		args = append(args, "--readonly")
+	}
+
+	_, err = shared.RunCommandContext(context.TODO(), "cryptsetup", append(args, diskPath, name)...)
+	if err != nil {
+		return false, fmt.Errorf("Failed opening LUKS device of %q: %w", vol.name, err)
+	}
+
+	d.logger.Debug("Opened LUKS device", logger.Ctx{"name": vol.name, "dev": name})
+
+	return true, nil
+}
+
+// luksClose closes the decrypted device of an encrypted volume if open.
+func (d *btrfs) luksClose(vol Volume) error {
+	name := d.luksMappingName(vol)
+	if !shared.PathExists(filepath.Join("/dev/mapper", name)) {
+		return nil
+	}
+
+	_, err := shared.RunCommandContext(context.TODO(), "cryptsetup", "close", name)
+	if err != nil {
+		return fmt.Errorf("Failed closing LUKS device of %q: %w", vol.name, err)
+	}
+
+	d.logger.Debug("Closed LUKS device", logger.Ctx{"name": vol.name, "dev": name})
+
+	return nil
+}
+
+// luksResize grows the decrypted device of an encrypted volume to match its disk file if the device is open.
+func (d *btrfs) luksResize(vol Volume) error {
+	name := d.luksMappingName(vol)
+	if !shared.PathExists(filepath.Join("/dev/mapper", name)) {
+		return nil
+	}
+
+	keyFile, err := d.luksKeyFile()
+	if err != nil {
+		return err
+	}
+
+	_, err = shared.RunCommandContext(context.TODO(), "cryptsetup", "resize", "--key-file", keyFile, name)
+	if err != nil {
+		return fmt.Errorf("Failed resizing LUKS device of %q: %w", vol.name, err)
+	}
+
+	return nil
+}
+
+// encryptBlockFile moves the unencrypted disk file of vol into a new LUKS container, for example when an
+// encrypted volume is created from an unencrypted image.
+func (d *btrfs) encryptBlockFile(vol Volume) error {
+	diskPath := filepath.Join(vol.MountPath(), genericVolumeDiskFile)
+	plainPath := diskPath + tmpVolSuffix
+
+	err := os.Rename(diskPath, plainPath)
+	if err != nil {
+		return fmt.Errorf("Failed renaming %q: %w", diskPath, err)
+	}
+
+	defer func() { _ = os.Remove(plainPath) }()
+
+	sizeBytes, err := block.DiskSizeBytes(plainPath)
+	if err != nil {
+		return err
+	}
+
+	err = d.luksFormat(vol, sizeBytes)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.luksOpen(vol)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = d.luksClose(vol) }()
+
+	devPath := filepath.Join("/dev/mapper", d.luksMappingName(vol))
+
+	cmd := []string{
+		"nice", "-n19", // Run with low priority to reduce CPU impact on other processes.
+		"qemu-img", "convert", "-f", "raw", "-O", "raw", "-n", plainPath, devPath,
+	}
+
+	_, err = apparmor.QemuImg(d.state.OS, cmd, plainPath, devPath, nil)
+	if err != nil {
+		return fmt.Errorf("Failed encrypting %q: %w", diskPath, err)
+	}
+
+	return nil
+}
+
+// btrfsReflinkFile replaces dstPath with a reflink copy of srcPath.
+// The copy is created next to dstPath and then renamed over it, so dstPath is left untouched on failure.
+// The nodatacow attribute of the copy is matched to srcPath first, as the kernel refuses to share extents
+// between files which differ in it. Writes to the shared extents of a nodatacow file are still copied on
+// write once, and the shared extents only count towards the exclusive usage of a qgroup once they diverge.
+func btrfsReflinkFile(srcPath string, dstPath string) error {
+	revert := revert.New()
+	defer revert.Fail()
+
+	noDataCOW, err := btrfsIsNoDataCOW(srcPath)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("Failed opening %q: %w", srcPath, err)
+	}
+
+	defer func() { _ = src.Close() }()
+
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := dstPath + tmpVolSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, srcInfo.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("Failed creating %q: %w", tmpPath, err)
+	}
+
+	defer func() { _ = dst.Close() }()
+
+	revert.Add(func() { _ = os.Remove(tmpPath) })
+
+	// The attribute can only be changed while the file is still empty.
+	flags, err := unix.IoctlGetUint32(int(dst.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return fmt.Errorf("Failed getting file attributes of %q: %w", tmpPath, err)
+	}
+
+	if (flags&btrfsNoCOWFlag != 0) != noDataCOW {
+		flags ^= btrfsNoCOWFlag
+
+		err = unix.IoctlSetPointerInt(int(dst.Fd()), unix.FS_IOC_SETFLAGS, int(flags))
+		if err != nil {
+			return fmt.Errorf("Failed setting file attributes of %q: %w", tmpPath, err)
+		}
+	}
+
+	err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	if err != nil {
+		return fmt.Errorf("Failed reflinking %q to %q: %w", srcPath, tmpPath, err)
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	revert.Success()
+	return nil
+}
+
+// btrfsParseFindNew returns the paths of the files listed in the output of "btrfs subvolume find-new".
+func btrfsParseFindNew(output string) ([]string, error) {
+	paths := []string{}
+	foundMarker := false
+
+	for line := range strings.SplitSeq(output, "\n") {
+		if strings.HasPrefix(line, "transid marker was ") {
+			foundMarker = true
+			continue
+		}
+
+		if line == "" {
+			continue
+		}
+
+		// Lines are "inode ... gen <gen> flags <flags> <path>", where the path may contain spaces.
+		_, after, found := strings.Cut(line, " flags ")
+		if !found {
+			return nil, fmt.Errorf("Unexpected find-new output line %q", line)
+		}
+
+		_, path, found := strings.Cut(after, " ")
+		if !found || path == "" {
+			return nil, fmt.Errorf("Unexpected find-new output line %q", line)
+		}
+
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	// The marker is printed last, so without it the list may be incomplete.
+	if !foundMarker {
+		return nil, errors.New("Missing transid marker in find-new output")
+	}
+
+	return paths, nil
+}
+
+// btrfsFindNewFileSize returns the total length of the extents of the file at path listed in the output of
+// "btrfs subvolume find-new", which is the amount of data written to the file since the given generation.
+// If path is empty the extents of all files are counted.
+func btrfsFindNewFileSize(output string, path string) (int64, error) {
+	var size int64
+	foundMarker := false
+
+	for line := range strings.SplitSeq(output, "\n") {
+		if strings.HasPrefix(line, "transid marker was ") {
+			foundMarker = true
+			continue
+		}
+
+		if line == "" {
+			continue
+		}
+
+		// Lines are "inode <ino> file offset <offset> len <len> ... flags <flags> <path>".
+		before, after, found := strings.Cut(line, " flags ")
+		if !found {
+			return -1, fmt.Errorf("Unexpected find-new output line %q", line)
+		}
+
+		_, linePath, _ := strings.Cut(after, " ")
+		if path != "" && linePath != path {
+			continue
+		}
+
+		fields := strings.Fields(before)
+		if len(fields) < 7 || fields[5] != "len" {
+			return -1, fmt.Errorf("Unexpected find-new output line %q", line)
+		}
+
+		length, err := strconv.ParseInt(fields[6], 10, 64)
+		if err != nil {
+			return -1, fmt.Errorf("Failed parsing extent length in find-new output line %q: %w", line, err)
+		}
+
+		size += length
+	}
+
+	// The marker is printed last, so without it the list may be incomplete.
+	if !foundMarker {
+		return -1, errors.New("Missing transid marker in find-new output")
+	}
+
+	return size, nil
+}
+
+// restoreVolumeDiff restores vol to its snapshot srcVol in place by only applying what changed since the
+// snapshot was taken. Returns an error if the changes can't be determined reliably, in which case the volume
+// may be partially restored and needs to be replaced instead.
+func (d *btrfs) restoreVolumeDiff(vol Volume, srcVol Volume) error {
+	if vol.contentType != ContentTypeFS {
+		return errors.New("Only filesystem volumes can be restored in place")
+	}
+
+	target := vol.MountPath()
+	snapPath := srcVol.MountPath()
+
+	// Changes in nested subvolumes aren't listed for the volume.
+	for _, path := range []string{target, snapPath} {
+		subVols, err := d.getSubvolumes(path)
+		if err != nil {
+			return err
+		}
+
+		if len(subVols) > 0 {
+			return fmt.Errorf("%q has nested subvolumes", path)
+		}
+	}
+
+	targetInfo, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", target)
+	if err != nil {
+		return fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	snapInfo, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", snapPath)
+	if err != nil {
+		return fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	// The generations can only be compared if the snapshot was taken of the current subvolume, which isn't
+	// the case after the volume has been replaced by an earlier restore.
+	targetUUID, _ := btrfsSubvolumeShowField(targetInfo, "UUID")
+	parentUUID, _ := btrfsSubvolumeShowField(snapInfo, "Parent UUID")
+	if targetUUID == "" || targetUUID == "-" || parentUUID != targetUUID {
+		return errors.New("Snapshot wasn't taken of the current subvolume")
+	}
+
+	value, found := btrfsSubvolumeShowField(snapInfo, "Gen at creation")
+	if !found {
+		return fmt.Errorf("Failed to find creation generation for %q", snapPath)
+	}
+
+	generation, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || generation < 1 {
+		return fmt.Errorf("Failed parsing creation generation %q", value)
+	}
+
+	// Include the snapshot's own transaction, which may have data written after the snapshot was taken.
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "find-new", target, strconv.FormatUint(generation-1, 10))
+	if err != nil {
+		return fmt.Errorf("Failed listing changed files of %q: %w", target, err)
+	}
+
+	changedPaths, err := btrfsParseFindNew(output)
+	if err != nil {
+		return err
+	}
+
+	// Share the snapshot's data for the files whose data changed. Their modification time is restored too
+	// so that rsync below only needs to restore their metadata rather than copying them again.
+	for _, relPath := range changedPaths {
+		srcPath := filepath.Join(snapPath, relPath)
+		dstPath := filepath.Join(target, relPath)
+
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // Created after the snapshot, removed below.
+			}
+
+			return err
+		}
+
+		dstInfo, err := os.Lstat(dstPath)
+		if err != nil || !srcInfo.Mode().IsRegular() || !dstInfo.Mode().IsRegular() {
+			continue // Left to rsync below.
+		}
+
+		err = btrfsReflinkFile(srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chtimes(dstPath, srcInfo.ModTime(), srcInfo.ModTime())
+		if err != nil {
+			return fmt.Errorf("Failed restoring modification time of %q: %w", dstPath, err)
+		}
+	}
+
+	// Apply the remaining changes, such as created, deleted and renamed files and changed metadata.
+	_, err = rsync.LocalCopy(snapPath, target, "", true)
+	if err != nil {
+		return fmt.Errorf("Failed to rsync volume: %w", err)
+	}
+
+	d.logger.Debug("Restored volume in place", logger.Ctx{"name": vol.name, "snapshot": srcVol.name, "changedFiles": len(changedPaths)})
+
+	return nil
+}
+
+// setSnapshotLabels replaces the labels stored on the root of the subvolume at path.
+// Any existing labels (which a snapshot inherits from its source) are removed first.
+func setSnapshotLabels(path string, labels map[string]string) error {
+	xattrs, err := shared.GetAllXattr(path)
+	if err != nil {
+		return err
+	}
+
+	for key := range xattrs {
+		if !strings.HasPrefix(key, btrfsSnapshotLabelXattrPrefix) {
+			continue
+		}
+
+		err = unix.Removexattr(path, key)
+		if err != nil {
+			return fmt.Errorf("Failed removing %q extended attribute from %q: %w", key, path, err)
+		}
+	}
+
+	for name, value := range labels {
+		key := btrfsSnapshotLabelXattrPrefix + name
+
+		err = unix.Setxattr(path, key, []byte(value), 0)
+		if err != nil {
+			return fmt.Errorf("Failed setting %q extended attribute on %q: %w", key, path, err)
+		}
+	}
+
+	return nil
+}
+
+// setReceivedUUID sets the "Received UUID" field on a subvolume with the given path using ioctl.
+func setReceivedUUID(path string, UUID string) error {
+	type btrfsIoctlReceivedSubvolArgs struct {
+		uuid [16]byte
+		_    [22]uint64 // padding
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed opening %s: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	args := btrfsIoctlReceivedSubvolArgs{}
+
+	strUUID, err := uuid.Parse(UUID)
+	if err != nil {
+		return fmt.Errorf("Failed parsing UUID: %w", err)
+	}
+
+	binUUID, err := strUUID.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Failed coverting UUID: %w", err)
+	}
+
+	copy(args.uuid[:], binUUID)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), linux.IoctlBtrfsSetReceivedSubvol, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return fmt.Errorf("Failed setting received UUID: %w", unix.Errno(errno))
+	}
+
+	return nil
+}
+
+// setReceivedUUIDChecked sets the received UUID of the subvolume at path and reads it back, as some kernel and
+// tool versions don't keep it. If it wasn't kept the subvolume is marked with btrfsNoIncrementalXattr, so that
+// it isn't used as the parent of incremental transfers which the target would fail to find the parent of.
+// Otherwise any such marker received with the content of the subvolume is removed.
+func (d *btrfs) setReceivedUUIDChecked(path string, UUID string) error {
+	err := setReceivedUUID(path, UUID)
+	if err == nil {
+		var output string
+		output, err = shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", path)
+		if err == nil {
+			receivedUUID := btrfsSnapshotUUIDInfo("", output).ReceivedUUID
+			if strings.EqualFold(receivedUUID, UUID) {
+				err = unix.Removexattr(path, btrfsNoIncrementalXattr)
+				if err != nil && !errors.Is(err, unix.ENODATA) {
+					return fmt.Errorf("Failed removing %q extended attribute from %q: %w", btrfsNoIncrementalXattr, path, err)
+				}
+
+				return nil
+			}
+
+			err = fmt.Errorf("Received UUID is %q after setting it", receivedUUID)
+		}
+	}
+
+	d.logger.Warn("Failed setting received UUID, the subvolume can't be the parent of incremental transfers", logger.Ctx{"path": path, "uuid": UUID, "err": err})
+
+	err = unix.Setxattr(path, btrfsNoIncrementalXattr, []byte(UUID), 0)
+	if err != nil {
+		return fmt.Errorf("Failed setting %q extended attribute on %q: %w", btrfsNoIncrementalXattr, path, err)
+	}
+
+	return nil
+}
+
+// btrfsIncrementalDisabled returns whether the subvolume at path is marked with btrfsNoIncrementalXattr.
+func btrfsIncrementalDisabled(path string) bool {
+	_, err := unix.Getxattr(path, btrfsNoIncrementalXattr, nil)
+	return err == nil
+}
+
+// btrfsGetCompressionProperty returns the compression property of the subvolume or file at path, which is empty
+// if none is set.
+func btrfsGetCompressionProperty(path string) (string, error) {
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "property", "get", path, "compression")
+	if err != nil {
+		return "", fmt.Errorf("Failed getting compression property of %q: %w", path, err)
+	}
+
+	_, compression, _ := strings.Cut(strings.TrimSpace(output), "=")
+
+	return compression, nil
+}
+
+func (d *btrfs) getMountOptions() string {
+	// Allow overriding the default options.
+	if d.config["btrfs.mount_options"] != "" {
+		return d.config["btrfs.mount_options"]
+	}
+
+	return "user_subvol_rm_allowed"
+}
+
+// btrfsMountOptions combines the configured mount options with the super block options of the mount (the last
+// field of its mountinfo entry), without duplicates.
+func btrfsMountOptions(configured string, superOptions string) []string {
+	options := []string{}
+	for _, option := range slices.Concat(strings.Split(configured, ","), strings.Split(superOptions, ",")) {
+		if option != "" && !slices.Contains(options, option) {
+			options = append(options, option)
+		}
+	}
+
+	return options
+}
+
+// btrfsUseNodatacow returns whether copy-on-write should be disabled for block volumes given the mount options
+// and the compression property of the volume. This is unless data copy-on-write was explicitly requested or
+// compression is enabled, as compression requires copy-on-write.
+func btrfsUseNodatacow(options []string, compression string) bool {
+	// The compression property takes precedence over the mount options.
+	if compression != "" {
+		return compression == "none" && !slices.Contains(options, "datacow")
+	}
+
+	for _, option := range options {
+		if option == "datacow" || strings.HasPrefix(option, "compress") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// btrfsLoadKernelFeatures returns the btrfs features supported by the running kernel.
+// The list is read from sysfs on first successful use and cached afterwards.
+func btrfsLoadKernelFeatures() ([]string, error) {
+	btrfsKernelFeaturesMu.Lock()
+	defer btrfsKernelFeaturesMu.Unlock()
+
+	if btrfsKernelFeatures != nil {
+		return btrfsKernelFeatures, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(btrfsSysfsPath, "features"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing btrfs kernel features: %w", err)
+	}
+
+	features := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		features = append(features, entry.Name())
+	}
+
+	btrfsKernelFeatures = features
+
+	return btrfsKernelFeatures, nil
+}
+
+// getFilesystemUUID returns the UUID of the btrfs filesystem backing the pool.
+func (d *btrfs) getFilesystemUUID() (string, error) {
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "filesystem", "show", GetPoolMountPath(d.name))
+	if err != nil {
+		return "", err
+	}
+
+	for line := range strings.SplitSeq(output, "\n") {
+		_, value, found := strings.Cut(line, "uuid:")
+		if found {
+			return strings.TrimSpace(value), nil
+		}
+	}
+
+	return "", fmt.Errorf("Failed to find filesystem UUID of pool %q", d.name)
+}
+
+// GetKernelBtrfsFeatures returns the btrfs features supported by the running kernel (as listed in
+// /sys/fs/btrfs/features), each mapped to whether it is enabled on the pool's filesystem.
+func (d *btrfs) GetKernelBtrfsFeatures() (map[string]bool, error) {
+	kernelFeatures, err := btrfsLoadKernelFeatures()
+	if err != nil {
+		return nil, err
+	}
+
+	features := make(map[string]bool, len(kernelFeatures))
+	for _, feature := range kernelFeatures {
+		features[feature] = false
+	}
+
+	fsUUID, err := d.getFilesystemUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	// The filesystem's features directory contains the features which are enabled as well as those which
+	// could be changed at runtime, with the file content indicating whether the feature is currently set.
+	poolFeaturesPath := filepath.Join(btrfsSysfsPath, fsUUID, "features")
+	entries, err := os.ReadDir(poolFeaturesPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing btrfs features of pool %q: %w", d.name, err)
+	}
+
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(poolFeaturesPath, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		features[entry.Name()] = strings.TrimSpace(string(content)) == "1"
+	}
+
+	return features, nil
+}
+
+// enableQuota enables quotas on the pool, using simple quotas if configured.
+func (d *btrfs) enableQuota() error {
+	args := []string{"quota", "enable"}
+
+	if shared.IsTrue(d.config["btrfs.quota.simple"]) {
+		features, err := d.GetKernelBtrfsFeatures()
+		if err != nil {
+			return err
+		}
+
+		_, ok := features["simple_quota"]
+		if !ok {
+			return errors.New("Simple quotas aren't supported by the kernel")
+		}
+
+		args = append(args, "--simple")
+	}
+
+	args = append(args, GetPoolMountPath(d.name))
+
+	_, err := shared.RunCommandContext(context.TODO(), "btrfs", args...)
+	return err
+}
+
+// btrfsIsNoDataCOW returns whether the nodatacow file attribute (as set by "chattr +C") is set on path.
+func btrfsIsNoDataCOW(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed opening %q: %w", path, err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, fmt.Errorf("Failed getting file attributes of %q: %w", path, err)
+	}
+
+	return flags&btrfsNoCOWFlag != 0, nil
+}
+
+// createSubvolumePrefix creates the subvolume configured in btrfs.subvolume_prefix at the top level of the
+// freshly formatted btrfs filesystem found at source (either a block device or a loop file).
+func (d *btrfs) createSubvolumePrefix(source string) error {
+	prefix := d.config["btrfs.subvolume_prefix"]
+	if prefix == "" {
+		return nil
+	}
+
+	devPath := source
+	if !shared.IsBlockdevPath(source) {
+		loopDevPath, err := loopDeviceSetup(source)
+		if err != nil {
+			return err
+		}
+
+		defer func() { _ = loopDeviceAutoDetach(loopDevPath) }()
+
+		devPath = loopDevPath
+	}
+
+	tmpMountPath, err := os.MkdirTemp("", "lxd_btrfs_")
+	if err != nil {
+		return fmt.Errorf("Failed creating temporary mount path: %w", err)
+	}
+
+	defer func() { _ = os.Remove(tmpMountPath) }()
+
+	err = TryMount(context.TODO(), devPath, tmpMountPath, "btrfs", 0, "")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _, _ = forceUnmount(tmpMountPath) }()
+
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "create", filepath.Join(tmpMountPath, prefix))
+	if err != nil {
+		return fmt.Errorf("Failed creating subvolume prefix %q: %w", prefix, err)
+	}
+
+	return nil
+}
+
+// btrfsSuperIsSeed returns whether the output of "btrfs inspect-internal dump-super" is of a seed device.
+func btrfsSuperIsSeed(output string) bool {
+	inFlags := false
+
+	for line := range strings.SplitSeq(output, "\n") {
+		// The names of the flags may continue on indented lines.
+		if inFlags && !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			return false
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "flags" {
+			inFlags = true
+		}
+
+		if inFlags && strings.Contains(line, "SEEDING") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scanSeed makes the seed device of the pool (set in btrfs.seed) known to the kernel, setting up a loop device
+// if the seed is a file. The returned function releases the loop device once it's no longer used by a mount.
+func (d *btrfs) scanSeed() (func(), error) {
+	if d.state.OS.RunningInUserNS {
+		return nil, fmt.Errorf("Seed devices can't be used in a user namespace: %w", ErrNotSupported)
+	}
+
+	seedPath := shared.HostPath(d.config["btrfs.seed"])
+	devPath := seedPath
+	release := func() {}
+
+	if !shared.IsBlockdevPath(seedPath) {
+		loopDevPath, err := loopDeviceSetup(seedPath)
+		if err != nil {
+			return nil, err
+		}
+
+		devPath = loopDevPath
+		release = func() { _ = loopDeviceAutoDetach(loopDevPath) }
+	}
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "inspect-internal", "dump-super", devPath)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("Failed reading super block of seed %q: %w", seedPath, err)
+	}
+
+	if !btrfsSuperIsSeed(output) {
+		release()
+		return nil, fmt.Errorf("%q isn't a Btrfs seed device, it can be made one with \"btrfstune -S 1\"", seedPath)
+	}
+
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", "device", "scan", devPath)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("Failed scanning seed %q: %w", seedPath, err)
+	}
+
+	return release, nil
+}
+
+// sproutSeed creates the pool's file system on source by adding it to the seed file system as the writable
+// device. New data is then only written to source and the seed stays read-only.
+func (d *btrfs) sproutSeed(source string) error {
+	release, err := d.scanSeed()
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	devPath := source
+	if !shared.IsBlockdevPath(source) {
+		loopDevPath, err := loopDeviceSetup(source)
+		if err != nil {
+			return err
+		}
+
+		defer func() { _ = loopDeviceAutoDetach(loopDevPath) }()
+
+		devPath = loopDevPath
+	}
+
+	tmpMountPath, err := os.MkdirTemp("", "lxd_btrfs_")
+	if err != nil {
+		return fmt.Errorf("Failed creating temporary mount path: %w", err)
+	}
+
+	defer func() { _ = os.Remove(tmpMountPath) }()
+
+	// Seed file systems can only be mounted read-only until a writable device is added.
+	err = TryMount(context.TODO(), shared.HostPath(d.config["btrfs.seed"]), tmpMountPath, "btrfs", unix.MS_RDONLY, "")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _, _ = forceUnmount(tmpMountPath) }()
+
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", "device", "add", "-f", devPath, tmpMountPath)
+	if err != nil {
+		return fmt.Errorf("Failed adding %q to seed file system: %w", source, err)
+	}
+
+	err = TryMount(context.TODO(), "", tmpMountPath, "btrfs", unix.MS_REMOUNT, "")
+	if err != nil {
+		return err
+	}
+
+	prefix := d.config["btrfs.subvolume_prefix"]
+	if prefix != "" {
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "create", filepath.Join(tmpMountPath, prefix))
+		if err != nil {
+			return fmt.Errorf("Failed creating subvolume prefix %q: %w", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+// poolRelativeSubvolumePath converts a subvolume path as reported by "btrfs subvolume list" (which is relative
+// to the top level of the filesystem) into a path relative to the pool mount path.
+// Returns false if the subvolume doesn't belong to the pool's subvolume prefix.
+func (d *btrfs) poolRelativeSubvolumePath(listPath string) (string, bool) {
+	prefix := d.config["btrfs.subvolume_prefix"]
+	if prefix == "" {
+		return listPath, true
+	}
+
+	return strings.CutPrefix(listPath, prefix+"/")
+}
+
+func (d *btrfs) isSubvolume(path string) bool {
+	// Stat the path.
+	fs := unix.Stat_t{}
+	err := unix.Lstat(path, &fs)
+	if err != nil {
+		return false
+	}
+
+	// Check if BTRFS_FIRST_FREE_OBJECTID is the inode number.
+	if fs.Ino != 256 {
+		return false
+	}
+
+	return true
+}
+
+func (d *btrfs) hasSubvolumes(path string) (bool, error) {
+	var stdout strings.Builder
+
+	err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-o", path)
+	if err != nil {
+		return false, err
+	}
+
+	return stdout.Len() > 0, nil
+}
+
+func (d *btrfs) getSubvolumes(path string) ([]string, error) {
+	// Make sure the path has a trailing slash.
+	if !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	poolMountPath := GetPoolMountPath(d.name)
+	if !strings.HasPrefix(path, poolMountPath+"/") {
+		return nil, fmt.Errorf("%q is outside pool mount path %q", path, poolMountPath)
+	}
+
+	var result []string
+
+	if d.state.OS.RunningInUserNS {
+		// If using BTRFS in a nested container we cannot use "btrfs subvolume list" due to a permission error.
+		// So instead walk the directory tree testing each directory to see if it is subvolume.
+		err := filepath.Walk(path, func(fpath string, entry fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Ignore the base path.
+			if strings.TrimRight(fpath, "/") == strings.TrimRight(path, "/") {
+				return nil
+			}
+
+			// Subvolumes can only be directories.
+			if !entry.IsDir() {
+				return nil
+			}
+
+			// Check if directory is a subvolume.
+			if d.isSubvolume(fpath) {
+				result = append(result, strings.TrimPrefix(fpath, path))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// If not running inside a nested container we can use "btrfs subvolume list" to get subvolumes which is more
+		// performant than walking the directory tree.
+		var stdout bytes.Buffer
+		err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", poolMountPath)
+		if err != nil {
+			return nil, err
+		}
+
+		path = strings.TrimPrefix(path, poolMountPath+"/")
+		scanner := bufio.NewScanner(&stdout)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) != 9 {
+				continue
+			}
+
+			relPath, found := d.poolRelativeSubvolumePath(fields[8])
+			if !found {
+				continue
+			}
+
+			subvolPath, found := strings.CutPrefix(relPath, path)
+			if !found {
+				continue
+			}
+
+			result = append(result, subvolPath)
+		}
+	}
+
+	return result, nil
+}
+
+// subvolumeStates returns whether the subvolume at rootPath and each subvolume below it is readonly, keyed by
+// their path inside the root subvolume (so / is the root subvolume itself). Paths which aren't subvolumes are
+// left out. This allows sending many subvolumes without checking each of them with an external command.
+func (d *btrfs) subvolumeStates(rootPath string) (map[string]bool, error) {
+	states := map[string]bool{}
+
+	if !d.isSubvolume(rootPath) {
+		return states, nil
+	}
+
+	subVolPaths, err := d.getSubvolumes(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subVolPath := range append([]string{""}, subVolPaths...) {
+		readonly, err := btrfsSubvolumeReadonlyFlag(filepath.Join(rootPath, subVolPath))
+		if err != nil {
+			return nil, err
+		}
+
+		states[string(filepath.Separator)+subVolPath] = readonly
+	}
+
+	return states, nil
+}
+
+// snapshotSubvolume creates a snapshot of the specified path at the dest supplied. If recursion is true and
+// sub volumes are found below the path then they are created at the relative location in dest.
+func (d *btrfs) snapshotSubvolume(path string, dest string, recursion bool) (revert.Hook, error) {
+	revert := revert.New()
+	defer revert.Fail()
+
+	// Single subvolume creation.
+	snapshot := func(path string, dest string) error {
+		_, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "snapshot", path, dest)
+		if err != nil {
+			return err
+		}
+
+		revert.Add(func() {
+			// Don't delete recursive since there already is a revert hook
+			// for each subvolume that got created.
+			_ = d.deleteSubvolume(dest, false)
+		})
+
+		return nil
+	}
+
+	// First snapshot the root.
+	err := snapshot(path, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now snapshot all subvolumes of the root.
+	if recursion {
+		// Get the subvolumes list.
+		subSubVols, err := d.getSubvolumes(path)
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(subSubVols)
+
+		for _, subSubVol := range subSubVols {
+			subSubVolSnapPath := filepath.Join(dest, subSubVol)
+
+			// Clear the target for the subvol to use.
+			_ = os.Remove(subSubVolSnapPath)
+
+			err := snapshot(filepath.Join(path, subSubVol), subSubVolSnapPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cleanup := revert.Clone().Fail
+	revert.Success()
+	return cleanup, nil
+}
+
+func (d *btrfs) deleteSubvolume(rootPath string, recursion bool) error {
+	// Single subvolume deletion.
+	destroy := func(path string) error {
+		// Attempt (but don't fail on) to delete any qgroup on the subvolume.
+		qgroup, _, err := d.getQGroup(path)
+		if err == nil {
+			_, _ = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "destroy", qgroup, path)
+		}
+
+		// Temporarily change ownership & mode to help with nesting.
+		_ = os.Chmod(path, 0700)
+		_ = os.Chown(path, 0, 0)
+
+		// Delete the subvolume itself.
+		args := []string{"subvolume", "delete"}
+		if d.config["btrfs.delete_mode"] == "sync" {
+			// Wait for the deletion to be committed rather than leaving it to the next transaction.
+			args = append(args, "--commit-each")
+		}
+
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", append(args, path)...)
+
+		return err
+	}
+
+	// Try and ensure volume is writable to possibility of destroy failing.
+	err := d.setSubvolumeReadonlyProperty(rootPath, false)
+	if err != nil {
+		d.logger.Warn("Failed setting subvolume writable", logger.Ctx{"path": rootPath, "err": err})
+	}
+
+	// Attempt to delete the root subvol itself (short path).
+	err = destroy(rootPath)
+	if err == nil {
+		return nil
+	} else if !recursion {
+		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, err)
+	}
+
+	// Delete subsubvols as recursion enabled.
+
+	// Get the subvolumes list.
+	subSubVols, err := d.getSubvolumes(rootPath)
+	if err != nil {
+		return err
+	}
+
+	// Perform a first pass and ensure all sub volumes are writable.
+	sort.Sort(sort.StringSlice(subSubVols))
+	for _, subSubVol := range subSubVols {
+		subSubVolPath := filepath.Join(rootPath, subSubVol)
+		err = d.setSubvolumeReadonlyProperty(subSubVolPath, false)
+		if err != nil {
+			d.logger.Warn("Failed setting subvolume writable", logger.Ctx{"path": subSubVolPath, "err": err})
+		}
+	}
+
+	// Perform a second pass to delete subvolumes.
+	sort.Sort(sort.Reverse(sort.StringSlice(subSubVols)))
+	for _, subSubVol := range subSubVols {
+		subSubVolPath := filepath.Join(rootPath, subSubVol)
+		err := destroy(subSubVolPath)
+		if err != nil {
+			return fmt.Errorf("Failed deleting subvolume %q: %w", subSubVolPath, err)
+		}
+	}
+
+	// Delete the root subvol itself.
+	err = destroy(rootPath)
+	if err != nil {
+		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, err)
+	}
+
+	return nil
+}
+
+func (d *btrfs) getQGroup(path string) (string, int64, error) {
+	// Try to get the qgroup details.
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "show", "-e", "-f", "--raw", path)
+	if err != nil {
+		return "", -1, errBtrfsNoQuota
+	}
+
+	// Parse to extract the qgroup identifier and its exclusive usage.
+	// With simple quotas extents are only accounted to the subvolume which first wrote them, so the exclusive
+	// column reports the usage charged to the subvolume in both modes.
+	var qgroup string
+	usage := int64(-1)
+	for line := range strings.SplitSeq(output, "\n") {
+		// Use case-insensitive field title match because BTRFS tooling changed casing between versions.
+		if line == "" || strings.HasPrefix(strings.ToLower(line), "qgroupid") || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		// The BTRFS tooling changed the number of columns between versions so we only check for minimum.
+		if len(fields) < 3 {
+			continue
+		}
+
+		qgroup = fields[0]
+		val, err := strconv.ParseInt(fields[2], 10, 64)
+		if err == nil {
+			usage = val
+		}
+
+		break
+	}
+
+	if qgroup == "" {
+		return "", -1, errBtrfsNoQGroup
+	}
+
+	return qgroup, usage, nil
+}
+
+// btrfsSubvolumeShowField returns the value of the named field in the output of "btrfs subvolume show".
+func btrfsSubvolumeShowField(output string, name string) (string, bool) {
+	for line := range strings.SplitSeq(output, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == name {
+			return strings.TrimSpace(value), true
+		}
+	}
+
+	return "", false
+}
+
+// btrfsSubvolumeShowPath returns the path of the subvolume from the output of "btrfs subvolume show", which is
+// relative to the top level subvolume of the filesystem.
+func btrfsSubvolumeShowPath(output string) string {
+	path, _, _ := strings.Cut(strings.TrimLeft(output, "\n"), "\n")
+
+	return strings.TrimSpace(path)
+}
+
+// recompressVolume sets the compression property of the volume to btrfs.compression and rewrites its data with
+// that compression. Data can't be decompressed this way, so with compression set to none only new writes are
+// left uncompressed.
+func (d *btrfs) recompressVolume(vol Volume) error {
+	compression := d.config["btrfs.compression"]
+	if compression == "" {
+		return nil
+	}
+
+	volPath := vol.MountPath()
+
+	_, err := shared.RunCommandContext(context.TODO(), "btrfs", "property", "set", volPath, "compression", compression)
+	if err != nil {
+		return fmt.Errorf("Failed setting compression property on %q: %w", volPath, err)
+	}
+
+	if compression == "none" {
+		return nil
+	}
+
+	d.logger.Debug("Recompressing volume", logger.Ctx{"name": vol.name, "compression": compression})
+
+	_, err = shared.RunCommandContext(d.state.ShutdownCtx, "btrfs", "filesystem", "defragment", "-r", "-c"+compression, volPath)
+	if err != nil {
+		return fmt.Errorf("Failed recompressing %q: %w", volPath, err)
+	}
+
+	return nil
+}
+
+// btrfsSetFillMarker sets or removes btrfsFillMarkerXattr, holding the fingerprint of the image being unpacked
+// if any, on the volume at path.
+func btrfsSetFillMarker(path string, fingerprint string, filling bool) error {
+	if !filling {
+		err := unix.Removexattr(path, btrfsFillMarkerXattr)
+		if err != nil {
+			return fmt.Errorf("Failed removing %q extended attribute from %q: %w", btrfsFillMarkerXattr, path, err)
+		}
+
+		return nil
+	}
+
+	err := unix.Setxattr(path, btrfsFillMarkerXattr, []byte(fingerprint), 0)
+	if err != nil {
+		return fmt.Errorf("Failed setting %q extended attribute on %q: %w", btrfsFillMarkerXattr, path, err)
+	}
+
+	return nil
+}
+
+// btrfsTrackFill records that the volume at path is being filled by this process, so that its fill marker isn't
+// mistaken for an interrupted fill. The returned function must be called once the fill has ended.
+func btrfsTrackFill(path string) func() {
+	btrfsFillingPathsMu.Lock()
+	btrfsFillingPaths[path]++
+	btrfsFillingPathsMu.Unlock()
+
+	return func() {
+		btrfsFillingPathsMu.Lock()
+		defer btrfsFillingPathsMu.Unlock()
+
+		btrfsFillingPaths[path]--
+		if btrfsFillingPaths[path] <= 0 {
+			delete(btrfsFillingPaths, path)
+		}
+	}
+}
+
+// btrfsFillInterrupted returns the fingerprint recorded in btrfsFillMarkerXattr and true if the volume at path
+// was left partially filled. A volume being filled by this process carries the marker too, but isn't reported.
+func btrfsFillInterrupted(path string) (string, bool) {
+	btrfsFillingPathsMu.Lock()
+	filling := btrfsFillingPaths[path] > 0
+	btrfsFillingPathsMu.Unlock()
+
+	if filling {
+		return "", false
+	}
+
+	fingerprint := make([]byte, 256)
+	n, err := unix.Getxattr(path, btrfsFillMarkerXattr, fingerprint)
+	if err != nil {
+		return "", false
+	}
+
+	return string(fingerprint[:n]), true
+}
+
+// removeInterruptedFill deletes what is left of the volume if a previous attempt at creating it was interrupted
+// while it was being filled (such as by a crash), as marked by btrfsFillMarkerXattr.
+//
+// The volume is always filled again from scratch rather than resumed. Fillers unpack or convert the whole image
+// in one go (qemu-img convert skips zeroed areas and may write out of order), so there is no point up to which
+// the partial content is known to be complete, and nothing records what the finished content should be to
+// check the partial content against. Resuming could therefore leave a volume that looks complete but isn't.
+func (d *btrfs) removeInterruptedFill(vol Volume) error {
+	volPath := vol.MountPath()
+	if !d.isSubvolume(volPath) {
+		return nil
+	}
+
+	fingerprint, interrupted := btrfsFillInterrupted(volPath)
+	if !interrupted {
+		return nil
+	}
+
+	d.logger.Warn("Removing volume left by interrupted fill", logger.Ctx{"name": vol.name, "fingerprint": fingerprint})
+
+	if btrfsEncrypted(vol) {
+		_ = d.luksClose(vol)
+	}
+
+	err := d.deleteSubvolume(volPath, true)
+	if err != nil {
+		return fmt.Errorf("Failed deleting volume left by interrupted fill %q: %w", volPath, err)
+	}
+
+	return nil
+}
+
+// btrfsSubvolumeCreationTime returns the creation time in the output of "btrfs subvolume show".
+func btrfsSubvolumeCreationTime(output string) (time.Time, error) {
+	value, found := btrfsSubvolumeShowField(output, "Creation time")
+	if !found {
+		return time.Time{}, errors.New("Failed to find creation time")
+	}
+
+	created, err := time.Parse("2006-01-02 15:04:05 -0700", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed parsing creation time %q: %w", value, err)
+	}
+
+	return created, nil
+}
+
+// checkSnapshotInterval refuses to snapshot the volume within btrfs.snapshots.min_interval of the creation of
+// its latest snapshot. The caller must hold the snapshots lock of the volume.
+func (d *btrfs) checkSnapshotInterval(snapVol Volume) error {
+	if snapVol.config["btrfs.snapshots.min_interval"] == "" {
+		return nil
+	}
+
+	seconds, err := strconv.ParseUint(snapVol.config["btrfs.snapshots.min_interval"], 10, 32)
+	if err != nil || seconds == 0 {
+		return nil
+	}
+
+	interval := time.Duration(seconds) * time.Second
+
+	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
+	parentVol := NewVolume(d, d.name, snapVol.volType, snapVol.contentType, parentName, snapVol.config, snapVol.poolConfig)
+
+	// The snapshots are ordered by subvolume ID, so the latest one is last.
+	snapshots, err := d.volumeSnapshotsSorted(parentVol, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	latestPath := GetVolumeMountPath(d.name, snapVol.volType, GetSnapshotVolumeName(parentName, snapshots[len(snapshots)-1]))
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", latestPath)
+	if err != nil {
+		return fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	created, err := btrfsSubvolumeCreationTime(output)
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(created)
+	if elapsed < interval {
+		return fmt.Errorf("Latest snapshot of volume %q was created %s ago, less than btrfs.snapshots.min_interval of %s", parentName, elapsed.Round(time.Second), interval)
+	}
+
+	return nil
+}
+
+// btrfsSendParentUUID returns the UUID by which a send stream refers to the subvolume described by the output of
+// "btrfs subvolume show" when used as the parent. This is the received UUID if the subvolume was itself received,
+// as that is what matches the subvolume on the target, otherwise its own UUID. Returns a reason instead if the
+// subvolume can't be used as a parent.
+func btrfsSendParentUUID(output string) (string, string) {
+	flags, _ := btrfsSubvolumeShowField(output, "Flags")
+	if !slices.Contains(strings.Fields(flags), "readonly") {
+		return "", "Snapshot is not read-only"
+	}
+
+	receivedUUID, _ := btrfsSubvolumeShowField(output, "Received UUID")
+	if receivedUUID != "" && receivedUUID != "-" {
+		return receivedUUID, ""
+	}
+
+	subvolUUID, _ := btrfsSubvolumeShowField(output, "UUID")
+	if subvolUUID == "" || subvolUUID == "-" {
+		return "", "Snapshot has no UUID"
+	}
+
+	return subvolUUID, ""
+}
+
+// getSubvolumeID returns the ID of the subvolume at path.
+func (d *btrfs) getSubvolumeID(path string) (string, error) {
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	subvolID, found := btrfsSubvolumeShowField(output, "Subvolume ID")
+	if !found {
+		return "", fmt.Errorf("Failed to find subvolume id for %q", path)
+	}
+
+	return subvolID, nil
+}
+
+// getSubvolumeGeneration returns the generation of the subvolume at path.
+func (d *btrfs) getSubvolumeGeneration(path string) (uint64, error) {
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", path)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	value, found := btrfsSubvolumeShowField(output, "Generation")
+	if !found {
+		return 0, fmt.Errorf("Failed to find subvolume generation for %q", path)
+	}
+
+	generation, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed parsing subvolume generation %q: %w", value, err)
+	}
+
+	return generation, nil
+}
+
+// createQGroup creates the level 0 quota group for the subvolume at path and returns its identifier.
+func (d *btrfs) createQGroup(path string) (string, error) {
+	id, err := d.getSubvolumeID(path)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "create", "0/"+id, path)
+	if err != nil {
+		return "", err
+	}
+
+	qgroup, _, err := d.getQGroup(path)
+	if err != nil {
+		return "", err
+	}
+
+	return qgroup, nil
+}
+
+// btrfsParseParentQGroup parses the identifier of a higher level quota group ("<level>/<id>").
+func btrfsParseParentQGroup(value string) (uint64, uint64, error) {
+	levelStr, idStr, found := strings.Cut(value, "/")
+	if !found {
+		return 0, 0, fmt.Errorf("Invalid quota group %q, expected <level>/<id>", value)
+	}
+
+	level, err := strconv.ParseUint(levelStr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid level in quota group %q: %w", value, err)
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 48)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid ID in quota group %q: %w", value, err)
+	}
+
+	// Level 0 quota groups are those of the subvolumes themselves.
+	if level < 1 {
+		return 0, 0, fmt.Errorf("Quota group %q must be of level 1 or higher", value)
+	}
+
+	return level, id, nil
+}
+
+// parentQGroupArgs returns the arguments making a new subvolume a member of the quota group set in
+// btrfs.qgroup.parent, creating it if needed. No arguments are returned if quotas are disabled.
+func (d *btrfs) parentQGroupArgs() ([]string, error) {
+	parent := d.config["btrfs.qgroup.parent"]
+	if parent == "" {
+		return nil, nil
+	}
+
+	poolMountPath := GetPoolMountPath(d.name)
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "show", "--raw", poolMountPath)
+	if err != nil {
+		return nil, nil
+	}
+
+	_, found := btrfsParseQGroupTable(output)[parent]
+	if !found {
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "create", parent, poolMountPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed creating parent quota group %q: %w", parent, err)
+		}
+	}
+
+	return []string{"-i", parent}, nil
+}
+
+// btrfsIOPrioClasses maps the I/O scheduling classes accepted in btrfs.migration.ioprio to their ionice number.
+var btrfsIOPrioClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// btrfsIOPrioArgs returns the ionice arguments for a btrfs.migration.ioprio value.
+func btrfsIOPrioArgs(value string) ([]string, error) {
+	class, level, hasLevel := strings.Cut(value, ":")
+
+	classNum, ok := btrfsIOPrioClasses[class]
+	if !ok {
+		return nil, fmt.Errorf("Invalid I/O scheduling class %q", class)
+	}
+
+	args := []string{"-c", classNum}
+
+	if hasLevel {
+		if class == "idle" {
+			return nil, errors.New("The idle I/O scheduling class doesn't have levels")
+		}
+
+		levelNum, err := strconv.Atoi(level)
+		if err != nil || levelNum < 0 || levelNum > 7 {
+			return nil, fmt.Errorf("Invalid I/O priority level %q, must be from 0 to 7", level)
+		}
+
+		args = append(args, "-n", level)
+	}
+
+	return args, nil
+}
+
+// btrfsMigrationTransport returns the transport used for a migration of the given type and why it was selected.
+func btrfsMigrationTransport(migrationType migration.Type) string {
+	switch migrationType.FSType {
+	case migration.MigrationFSType_BTRFS:
+		if len(migrationType.Features) == 0 {
+			return "btrfs: optimized transfer negotiated"
+		}
+
+		return fmt.Sprintf("btrfs: optimized transfer negotiated with features %s", strings.Join(migrationType.Features, ", "))
+	case migration.MigrationFSType_RSYNC:
+		return "rsync: optimized transfer not negotiated, the other pool isn't btrfs or doesn't support it"
+	case migration.MigrationFSType_BLOCK_AND_RSYNC:
+		return "block_and_rsync: optimized transfer not negotiated, the other pool isn't btrfs or doesn't support it"
+	}
+
+	return fmt.Sprintf("%s: not supported by btrfs", strings.ToLower(migrationType.FSType.String()))
+}
+
+// reportMigrationTransport logs the transport used to migrate vol and records it in the metadata of op, to help
+// understand why a migration is slower than expected.
+func (d *btrfs) reportMigrationTransport(vol Volume, migrationType migration.Type, op *operations.Operation) {
+	transport := btrfsMigrationTransport(migrationType)
+
+	d.logger.Debug("Selected migration transport", logger.Ctx{"name": vol.name, "transport": transport})
+
+	if op != nil {
+		_ = op.ExtendMetadata(map[string]any{"migration_transport": transport})
+	}
+}
+
+// migrationHeaderTimeout returns how long to wait for the header of a migration as set by
+// btrfs.migration.header_timeout.
+func (d *btrfs) migrationHeaderTimeout() time.Duration {
+	seconds, err := strconv.ParseUint(d.config["btrfs.migration.header_timeout"], 10, 32)
+	if err != nil {
+		return btrfsMigrationHeaderTimeout
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// btrfsReadMigrationHeader reads the migration header frame from conn. If the frame isn't received within the
+// timeout, conn is closed to abort the migration and an error is returned.
+func btrfsReadMigrationHeader(conn io.ReadWriteCloser, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		buf []byte
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		buf, err := io.ReadAll(conn)
+		done <- result{buf: buf, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.buf, res.err
+	case <-timer.C:
+		_ = conn.Close()
+		return nil, fmt.Errorf("Timed out reading migration header after %s", timeout)
+	}
+}
+
+// btrfsPreCopyMaxRounds is the maximum number of pre-copy rounds sent after the full send of a volume in a
+// multi sync migration.
+const btrfsPreCopyMaxRounds = 5
+
+// btrfsPreCopyConvergedSize is the amount of data sent by a pre-copy round below which no further rounds are
+// sent, as the final sync is expected to be quick.
+const btrfsPreCopyConvergedSize = 64 * 1024 * 1024
+
+// btrfsPreCopyFrame is sent after each send of the volume during the pre-copy rounds of a multi sync migration,
+// and tells the target whether another differential send of the volume follows.
+type btrfsPreCopyFrame struct {
+	More bool `json:"more"`
+}
+
+// btrfsMultiSyncState is the state of a multi sync migration kept between its pre-copy and final sync phases.
+type btrfsMultiSyncState struct {
+	sendSnapshotPrefix string           // The read-only snapshot of the volume sent by the last pre-copy round.
+	subvolumes         []BTRFSSubVolume // The subvolumes of the volume in the header the target received.
+	cleanup            *revert.Reverter // Removes the snapshot and its temporary directory.
+	cleanupOnce        sync.Once
+}
+
+// Cleanup removes the read-only snapshot of the last pre-copy round and its temporary directory.
+// It can be called more than once, so both the final sync and the caller on failure can call it.
+func (s *btrfsMultiSyncState) Cleanup() {
+	s.cleanupOnce.Do(s.cleanup.Fail)
+}
+
+// btrfsPreCopyMore returns whether another pre-copy round should follow a round which sent roundSize bytes.
+func btrfsPreCopyMore(round int, roundSize int64) bool {
+	return round <= btrfsPreCopyMaxRounds && roundSize > btrfsPreCopyConvergedSize
+}
+
+// btrfsSubvolumeLayoutChanged returns whether the subvolumes found in a snapshot of a volume, as returned by
+// subvolumeStates, differ from the subvolumes of the volume (not of its snapshots) listed in a header.
+func btrfsSubvolumeLayoutChanged(subvolumes []BTRFSSubVolume, states map[string]bool) bool {
+	count := 0
+	for _, subVol := range subvolumes {
+		if subVol.Snapshot != "" {
+			continue
+		}
+
+		_, found := states[subVol.Path]
+		if !found {
+			return true
+		}
+
+		count++
+	}
+
+	return count != len(states)
+}
+
+// btrfsWritePreCopyFrame sends a pre-copy frame telling the target whether another round follows.
+func btrfsWritePreCopyFrame(conn io.WriteCloser, more bool) error {
+	frameJSON, err := json.Marshal(btrfsPreCopyFrame{More: more})
+	if err != nil {
+		return fmt.Errorf("Failed encoding BTRFS pre-copy frame: %w", err)
+	}
+
+	_, err = conn.Write(frameJSON)
+	if err != nil {
+		return fmt.Errorf("Failed sending BTRFS pre-copy frame: %w", err)
+	}
+
+	err = conn.Close() // End the frame.
+	if err != nil {
+		return fmt.Errorf("Failed closing BTRFS pre-copy frame: %w", err)
+	}
+
+	return nil
+}
+
+// btrfsReadPreCopyFrame reads a pre-copy frame and returns whether another round follows.
+func btrfsReadPreCopyFrame(conn io.ReadWriteCloser, timeout time.Duration) (bool, error) {
+	buf, err := btrfsReadMigrationHeader(conn, timeout)
+	if err != nil {
+		return false, fmt.Errorf("Failed reading BTRFS pre-copy frame: %w", err)
+	}
+
+	var frame btrfsPreCopyFrame
+	err = json.Unmarshal(buf, &frame)
+	if err != nil {
+		return false, fmt.Errorf("Failed decoding BTRFS pre-copy frame: %w", err)
+	}
+
+	return frame.More, nil
+}
+
+// btrfsCountingConn counts the bytes written to the wrapped connection.
+type btrfsCountingConn struct {
+	io.ReadWriteCloser
+
+	written int64
+}
+
+// Write writes p to the wrapped connection.
+func (c *btrfsCountingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.written += int64(n)
+
+	return n, err
+}
+
+// checkMultiSyncLayout returns an error if the subvolumes of the snapshot of vol at prefix differ from those of
+// the volume listed in the header the target received, as the target couldn't receive them.
+func (d *btrfs) checkMultiSyncLayout(vol Volume, prefix string, subvolumes []BTRFSSubVolume) error {
+	states, err := d.subvolumeStates(prefix)
+	if err != nil {
+		return err
+	}
+
+	if btrfsSubvolumeLayoutChanged(subvolumes, states) {
+		return fmt.Errorf("Nested subvolumes of volume %q changed during multi sync migration", vol.name)
+	}
+
+	return nil
+}
+
+// deleteSubvolumesIn deletes the subvolumes directly inside the directory at path (and any nested subvolumes).
+func (d *btrfs) deleteSubvolumesIn(path string) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if d.isSubvolume(entryPath) {
+			_ = d.deleteSubvolume(entryPath, true)
+		}
+	}
+}
+
+// migrationCommand returns the command to run btrfs with args for a migration, which runs it through ionice
+// if btrfs.migration.ioprio is set.
+func (d *btrfs) migrationCommand(args ...string) (string, []string) {
+	if d.config["btrfs.migration.ioprio"] == "" {
+		return "btrfs", args
+	}
+
+	ioniceArgs, err := btrfsIOPrioArgs(d.config["btrfs.migration.ioprio"])
+	if err != nil {
+		return "btrfs", args
+	}
+
+	return "ionice", slices.Concat(ioniceArgs, []string{"btrfs"}, args)
+}
+
+// sendSubvolume sends the subvolume at path to conn, as a difference to parent if set.
+// It returns the protocol version of the stream sent.
+func (d *btrfs) sendSubvolume(path string, parent string, conn io.ReadWriteCloser, tracker *ioprogress.ProgressTracker) (uint32, error) {
+	defer func() { _ = conn.Close() }()
+
+	// Assemble btrfs send command.
+	args := []string{"send"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+
+	args = append(args, path)
+	name, args := d.migrationCommand(args...)
+	cmd := exec.Command(name, args...)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	// Setup progress tracker.
+	var stdout io.WriteCloser = conn
+	if tracker != nil {
+		stdout = &ioprogress.ProgressWriter{
+			WriteCloser: conn,
+			Tracker:     tracker,
+		}
+	}
+
+	// Keep track of the stream so we can check it was sent in full.
+	verifier := &btrfsSendStreamVerifier{}
+	cmd.Stdout = io.MultiWriter(stdout, verifier)
+
+	// Run the command.
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+
+	// Read any error.
+	output, err := io.ReadAll(stderr)
+	if err != nil {
+		logger.Errorf("Problem reading btrfs send stderr: %s", err)
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return 0, fmt.Errorf("Btrfs send failed: %w (%s)", err, string(output))
+	}
+
+	err = verifier.Verify()
+	if err != nil {
+		return 0, fmt.Errorf("Btrfs send of %q failed: %w", path, err)
+	}
+
+	return verifier.Version(), nil
+}
+
+// setSubvolumeReadonlyProperty sets the readonly property on the subvolume to true or false.
+func (d *btrfs) setSubvolumeReadonlyProperty(path string, readonly bool) error {
+	// Silently ignore requests to set subvolume readonly property if running in a user namespace as we won't
+	// be able to change it if it is readonly already, and making it readonly will mean we cannot undo it.
+	if d.state.OS.RunningInUserNS {
+		return nil
+	}
+
+	args := []string{"property", "set"}
+	if btrfsPropertyForce {
+		args = append(args, "-f")
+	}
+
+	args = append(args, "-ts", path, "ro", strconv.FormatBool(readonly))
+
+	_, err := shared.RunCommandContext(context.TODO(), "btrfs", args...)
+	return err
+}
+
+// BTRFSSubVolume is the structure used to store information about a subvolume.
+// Note: This is used by both migration and backup subsystems so do not modify without considering both!
+type BTRFSSubVolume struct {
+	Path          string `json:"path" yaml:"path"`                                         // Path inside the volume where the subvolume belongs (so / is the top of the volume tree).
+	Snapshot      string `json:"snapshot" yaml:"snapshot"`                                 // Snapshot name the subvolume belongs to.
+	Readonly      bool   `json:"readonly" yaml:"readonly"`                                 // Is the sub volume read only or not.
+	UUID          string `json:"uuid" yaml:"uuid"`                                         // The subvolume UUID.
+	Size          int64  `json:"size,omitempty" yaml:"size,omitempty"`                     // Referenced size of the subvolume (only included in migrations).
+	ExclusiveSize int64  `json:"exclusive_size,omitempty" yaml:"exclusive_size,omitempty"` // Exclusive size of the subvolume (only included in migrations).
+}
+
+// SnapshotUUIDInfo is the identity of a snapshot's subvolume as used by "btrfs send -p" to find parents.
+type SnapshotUUIDInfo struct {
+	Name         string `json:"name" yaml:"name"`                   // Snapshot name (empty for the volume itself).
+	UUID         string `json:"uuid" yaml:"uuid"`                   // The subvolume UUID.
+	ParentUUID   string `json:"parent_uuid" yaml:"parent_uuid"`     // UUID of the subvolume the snapshot was taken of.
+	ReceivedUUID string `json:"received_uuid" yaml:"received_uuid"` // UUID of the sent subvolume if the snapshot was received.
+}
+
+// BackupStep is a send of a snapshot or of the volume itself which is part of an incremental backup plan.
+type BackupStep struct {
+	Snapshot string `json:"snapshot" yaml:"snapshot"` // Snapshot to send (empty for the volume itself).
+	Parent   string `json:"parent" yaml:"parent"`     // Snapshot the send is a difference to (empty for a full send).
+}
+
+// btrfsIncrementalBackupPlan returns the sends needed to bring a backup holding the snapshot since up to date,
+// given the volume's snapshots from oldest to newest. As in optimized backups, each snapshot is sent as the
+// difference to the one before it and the volume as the difference to its latest snapshot. If since is empty
+// or not one of the snapshots, the oldest snapshot is sent in full.
+func btrfsIncrementalBackupPlan(snapshots []string, since string) []BackupStep {
+	parent := ""
+	sinceIndex := slices.Index(snapshots, since)
+	if since != "" && sinceIndex >= 0 {
+		parent = since
+		snapshots = snapshots[sinceIndex+1:]
+	}
+
+	steps := make([]BackupStep, 0, len(snapshots)+1)
+	for _, snapName := range append(slices.Clone(snapshots), "") {
+		steps = append(steps, BackupStep{Snapshot: snapName, Parent: parent})
+		parent = snapName
+	}
+
+	return steps
+}
+
+// UsageBreakdown details how the space used by a volume is accounted. Figures which aren't available are -1.
+type UsageBreakdown struct {
+	Referenced     int64    `json:"referenced" yaml:"referenced"`           // Bytes referenced by the volume's qgroup, including those shared with other subvolumes (requires quotas).
+	Exclusive      int64    `json:"exclusive" yaml:"exclusive"`             // Bytes only referenced by the volume's qgroup, as reported as its usage (requires quotas).
+	Shared         int64    `json:"shared" yaml:"shared"`                   // Bytes of the qgroup shared with snapshots or other subvolumes (requires quotas).
+	FilesTotal     int64    `json:"files_total" yaml:"files_total"`         // Total size of the extents of the volume's files.
+	FilesExclusive int64    `json:"files_exclusive" yaml:"files_exclusive"` // Size of the extents only used by the volume's files.
+	FilesShared    int64    `json:"files_shared" yaml:"files_shared"`       // Size of the extents the volume's files share with other files.
+	Uncompressed   int64    `json:"uncompressed" yaml:"uncompressed"`       // Uncompressed size of the volume's data (requires compsize).
+	Compressed     int64    `json:"compressed" yaml:"compressed"`           // Size of the volume's data on disk after compression (requires compsize).
+	Notes          []string `json:"notes,omitempty" yaml:"notes,omitempty"` // Why figures are missing.
+}
+
+// SnapshotDiagnostics is the identity and creation time of a snapshot's subvolume.
+type SnapshotDiagnostics struct {
+	SnapshotUUIDInfo `yaml:",inline"`
+
+	CreationTime time.Time `json:"creation_time" yaml:"creation_time"` // When the snapshot was taken.
+}
+
+// QGroupDiagnostics is the qgroup of a volume and its usage. Figures which aren't available are -1.
+type QGroupDiagnostics struct {
+	ID         string `json:"id" yaml:"id"`                 // The qgroup ID (for example, 0/257).
+	Referenced int64  `json:"referenced" yaml:"referenced"` // Bytes referenced by the qgroup.
+	Exclusive  int64  `json:"exclusive" yaml:"exclusive"`   // Bytes only referenced by the qgroup.
+	Limit      int64  `json:"limit" yaml:"limit"`           // Limit on the referenced bytes, -1 if none.
+}
+
+// VolumeDiagnostics is the btrfs state of a volume as gathered for bug reports. Sections which couldn't be
+// gathered are left empty with the reason in Errors.
+type VolumeDiagnostics struct {
+	Volume        string                `json:"volume" yaml:"volume"`                                   // Name of the volume.
+	Subvolumes    []BTRFSSubVolume      `json:"subvolumes,omitempty" yaml:"subvolumes,omitempty"`       // Subvolumes of the volume, starting with its root subvolume.
+	QGroup        *QGroupDiagnostics    `json:"qgroup,omitempty" yaml:"qgroup,omitempty"`               // Qgroup usage and limit (requires quotas).
+	Usage         *UsageBreakdown       `json:"usage,omitempty" yaml:"usage,omitempty"`                 // Space usage, including the compression figures.
+	Snapshots     []SnapshotDiagnostics `json:"snapshots,omitempty" yaml:"snapshots,omitempty"`         // Snapshots of the volume, from oldest to newest.
+	MountOptions  []string              `json:"mount_options,omitempty" yaml:"mount_options,omitempty"` // Effective mount options of the pool.
+	Fragmentation float64               `json:"fragmentation" yaml:"fragmentation"`                     // Fragmentation estimate of the volume's data, -1 if unknown.
+	Errors        map[string]string     `json:"errors,omitempty" yaml:"errors,omitempty"`               // Why sections are missing, by section name ("snapshots/<name>" for single snapshots).
+}
+
+// btrfsSnapshotDiagnostics returns the diagnostics of a snapshot from the output of "btrfs subvolume show".
+func btrfsSnapshotDiagnostics(name string, output string) (SnapshotDiagnostics, error) {
+	created, err := btrfsSubvolumeCreationTime(output)
+	if err != nil {
+		return SnapshotDiagnostics{}, err
+	}
+
+	return SnapshotDiagnostics{SnapshotUUIDInfo: btrfsSnapshotUUIDInfo(name, output), CreationTime: created}, nil
+}
+
+// btrfsParseFilesystemDu returns the total, exclusive and shared sizes in the output of
+// "btrfs filesystem du -s --raw" for a single path.
+func btrfsParseFilesystemDu(output string) (int64, int64, int64, error) {
+	for line := range strings.SplitSeq(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] == "Total" {
+			continue
+		}
+
+		sizes := make([]int64, 3)
+		for i := range sizes {
+			size, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return -1, -1, -1, fmt.Errorf("Failed parsing filesystem du output line %q: %w", line, err)
+			}
+
+			sizes[i] = size
+		}
+
+		return sizes[0], sizes[1], sizes[2], nil
+	}
+
+	return -1, -1, -1, errors.New("Missing sizes in filesystem du output")
+}
+
+// btrfsParseCompsize returns the on disk and uncompressed sizes in the TOTAL line of the output of "compsize -b".
+func btrfsParseCompsize(output string) (int64, int64, error) {
+	for line := range strings.SplitSeq(output, "\n") {
+		// Lines are "<type> <percentage> <disk usage> <uncompressed> <referenced>".
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "TOTAL" {
+			continue
+		}
+
+		compressed, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Failed parsing compsize output line %q: %w", line, err)
+		}
+
+		uncompressed, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return -1, -1, fmt.Errorf("Failed parsing compsize output line %q: %w", line, err)
+		}
+
+		return compressed, uncompressed, nil
+	}
+
+	return -1, -1, errors.New("Missing TOTAL line in compsize output")
+}
+
+// btrfsSnapshotUUIDInfo returns the UUIDs in the output of "btrfs subvolume show". Unset UUIDs are left empty.
+func btrfsSnapshotUUIDInfo(name string, output string) SnapshotUUIDInfo {
+	field := func(name string) string {
+		value, _ := btrfsSubvolumeShowField(output, name)
+		if value == "-" {
+			return ""
+		}
+
+		return value
+	}
+
+	return SnapshotUUIDInfo{
+		Name:         name,
+		UUID:         field("UUID"),
+		ParentUUID:   field("Parent UUID"),
+		ReceivedUUID: field("Received UUID"),
+	}
+}
+
+// btrfsSubvolumeDescendants returns the paths of the subvolumes in the output of "btrfs subvolume list -q -u"
+// which descend from the subvolume with the given UUID, either as a snapshot of it or as a snapshot of one of
+// its descendants. Subvolumes which were copied rather than snapshotted have no parent and so aren't included.
+func btrfsSubvolumeDescendants(output string, uuid string) []string {
+	parents := make(map[string]string)
+	paths := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 13 {
+			continue
+		}
+
+		parents[fields[10]] = fields[8]
+		paths[fields[10]] = fields[12]
+	}
+
+	descendants := []string{}
+
+	for subVolUUID, path := range paths {
+		// Follow the parents for as long as they exist, guarding against loops.
+		seen := map[string]bool{subVolUUID: true}
+		parentUUID := parents[subVolUUID]
+
+		for parentUUID != "-" && parentUUID != "" && !seen[parentUUID] {
+			if parentUUID == uuid {
+				descendants = append(descendants, path)
+				break
+			}
+
+			seen[parentUUID] = true
+			parentUUID = parents[parentUUID]
+		}
+	}
+
+	sort.Strings(descendants)
+
+	return descendants
+}
+
+// setMigrationSizes fills in the sizes of the subvolumes of vol in the migration header from the qgroup usage.
+// This is best effort, if the size of any subvolume is unknown then no sizes are included.
+func (d *btrfs) setMigrationSizes(vol Volume, migrationHeader *BTRFSMetaDataHeader) {
+	sizes := make([]btrfsQGroupUsage, 0, len(migrationHeader.Subvolumes))
+
+	for _, subVol := range migrationHeader.Subvolumes {
+		volPath := vol.MountPath()
+		if subVol.Snapshot != "" {
+			snapVol, _ := vol.NewSnapshot(subVol.Snapshot)
+			volPath = snapVol.MountPath()
+		}
+
+		usage, err := d.getQGroupSizes(filepath.Join(volPath, subVol.Path))
+		if err != nil {
+			d.logger.Debug("Unable to get subvolume sizes for migration", logger.Ctx{"name": vol.name, "path": subVol.Path, "snapshot": subVol.Snapshot, "err": err})
+			return
+		}
+
+		sizes = append(sizes, usage)
+	}
+
+	for i, usage := range sizes {
+		migrationHeader.Subvolumes[i].Size = usage.referenced
+		migrationHeader.Subvolumes[i].ExclusiveSize = usage.exclusive
+	}
+}
+
+// btrfsMigrationSize estimates the space needed to receive the subvolumes of a migration header.
+// Only the first subvolume received for each path is sent in full, later ones are sent as the difference to
+// the previous one and so only need their exclusive size. If haveParent is true the target already has a
+// parent for the first subvolume of each path. Returns 0 if the source didn't include the subvolume sizes.
+func btrfsMigrationSize(subvolumes []BTRFSSubVolume, haveParent bool) int64 {
+	var total int64
+	sent := map[string]bool{}
+
+	for _, subVol := range subvolumes {
+		if subVol.Size <= 0 {
+			return 0
+		}
+
+		if haveParent || sent[subVol.Path] {
+			total += subVol.ExclusiveSize
+		} else {
+			total += subVol.Size
+		}
+
+		sent[subVol.Path] = true
+	}
+
+	return total
+}
+
+// btrfsRecommendBackupMode returns whether an optimized backup of the subvolumes of a restoration header is
+// recommended over a generic one, and why. Only optimized backups keep nested subvolumes. Otherwise the
+// backup with the smaller estimated size is recommended: generic backups store each snapshot in full while
+// optimized ones store snapshots as differences. Without sizes, optimized backups are recommended as soon as
+// there are snapshots. Generic backups are preferred when there's no difference as they restore on any driver.
+func btrfsRecommendBackupMode(subvolumes []BTRFSSubVolume) (bool, string) {
+	var snapshots int
+	var genericSize int64
+
+	for _, subVol := range subvolumes {
+		if subVol.Path != string(filepath.Separator) {
+			return true, fmt.Sprintf("The volume has nested subvolumes (such as %q) which only optimized backups keep", subVol.Path)
+		}
+
+		if subVol.Snapshot != "" {
+			snapshots++
+		}
+
+		genericSize += subVol.Size
+	}
+
+	optimizedSize := btrfsMigrationSize(subvolumes, false)
+	if optimizedSize <= 0 {
+		if snapshots > 0 {
+			return true, fmt.Sprintf("The volume has %d snapshots which optimized backups store as differences rather than in full (sizes are unknown without quotas)", snapshots)
+		}
+
+		return false, "The volume has no snapshots so an optimized backup wouldn't be smaller, and generic backups can be restored on any storage driver"
+	}
+
+	if optimizedSize < genericSize {
+		return true, fmt.Sprintf("An optimized backup is estimated at %s compared to %s for a generic backup, as its %d snapshots are stored as differences", units.GetByteSizeStringIEC(optimizedSize, 2), units.GetByteSizeStringIEC(genericSize, 2), snapshots)
+	}
+
+	return false, fmt.Sprintf("An optimized backup isn't estimated smaller than a generic backup (%s), and generic backups can be restored on any storage driver", units.GetByteSizeStringIEC(genericSize, 2))
+}
+
+// checkMigrationSpace returns an error if the pool doesn't have enough free space to receive the subvolumes.
+// Nothing is checked if the source didn't include the subvolume sizes.
+func (d *btrfs) checkMigrationSpace(vol Volume, subvolumes []BTRFSSubVolume, haveParent bool) error {
+	size := btrfsMigrationSize(subvolumes, haveParent)
+	if size <= 0 {
+		return nil
+	}
+
+	res, err := d.GetResources()
+	if err != nil {
+		return fmt.Errorf("Failed getting free space of pool: %w", err)
+	}
+
+	var free int64
+	if res.Space.Total > res.Space.Used {
+		free = int64(res.Space.Total - res.Space.Used)
+	}
+
+	if size > free {
+		return fmt.Errorf("Not enough free space in pool %q to receive volume %q (needs %s, %s available)", d.name, vol.name, units.GetByteSizeStringIEC(size, 2), units.GetByteSizeStringIEC(free, 2))
+	}
+
+	return nil
+}
+
+// btrfsSpaceMargin is how close to full the data or metadata space must be to be reported as exhausted.
+const btrfsSpaceMargin = 16 * 1024 * 1024
+
+// btrfsChunkSize is the size of the chunks btrfs allocates from the unallocated device space as needed.
+const btrfsChunkSize = 256 * 1024 * 1024
+
+// btrfsSpaceUsage is the size and usage of the data or metadata space of a file system.
+type btrfsSpaceUsage struct {
+	size int64
+	used int64
+}
+
+// btrfsParseFilesystemUsage parses the output of "btrfs filesystem usage -b" into the usage of the "Data" and
+// "Metadata" spaces, the unallocated device space (-1 if unknown) and the size of the global reserve.
+func btrfsParseFilesystemUsage(output string) (map[string]btrfsSpaceUsage, int64, int64) {
+	usage := map[string]btrfsSpaceUsage{}
+	unallocated := int64(-1)
+	var globalReserve int64
+
+	for line := range strings.SplitSeq(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "Device unallocated":
+			unallocated, _ = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			continue
+		case "Global reserve":
+			// Value is "<size>\t(used: <used>)".
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				globalReserve, _ = strconv.ParseInt(fields[0], 10, 64)
+			}
+
+			continue
+		}
+
+		// Lines are "<type>,<profile>: Size:<size>, Used:<used> (<percentage>)".
+		spaceType, _, found := strings.Cut(key, ",")
+		if !found || (spaceType != "Data" && spaceType != "Metadata") {
+			continue
+		}
+
+		var space btrfsSpaceUsage
+		for field := range strings.SplitSeq(value, ",") {
+			name, number, _ := strings.Cut(strings.TrimSpace(field), ":")
+			number, _, _ = strings.Cut(number, " ")
+			switch name {
+			case "Size":
+				space.size, _ = strconv.ParseInt(number, 10, 64)
+			case "Used":
+				space.used, _ = strconv.ParseInt(number, 10, 64)
+			}
+		}
+
+		usage[spaceType] = space
+	}
+
+	return usage, unallocated, globalReserve
+}
+
+// btrfsDiagnoseSpace returns the likely cause of a failure given the output of "btrfs filesystem usage -b"
+// and the qgroup usage of the affected subvolume (nil if quotas are disabled), or an empty string if there
+// is no sign of the file system or the quota being full.
+func btrfsDiagnoseSpace(usageOutput string, qgroup *btrfsQGroupUsage) string {
+	if qgroup != nil && qgroup.limit > 0 && qgroup.referenced+btrfsSpaceMargin >= qgroup.limit {
+		return fmt.Sprintf("quota limit reached (%s of %s referenced)", units.GetByteSizeStringIEC(qgroup.referenced, 2), units.GetByteSizeStringIEC(qgroup.limit, 2))
+	}
+
+	usage, unallocated, globalReserve := btrfsParseFilesystemUsage(usageOutput)
+
+	// Space is only exhausted if no new chunk can be allocated for it.
+	if unallocated < 0 || unallocated >= btrfsChunkSize {
+		return ""
+	}
+
+	// The global reserve is kept for critical operations and can't be used by others.
+	metadata, found := usage["Metadata"]
+	if found && metadata.size-metadata.used < globalReserve+btrfsSpaceMargin {
+		return fmt.Sprintf("metadata space exhausted (%s of %s used and no unallocated space for more)", units.GetByteSizeStringIEC(metadata.used, 2), units.GetByteSizeStringIEC(metadata.size, 2))
+	}
+
+	data, found := usage["Data"]
+	if found && data.size-data.used < btrfsSpaceMargin {
+		return fmt.Sprintf("data space exhausted (%s of %s used and no unallocated space for more)", units.GetByteSizeStringIEC(data.used, 2), units.GetByteSizeStringIEC(data.size, 2))
+	}
+
+	return ""
+}
+
+// btrfsSnapshotMetadataSize is the metadata space estimated to be needed to snapshot a subvolume.
+const btrfsSnapshotMetadataSize = 1024 * 1024
+
+// btrfsMetadataAvailable returns the metadata space available for new metadata given the output of
+// "btrfs filesystem usage -b". This excludes the global reserve and includes the unallocated space if a new
+// chunk can be allocated from it.
+func btrfsMetadataAvailable(usageOutput string) int64 {
+	usage, unallocated, globalReserve := btrfsParseFilesystemUsage(usageOutput)
+
+	metadata := usage["Metadata"]
+	available := max(metadata.size-metadata.used-globalReserve, 0)
+	if unallocated >= btrfsChunkSize {
+		available += unallocated
+	}
+
+	return available
+}
+
+// checkRestoreSpace returns an error if the pool doesn't have enough metadata space to snapshot the given
+// number of subvolumes into place while the replaced volume is kept aside, so that a restore doesn't fail
+// partway. The snapshots share all data with the restored snapshot so only need metadata space.
+// Nothing is checked if the usage of the pool can't be found.
+func (d *btrfs) checkRestoreSpace(vol Volume, subvolumes int) error {
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "filesystem", "usage", "-b", GetPoolMountPath(d.name))
+	if err != nil {
+		d.logger.Debug("Unable to get pool usage for restore", logger.Ctx{"name": vol.name, "err": err})
+		return nil
+	}
+
+	needed := int64(subvolumes)*btrfsSnapshotMetadataSize + btrfsSpaceMargin
+	available := btrfsMetadataAvailable(output)
+	if needed > available {
+		return fmt.Errorf("Not enough metadata space in pool %q to restore volume %q (needs %s, %s available)", d.name, vol.name, units.GetByteSizeStringIEC(needed, 2), units.GetByteSizeStringIEC(available, 2))
+	}
+
+	return nil
+}
+
+// diagnoseSpaceError adds the likely cause to an error of an operation on the subvolume at path if the pool
+// or the subvolume's quota is full. It's only meant for error paths as it runs extra commands.
+func (d *btrfs) diagnoseSpaceError(path string, err error) error {
+	output, usageErr := shared.RunCommandContext(context.TODO(), "btrfs", "filesystem", "usage", "-b", GetPoolMountPath(d.name))
+	if usageErr != nil {
+		return err
+	}
+
+	// Make sure the usage is current rather than from before the failure.
+	d.invalidateQGroupTable()
+
+	var qgroup *btrfsQGroupUsage
+	usage, qgroupErr := d.getQGroupSizes(path)
+	if qgroupErr == nil {
+		qgroup = &usage
+	}
+
+	cause := btrfsDiagnoseSpace(output, qgroup)
+	if cause == "" {
+		return err
+	}
+
+	return fmt.Errorf("%w (likely cause: %s)", err, cause)
+}
+
+// getSubvolumesMetaData retrieves subvolume meta data with paths relative to the root volume.
+// The first item in the returned list is the root subvolume itself.
+func (d *btrfs) getSubvolumesMetaData(vol Volume) ([]BTRFSSubVolume, error) {
+	snapName := ""
+	if vol.IsSnapshot() {
+		_, snapName, _ = api.GetParentAndSnapshotName(vol.name)
+	}
+
+	// Find any subvolumes in volume.
+	subVolPaths, err := d.getSubvolumes(vol.MountPath())
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(subVolPaths)
+
+	// Add main root volume to subvolumes list first.
+	subVols := make([]BTRFSSubVolume, 0, len(subVolPaths)+1)
+	subVols = append(subVols, BTRFSSubVolume{
+		Snapshot: snapName,
+		Path:     string(filepath.Separator),
+		Readonly: btrfsSubVolumeIsRo(vol.MountPath()),
+	})
+
+	// Add any subvolumes under the root subvolume with relative path to root.
+	for _, subVolPath := range subVolPaths {
+		subVols = append(subVols, BTRFSSubVolume{
+			Snapshot: snapName,
+			Path:     string(filepath.Separator) + subVolPath,
+			Readonly: btrfsSubVolumeIsRo(filepath.Join(vol.MountPath(), subVolPath)),
+		})
+	}
+
+	stdout := strings.Builder{}
+
+	poolMountPath := GetPoolMountPath(vol.pool)
+
+	if !d.state.OS.RunningInUserNS {
+		// List all subvolumes in the given filesystem with their UUIDs and received UUIDs.
+		err = shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-u", "-R", poolMountPath)
+		if err != nil {
+			return nil, err
+		}
+
+		uuidMap := make(map[string]string)
+		receivedUUIDMap := make(map[string]string)
+
+		scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			if len(fields) != 13 {
+				continue
+			}
+
+			relPath, found := d.poolRelativeSubvolumePath(fields[12])
+			if !found {
+				continue
+			}
+
+			uuidMap[filepath.Join(poolMountPath, relPath)] = fields[10]
+
+			if fields[8] != "-" {
+				receivedUUIDMap[filepath.Join(poolMountPath, relPath)] = fields[8]
+			}
+		}
+
+		for i, subVol := range subVols {
+			subVols[i].UUID = uuidMap[filepath.Join(vol.MountPath(), subVol.Path)]
+		}
+	}
+
+	return subVols, nil
+}
+
+func (d *btrfs) getSubVolumeReceivedUUID(vol Volume) (string, error) {
+	stdout := strings.Builder{}
+
+	poolMountPath := GetPoolMountPath(vol.pool)
+
+	// List all subvolumes in the given filesystem with their UUIDs.
+	err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-R", poolMountPath)
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) != 11 {
+			continue
+		}
+
+		relPath, found := d.poolRelativeSubvolumePath(fields[10])
+		if !found {
+			continue
+		}
+
+		if vol.MountPath() == filepath.Join(poolMountPath, relPath) && fields[8] != "-" {
+			return fields[8], nil
+		}
 	}
 
-	defer func() { _ = f.Close() }()
+	return "", nil
+}
 
-	args := btrfsIoctlReceivedSubvolArgs{}
+// btrfsMaxNameLength is the maximum length in bytes of a file name, and so of a subvolume name.
+const btrfsMaxNameLength = 255
 
-	strUUID, err := uuid.Parse(UUID)
+// btrfsValidSnapName checks that a snapshot name is valid for LXD and can be used as the name of a subvolume.
+// Names with whitespace or control characters are rejected as they break the parsing of "btrfs subvolume list",
+// which would make the snapshot impossible to enumerate or send.
+func btrfsValidSnapName(snapName string) error {
+	err := instancetype.ValidSnapName(snapName)
 	if err != nil {
-		return fmt.Errorf("Failed parsing UUID: %w", err)
+		return fmt.Errorf("Invalid snapshot name %q: %w", snapName, err)
 	}
 
-	binUUID, err := strUUID.MarshalBinary()
-	if err != nil {
-		return fmt.Errorf("Failed coverting UUID: %w", err)
+	if snapName == "." {
+		return fmt.Errorf("Invalid snapshot name %q", snapName)
 	}
 
-	copy(args.uuid[:], binUUID)
+	if len(snapName) > btrfsMaxNameLength {
+		return fmt.Errorf("Invalid snapshot name %q: Cannot be longer than %d bytes", snapName, btrfsMaxNameLength)
+	}
 
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), linux.IoctlBtrfsSetReceivedSubvol, uintptr(unsafe.Pointer(&args)))
-	if errno != 0 {
-		return fmt.Errorf("Failed setting received UUID: %w", unix.Errno(errno))
+	if strings.IndexFunc(snapName, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("Invalid snapshot name %q: Cannot contain whitespace or control characters", snapName)
 	}
 
 	return nil
 }
 
-func (d *btrfs) getMountOptions() string {
-	// Allow overriding the default options.
-	if d.config["btrfs.mount_options"] != "" {
-		return d.config["btrfs.mount_options"]
-	}
+// btrfsTransientDirPrefixes are the prefixes of the temporary directories which hold transient subvolumes.
+var btrfsTransientDirPrefixes = []string{"backup.", "migration.", btrfsEphemeralSnapshotPrefix}
 
-	return "user_subvol_rm_allowed"
-}
+// btrfsTrackTransientPath records that path holds transient subvolumes of an ongoing operation, so that they
+// aren't reported as orphaned. The returned function must be called once the path is no longer in use.
+func btrfsTrackTransientPath(path string) func() {
+	btrfsTransientPathsMu.Lock()
+	btrfsTransientPaths[path]++
+	btrfsTransientPathsMu.Unlock()
 
-func (d *btrfs) isSubvolume(path string) bool {
-	// Stat the path.
-	fs := unix.Stat_t{}
-	err := unix.Lstat(path, &fs)
-	if err != nil {
-		return false
+	return func() {
+		btrfsTransientPathsMu.Lock()
+		defer btrfsTransientPathsMu.Unlock()
+
+		btrfsTransientPaths[path]--
+		if btrfsTransientPaths[path] <= 0 {
+			delete(btrfsTransientPaths, path)
+		}
 	}
+}
 
-	// Check if BTRFS_FIRST_FREE_OBJECTID is the inode number.
-	if fs.Ino != 256 {
-		return false
+// btrfsTransientPathInUse returns whether path is in use by an ongoing operation.
+func btrfsTransientPathInUse(path string) bool {
+	btrfsTransientPathsMu.Lock()
+	defer btrfsTransientPathsMu.Unlock()
+
+	return btrfsTransientPaths[path] > 0
+}
+
+// btrfsIsTransientDir returns whether name is the name of a temporary directory created by the driver.
+func btrfsIsTransientDir(name string) bool {
+	for _, prefix := range btrfsTransientDirPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
 	}
 
-	return true
+	return false
 }
 
-func (d *btrfs) hasSubvolumes(path string) (bool, error) {
-	var stdout strings.Builder
+// checkVolumeLimit returns an error if creating vol would exceed btrfs.max_volumes.
+// Image volumes and temporary volumes of ongoing operations aren't counted.
+// Otherwise the volume is reserved until the returned function is called, which the caller must do once the
+// volume's subvolume exists (or its creation failed). The volumes being created concurrently are counted
+// through their reservations, as they may not be listed yet while received into temporary directories.
+func (d *btrfs) checkVolumeLimit(vol Volume) (func(), error) {
+	limit, _ := strconv.Atoi(d.config["btrfs.max_volumes"])
+	if limit <= 0 || vol.volType == VolumeTypeImage {
+		return func() {}, nil
+	}
 
-	err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-o", path)
+	btrfsVolumeReservationsMu.Lock()
+	defer btrfsVolumeReservationsMu.Unlock()
+
+	vols, err := d.ListVolumes()
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("Failed listing volumes: %w", err)
 	}
 
-	return stdout.Len() > 0, nil
-}
+	count := btrfsVolumeReservations[d.name]
+	for _, v := range vols {
+		if v.volType == VolumeTypeImage {
+			continue
+		}
 
-func (d *btrfs) getSubvolumes(path string) ([]string, error) {
-	// Make sure the path has a trailing slash.
-	if !strings.HasSuffix(path, "/") {
-		path = path + "/"
+		transientRoot, _ := btrfsClassifySubvolume(filepath.Join(BaseDirectories[v.volType][0], v.name))
+		if transientRoot != "" {
+			continue
+		}
+
+		count++
 	}
 
-	poolMountPath := GetPoolMountPath(d.name)
-	if !strings.HasPrefix(path, poolMountPath+"/") {
-		return nil, fmt.Errorf("%q is outside pool mount path %q", path, poolMountPath)
+	if count >= limit {
+		return nil, fmt.Errorf("Pool %q already has %d volumes, which is the maximum allowed by btrfs.max_volumes", d.name, count)
 	}
 
-	var result []string
+	btrfsVolumeReservations[d.name]++
 
-	if d.state.OS.RunningInUserNS {
-		// If using BTRFS in a nested container we cannot use "btrfs subvolume list" due to a permission error.
-		// So instead walk the directory tree testing each directory to see if it is subvolume.
-		err := filepath.Walk(path, func(fpath string, entry fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			btrfsVolumeReservationsMu.Lock()
+			defer btrfsVolumeReservationsMu.Unlock()
 
-			// Ignore the base path.
-			if strings.TrimRight(fpath, "/") == strings.TrimRight(path, "/") {
-				return nil
+			btrfsVolumeReservations[d.name]--
+			if btrfsVolumeReservations[d.name] <= 0 {
+				delete(btrfsVolumeReservations, d.name)
 			}
+		})
+	}
 
-			// Subvolumes can only be directories.
-			if !entry.IsDir() {
-				return nil
+	return release, nil
+}
+
+// btrfsClassifySubvolume checks a pool relative subvolume path against the layout of the pool.
+// It returns true if the subvolume belongs to a volume or is one of the base directories. If the subvolume
+// is inside a temporary directory (or is a temporary volume) the pool relative path of that transient root
+// is returned, which is only expected to exist while the operation that created it is running.
+func btrfsClassifySubvolume(relPath string) (string, bool) {
+	parts := strings.Split(relPath, "/")
+
+	for _, dirs := range BaseDirectories {
+		// Volumes (and temporary directories or volumes next to them).
+		if parts[0] == dirs[0] {
+			if len(parts) == 1 {
+				return "", true
 			}
 
-			// Check if directory is a subvolume.
-			if d.isSubvolume(fpath) {
-				result = append(result, strings.TrimPrefix(fpath, path))
+			if btrfsIsTransientDir(parts[1]) || strings.HasSuffix(parts[1], tmpVolSuffix) {
+				return filepath.Join(parts[0], parts[1]), false
 			}
 
-			return nil
-		})
-		if err != nil {
-			return nil, err
+			return "", true
 		}
-	} else {
-		// If not running inside a nested container we can use "btrfs subvolume list" to get subvolumes which is more
-		// performant than walking the directory tree.
-		var stdout bytes.Buffer
-		err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", poolMountPath)
-		if err != nil {
-			return nil, err
+
+		// Snapshots are expected to be found below a per-volume directory.
+		if len(dirs) > 1 && parts[0] == dirs[1] {
+			return "", len(parts) == 1 || len(parts) > 2
 		}
+	}
 
-		path = strings.TrimPrefix(path, poolMountPath+"/")
-		scanner := bufio.NewScanner(&stdout)
-		for scanner.Scan() {
-			fields := strings.Fields(scanner.Text())
+	if btrfsIsTransientDir(parts[0]) {
+		return parts[0], false
+	}
 
-			if len(fields) != 9 {
-				continue
+	return "", false
+}
+
+// btrfsOrphanedSubvolumes returns the pool relative paths of the subvolumes which don't belong to any of the
+// known volumes (including snapshots), which are given by their pool relative paths. These are subvolumes which
+// don't fit the pool's layout, volumes and snapshots which aren't known, and subvolumes in temporary directories
+// which aren't in use. Nested subvolumes of a returned subvolume aren't returned separately.
+func btrfsOrphanedSubvolumes(subVolPaths []string, known map[string]bool, inUse func(transientRoot string) bool) []string {
+	subVolPaths = slices.Clone(subVolPaths)
+	sort.Strings(subVolPaths)
+
+	orphans := []string{}
+
+	for _, relPath := range subVolPaths {
+		nested := slices.ContainsFunc(orphans, func(orphan string) bool {
+			return strings.HasPrefix(relPath, orphan+"/")
+		})
+
+		if nested {
+			continue
+		}
+
+		transientRoot, expected := btrfsClassifySubvolume(relPath)
+		if transientRoot != "" {
+			if !inUse(transientRoot) {
+				orphans = append(orphans, relPath)
 			}
 
-			subvolPath, found := strings.CutPrefix(fields[8], path)
-			if !found {
-				continue
+			continue
+		}
+
+		// Find the volume or snapshot the subvolume belongs to. The base directories belong to the pool.
+		parts := strings.Split(relPath, "/")
+		owner := ""
+		for _, dirs := range BaseDirectories {
+			if parts[0] == dirs[0] && len(parts) > 1 {
+				owner = filepath.Join(parts[:2]...)
+				break
 			}
 
-			result = append(result, subvolPath)
+			if len(dirs) > 1 && parts[0] == dirs[1] && len(parts) > 2 {
+				owner = filepath.Join(parts[:3]...)
+				break
+			}
+		}
+
+		if expected && (owner == "" || known[owner]) {
+			continue
 		}
+
+		orphans = append(orphans, relPath)
 	}
 
-	return result, nil
+	return orphans
 }
 
-// snapshotSubvolume creates a snapshot of the specified path at the dest supplied. If recursion is true and
-// sub volumes are found below the path then they are created at the relative location in dest.
-func (d *btrfs) snapshotSubvolume(path string, dest string, recursion bool) (revert.Hook, error) {
-	revert := revert.New()
-	defer revert.Fail()
+// FindOrphanedSubvolumes returns the paths of subvolumes in the pool which don't belong to any of the volumes
+// (including snapshots and images) in the pool that are known to LXD. Such subvolumes are typically left behind
+// by interrupted operations. Subvolumes in temporary directories are only reported when no ongoing operation is
+// using them. Nested subvolumes of a reported subvolume aren't reported separately.
+func (d *btrfs) FindOrphanedSubvolumes(known []Volume) ([]string, error) {
+	poolMountPath := GetPoolMountPath(d.name)
 
-	// Single subvolume creation.
-	snapshot := func(path string, dest string) error {
-		_, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "snapshot", path, dest)
+	subVolPaths, err := d.getSubvolumes(poolMountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	knownPaths := make(map[string]bool, len(known))
+	for _, vol := range known {
+		relPath, err := filepath.Rel(poolMountPath, vol.MountPath())
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		revert.Add(func() {
-			// Don't delete recursive since there already is a revert hook
-			// for each subvolume that got created.
-			_ = d.deleteSubvolume(dest, false)
-		})
+		knownPaths[relPath] = true
+	}
 
-		return nil
+	inUse := func(transientRoot string) bool {
+		return btrfsTransientPathInUse(filepath.Join(poolMountPath, transientRoot))
 	}
 
-	// First snapshot the root.
-	err := snapshot(path, dest)
+	orphans := btrfsOrphanedSubvolumes(subVolPaths, knownPaths, inUse)
+	for i, relPath := range orphans {
+		orphans[i] = filepath.Join(poolMountPath, relPath)
+	}
+
+	return orphans, nil
+}
+
+// DeleteOrphanedSubvolumes deletes the subvolumes reported by FindOrphanedSubvolumes (including any nested
+// subvolumes) and returns the paths that were deleted.
+func (d *btrfs) DeleteOrphanedSubvolumes(known []Volume) ([]string, error) {
+	orphans, err := d.FindOrphanedSubvolumes(known)
 	if err != nil {
 		return nil, err
 	}
 
-	// Now snapshot all subvolumes of the root.
-	if recursion {
-		// Get the subvolumes list.
-		subSubVols, err := d.getSubvolumes(path)
+	deleted := make([]string, 0, len(orphans))
+	for _, orphan := range orphans {
+		d.logger.Info("Deleting orphaned subvolume", logger.Ctx{"path": orphan})
+
+		err = d.deleteSubvolume(orphan, true)
 		if err != nil {
-			return nil, err
+			return deleted, err
 		}
 
-		sort.Strings(subSubVols)
+		deleted = append(deleted, orphan)
+	}
 
-		for _, subSubVol := range subSubVols {
-			subSubVolSnapPath := filepath.Join(dest, subSubVol)
+	return deleted, nil
+}
 
-			// Clear the target for the subvol to use.
-			_ = os.Remove(subSubVolSnapPath)
+// getReceivedSubvolumes returns the pool relative paths of the subvolumes in the pool which have a received UUID,
+// i.e. those received by a migration, mapped to their received UUID.
+func (d *btrfs) getReceivedSubvolumes() (map[string]string, error) {
+	stdout := strings.Builder{}
 
-			err := snapshot(filepath.Join(path, subSubVol), subSubVolSnapPath)
-			if err != nil {
-				return nil, err
-			}
+	err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-R", GetPoolMountPath(d.name))
+	if err != nil {
+		return nil, err
+	}
+
+	received := map[string]string{}
+
+	for line := range strings.SplitSeq(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 11 || fields[8] == "-" {
+			continue
+		}
+
+		relPath, found := d.poolRelativeSubvolumePath(fields[10])
+		if !found {
+			continue
 		}
+
+		received[relPath] = fields[8]
 	}
 
-	cleanup := revert.Clone().Fail
-	revert.Success()
-	return cleanup, nil
+	return received, nil
 }
 
-func (d *btrfs) deleteSubvolume(rootPath string, recursion bool) error {
-	// Single subvolume deletion.
-	destroy := func(path string) error {
-		// Attempt (but don't fail on) to delete any qgroup on the subvolume.
-		qgroup, _, err := d.getQGroup(path)
-		if err == nil {
-			_, _ = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "destroy", qgroup, path)
+// btrfsStaleReceivedSubvolumes returns the pool relative paths of the received subvolumes which are no longer
+// referenced. These are received subvolumes left in a migration directory which isn't in use, and received
+// snapshots of a known volume which aren't known themselves (left behind by a failed refresh). Received
+// snapshots are only considered if their parent volume is known, so other volumes are never affected.
+// Nested subvolumes of a returned subvolume aren't returned separately.
+func btrfsStaleReceivedSubvolumes(received []string, known map[string]bool, inUse func(transientRoot string) bool) []string {
+	received = slices.Clone(received)
+	sort.Strings(received)
+
+	stale := []string{}
+
+	for _, relPath := range received {
+		nested := slices.ContainsFunc(stale, func(path string) bool {
+			return strings.HasPrefix(relPath, path+"/")
+		})
+
+		if nested {
+			continue
 		}
 
-		// Temporarily change ownership & mode to help with nesting.
-		_ = os.Chmod(path, 0700)
-		_ = os.Chown(path, 0, 0)
+		parts := strings.Split(relPath, "/")
 
-		// Delete the subvolume itself.
-		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "delete", path)
+		transientRoot, expected := btrfsClassifySubvolume(relPath)
+		if transientRoot != "" {
+			if len(parts) > 1 && strings.HasPrefix(parts[1], "migration.") && !inUse(transientRoot) {
+				stale = append(stale, relPath)
+			}
 
-		return err
+			continue
+		}
+
+		if !expected || len(parts) < 3 {
+			continue
+		}
+
+		for _, dirs := range BaseDirectories {
+			if len(dirs) < 2 || parts[0] != dirs[1] {
+				continue
+			}
+
+			snapshotPath := filepath.Join(parts[:3]...)
+			if known[filepath.Join(dirs[0], parts[1])] && !known[snapshotPath] {
+				stale = append(stale, snapshotPath)
+			}
+
+			break
+		}
 	}
 
-	// Try and ensure volume is writable to possibility of destroy failing.
-	err := d.setSubvolumeReadonlyProperty(rootPath, false)
+	return stale
+}
+
+// FindStaleReceivedSubvolumes returns the paths of the subvolumes received by migrations which are no longer
+// referenced, given all of the volumes (including snapshots) in the pool that are known to LXD.
+// These are typically left behind when a refresh fails after receiving some snapshots.
+func (d *btrfs) FindStaleReceivedSubvolumes(known []Volume) ([]string, error) {
+	poolMountPath := GetPoolMountPath(d.name)
+
+	receivedUUIDs, err := d.getReceivedSubvolumes()
 	if err != nil {
-		d.logger.Warn("Failed setting subvolume writable", logger.Ctx{"path": rootPath, "err": err})
+		return nil, fmt.Errorf("Failed listing received subvolumes: %w", err)
 	}
 
-	// Attempt to delete the root subvol itself (short path).
-	err = destroy(rootPath)
-	if err == nil {
-		return nil
-	} else if !recursion {
-		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, err)
+	received := make([]string, 0, len(receivedUUIDs))
+	for relPath := range receivedUUIDs {
+		received = append(received, relPath)
 	}
 
-	// Delete subsubvols as recursion enabled.
+	knownPaths := make(map[string]bool, len(known))
+	for _, vol := range known {
+		relPath, err := filepath.Rel(poolMountPath, vol.MountPath())
+		if err != nil {
+			return nil, err
+		}
 
-	// Get the subvolumes list.
-	subSubVols, err := d.getSubvolumes(rootPath)
+		knownPaths[relPath] = true
+	}
+
+	inUse := func(transientRoot string) bool {
+		return btrfsTransientPathInUse(filepath.Join(poolMountPath, transientRoot))
+	}
+
+	stale := btrfsStaleReceivedSubvolumes(received, knownPaths, inUse)
+	for i, relPath := range stale {
+		stale[i] = filepath.Join(poolMountPath, relPath)
+	}
+
+	return stale, nil
+}
+
+// DeleteStaleReceivedSubvolumes deletes the subvolumes reported by FindStaleReceivedSubvolumes (including any
+// nested subvolumes). It returns the paths that were deleted and the space reclaimed, which only includes the
+// subvolumes whose exclusive usage is known from quotas.
+func (d *btrfs) DeleteStaleReceivedSubvolumes(known []Volume) ([]string, int64, error) {
+	stale, err := d.FindStaleReceivedSubvolumes(known)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	// Perform a first pass and ensure all sub volumes are writable.
-	sort.Sort(sort.StringSlice(subSubVols))
-	for _, subSubVol := range subSubVols {
-		subSubVolPath := filepath.Join(rootPath, subSubVol)
-		err = d.setSubvolumeReadonlyProperty(subSubVolPath, false)
-		if err != nil {
-			d.logger.Warn("Failed setting subvolume writable", logger.Ctx{"path": subSubVolPath, "err": err})
+	poolMountPath := GetPoolMountPath(d.name)
+
+	var reclaimed int64
+
+	deleted := make([]string, 0, len(stale))
+	for _, path := range stale {
+		usage, err := d.getQGroupUsage(path)
+		if err == nil {
+			reclaimed += usage
 		}
-	}
 
-	// Perform a second pass to delete subvolumes.
-	sort.Sort(sort.Reverse(sort.StringSlice(subSubVols)))
-	for _, subSubVol := range subSubVols {
-		subSubVolPath := filepath.Join(rootPath, subSubVol)
-		err := destroy(subSubVolPath)
+		d.logger.Info("Deleting stale received subvolume", logger.Ctx{"path": path})
+
+		err = d.deleteSubvolume(path, true)
 		if err != nil {
-			return fmt.Errorf("Failed deleting subvolume %q: %w", subSubVolPath, err)
+			return deleted, reclaimed, err
 		}
-	}
 
-	// Delete the root subvol itself.
-	err = destroy(rootPath)
-	if err != nil {
-		return fmt.Errorf("Failed deleting subvolume %q: %w", rootPath, err)
+		deleted = append(deleted, path)
+
+		// Remove the now empty directories up to and including the migration directory.
+		relPath, _ := filepath.Rel(poolMountPath, path)
+		transientRoot, _ := btrfsClassifySubvolume(relPath)
+		if transientRoot != "" {
+			for dir := filepath.Dir(relPath); dir != filepath.Dir(transientRoot); dir = filepath.Dir(dir) {
+				err = os.Remove(filepath.Join(poolMountPath, dir))
+				if err != nil {
+					break
+				}
+			}
+		}
 	}
 
-	return nil
+	return deleted, reclaimed, nil
 }
 
-func (d *btrfs) getQGroup(path string) (string, int64, error) {
-	// Try to get the qgroup details.
-	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "show", "-e", "-f", "--raw", path)
+// deleteEphemeralSnapshots removes any ephemeral writable snapshots (and their temporary directories) found in
+// the pool. These are normally removed by the cleanup function returned from MountSnapshotWritable, but may be
+// left behind if LXD stopped unexpectedly. Ephemeral snapshots still in use are skipped.
+func (d *btrfs) deleteEphemeralSnapshots() {
+	tmpDirs, err := filepath.Glob(filepath.Join(GetPoolMountPath(d.name), btrfsEphemeralSnapshotPrefix+"*"))
 	if err != nil {
-		return "", -1, errBtrfsNoQuota
+		return
 	}
 
-	// Parse to extract the qgroup identifier.
-	var qgroup string
-	usage := int64(-1)
-	for line := range strings.SplitSeq(output, "\n") {
-		// Use case-insensitive field title match because BTRFS tooling changed casing between versions.
-		if line == "" || strings.HasPrefix(strings.ToLower(line), "qgroupid") || strings.HasPrefix(line, "-") {
+	for _, tmpDir := range tmpDirs {
+		if btrfsTransientPathInUse(tmpDir) {
 			continue
 		}
 
-		fields := strings.Fields(line)
-
-		// The BTRFS tooling changed the number of columns between versions so we only check for minimum.
-		if len(fields) < 3 {
+		entries, err := os.ReadDir(tmpDir)
+		if err != nil {
 			continue
 		}
 
-		qgroup = fields[0]
-		val, err := strconv.ParseInt(fields[2], 10, 64)
-		if err == nil {
-			usage = val
+		deleted := true
+		for _, entry := range entries {
+			path := filepath.Join(tmpDir, entry.Name())
+			if !d.isSubvolume(path) {
+				continue
+			}
+
+			err = d.deleteSubvolume(path, true)
+			if err != nil {
+				d.logger.Warn("Failed deleting ephemeral snapshot", logger.Ctx{"path": path, "err": err})
+				deleted = false
+			}
 		}
 
-		break
+		if deleted {
+			_ = os.RemoveAll(tmpDir)
+		}
 	}
+}
 
-	if qgroup == "" {
-		return "", -1, errBtrfsNoQGroup
-	}
+// contentHash returns a SHA-256 hash over the tree found at path. The hash covers the relative path, type and
+// permissions of every entry, the target of symlinks and the content of regular files (so for block volumes the
+// root disk file). Ownership and timestamps aren't included.
+func (d *btrfs) contentHash(path string) (string, error) {
+	hash := sha256.New()
 
-	return qgroup, usage, nil
-}
+	err := filepath.WalkDir(path, func(fpath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
-func (d *btrfs) sendSubvolume(path string, parent string, conn io.ReadWriteCloser, tracker *ioprogress.ProgressTracker) error {
-	defer func() { _ = conn.Close() }()
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
 
-	// Assemble btrfs send command.
-	args := []string{"send"}
-	if parent != "" {
-		args = append(args, "-p", parent)
-	}
+		relPath, err := filepath.Rel(path, fpath)
+		if err != nil {
+			return err
+		}
 
-	args = append(args, path)
-	cmd := exec.Command("btrfs", args...)
+		_, _ = fmt.Fprintf(hash, "%s\x00%o\x00", relPath, info.Mode())
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
 
-	// Setup progress tracker.
-	var stdout io.WriteCloser = conn
-	if tracker != nil {
-		stdout = &ioprogress.ProgressWriter{
-			WriteCloser: conn,
-			Tracker:     tracker,
-		}
-	}
+			_, _ = fmt.Fprintf(hash, "%s\x00", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(fpath)
+			if err != nil {
+				return err
+			}
 
-	cmd.Stdout = stdout
+			defer func() { _ = f.Close() }()
 
-	// Run the command.
-	err = cmd.Start()
+			_, err = io.Copy(hash, f)
+			if err != nil {
+				return fmt.Errorf("Failed reading %q: %w", fpath, err)
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return "", fmt.Errorf("Failed hashing %q: %w", path, err)
 	}
 
-	// Read any error.
-	output, err := io.ReadAll(stderr)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// BTRFSMetaDataHeader is the meta data header about the volumes being sent/stored.
+// Note: This is used by both migration and backup subsystems so do not modify without considering both!
+type BTRFSMetaDataHeader struct {
+	Subvolumes     []BTRFSSubVolume     `json:"subvolumes" yaml:"subvolumes"`                               // Sub volumes inside the volume (including the top level ones).
+	Volume         *BTRFSVolumeSettings `json:"volume,omitempty" yaml:"volume,omitempty"`                   // Settings of the volume (only included in backups).
+	FormatVersion  int                  `json:"format_version,omitempty" yaml:"format_version,omitempty"`   // Format version of the backup (only included in backups).
+	PartialHistory bool                 `json:"partial_history,omitempty" yaml:"partial_history,omitempty"` // Whether older snapshots were left out of the backup.
+}
+
+// btrfsBackupFormatVersion is the format version of the optimized backups generated. It must be increased when
+// the format changes in a way that earlier versions can't restore. Backups without a version predate it and
+// are restored as version 1.
+const btrfsBackupFormatVersion = 1
+
+// btrfsUnmetBackupRequirements returns the requirements recorded in the header of an optimized backup which
+// aren't met by the given btrfs kernel features.
+func btrfsUnmetBackupRequirements(header *BTRFSMetaDataHeader, kernelFeatures []string) []string {
+	unmet := []string{}
+
+	err := btrfsCheckBackupFormatVersion(header.FormatVersion)
 	if err != nil {
-		logger.Errorf("Problem reading btrfs send stderr: %s", err)
+		unmet = append(unmet, err.Error())
 	}
 
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("Btrfs send failed: %w (%s)", err, string(output))
+	if header.Volume != nil && header.Volume.Compression != "" {
+		// The compression property may include a level, and zlib is always supported.
+		algorithm, _, _ := strings.Cut(header.Volume.Compression, ":")
+		if algorithm != "zlib" && !slices.Contains(kernelFeatures, "compress_"+algorithm) {
+			unmet = append(unmet, fmt.Sprintf("Kernel support for %q compression", algorithm))
+		}
 	}
 
-	return nil
+	return unmet
 }
 
-// setSubvolumeReadonlyProperty sets the readonly property on the subvolume to true or false.
-func (d *btrfs) setSubvolumeReadonlyProperty(path string, readonly bool) error {
-	// Silently ignore requests to set subvolume readonly property if running in a user namespace as we won't
-	// be able to change it if it is readonly already, and making it readonly will mean we cannot undo it.
-	if d.state.OS.RunningInUserNS {
-		return nil
+// btrfsCheckBackupFormatVersion returns an error if an optimized backup of the given format version can't be
+// restored.
+func btrfsCheckBackupFormatVersion(version int) error {
+	if version > btrfsBackupFormatVersion {
+		return fmt.Errorf("Optimized backup format version %d is newer than the supported version %d, restore it with a newer LXD", version, btrfsBackupFormatVersion)
 	}
 
-	args := []string{"property", "set"}
-	if btrfsPropertyForce {
-		args = append(args, "-f")
+	if version < 0 {
+		return fmt.Errorf("Invalid optimized backup format version %d", version)
 	}
 
-	args = append(args, "-ts", path, "ro", strconv.FormatBool(readonly))
-
-	_, err := shared.RunCommandContext(context.TODO(), "btrfs", args...)
-	return err
+	return nil
 }
 
-// BTRFSSubVolume is the structure used to store information about a subvolume.
-// Note: This is used by both migration and backup subsystems so do not modify without considering both!
-type BTRFSSubVolume struct {
-	Path     string `json:"path" yaml:"path"`         // Path inside the volume where the subvolume belongs (so / is the top of the volume tree).
-	Snapshot string `json:"snapshot" yaml:"snapshot"` // Snapshot name the subvolume belongs to.
-	Readonly bool   `json:"readonly" yaml:"readonly"` // Is the sub volume read only or not.
-	UUID     string `json:"uuid" yaml:"uuid"`         // The subvolume UUID.
+// BTRFSVolumeSettings are the settings of a volume needed to restore it from a backup without LXD's database.
+type BTRFSVolumeSettings struct {
+	Config      map[string]string `json:"config,omitempty" yaml:"config,omitempty"`           // Volume config relevant to the driver.
+	Compression string            `json:"compression,omitempty" yaml:"compression,omitempty"` // Compression property of the volume.
+	NoDataCOW   bool              `json:"nodatacow,omitempty" yaml:"nodatacow,omitempty"`     // Whether the nodatacow attribute is set on the volume.
 }
 
-// getSubvolumesMetaData retrieves subvolume meta data with paths relative to the root volume.
-// The first item in the returned list is the root subvolume itself.
-func (d *btrfs) getSubvolumesMetaData(vol Volume) ([]BTRFSSubVolume, error) {
-	snapName := ""
-	if vol.IsSnapshot() {
-		_, snapName, _ = api.GetParentAndSnapshotName(vol.name)
+// volumeSettings returns the settings of the volume to include in an optimized backup.
+func (d *btrfs) volumeSettings(vol Volume) (*BTRFSVolumeSettings, error) {
+	settings := &BTRFSVolumeSettings{Config: map[string]string{}}
+
+	for key, value := range vol.config {
+		if key == "size" || strings.HasPrefix(key, "btrfs.") {
+			settings.Config[key] = value
+		}
 	}
 
-	// Find any subvolumes in volume.
-	subVolPaths, err := d.getSubvolumes(vol.MountPath())
+	volPath := vol.MountPath()
+
+	var err error
+	settings.Compression, err = btrfsGetCompressionProperty(volPath)
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Strings(subVolPaths)
-
-	// Add main root volume to subvolumes list first.
-	subVols := make([]BTRFSSubVolume, 0, len(subVolPaths)+1)
-	subVols = append(subVols, BTRFSSubVolume{
-		Snapshot: snapName,
-		Path:     string(filepath.Separator),
-		Readonly: btrfsSubVolumeIsRo(vol.MountPath()),
-	})
-
-	// Add any subvolumes under the root subvolume with relative path to root.
-	for _, subVolPath := range subVolPaths {
-		subVols = append(subVols, BTRFSSubVolume{
-			Snapshot: snapName,
-			Path:     string(filepath.Separator) + subVolPath,
-			Readonly: btrfsSubVolumeIsRo(filepath.Join(vol.MountPath(), subVolPath)),
-		})
+	settings.NoDataCOW, err = btrfsIsNoDataCOW(volPath)
+	if err != nil {
+		return nil, err
 	}
 
-	stdout := strings.Builder{}
+	return settings, nil
+}
 
-	poolMountPath := GetPoolMountPath(vol.pool)
+// applyVolumeSettings applies the settings of a volume restored from an optimized backup.
+// The quota is applied separately, see restoreQuotaSize.
+func (d *btrfs) applyVolumeSettings(vol Volume, settings *BTRFSVolumeSettings) error {
+	volPath := vol.MountPath()
 
-	if !d.state.OS.RunningInUserNS {
-		// List all subvolumes in the given filesystem with their UUIDs and received UUIDs.
-		err = shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-u", "-R", poolMountPath)
+	if settings.Compression != "" {
+		_, err := shared.RunCommandContext(context.TODO(), "btrfs", "property", "set", volPath, "compression", settings.Compression)
 		if err != nil {
-			return nil, err
-		}
-
-		uuidMap := make(map[string]string)
-		receivedUUIDMap := make(map[string]string)
-
-		scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
-
-		for scanner.Scan() {
-			fields := strings.Fields(scanner.Text())
-
-			if len(fields) != 13 {
-				continue
-			}
-
-			uuidMap[filepath.Join(poolMountPath, fields[12])] = fields[10]
-
-			if fields[8] != "-" {
-				receivedUUIDMap[filepath.Join(poolMountPath, fields[12])] = fields[8]
-			}
+			return fmt.Errorf("Failed setting compression property on %q: %w", volPath, err)
 		}
+	}
 
-		for i, subVol := range subVols {
-			subVols[i].UUID = uuidMap[filepath.Join(vol.MountPath(), subVol.Path)]
+	if settings.NoDataCOW {
+		_, err := shared.RunCommandContext(context.TODO(), "chattr", "+C", volPath)
+		if err != nil {
+			return fmt.Errorf("Failed setting nodatacow on %q: %w", volPath, err)
 		}
 	}
 
-	return subVols, nil
+	return nil
 }
 
-func (d *btrfs) getSubVolumeReceivedUUID(vol Volume) (string, error) {
-	stdout := strings.Builder{}
-
-	poolMountPath := GetPoolMountPath(vol.pool)
+// resetVolumeSettings applies the compression and nodatacow settings of a volume to the subvolume now at its
+// path, clearing them if they're unset, such as when the subvolume has been exchanged with another one.
+func (d *btrfs) resetVolumeSettings(vol Volume, settings *BTRFSVolumeSettings) error {
+	volPath := vol.MountPath()
 
-	// List all subvolumes in the given filesystem with their UUIDs.
-	err := shared.RunCommandWithFds(d.state.ShutdownCtx, nil, &stdout, "btrfs", "subvolume", "list", "-R", poolMountPath)
+	_, err := shared.RunCommandContext(context.TODO(), "btrfs", "property", "set", volPath, "compression", settings.Compression)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("Failed setting compression property on %q: %w", volPath, err)
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(stdout.String()))
-
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-
-		if len(fields) != 11 {
-			continue
-		}
+	noDataCOWFlag := "-C"
+	if settings.NoDataCOW {
+		noDataCOWFlag = "+C"
+	}
 
-		if vol.MountPath() == filepath.Join(poolMountPath, fields[10]) && fields[8] != "-" {
-			return fields[8], nil
-		}
+	_, err = shared.RunCommandContext(context.TODO(), "chattr", noDataCOWFlag, volPath)
+	if err != nil {
+		return fmt.Errorf("Failed setting nodatacow on %q: %w", volPath, err)
 	}
 
-	return "", nil
+	return nil
 }
 
-// BTRFSMetaDataHeader is the meta data header about the volumes being sent/stored.
-// Note: This is used by both migration and backup subsystems so do not modify without considering both!
-type BTRFSMetaDataHeader struct {
-	Subvolumes []BTRFSSubVolume `json:"subvolumes" yaml:"subvolumes"` // Sub volumes inside the volume (including the top level ones).
+// restoreQuotaSize returns the quota to apply to a volume restored from an optimized backup.
+// The quota from the backup is only applied if the volume doesn't specify its own size.
+func restoreQuotaSize(vol Volume, settings *BTRFSVolumeSettings) string {
+	if settings == nil || vol.contentType != ContentTypeFS || vol.config["size"] != "" {
+		return ""
+	}
+
+	return settings.Config["size"]
 }
 
 // restorationHeader scans the volume and any specified snapshots, returning a header containing subvolume metadata
@@ -567,6 +4757,93 @@ func (d *btrfs) restorationHeader(vol Volume, snapshots []string) (*BTRFSMetaDat
 	return &migrationHeader, nil
 }
 
+// btrfsBackupFilePrefix returns the path prefix of the files holding a volume (or its snapshot snapName if set)
+// of the given type in an optimized backup tarball.
+func btrfsBackupFilePrefix(volType VolumeType, contentType ContentType, snapName string) string {
+	if snapName != "" {
+		snapDir := "snapshots"
+		fileName := snapName
+		switch volType {
+		case VolumeTypeVM:
+			snapDir = "virtual-machine-snapshots"
+			if contentType == ContentTypeFS {
+				fileName = snapName + "-config"
+			}
+
+		case VolumeTypeCustom:
+			snapDir = "volume-snapshots"
+		}
+
+		return filepath.Join(snapDir, fileName)
+	}
+
+	switch volType {
+	case VolumeTypeVM:
+		if contentType == ContentTypeFS {
+			return "virtual-machine-config"
+		}
+
+		return "virtual-machine"
+	case VolumeTypeCustom:
+		return "volume"
+	}
+
+	return "container"
+}
+
+// btrfsBackupFilePath returns the path of the file holding the subvolume at subVolPath in an optimized backup
+// tarball, where prefix is the volume's prefix from btrfsBackupFilePrefix.
+func btrfsBackupFilePath(prefix string, subVolPath string) string {
+	if subVolPath == string(filepath.Separator) {
+		return filepath.Join("backup", prefix+".bin")
+	}
+
+	// If subvolume is non-root, then we expect the file to be encoded as its original path with the leading /
+	// removed.
+	return filepath.Join("backup", prefix+"_"+filesystem.PathNameEncode(strings.TrimPrefix(subVolPath, string(filepath.Separator)))+".bin")
+}
+
+// checkBackupEntries checks that the optimized backup tarball contains the files of all subvolumes in the header
+// of the volume and the given snapshots. This only reads the headers of the tarball's entries, so an incomplete
+// backup is rejected before any subvolume is received.
+func (d *btrfs) checkBackupEntries(r io.ReadSeeker, unpacker []string, vol Volume, srcVolType VolumeType, srcContentType ContentType, snapshots []string, header *BTRFSMetaDataHeader) error {
+	tr, cancelFunc, err := archive.CompressedTarReader(d.state, context.Background(), r, unpacker, GetVolumeMountPath(d.name, vol.volType, ""))
+	if err != nil {
+		return err
+	}
+
+	defer cancelFunc()
+
+	entries := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break // End of archive.
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed reading backup tarball: %w", err)
+		}
+
+		if strings.HasPrefix(hdr.Name, "backup/") && strings.HasSuffix(hdr.Name, ".bin") {
+			entries[hdr.Name] = true
+		}
+	}
+
+	for _, subVol := range header.Subvolumes {
+		if subVol.Snapshot != "" && !slices.Contains(snapshots, subVol.Snapshot) {
+			continue // Snapshot isn't being restored.
+		}
+
+		srcFilePath := btrfsBackupFilePath(btrfsBackupFilePrefix(srcVolType, srcContentType, subVol.Snapshot), subVol.Path)
+		if !entries[srcFilePath] {
+			return fmt.Errorf("Backup is missing entry %q", srcFilePath)
+		}
+	}
+
+	return nil
+}
+
 // loadOptimizedBackupHeader extracts optimized backup header from a given ReadSeeker.
 func (d *btrfs) loadOptimizedBackupHeader(r io.ReadSeeker, mountPath string) (*BTRFSMetaDataHeader, error) {
 	header := BTRFSMetaDataHeader{}
@@ -604,22 +4881,33 @@ func (d *btrfs) loadOptimizedBackupHeader(r io.ReadSeeker, mountPath string) (*B
 }
 
 // receiveSubVolume receives a subvolume from an io.Reader into the receivePath and returns the path to the received subvolume.
-func (d *btrfs) receiveSubVolume(r io.Reader, receivePath string, tracker *ioprogress.ProgressTracker) (string, error) {
+// If migration is true, btrfs.migration.ioprio is applied to the receive.
+func (d *btrfs) receiveSubVolume(r io.Reader, receivePath string, tracker *ioprogress.ProgressTracker, migration bool) (string, error) {
 	files, err := os.ReadDir(receivePath)
 	if err != nil {
 		return "", fmt.Errorf("Failed listing contents of %q: %w", receivePath, err)
 	}
 
+	// Limit the rate the subvolume is received at if requested.
+	stdin, err := d.restoreReader(r)
+	if err != nil {
+		return "", err
+	}
+
 	// Setup progress tracker.
-	stdin := r
 	if tracker != nil {
 		stdin = &ioprogress.ProgressReader{
-			Reader:  r,
+			Reader:  stdin,
 			Tracker: tracker,
 		}
 	}
 
-	err = shared.RunCommandWithFds(d.state.ShutdownCtx, stdin, nil, "btrfs", "receive", "-e", receivePath)
+	name, args := "btrfs", []string{"receive", "-e", receivePath}
+	if migration {
+		name, args = d.migrationCommand(args...)
+	}
+
+	err = shared.RunCommandWithFds(d.state.ShutdownCtx, stdin, nil, name, args...)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,1285 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd/lxd/db/operationtype"
+	"github.com/canonical/lxd/lxd/instancewriter"
+	"github.com/canonical/lxd/lxd/migration"
+	"github.com/canonical/lxd/lxd/operations"
+	"github.com/canonical/lxd/lxd/storage/filesystem"
+	"github.com/canonical/lxd/shared"
+	"github.com/canonical/lxd/shared/logger"
+)
+
+// btrfsTestSendCmd returns an encoded btrfs send command header with the given length and command type.
+func btrfsTestSendCmd(length uint32, cmd uint16) []byte {
+	buf := make([]byte, btrfsSendCmdHeaderLen)
+	binary.LittleEndian.PutUint32(buf[0:4], length)
+	binary.LittleEndian.PutUint16(buf[4:6], cmd)
+	return buf
+}
+
+func TestBtrfsSendStreamVerifier(t *testing.T) {
+	header := append([]byte(btrfsSendStreamMagic), 1, 0, 0, 0) // Magic and version 1.
+	subvolCmd := append(btrfsTestSendCmd(4, 1), 0, 0, 0, 0)    // SUBVOL command with some payload.
+	endCmd := btrfsTestSendCmd(0, btrfsSendCmdEnd)
+
+	complete := append(append(append([]byte{}, header...), subvolCmd...), endCmd...)
+
+	// Complete stream written in one go.
+	v := &btrfsSendStreamVerifier{}
+	_, _ = v.Write(complete)
+	assert.NoError(t, v.Verify())
+	assert.Equal(t, uint32(1), v.Version())
+
+	// Complete stream written one byte at a time.
+	v = &btrfsSendStreamVerifier{}
+	for _, b := range complete {
+		_, _ = v.Write([]byte{b})
+	}
+
+	assert.NoError(t, v.Verify())
+	assert.Equal(t, uint32(1), v.Version())
+
+	// Stream missing the END command.
+	v = &btrfsSendStreamVerifier{}
+	_, _ = v.Write(complete[:len(complete)-btrfsSendCmdHeaderLen])
+	assert.ErrorIs(t, v.Verify(), errBtrfsSendStreamTruncated)
+
+	// Stream cut short in the middle of the END command.
+	v = &btrfsSendStreamVerifier{}
+	_, _ = v.Write(complete[:len(complete)-3])
+	assert.ErrorIs(t, v.Verify(), errBtrfsSendStreamTruncated)
+
+	// Empty stream.
+	v = &btrfsSendStreamVerifier{}
+	assert.ErrorIs(t, v.Verify(), errBtrfsSendStreamTruncated)
+	assert.Equal(t, uint32(0), v.Version())
+
+	// Invalid magic.
+	invalid := append([]byte{}, complete...)
+	invalid[0] = 'x'
+	v = &btrfsSendStreamVerifier{}
+	_, _ = v.Write(invalid)
+	err := v.Verify()
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errBtrfsSendStreamTruncated)
+}
+
+func TestBtrfsReadStreamParentUUID(t *testing.T) {
+	header := append([]byte(btrfsSendStreamMagic), 1, 0, 0, 0) // Magic and version 1.
+	parentUUID := uuid.MustParse("2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10")
+
+	// btrfsTestAttr returns an encoded btrfs send attribute.
+	btrfsTestAttr := func(attrType uint16, data []byte) []byte {
+		buf := make([]byte, 4, 4+len(data))
+		binary.LittleEndian.PutUint16(buf[0:2], attrType)
+		binary.LittleEndian.PutUint16(buf[2:4], uint16(len(data)))
+		return append(buf, data...)
+	}
+
+	path := btrfsTestAttr(15, []byte("snap1"))
+	clone := btrfsTestAttr(btrfsSendAttrCloneUUID, parentUUID[:])
+	rest := btrfsTestSendCmd(0, btrfsSendCmdEnd)
+
+	// Incremental stream.
+	payload := append(append([]byte{}, path...), clone...)
+	stream := slices.Concat(header, btrfsTestSendCmd(uint32(len(payload)), btrfsSendCmdSnapshot), payload, rest)
+
+	streamParentUUID, r, err := btrfsReadStreamParentUUID(bytes.NewReader(stream))
+	assert.NoError(t, err)
+	assert.Equal(t, parentUUID.String(), streamParentUUID)
+
+	// The returned reader yields the whole stream.
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, stream, data)
+
+	// Full stream.
+	stream = slices.Concat(header, btrfsTestSendCmd(uint32(len(path)), 1), path, rest)
+
+	streamParentUUID, _, err = btrfsReadStreamParentUUID(bytes.NewReader(stream))
+	assert.NoError(t, err)
+	assert.Empty(t, streamParentUUID)
+
+	// Incremental stream without its parent.
+	stream = slices.Concat(header, btrfsTestSendCmd(uint32(len(path)), btrfsSendCmdSnapshot), path, rest)
+
+	_, _, err = btrfsReadStreamParentUUID(bytes.NewReader(stream))
+	assert.Error(t, err)
+
+	// Not a send stream.
+	_, _, err = btrfsReadStreamParentUUID(strings.NewReader("not a btrfs send stream"))
+	assert.Error(t, err)
+}
+
+func TestBtrfsPoolRelativeSubvolumePath(t *testing.T) {
+	d := &btrfs{}
+	d.config = map[string]string{}
+
+	// No prefix uses the paths as listed.
+	relPath, found := d.poolRelativeSubvolumePath("containers-snapshots/c1/snap0")
+	assert.True(t, found)
+	assert.Equal(t, "containers-snapshots/c1/snap0", relPath)
+
+	// With a prefix, only subvolumes below it belong to the pool.
+	d.config["btrfs.subvolume_prefix"] = "tenant1"
+
+	relPath, found = d.poolRelativeSubvolumePath("tenant1/containers-snapshots/c1/snap0")
+	assert.True(t, found)
+	assert.Equal(t, "containers-snapshots/c1/snap0", relPath)
+
+	_, found = d.poolRelativeSubvolumePath("tenant2/containers-snapshots/c1/snap0")
+	assert.False(t, found)
+
+	_, found = d.poolRelativeSubvolumePath("tenant1")
+	assert.False(t, found)
+}
+
+func TestBtrfsMaintenance(t *testing.T) {
+	d := &btrfs{}
+	d.name = "test-maintenance"
+
+	finishBalance, err := d.startMaintenance("balance")
+	assert.NoError(t, err)
+	assert.Equal(t, "balance", d.MaintenanceStatus())
+
+	// Scrub can't start while the balance is running.
+	_, err = d.startMaintenance("scrub")
+	assert.ErrorIs(t, err, errBtrfsMaintenanceRunning)
+
+	// Other pools aren't affected.
+	other := &btrfs{}
+	other.name = "test-maintenance-other"
+	finishOther, err := other.startMaintenance("scrub")
+	assert.NoError(t, err)
+	finishOther()
+
+	finishBalance()
+	assert.Empty(t, d.MaintenanceStatus())
+
+	finishScrub, err := d.startMaintenance("scrub")
+	assert.NoError(t, err)
+	finishScrub()
+}
+
+func TestBtrfsParseScrubStatus(t *testing.T) {
+	output := `UUID:             6e8a2b1c-3f4d-4e5a-9b6c-7d8e9f0a1b2c
+Scrub started:    Tue Oct 10 10:00:00 2023
+Status:           running
+Duration:         0:00:10
+Time left:        0:01:20
+ETA:              Tue Oct 10 10:01:30 2023
+Total to scrub:   10.00GiB
+Bytes scrubbed:   1.10GiB  (11.00%)
+Rate:             112.64MiB/s
+Error summary:    no errors found
+`
+
+	assert.Equal(t, btrfsMaintenanceProgress{percent: 11, remaining: 80 * time.Second}, btrfsParseScrubStatus(output))
+
+	// Older btrfs-progs versions don't report the progress.
+	output = `scrub status for 6e8a2b1c-3f4d-4e5a-9b6c-7d8e9f0a1b2c
+	scrub started at Tue Oct 10 10:00:00 2023, running for 00:00:10
+	total bytes scrubbed: 1.10GiB with 0 errors
+`
+
+	assert.Equal(t, btrfsMaintenanceProgress{percent: -1, remaining: -1}, btrfsParseScrubStatus(output))
+}
+
+func TestBtrfsParseBalanceStatus(t *testing.T) {
+	output := `Balance on '/var/lib/lxd/storage-pools/default' is running
+2 out of about 10 chunks balanced (3 considered),  80% left
+`
+
+	assert.Equal(t, btrfsMaintenanceProgress{percent: 20, remaining: -1}, btrfsParseBalanceStatus(output))
+
+	output = `Balance on '/var/lib/lxd/storage-pools/default' is running
+5 out of about 10 chunks balanced (6 considered)
+`
+
+	assert.Equal(t, btrfsMaintenanceProgress{percent: 50, remaining: -1}, btrfsParseBalanceStatus(output))
+
+	assert.Equal(t, btrfsMaintenanceProgress{percent: -1, remaining: -1}, btrfsParseBalanceStatus("No balance found on '/var/lib/lxd/storage-pools/default'\n"))
+}
+
+func TestBtrfsParseDuration(t *testing.T) {
+	duration, err := btrfsParseDuration("1:02:03")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour+2*time.Minute+3*time.Second, duration)
+
+	duration, err = btrfsParseDuration("2d 0:00:05")
+	assert.NoError(t, err)
+	assert.Equal(t, 48*time.Hour+5*time.Second, duration)
+
+	_, err = btrfsParseDuration("10s")
+	assert.Error(t, err)
+}
+
+func TestBtrfsClassifySubvolume(t *testing.T) {
+	tests := []struct {
+		relPath       string
+		transientRoot string
+		expected      bool
+	}{
+		// Base directories and volumes.
+		{relPath: "containers", expected: true},
+		{relPath: "containers/c1", expected: true},
+		{relPath: "containers/c1/nested", expected: true},
+		{relPath: "custom/default_vol1", expected: true},
+		{relPath: "images/fingerprint", expected: true},
+
+		// Snapshots.
+		{relPath: "containers-snapshots", expected: true},
+		{relPath: "containers-snapshots/c1/snap0", expected: true},
+		{relPath: "containers-snapshots/c1/snap0/nested", expected: true},
+		{relPath: "containers-snapshots/c1", expected: false},
+
+		// Temporary directories and volumes.
+		{relPath: "containers/migration.1234/.migration-send", transientRoot: "containers/migration.1234"},
+		{relPath: "virtual-machines/backup.1234/.backup", transientRoot: "virtual-machines/backup.1234"},
+		{relPath: "containers/c1.lxdtmp", transientRoot: "containers/c1.lxdtmp"},
+		{relPath: "backup.1234/c1", transientRoot: "backup.1234"},
+		{relPath: "ephemeral.1234/snap0", transientRoot: "ephemeral.1234"},
+
+		// Unknown subvolumes.
+		{relPath: "unknown"},
+		{relPath: "unknown/nested"},
+	}
+
+	for _, test := range tests {
+		transientRoot, expected := btrfsClassifySubvolume(test.relPath)
+		assert.Equal(t, test.expected, expected, test.relPath)
+		assert.Equal(t, test.transientRoot, transientRoot, test.relPath)
+	}
+}
+
+func TestBtrfsFillSemaphore(t *testing.T) {
+	s := &btrfsFillSemaphore{}
+
+	assert.NoError(t, s.acquire(context.Background(), 2))
+	assert.NoError(t, s.acquire(context.Background(), 2))
+
+	// Lowering the limit doesn't let further fillers start until enough running ones completed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, s.acquire(ctx, 1), context.DeadlineExceeded)
+
+	acquired := make(chan error)
+	go func() { acquired <- s.acquire(context.Background(), 1) }()
+
+	s.release()
+
+	select {
+	case <-acquired:
+		t.Fatal("Filler started while the limit was still reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.release()
+	assert.NoError(t, <-acquired)
+
+	// Without a limit fillers don't wait.
+	assert.NoError(t, s.acquire(context.Background(), 0))
+	assert.Equal(t, 2, s.running)
+}
+
+func TestBtrfsOrphanedSubvolumes(t *testing.T) {
+	subVolPaths := []string{
+		"containers",
+		"containers/c1",
+		"containers/c1/nested",
+		"containers/c2",
+		"containers/c2/nested",
+		"containers-snapshots",
+		"containers-snapshots/c1/snap0",
+		"containers-snapshots/c1/snap1",
+		"containers/migration.123/.migration-send",
+		"containers/migration.456/.migration-send",
+		"images/fingerprint",
+		"unknown",
+	}
+
+	known := map[string]bool{
+		"containers/c1":                 true,
+		"containers-snapshots/c1/snap0": true,
+		"images/fingerprint":            true,
+	}
+
+	inUse := func(transientRoot string) bool {
+		return transientRoot == "containers/migration.456"
+	}
+
+	// Volumes and snapshots which aren't known are reported as well as subvolumes outside of the layout.
+	orphans := btrfsOrphanedSubvolumes(subVolPaths, known, inUse)
+	assert.Equal(t, []string{"containers-snapshots/c1/snap1", "containers/c2", "containers/migration.123/.migration-send", "unknown"}, orphans)
+}
+
+func TestBtrfsParseQGroupTable(t *testing.T) {
+	output := `Qgroupid    Referenced    Exclusive   Path
+--------    ----------    ---------   ----
+0/5              16384        16384   <toplevel>
+0/256          1048576        65536   containers/c1
+1/100          2097152      2097152   <under deletion>
+`
+
+	usage := btrfsParseQGroupTable(output)
+	assert.Equal(t, map[string]btrfsQGroupUsage{
+		"0/5":   {referenced: 16384, exclusive: 16384, limit: -1},
+		"0/256": {referenced: 1048576, exclusive: 65536, limit: -1},
+		"1/100": {referenced: 2097152, exclusive: 2097152, limit: -1},
+	}, usage)
+
+	// With the limits.
+	output = `Qgroupid    Referenced    Exclusive   Max referenced   Path
+--------    ----------    ---------   --------------   ----
+0/5              16384        16384             none   <toplevel>
+0/256          1048576        65536       1073741824   containers/c1
+`
+
+	usage = btrfsParseQGroupTable(output)
+	assert.Equal(t, map[string]btrfsQGroupUsage{
+		"0/5":   {referenced: 16384, exclusive: 16384, limit: -1},
+		"0/256": {referenced: 1048576, exclusive: 65536, limit: 1073741824},
+	}, usage)
+}
+
+func TestBtrfsParseParentQGroup(t *testing.T) {
+	level, id, err := btrfsParseParentQGroup("1/100")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), level)
+	assert.Equal(t, uint64(100), id)
+
+	for _, value := range []string{"0/257", "100", "1/", "a/1", "1/-1"} {
+		_, _, err = btrfsParseParentQGroup(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestBtrfsParseDeletedSubvolumes(t *testing.T) {
+	output := `ID 260 gen 20 top level 5 path DELETED
+ID 261 gen 21 top level 5 path DELETED
+`
+
+	assert.Equal(t, []string{"260", "261"}, btrfsParseDeletedSubvolumes(output))
+	assert.Empty(t, btrfsParseDeletedSubvolumes(""))
+}
+
+func TestBtrfsIOPrioArgs(t *testing.T) {
+	args, err := btrfsIOPrioArgs("idle")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-c", "3"}, args)
+
+	args, err = btrfsIOPrioArgs("best-effort:7")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-c", "2", "-n", "7"}, args)
+
+	for _, value := range []string{"", "low", "idle:1", "best-effort:8", "realtime:x"} {
+		_, err = btrfsIOPrioArgs(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestBtrfsMigrationSize(t *testing.T) {
+	subvolumes := []BTRFSSubVolume{
+		{Path: "/", Snapshot: "snap0", Size: 1000, ExclusiveSize: 100},
+		{Path: "/sub", Snapshot: "snap0", Size: 500, ExclusiveSize: 50},
+		{Path: "/", Snapshot: "snap1", Size: 1100, ExclusiveSize: 200},
+		{Path: "/sub", Snapshot: "snap1", Size: 500, ExclusiveSize: 20},
+		{Path: "/", Size: 1200, ExclusiveSize: 300},
+	}
+
+	// First subvolume of each path is sent in full, the rest as differences.
+	assert.Equal(t, int64(1000+500+200+20+300), btrfsMigrationSize(subvolumes, false))
+
+	// All subvolumes are sent as differences when the target has a parent.
+	assert.Equal(t, int64(100+50+200+20+300), btrfsMigrationSize(subvolumes, true))
+
+	// Unknown when the source didn't include sizes.
+	subvolumes[2].Size = 0
+	assert.Equal(t, int64(0), btrfsMigrationSize(subvolumes, false))
+}
+
+func TestBtrfsBackupPeakSize(t *testing.T) {
+	subvolumes := []BTRFSSubVolume{
+		{Path: "/", Snapshot: "snap0", Size: 1000, ExclusiveSize: 100},
+		{Path: "/sub", Snapshot: "snap0", Size: 500, ExclusiveSize: 50},
+		{Path: "/", Snapshot: "snap1", Size: 1100, ExclusiveSize: 200},
+		{Path: "/sub", Snapshot: "snap1", Size: 500, ExclusiveSize: 20},
+		{Path: "/", Size: 3000, ExclusiveSize: 1900},
+	}
+
+	// The first snapshot is generated in full, the volume itself as a difference to the last snapshot.
+	assert.Equal(t, int64(1900), btrfsBackupPeakSize(subvolumes))
+
+	// Without snapshots the volume is generated in full.
+	assert.Equal(t, int64(3000), btrfsBackupPeakSize(subvolumes[4:]))
+
+	// Unknown when any size is missing.
+	subvolumes[3].Size = 0
+	assert.Equal(t, int64(0), btrfsBackupPeakSize(subvolumes))
+}
+
+func TestBtrfsValidateBackupConversion(t *testing.T) {
+	customFS := Volume{volType: VolumeTypeCustom, contentType: ContentTypeFS}
+	customBlock := Volume{volType: VolumeTypeCustom, contentType: ContentTypeBlock}
+	vmFS := Volume{volType: VolumeTypeVM, contentType: ContentTypeFS}
+
+	// Restoring as the same type.
+	assert.NoError(t, btrfsValidateBackupConversion(VolumeTypeCustom, ContentTypeFS, customFS))
+	assert.NoError(t, btrfsValidateBackupConversion(VolumeTypeVM, ContentTypeFS, vmFS))
+
+	// Restoring a VM's config volume as a custom volume.
+	assert.NoError(t, btrfsValidateBackupConversion(VolumeTypeVM, ContentTypeFS, customFS))
+
+	// Unsupported conversions.
+	assert.ErrorIs(t, btrfsValidateBackupConversion(VolumeTypeVM, ContentTypeBlock, customFS), ErrNotSupported)
+	assert.ErrorIs(t, btrfsValidateBackupConversion(VolumeTypeVM, ContentTypeFS, customBlock), ErrNotSupported)
+	assert.ErrorIs(t, btrfsValidateBackupConversion(VolumeTypeContainer, ContentTypeFS, customFS), ErrNotSupported)
+	assert.ErrorIs(t, btrfsValidateBackupConversion(VolumeTypeCustom, ContentTypeFS, vmFS), ErrNotSupported)
+}
+
+func TestBtrfsCheckBackupFormatVersion(t *testing.T) {
+	// Backups predating the format version.
+	assert.NoError(t, btrfsCheckBackupFormatVersion(0))
+
+	assert.NoError(t, btrfsCheckBackupFormatVersion(btrfsBackupFormatVersion))
+
+	err := btrfsCheckBackupFormatVersion(btrfsBackupFormatVersion + 1)
+	assert.ErrorContains(t, err, fmt.Sprintf("version %d is newer than the supported version %d", btrfsBackupFormatVersion+1, btrfsBackupFormatVersion))
+}
+
+func TestBtrfsUnmetBackupRequirements(t *testing.T) {
+	header := &BTRFSMetaDataHeader{FormatVersion: btrfsBackupFormatVersion, Volume: &BTRFSVolumeSettings{Compression: "zstd"}}
+	assert.Empty(t, btrfsUnmetBackupRequirements(header, []string{"compress_lzo", "compress_zstd"}))
+	assert.Equal(t, []string{`Kernel support for "zstd" compression`}, btrfsUnmetBackupRequirements(header, []string{"compress_lzo"}))
+
+	header = &BTRFSMetaDataHeader{FormatVersion: btrfsBackupFormatVersion + 1, Volume: &BTRFSVolumeSettings{Compression: "zlib"}}
+	assert.Len(t, btrfsUnmetBackupRequirements(header, nil), 1)
+}
+
+func TestBtrfsSubvolumeShowField(t *testing.T) {
+	output := `containers/c1
+	Name: 			c1
+	UUID: 			2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10
+	Parent UUID: 		-
+	Received UUID: 		-
+	Creation time: 		2024-01-01 12:00:00 +0000
+	Subvolume ID: 		257
+	Generation: 		1234
+	Gen at creation: 	10
+	Parent ID: 		5
+	Top level ID: 		5
+	Flags: 			-
+`
+
+	value, found := btrfsSubvolumeShowField(output, "Subvolume ID")
+	assert.True(t, found)
+	assert.Equal(t, "257", value)
+
+	value, found = btrfsSubvolumeShowField(output, "Generation")
+	assert.True(t, found)
+	assert.Equal(t, "1234", value)
+
+	_, found = btrfsSubvolumeShowField(output, "Quota group")
+	assert.False(t, found)
+
+	assert.Equal(t, "containers/c1", btrfsSubvolumeShowPath(output))
+}
+
+func TestBtrfsSendParentUUID(t *testing.T) {
+	output := `containers-snapshots/c1/snap0
+	Name: 			snap0
+	UUID: 			2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10
+	Parent UUID: 		9c0e7d1a-3f2b-4e5d-8a6b-1c2d3e4f5a6b
+	Received UUID: 		-
+	Flags: 			readonly
+`
+
+	// Local snapshot is referred to by its own UUID.
+	parentUUID, reason := btrfsSendParentUUID(output)
+	assert.Empty(t, reason)
+	assert.Equal(t, "2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10", parentUUID)
+
+	// Received snapshot is referred to by its received UUID.
+	received := strings.Replace(output, "Received UUID: \t\t-", "Received UUID: \t\t5e4d3c2b-1a09-4f8e-9d7c-6b5a4f3e2d1c", 1)
+	parentUUID, reason = btrfsSendParentUUID(received)
+	assert.Empty(t, reason)
+	assert.Equal(t, "5e4d3c2b-1a09-4f8e-9d7c-6b5a4f3e2d1c", parentUUID)
+
+	// Writable snapshot.
+	_, reason = btrfsSendParentUUID(strings.Replace(output, "readonly", "-", 1))
+	assert.Equal(t, "Snapshot is not read-only", reason)
+}
+
+func TestBtrfsSnapshotUUIDInfo(t *testing.T) {
+	output := `containers-snapshots/c1/snap0
+	Name: 			snap0
+	UUID: 			2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10
+	Parent UUID: 		9c0e7d1a-3f2b-4e5d-8a6b-1c2d3e4f5a6b
+	Received UUID: 		-
+	Flags: 			readonly
+`
+
+	assert.Equal(t, SnapshotUUIDInfo{
+		Name:       "snap0",
+		UUID:       "2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10",
+		ParentUUID: "9c0e7d1a-3f2b-4e5d-8a6b-1c2d3e4f5a6b",
+	}, btrfsSnapshotUUIDInfo("snap0", output))
+}
+
+func TestBtrfsSubvolumeDescendants(t *testing.T) {
+	output := `ID 256 gen 10 top level 5 parent_uuid - uuid 11111111-0000-0000-0000-000000000000 path images/abc
+ID 257 gen 11 top level 5 parent_uuid 11111111-0000-0000-0000-000000000000 uuid 22222222-0000-0000-0000-000000000000 path containers/c1
+ID 258 gen 12 top level 5 parent_uuid 22222222-0000-0000-0000-000000000000 uuid 33333333-0000-0000-0000-000000000000 path containers-snapshots/c1/snap0
+ID 259 gen 13 top level 5 parent_uuid 33333333-0000-0000-0000-000000000000 uuid 44444444-0000-0000-0000-000000000000 path containers/c2
+ID 260 gen 14 top level 5 parent_uuid - uuid 55555555-0000-0000-0000-000000000000 path containers/c3
+ID 261 gen 15 top level 5 parent_uuid 99999999-0000-0000-0000-000000000000 uuid 66666666-0000-0000-0000-000000000000 path containers/c4
+`
+
+	// The snapshot of c1 and the volume restored from it still descend from the image, while the copied c3
+	// and c4 (whose parent was deleted) don't.
+	assert.Equal(t, []string{"containers-snapshots/c1/snap0", "containers/c1", "containers/c2"}, btrfsSubvolumeDescendants(output, "11111111-0000-0000-0000-000000000000"))
+	assert.Empty(t, btrfsSubvolumeDescendants(output, "55555555-0000-0000-0000-000000000000"))
+}
+
+func TestBtrfsParseFilesystemDu(t *testing.T) {
+	output := `     Total   Exclusive  Set shared  Filename
+  10485760     2097152     8388608  /var/lib/lxd/storage-pools/default/containers/c1
+`
+
+	total, exclusive, shared, err := btrfsParseFilesystemDu(output)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{10485760, 2097152, 8388608}, []int64{total, exclusive, shared})
+
+	_, _, _, err = btrfsParseFilesystemDu("     Total   Exclusive  Set shared  Filename\n")
+	assert.Error(t, err)
+}
+
+func TestBtrfsParseCompsize(t *testing.T) {
+	output := `Processed 1234 files, 567 regular extents (600 refs), 700 inline.
+Type       Perc     Disk Usage   Uncompressed Referenced
+TOTAL       45%      471859200   1048576000   1100000000
+none       100%      104857600    104857600    110000000
+zstd        38%      367001600    943718400    990000000
+`
+
+	compressed, uncompressed, err := btrfsParseCompsize(output)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(471859200), compressed)
+	assert.Equal(t, int64(1048576000), uncompressed)
+
+	_, _, err = btrfsParseCompsize("")
+	assert.Error(t, err)
+}
+
+func TestBtrfsSuperIsSeed(t *testing.T) {
+	output := `superblock: bytenr=65536, device=/dev/loop0
+---------------------------------------------------------
+csum_type		0 (crc32c)
+bytenr			65536
+flags			0x100000001
+			( WRITTEN |
+			  SEEDING )
+magic			_BHRfS_M [match]
+`
+
+	assert.True(t, btrfsSuperIsSeed(output))
+	assert.False(t, btrfsSuperIsSeed(strings.Replace(output, "0x100000001\n\t\t\t( WRITTEN |\n\t\t\t  SEEDING )", "0x1\n\t\t\t( WRITTEN )", 1)))
+}
+
+func TestBtrfsDiagnoseSpace(t *testing.T) {
+	output := `Overall:
+    Device size:		    5368709120
+    Device allocated:		    5368709120
+    Device unallocated:		             0
+    Device missing:		             0
+    Used:			    4563402752
+    Free (estimated):		     536870912	(min: 536870912)
+    Global reserve:		       5570560	(used: 0)
+
+Data,single: Size:4294967296, Used:3758096384 (87.50%)
+   /dev/loop0	4294967296
+
+Metadata,DUP: Size:536870912, Used:530579456 (98.83%)
+   /dev/loop0	1073741824
+
+System,DUP: Size:8388608, Used:16384 (0.20%)
+   /dev/loop0	16777216
+`
+
+	assert.Equal(t, "metadata space exhausted (506.00MiB of 512.00MiB used and no unallocated space for more)", btrfsDiagnoseSpace(output, nil))
+
+	// A full quota is reported first.
+	qgroup := &btrfsQGroupUsage{referenced: 1073741824, exclusive: 1073741824, limit: 1073741824}
+	assert.Equal(t, "quota limit reached (1.00GiB of 1.00GiB referenced)", btrfsDiagnoseSpace(output, qgroup))
+
+	// No problem while chunks can still be allocated.
+	output = strings.Replace(output, "Device unallocated:		             0", "Device unallocated:		    1073741824", 1)
+	assert.Empty(t, btrfsDiagnoseSpace(output, nil))
+}
+
+func TestBtrfsMetadataAvailable(t *testing.T) {
+	output := `Overall:
+    Device unallocated:		             0
+    Global reserve:		       5570560	(used: 0)
+
+Metadata,DUP: Size:536870912, Used:530579456 (98.83%)
+   /dev/loop0	1073741824
+`
+
+	// The global reserve isn't available.
+	assert.Equal(t, int64(720896), btrfsMetadataAvailable(output))
+
+	// Unallocated space counts once a chunk can be allocated from it.
+	output = strings.Replace(output, "Device unallocated:		             0", "Device unallocated:		    1073741824", 1)
+	assert.Equal(t, int64(1074462720), btrfsMetadataAvailable(output))
+}
+
+func TestBtrfsMountOptions(t *testing.T) {
+	options := btrfsMountOptions("user_subvol_rm_allowed", "rw,compress=zstd:3,space_cache=v2,user_subvol_rm_allowed")
+	assert.Equal(t, []string{"user_subvol_rm_allowed", "rw", "compress=zstd:3", "space_cache=v2"}, options)
+	assert.False(t, btrfsUseNodatacow(options, ""))
+
+	assert.True(t, btrfsUseNodatacow(btrfsMountOptions("user_subvol_rm_allowed", "rw,space_cache=v2"), ""))
+	assert.False(t, btrfsUseNodatacow(btrfsMountOptions("datacow", "rw,space_cache=v2"), ""))
+	assert.False(t, btrfsUseNodatacow(btrfsMountOptions("", "rw,compress-force=zstd"), ""))
+
+	// The default compression of new volumes overrides the mount options.
+	assert.True(t, btrfsUseNodatacow(options, "none"))
+	assert.False(t, btrfsUseNodatacow(btrfsMountOptions("", "rw,space_cache=v2"), "zstd"))
+	assert.False(t, btrfsUseNodatacow(btrfsMountOptions("datacow", "rw,space_cache=v2"), "none"))
+}
+
+func TestBtrfsParseFindNew(t *testing.T) {
+	output := `inode 257 file offset 0 len 4096 disk start 13631488 offset 0 gen 12 flags NONE etc/hosts
+inode 258 file offset 0 len 8192 disk start 13635584 offset 0 gen 12 flags COMPRESS|PREALLOC var/log/my file.log
+inode 258 file offset 8192 len 4096 disk start 13643776 offset 0 gen 13 flags NONE var/log/my file.log
+transid marker was 13
+`
+
+	paths, err := btrfsParseFindNew(output)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"etc/hosts", "var/log/my file.log"}, paths)
+
+	// Nothing changed.
+	paths, err = btrfsParseFindNew("transid marker was 13\n")
+	assert.NoError(t, err)
+	assert.Empty(t, paths)
+
+	// Truncated output.
+	_, err = btrfsParseFindNew(strings.SplitAfter(output, "\n")[0])
+	assert.Error(t, err)
+}
+
+func TestBtrfsFindNewFileSize(t *testing.T) {
+	output := `inode 257 file offset 0 len 1048576 disk start 13631488 offset 0 gen 12 flags NONE root.img
+inode 258 file offset 0 len 4096 disk start 14680064 offset 0 gen 12 flags NONE agent.conf
+inode 257 file offset 104857600 len 4096 disk start 14684160 offset 0 gen 13 flags NONE root.img
+transid marker was 13
+`
+
+	size, err := btrfsFindNewFileSize(output, "root.img")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1052672), size)
+
+	// All files.
+	size, err = btrfsFindNewFileSize(output, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1056768), size)
+
+	// Nothing changed.
+	size, err = btrfsFindNewFileSize("transid marker was 13\n", "root.img")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	// Truncated output.
+	_, err = btrfsFindNewFileSize(strings.SplitAfter(output, "\n")[0], "root.img")
+	assert.Error(t, err)
+}
+
+func TestBtrfsBackupFilePath(t *testing.T) {
+	assert.Equal(t, "backup/container.bin", btrfsBackupFilePath(btrfsBackupFilePrefix(VolumeTypeContainer, ContentTypeFS, ""), "/"))
+	assert.Equal(t, "backup/virtual-machine.bin", btrfsBackupFilePath(btrfsBackupFilePrefix(VolumeTypeVM, ContentTypeBlock, ""), "/"))
+	assert.Equal(t, "backup/virtual-machine-snapshots/snap0-config.bin", btrfsBackupFilePath(btrfsBackupFilePrefix(VolumeTypeVM, ContentTypeFS, "snap0"), "/"))
+	assert.Equal(t, "backup/volume-snapshots/snap0_a-b.bin", btrfsBackupFilePath(btrfsBackupFilePrefix(VolumeTypeCustom, ContentTypeFS, "snap0"), "/a/b"))
+}
+
+func TestBtrfsIncrementalBackupPlan(t *testing.T) {
+	snapshots := []string{"snap0", "snap1", "snap2"}
+
+	// Without a parent the whole chain is sent, as in an optimized backup.
+	assert.Equal(t, []BackupStep{
+		{Snapshot: "snap0", Parent: ""},
+		{Snapshot: "snap1", Parent: "snap0"},
+		{Snapshot: "snap2", Parent: "snap1"},
+		{Snapshot: "", Parent: "snap2"},
+	}, btrfsIncrementalBackupPlan(snapshots, ""))
+
+	assert.Equal(t, []BackupStep{
+		{Snapshot: "snap2", Parent: "snap1"},
+		{Snapshot: "", Parent: "snap2"},
+	}, btrfsIncrementalBackupPlan(snapshots, "snap1"))
+
+	assert.Equal(t, []BackupStep{{Snapshot: "", Parent: "snap2"}}, btrfsIncrementalBackupPlan(snapshots, "snap2"))
+
+	// An unknown parent results in a full send.
+	assert.Equal(t, btrfsIncrementalBackupPlan(snapshots, ""), btrfsIncrementalBackupPlan(snapshots, "snap9"))
+	assert.Equal(t, []BackupStep{{Snapshot: "", Parent: ""}}, btrfsIncrementalBackupPlan(nil, "snap0"))
+}
+
+func TestBtrfsRecommendBackupMode(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+
+	// Snapshots only differing slightly from each other are much smaller as differences.
+	subvolumes := []BTRFSSubVolume{}
+	for i := range 10 {
+		subvolumes = append(subvolumes, BTRFSSubVolume{Snapshot: fmt.Sprintf("snap%d", i), Path: "/", Size: gib, ExclusiveSize: 10 * 1024 * 1024})
+	}
+
+	subvolumes = append(subvolumes, BTRFSSubVolume{Path: "/", Size: gib, ExclusiveSize: 10 * 1024 * 1024})
+
+	optimized, reason := btrfsRecommendBackupMode(subvolumes)
+	assert.True(t, optimized)
+	assert.Contains(t, reason, "10 snapshots")
+
+	// Without sizes the snapshots still favour optimized backups.
+	optimized, _ = btrfsRecommendBackupMode([]BTRFSSubVolume{{Snapshot: "snap0", Path: "/"}, {Path: "/"}})
+	assert.True(t, optimized)
+
+	// Without snapshots both backups are the same size.
+	optimized, _ = btrfsRecommendBackupMode([]BTRFSSubVolume{{Path: "/", Size: gib, ExclusiveSize: gib}})
+	assert.False(t, optimized)
+
+	optimized, _ = btrfsRecommendBackupMode([]BTRFSSubVolume{{Path: "/"}})
+	assert.False(t, optimized)
+
+	// Only optimized backups keep nested subvolumes.
+	optimized, reason = btrfsRecommendBackupMode([]BTRFSSubVolume{{Path: "/"}, {Path: "/var/lib/docker"}})
+	assert.True(t, optimized)
+	assert.Contains(t, reason, "/var/lib/docker")
+}
+
+func TestBtrfsFilterSnapshots(t *testing.T) {
+	snapshots := []string{"snap0", "before-upgrade", "snap1", "snap10"}
+
+	assert.Equal(t, snapshots, btrfsFilterSnapshots(snapshots, ""))
+	assert.Equal(t, []string{"before-upgrade"}, btrfsFilterSnapshots(snapshots, "snap*"))
+	assert.Equal(t, []string{"snap0", "before-upgrade", "snap10"}, btrfsFilterSnapshots(snapshots, "snap1"))
+	assert.Equal(t, []string{}, btrfsFilterSnapshots(snapshots, "*"))
+
+	assert.Equal(t, snapshots, btrfsLimitSnapshots(snapshots, ""))
+	assert.Equal(t, snapshots, btrfsLimitSnapshots(snapshots, "10"))
+	assert.Equal(t, []string{"snap1", "snap10"}, btrfsLimitSnapshots(snapshots, "2"))
+	assert.Equal(t, snapshots, btrfsLimitSnapshots(snapshots, "0"))
+
+	// Exclusion applies before the limit, and only the limit leaves out older snapshots.
+	d := &btrfs{}
+	vol := NewVolume(d, "pool", VolumeTypeCustom, ContentTypeFS, "vol1", map[string]string{"btrfs.backup.snapshot_exclude": "snap1*", "btrfs.backup.snapshot_limit": "2"}, nil)
+	included, partialHistory := d.FilterBackupSnapshots(vol, snapshots)
+	assert.Equal(t, []string{"snap0", "before-upgrade"}, included)
+	assert.False(t, partialHistory)
+
+	vol = NewVolume(d, "pool", VolumeTypeCustom, ContentTypeFS, "vol1", map[string]string{"btrfs.backup.snapshot_limit": "1"}, nil)
+	included, partialHistory = d.FilterBackupSnapshots(vol, snapshots)
+	assert.Equal(t, []string{"snap10"}, included)
+	assert.True(t, partialHistory)
+
+	assert.NoError(t, btrfsValidateSnapshotPattern("snap?"))
+	assert.Error(t, btrfsValidateSnapshotPattern("snap["))
+}
+
+func TestBtrfsExpectReadonly(t *testing.T) {
+	assert.True(t, btrfsExpectReadonly(NewVolume(nil, "pool", VolumeTypeImage, ContentTypeFS, "fingerprint", nil, nil)))
+	assert.True(t, btrfsExpectReadonly(NewVolume(nil, "pool", VolumeTypeContainer, ContentTypeFS, "c1/snap0", nil, nil)))
+	assert.False(t, btrfsExpectReadonly(NewVolume(nil, "pool", VolumeTypeContainer, ContentTypeFS, "c1", nil, nil)))
+	assert.True(t, btrfsExpectReadonly(NewVolume(nil, "pool", VolumeTypeCustom, ContentTypeFS, "vol1", map[string]string{"btrfs.readonly": "true"}, nil)))
+	assert.False(t, btrfsExpectReadonly(NewVolume(nil, "pool", VolumeTypeCustom, ContentTypeFS, "vol1", nil, nil)))
+}
+
+func TestBtrfsQuotaConsistency(t *testing.T) {
+	assert.True(t, btrfsQGroupDataInconsistent("WARNING: qgroup data inconsistent, rescan recommended\n"))
+	assert.False(t, btrfsQGroupDataInconsistent(""))
+
+	assert.True(t, btrfsQuotaRescanRunning("rescan operation running (current key 1234)\n"))
+	assert.False(t, btrfsQuotaRescanRunning("no rescan operation in progress\n"))
+}
+
+func TestBtrfsReadMigrationHeader(t *testing.T) {
+	source, target := net.Pipe()
+
+	go func() {
+		_, _ = source.Write([]byte(`{"subvolumes":[]}`))
+		_ = source.Close()
+	}()
+
+	buf, err := btrfsReadMigrationHeader(target, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"subvolumes":[]}`, string(buf))
+
+	// A source which never ends the frame.
+	source, target = net.Pipe()
+	defer func() { _ = source.Close() }()
+
+	start := time.Now()
+	_, err = btrfsReadMigrationHeader(target, 50*time.Millisecond)
+	assert.ErrorContains(t, err, "Timed out reading migration header")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestBtrfsFragments(t *testing.T) {
+	const mib = 1024 * 1024
+
+	// Contiguous extents.
+	extents := []btrfsExtent{{physical: 0, length: mib}, {physical: mib, length: mib}}
+	runs, minRuns := btrfsFragments(extents)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, 1, minRuns)
+	assert.Equal(t, float64(0), btrfsFragmentation(runs, minRuns))
+
+	// Scattered extents.
+	extents = []btrfsExtent{{physical: 0, length: mib}, {physical: 10 * mib, length: mib}, {physical: 5 * mib, length: mib}, {physical: 20 * mib, length: mib}}
+	runs, minRuns = btrfsFragments(extents)
+	assert.Equal(t, 4, runs)
+	assert.Equal(t, 1, minRuns)
+	assert.Equal(t, 0.75, btrfsFragmentation(runs, minRuns))
+
+	// Compressed extents aren't fragmented.
+	extents = []btrfsExtent{{physical: 0, length: mib, flags: btrfsFiemapExtentEncoded}, {physical: 10 * mib, length: mib, flags: btrfsFiemapExtentEncoded}}
+	runs, minRuns = btrfsFragments(extents)
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, float64(0), btrfsFragmentation(runs, minRuns))
+
+	// Large files need several extents.
+	extents = []btrfsExtent{{physical: 0, length: btrfsMaxExtentSize}, {physical: 2 * btrfsMaxExtentSize, length: btrfsMaxExtentSize}}
+	runs, minRuns = btrfsFragments(extents)
+	assert.Equal(t, 2, runs)
+	assert.Equal(t, 2, minRuns)
+	assert.Equal(t, float64(0), btrfsFragmentation(runs, minRuns))
+
+	runs, minRuns = btrfsFragments(nil)
+	assert.Equal(t, float64(0), btrfsFragmentation(runs, minRuns))
+}
+
+func TestBtrfsEmitEvent(t *testing.T) {
+	d := &btrfs{}
+	d.name = "testpool-events"
+	vol := NewVolume(d, d.name, VolumeTypeCustom, ContentTypeFS, "vol1/snap0", nil, nil)
+
+	// No sink set.
+	d.emitEvent(BTRFSEventSnapshotCreated, vol, nil)
+
+	var events []BTRFSEvent
+	d.SetEventSink(func(event BTRFSEvent) { events = append(events, event) })
+
+	d.emitEvent(BTRFSEventSnapshotCreated, vol, nil)
+	assert.Equal(t, []BTRFSEvent{{Type: BTRFSEventSnapshotCreated, Pool: "testpool-events", VolumeType: VolumeTypeCustom, ContentType: ContentTypeFS, Volume: "vol1/snap0"}}, events)
+
+	// Other pools don't share the sink.
+	other := &btrfs{}
+	other.name = "otherpool-events"
+	other.emitEvent(BTRFSEventVolumeDeleted, vol, nil)
+	assert.Len(t, events, 1)
+
+	d.SetEventSink(nil)
+	d.emitEvent(BTRFSEventSnapshotCreated, vol, errors.New("Failed"))
+	assert.Len(t, events, 1)
+}
+
+func TestBtrfsSubvolumeCreationTime(t *testing.T) {
+	created, err := btrfsSubvolumeCreationTime("\tName: \t\t\tsnap0\n\tCreation time: \t\t2024-01-01 12:00:00 +0100\n")
+	assert.NoError(t, err)
+	assert.True(t, created.Equal(time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)))
+
+	_, err = btrfsSubvolumeCreationTime("\tName: \t\t\tsnap0\n")
+	assert.Error(t, err)
+}
+
+func TestBtrfsEnvironInContainer(t *testing.T) {
+	assert.True(t, btrfsEnvironInContainer([]byte("PATH=/sbin:/bin\x00container=lxc\x00TERM=linux\x00")))
+	assert.False(t, btrfsEnvironInContainer([]byte("PATH=/sbin:/bin\x00TERM=linux\x00")))
+	assert.False(t, btrfsEnvironInContainer([]byte("container=\x00")))
+	assert.False(t, btrfsEnvironInContainer(nil))
+}
+
+func TestBtrfsSnapshotSlot(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// No snapshot was taken recently.
+	wait, next := btrfsSnapshotSlot(time.Time{}, now, time.Second)
+	assert.Equal(t, time.Duration(0), wait)
+	assert.Equal(t, now.Add(time.Second), next)
+
+	// The previous snapshot reserved the pool until later.
+	wait, next = btrfsSnapshotSlot(now.Add(300*time.Millisecond), now, time.Second)
+	assert.Equal(t, 300*time.Millisecond, wait)
+	assert.Equal(t, now.Add(1300*time.Millisecond), next)
+}
+
+func TestBtrfsSnapshotDiagnostics(t *testing.T) {
+	output := "\tName: \t\t\tsnap0\n\tUUID: \t\t\t2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10\n\tParent UUID: \t\t-\n\tReceived UUID: \t\t-\n\tCreation time: \t\t2024-01-01 12:00:00 +0100\n"
+
+	snapDiag, err := btrfsSnapshotDiagnostics("snap0", output)
+	assert.NoError(t, err)
+
+	// The snapshot's identity is inlined next to its creation time.
+	data, err := json.Marshal(snapDiag)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name":"snap0","uuid":"2b1fd2a5-0c6d-9f4b-a1e3-5d8c2f7e6a10","parent_uuid":"","received_uuid":"","creation_time":"2024-01-01T12:00:00+01:00"}`, string(data))
+
+	_, err = btrfsSnapshotDiagnostics("snap0", "\tName: \t\t\tsnap0\n")
+	assert.Error(t, err)
+}
+
+func TestBtrfsMigrationTransport(t *testing.T) {
+	assert.Equal(t, "rsync: optimized transfer not negotiated, the other pool isn't btrfs or doesn't support it", btrfsMigrationTransport(migration.Type{FSType: migration.MigrationFSType_RSYNC}))
+	assert.Equal(t, "btrfs: optimized transfer negotiated with features migration_header, header_subvolumes", btrfsMigrationTransport(migration.Type{FSType: migration.MigrationFSType_BTRFS, Features: []string{"migration_header", "header_subvolumes"}}))
+	assert.Equal(t, "zfs: not supported by btrfs", btrfsMigrationTransport(migration.Type{FSType: migration.MigrationFSType_ZFS}))
+}
+
+func TestBtrfsStaleReceivedSubvolumes(t *testing.T) {
+	received := []string{
+		"containers/c1",
+		"containers-snapshots/c1/snap0",
+		"containers-snapshots/c1/snap1",
+		"containers-snapshots/c1/snap1/nested",
+		"containers-snapshots/c2/snap0",
+		"containers/migration.123/snap0/c1",
+		"containers/migration.456/c1",
+	}
+
+	known := map[string]bool{
+		"containers/c1":                 true,
+		"containers-snapshots/c1/snap0": true,
+	}
+
+	inUse := func(transientRoot string) bool {
+		return transientRoot == "containers/migration.456"
+	}
+
+	// Snapshots of unknown volumes and migration directories in use are left alone.
+	stale := btrfsStaleReceivedSubvolumes(received, known, inUse)
+	assert.Equal(t, []string{"containers-snapshots/c1/snap1", "containers/migration.123/snap0/c1"}, stale)
+}
+
+func TestBtrfsValidSnapName(t *testing.T) {
+	assert.NoError(t, btrfsValidSnapName("snap0"))
+	assert.NoError(t, btrfsValidSnapName(strings.Repeat("a", 255)))
+
+	for _, name := range []string{"", ".", "..", "a/b", "a b", "a\tb", "a\nb", "a\x00b", strings.Repeat("a", 256)} {
+		assert.Error(t, btrfsValidSnapName(name), "name %q", name)
+	}
+}
+
+func TestBtrfsExchangePaths(t *testing.T) {
+	dir := t.TempDir()
+	pathA := filepath.Join(dir, "a")
+	pathB := filepath.Join(dir, "b")
+
+	for _, path := range []string{pathA, pathB} {
+		assert.NoError(t, os.Mkdir(path, 0700))
+		assert.NoError(t, os.WriteFile(filepath.Join(path, "name"), []byte(filepath.Base(path)), 0600))
+	}
+
+	assert.NoError(t, btrfsExchangePaths(pathA, pathB))
+
+	content, err := os.ReadFile(filepath.Join(pathA, "name"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+
+	content, err = os.ReadFile(filepath.Join(pathB, "name"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	// Both paths must exist.
+	assert.Error(t, btrfsExchangePaths(pathA, filepath.Join(dir, "missing")))
+}
+
+func TestBtrfsQuotaVolume(t *testing.T) {
+	d := &btrfs{}
+
+	// Filesystem volumes have their own quota.
+	vol := NewVolume(d, "pool", VolumeTypeCustom, ContentTypeFS, "vol1", map[string]string{"size": "1GiB"}, nil)
+	quotaVol, hasQuota := btrfsQuotaVolume(vol)
+	assert.True(t, hasQuota)
+	assert.Equal(t, "1GiB", quotaVol.ConfigSize())
+
+	// Custom block volumes don't have a quota.
+	vol = NewVolume(d, "pool", VolumeTypeCustom, ContentTypeBlock, "vol1", map[string]string{"size": "1GiB"}, nil)
+	_, hasQuota = btrfsQuotaVolume(vol)
+	assert.False(t, hasQuota)
+
+	// The subvolume of a VM's block volume has the quota of the VM's filesystem volume.
+	vol = NewVolume(d, "pool", VolumeTypeVM, ContentTypeBlock, "vm1", map[string]string{"size": "10GiB", "size.state": "100MiB"}, nil)
+	quotaVol, hasQuota = btrfsQuotaVolume(vol)
+	assert.True(t, hasQuota)
+	assert.Equal(t, ContentTypeFS, quotaVol.contentType)
+	assert.Equal(t, "100MiB", quotaVol.ConfigSize())
+
+	// Which also covers the root disk file.
+	volPath := t.TempDir()
+	f, err := os.Create(filepath.Join(volPath, genericVolumeDiskFile))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Truncate(10*1024*1024))
+	assert.NoError(t, f.Close())
+
+	quotaSize, err := vmFilesystemQuotaSize(volPath, 100*1024*1024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110*1024*1024), quotaSize)
+}
+
+// btrfsTestCancelWriter discards the data written to it, cancelling the operation on the first write.
+type btrfsTestCancelWriter struct {
+	op   *operations.Operation
+	once sync.Once
+}
+
+// Write cancels the operation on the first write and waits for its context to be cancelled.
+func (w *btrfsTestCancelWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		chanCancel, err := w.op.Cancel()
+		if err == nil {
+			<-chanCancel
+		}
+	})
+
+	return len(p), nil
+}
+
+func TestBtrfsBackupVolumeCancelled(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Requires root")
+	}
+
+	_, err := exec.LookPath("btrfs")
+	if err != nil {
+		t.Skip("Requires the btrfs tool")
+	}
+
+	varDir := t.TempDir()
+	fsType, _ := filesystem.Detect(varDir)
+	if fsType != "btrfs" {
+		t.Skip("Requires a temporary directory on btrfs")
+	}
+
+	t.Setenv("LXD_DIR", varDir)
+
+	d := &btrfs{}
+	d.name = "pool"
+	d.logger = logger.AddContext(logger.Ctx{"driver": "btrfs", "pool": d.name})
+
+	vol := NewVolume(d, d.name, VolumeTypeCustom, ContentTypeFS, "vol1", nil, nil)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(vol.MountPath()), 0711))
+
+	_, err = shared.RunCommandContext(context.Background(), "btrfs", "subvolume", "create", vol.MountPath())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Cleanup(func() { _ = d.deleteSubvolume(vol.MountPath(), true) })
+
+	for i := range 10 {
+		assert.NoError(t, os.WriteFile(filepath.Join(vol.MountPath(), fmt.Sprintf("file%d", i)), []byte("data"), 0600))
+	}
+
+	// Run an operation until the test ends, which is cancelled once the backup starts writing the tarball.
+	finished := make(chan struct{})
+	defer close(finished)
+
+	op, err := operations.OperationCreate(context.Background(), nil, "", operations.OperationClassTask, operationtype.CustomVolumeBackupCreate, nil, nil, func(op *operations.Operation) error {
+		<-finished
+		return nil
+	}, func(op *operations.Operation) error { return nil }, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, op.Start())
+
+	tarWriter := instancewriter.NewInstanceTarWriter(&btrfsTestCancelWriter{op: op}, nil)
+	err = d.BackupVolume(NewVolumeCopy(vol), tarWriter, false, nil, op)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The read-only snapshot taken for the backup is removed.
+	leftovers, err := filepath.Glob(filepath.Join(GetPoolMountPath(d.name), "backup.*"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+func TestBtrfsHasVolumeInterruptedFill(t *testing.T) {
+	t.Setenv("LXD_DIR", t.TempDir())
+
+	d := &btrfs{}
+	d.name = "pool"
+	d.logger = logger.AddContext(logger.Ctx{"driver": "btrfs", "pool": d.name})
+
+	vol := NewVolume(d, d.name, VolumeTypeImage, ContentTypeFS, "fingerprint", nil, nil)
+	assert.NoError(t, os.MkdirAll(vol.MountPath(), 0711))
+
+	err := btrfsSetFillMarker(vol.MountPath(), "fingerprint", true)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("Requires a temporary directory supporting user extended attributes")
+	}
+
+	assert.NoError(t, err)
+
+	fingerprint, interrupted := btrfsFillInterrupted(vol.MountPath())
+	assert.True(t, interrupted)
+	assert.Equal(t, "fingerprint", fingerprint)
+
+	// A volume left partially filled is reported as missing.
+	exists, err := d.HasVolume(vol)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// A volume being filled by this process carries the marker too, but isn't reported as interrupted.
+	untrack := btrfsTrackFill(vol.MountPath())
+
+	_, interrupted = btrfsFillInterrupted(vol.MountPath())
+	assert.False(t, interrupted)
+
+	exists, err = d.HasVolume(vol)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	untrack()
+
+	_, interrupted = btrfsFillInterrupted(vol.MountPath())
+	assert.True(t, interrupted)
+
+	assert.NoError(t, btrfsSetFillMarker(vol.MountPath(), "", false))
+
+	exists, err = d.HasVolume(vol)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// btrfsTestFramedConn is an in-memory connection where closing the writing side ends a frame, and reading
+// returns io.EOF at the end of each frame, as with the websocket connections used for migrations.
+type btrfsTestFramedConn struct {
+	frames  chan []byte
+	writing []byte
+	reading []byte
+	inFrame bool
+}
+
+func newBtrfsTestFramedConn() *btrfsTestFramedConn {
+	return &btrfsTestFramedConn{frames: make(chan []byte, 16)}
+}
+
+// Read reads from the current frame, returning io.EOF once the frame has been read.
+func (c *btrfsTestFramedConn) Read(p []byte) (int, error) {
+	if !c.inFrame {
+		c.reading = <-c.frames
+		c.inFrame = true
+	}
+
+	if len(c.reading) == 0 {
+		c.inFrame = false
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.reading)
+	c.reading = c.reading[n:]
+
+	return n, nil
+}
+
+// Write adds p to the current frame.
+func (c *btrfsTestFramedConn) Write(p []byte) (int, error) {
+	c.writing = append(c.writing, p...)
+	return len(p), nil
+}
+
+// Close ends the current frame.
+func (c *btrfsTestFramedConn) Close() error {
+	c.frames <- c.writing
+	c.writing = nil
+	return nil
+}
+
+func TestBtrfsPreCopyFrames(t *testing.T) {
+	conn := newBtrfsTestFramedConn()
+
+	// The source sends two pre-copy rounds followed by the final frame.
+	for _, more := range []bool{true, true, false} {
+		assert.NoError(t, btrfsWritePreCopyFrame(conn, more))
+	}
+
+	for _, want := range []bool{true, true, false} {
+		more, err := btrfsReadPreCopyFrame(conn, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, want, more)
+	}
+
+	// A frame which isn't a pre-copy frame, such as a send stream, desyncs the exchange.
+	_, _ = conn.Write([]byte("btrfs-stream"))
+	_ = conn.Close()
+
+	_, err := btrfsReadPreCopyFrame(conn, time.Second)
+	assert.ErrorContains(t, err, "Failed decoding BTRFS pre-copy frame")
+
+	// Rounds continue until the last one is small enough, up to the maximum number of rounds.
+	assert.True(t, btrfsPreCopyMore(1, btrfsPreCopyConvergedSize+1))
+	assert.False(t, btrfsPreCopyMore(1, btrfsPreCopyConvergedSize))
+	assert.True(t, btrfsPreCopyMore(btrfsPreCopyMaxRounds, btrfsPreCopyConvergedSize+1))
+	assert.False(t, btrfsPreCopyMore(btrfsPreCopyMaxRounds+1, btrfsPreCopyConvergedSize+1))
+}
+
+func TestBtrfsCountingConn(t *testing.T) {
+	conn := newBtrfsTestFramedConn()
+	counter := &btrfsCountingConn{ReadWriteCloser: conn}
+
+	n, err := counter.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	_, err = counter.Write([]byte(" world"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), counter.written)
+
+	// Frames are still ended on the wrapped connection and the data is passed through.
+	assert.NoError(t, counter.Close())
+
+	buf, err := io.ReadAll(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(buf))
+	assert.Equal(t, int64(11), counter.written)
+}
+
+func TestBtrfsSubvolumeLayoutChanged(t *testing.T) {
+	subvolumes := []BTRFSSubVolume{
+		{Path: "/", Snapshot: "snap0"},
+		{Path: "/", Snapshot: ""},
+		{Path: "/var/lib/docker", Snapshot: ""},
+	}
+
+	assert.False(t, btrfsSubvolumeLayoutChanged(subvolumes, map[string]bool{"/": false, "/var/lib/docker": false}))
+
+	// A nested subvolume was created.
+	assert.True(t, btrfsSubvolumeLayoutChanged(subvolumes, map[string]bool{"/": false, "/var/lib/docker": false, "/var/lib/docker/btrfs/subvolumes/a": false}))
+
+	// A nested subvolume was removed.
+	assert.True(t, btrfsSubvolumeLayoutChanged(subvolumes, map[string]bool{"/": false}))
+}
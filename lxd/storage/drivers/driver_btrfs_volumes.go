@@ -8,21 +8,27 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
 
+	"github.com/canonical/lxd/lxd/apparmor"
 	"github.com/canonical/lxd/lxd/archive"
 	"github.com/canonical/lxd/lxd/backup"
 	"github.com/canonical/lxd/lxd/instance/instancetype"
 	"github.com/canonical/lxd/lxd/instancewriter"
+	"github.com/canonical/lxd/lxd/locking"
 	"github.com/canonical/lxd/lxd/migration"
 	"github.com/canonical/lxd/lxd/operations"
+	"github.com/canonical/lxd/lxd/rsync"
 	"github.com/canonical/lxd/lxd/storage/block"
 	"github.com/canonical/lxd/lxd/storage/filesystem"
 	"github.com/canonical/lxd/shared"
@@ -31,27 +37,66 @@ import (
 	"github.com/canonical/lxd/shared/logger"
 	"github.com/canonical/lxd/shared/revert"
 	"github.com/canonical/lxd/shared/units"
+	"github.com/canonical/lxd/shared/validate"
 )
 
 // CreateVolume creates an empty volume and can optionally fill it by executing the supplied filler function.
 func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Operation) error {
+	err := d.createVolume(vol, filler, op)
+	d.emitEvent(BTRFSEventVolumeCreated, vol, err)
+
+	return err
+}
+
+// createVolume creates an empty volume and can optionally fill it by executing the supplied filler function.
+func (d *btrfs) createVolume(vol Volume, filler *VolumeFiller, op *operations.Operation) error {
 	volPath := vol.MountPath()
 
 	// Setup revert.
 	revert := revert.New()
 	defer revert.Fail()
 
-	// Create the volume itself.
-	_, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "create", volPath)
+	err := d.removeInterruptedFill(vol)
+	if err != nil {
+		return err
+	}
+
+	releaseLimit, err := d.checkVolumeLimit(vol)
+	if err != nil {
+		return err
+	}
+
+	defer releaseLimit()
+
+	// Create the volume itself, in the parent quota group if configured.
+	qgroupArgs, err := d.parentQGroupArgs()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"subvolume", "create"}, qgroupArgs...)
+	_, err = shared.RunCommandContext(context.TODO(), "btrfs", append(args, volPath)...)
 	if err != nil {
 		return err
 	}
 
+	// The volume is now counted by checkVolumeLimit through its subvolume.
+	releaseLimit()
+
 	revert.Add(func() {
 		_ = d.deleteSubvolume(volPath, false)
 		_ = os.Remove(volPath)
 	})
 
+	// Apply the pool's default compression before any data is written so that it's inherited by all files.
+	compression := d.config["btrfs.compression"]
+	if compression != "" {
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "property", "set", volPath, "compression", compression)
+		if err != nil {
+			return fmt.Errorf("Failed setting compression property on %q: %w", volPath, err)
+		}
+	}
+
 	// Create sparse loopback file if volume is block.
 	rootBlockPath := ""
 	if IsContentBlock(vol.contentType) {
@@ -67,7 +112,7 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 			return err
 		}
 
-		mountOptions := strings.Split(d.getMountOptions(), ",")
+		mountOptions := btrfsMountOptions(d.getMountOptions(), mountinfo[len(mountinfo)-1])
 
 		// Enable nodatacow on the parent directory so that when the root disk file is created the setting
 		// is inherited and random writes don't cause fragmentation and old extents to be kept.
@@ -79,18 +124,64 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 		// in order to track the difference between original and snapshot. This will increase the size of
 		// data being referenced.
 		//
-		// An exception is made for when compression is enabled on the underlying storage.
-		if !slices.Contains(mountOptions, "datacow") && !strings.Contains(mountinfo[len(mountinfo)-1], "compress") {
+		// An exception is made for when compression is enabled on the underlying storage or the volume.
+		if btrfsUseNodatacow(mountOptions, compression) {
 			_, err = shared.RunCommandContext(context.TODO(), "chattr", "+C", volPath)
 			if err != nil {
 				return fmt.Errorf("Failed setting nodatacow on %q: %w", volPath, err)
 			}
 		}
+
+		// For encrypted volumes the filler writes to the decrypted device of a new LUKS container.
+		if btrfsEncrypted(vol) {
+			sizeBytes, err := units.ParseByteSizeString(vol.ConfigSize())
+			if err != nil {
+				return err
+			}
+
+			err = d.luksFormat(vol, sizeBytes)
+			if err != nil {
+				return err
+			}
+
+			_, err = d.luksOpen(vol)
+			if err != nil {
+				return err
+			}
+
+			// The device is opened again when the volume is mounted.
+			defer func() { _ = d.luksClose(vol) }()
+		}
 	}
 
-	err = d.runFiller(vol, rootBlockPath, filler, false)
-	if err != nil {
-		return err
+	// Limit the number of fillers running concurrently on the pool.
+	if filler != nil && filler.Fill != nil {
+		// Mark the volume as being filled until the fill completes, so that a fill interrupted by a crash
+		// is detected when the volume is created again. While the fill runs the volume is tracked as being
+		// filled by this process so that the marker isn't mistaken for an interrupted fill.
+		untrack := btrfsTrackFill(volPath)
+		defer untrack()
+
+		err = btrfsSetFillMarker(volPath, filler.Fingerprint, true)
+		if err != nil {
+			return err
+		}
+
+		release, err := d.acquireFillSlot(op)
+		if err != nil {
+			return err
+		}
+
+		err = d.runFiller(vol, rootBlockPath, filler, false)
+		release()
+		if err != nil {
+			return err
+		}
+
+		err = btrfsSetFillMarker(volPath, filler.Fingerprint, false)
+		if err != nil {
+			return err
+		}
 	}
 
 	// If we are creating a block volume, resize it to the requested size or the default.
@@ -111,10 +202,12 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 		// accidentally shrinking the filled volume if it is larger than vol.ConfigSize().
 		// In that situation ensureVolumeBlockFile returns ErrCannotBeShrunk, but we ignore it as this just
 		// means the filler run above has needed to increase the volume size beyond the default block
-		// volume size.
-		_, err = ensureVolumeBlockFile(vol, rootBlockPath, sizeBytes, false)
-		if err != nil && !errors.Is(err, ErrCannotBeShrunk) {
-			return err
+		// volume size. Encrypted volumes were already created with the requested size.
+		if !btrfsEncrypted(vol) {
+			_, err = ensureVolumeBlockFile(vol, rootBlockPath, sizeBytes, false)
+			if err != nil && !errors.Is(err, ErrCannotBeShrunk) {
+				return err
+			}
 		}
 
 		// Move the GPT alt header to end of disk if needed and if filler specified.
@@ -124,9 +217,18 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 				return err
 			}
 		}
+
+		// Keep image volumes in qcow2 format if requested to save space. This is done last as the raw disk
+		// has already been resized and had its GPT alt header moved.
+		if vol.volType == VolumeTypeImage && d.config["btrfs.block.format"] == "qcow2" {
+			err = d.convertBlockFile(rootBlockPath, "raw", filepath.Join(volPath, btrfsQcow2DiskFile), "qcow2")
+			if err != nil {
+				return err
+			}
+		}
 	} else if vol.contentType == ContentTypeFS {
 		// Set initial quota for filesystem volumes.
-		err := d.SetVolumeQuota(vol, vol.ConfigSize(), false, op)
+		err := d.setInitialQuota(vol, op)
 		if err != nil {
 			return err
 		}
@@ -150,13 +252,149 @@ func (d *btrfs) CreateVolume(vol Volume, filler *VolumeFiller, op *operations.Op
 	return nil
 }
 
+// PreflightCreateVolume checks whether CreateVolume is likely to succeed for the volume, without changing
+// anything. On top of validating the config it checks that the btrfs tooling is available, that the volume
+// doesn't exist yet and that the pool has the space and quota support required by the volume's size.
+// All failed checks are reported rather than only the first one.
+func (d *btrfs) PreflightCreateVolume(vol Volume) error {
+	errs := []error{}
+
+	err := d.ValidateVolume(vol, false)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	_, err = exec.LookPath("btrfs")
+	if err != nil {
+		errs = append(errs, errors.New("The btrfs tool isn't available"))
+	}
+
+	volPath := vol.MountPath()
+	if shared.PathExists(volPath) {
+		errs = append(errs, fmt.Errorf("Volume path %q already exists", volPath))
+	}
+
+	sizeBytes, err := units.ParseByteSizeString(vol.ConfigSize())
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Invalid volume size: %w", err))
+	}
+
+	if sizeBytes > 0 {
+		res, err := d.GetResources()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed getting pool resources: %w", err))
+		} else if uint64(sizeBytes) > res.Space.Total-res.Space.Used {
+			errs = append(errs, fmt.Errorf("Not enough free space in pool for volume size %q", vol.ConfigSize()))
+		}
+
+		// Filesystem volumes are limited using quotas, which get enabled on demand unless running in a
+		// user namespace.
+		if vol.contentType != ContentTypeBlock && d.state.OS.RunningInUserNS {
+			_, _, err := d.getQGroup(GetPoolMountPath(d.name))
+			if err == errBtrfsNoQuota {
+				errs = append(errs, errors.New("Quotas are disabled on the pool and can't be enabled in a user namespace"))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Preflight checks for volume %q failed: %w", vol.name, errors.Join(errs...))
+	}
+
+	return nil
+}
+
 // CreateVolumeFromBackup restores a backup tarball onto the storage device.
+// The volume and its snapshots are restored under the name of vol, which may differ from the name the backup
+// was taken of (srcBackup.Name), for example to restore it alongside the original volume. This works because
+// neither the files in the tarball nor the subvolumes in its optimized header are named after the volume.
 func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (VolumePostHook, revert.Hook, error) {
 	// Handle the non-optimized tarballs through the generic unpacker.
 	if !*srcBackup.OptimizedStorage {
 		return genericVFSBackupUnpack(d, d.state, vol, srcBackup.Snapshots, srcData, op)
 	}
 
+	return d.createVolumeFromBackup(vol, vol.volType, vol.contentType, srcBackup, srcData, op)
+}
+
+// CreateVolumeFromBackupAs restores the volume of the given type from an optimized backup tarball as a volume
+// of a different type. Only the conversions allowed by btrfsValidateBackupConversion are supported, such as
+// restoring the config volume of a VM as a custom volume to inspect it. The VM's root disk file is not
+// restored in that case.
+func (d *btrfs) CreateVolumeFromBackupAs(vol VolumeCopy, srcVolType VolumeType, srcContentType ContentType, srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (VolumePostHook, revert.Hook, error) {
+	err := btrfsValidateBackupConversion(srcVolType, srcContentType, vol.Volume)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !*srcBackup.OptimizedStorage {
+		return nil, nil, fmt.Errorf("Restoring as a different volume type requires an optimized backup: %w", ErrNotSupported)
+	}
+
+	return d.createVolumeFromBackup(vol, srcVolType, srcContentType, srcBackup, srcData, op)
+}
+
+// BackupRestoreRequirements returns the requirements for restoring the backup tarball which this host doesn't
+// meet, so that restores which would fail midway can be refused upfront. The list is empty if the backup can be
+// restored. For optimized backups this checks the tools needed to read the tarball and the requirements of the
+// volume recorded in the optimized header, such as its compression algorithm and encryption.
+func (d *btrfs) BackupRestoreRequirements(srcData io.ReadSeeker, srcBackup backup.Info) ([]string, error) {
+	unmet := []string{}
+
+	optimized := srcBackup.OptimizedStorage != nil && *srcBackup.OptimizedStorage
+	if optimized && srcBackup.Backend != d.Info().Name {
+		return append(unmet, fmt.Sprintf("Optimized backup of a %q storage pool", srcBackup.Backend)), nil
+	}
+
+	_, err := srcData.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, unpacker, err := shared.DetectCompressionFile(srcData)
+	if err != nil {
+		return append(unmet, "Supported backup compression"), nil
+	}
+
+	if len(unpacker) > 0 {
+		_, err = exec.LookPath(unpacker[0])
+		if err != nil {
+			return append(unmet, fmt.Sprintf("The %q tool to decompress the backup", unpacker[0])), nil
+		}
+	}
+
+	if !optimized || srcBackup.OptimizedHeader == nil || !*srcBackup.OptimizedHeader {
+		return unmet, nil
+	}
+
+	header, err := d.loadOptimizedBackupHeader(srcData, GetPoolMountPath(d.name))
+	if err != nil {
+		return nil, err
+	}
+
+	kernelFeatures, err := btrfsLoadKernelFeatures()
+	if err != nil {
+		return nil, err
+	}
+
+	unmet = append(unmet, btrfsUnmetBackupRequirements(header, kernelFeatures)...)
+
+	if header.Volume != nil && shared.IsTrue(header.Volume.Config["btrfs.block.encryption"]) {
+		_, err = exec.LookPath("cryptsetup")
+		if err != nil {
+			unmet = append(unmet, "The \"cryptsetup\" tool for the encrypted volume")
+		}
+
+		if d.config["btrfs.block.encryption.key_file"] == "" {
+			unmet = append(unmet, "A key file in btrfs.block.encryption.key_file for the encrypted volume")
+		}
+	}
+
+	return unmet, nil
+}
+
+// createVolumeFromBackup restores the volume of the given type from an optimized backup tarball.
+func (d *btrfs) createVolumeFromBackup(vol VolumeCopy, srcVolType VolumeType, srcContentType ContentType, srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (VolumePostHook, revert.Hook, error) {
 	volExists, err := d.HasVolume(vol.Volume)
 	if err != nil {
 		return nil, nil, err
@@ -166,6 +404,13 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		return nil, nil, errors.New("Cannot restore volume, already exists on target")
 	}
 
+	releaseLimit, err := d.checkVolumeLimit(vol.Volume)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer releaseLimit()
+
 	revert := revert.New()
 	defer revert.Fail()
 
@@ -179,7 +424,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		}
 
 		// And lastly the main volume.
-		_ = d.DeleteVolume(vol.Volume, op)
+		_ = d.deleteVolume(vol.Volume, op)
 	}
 	// Only execute the revert function if we have had an error internally.
 	revert.Add(revertHook)
@@ -202,6 +447,11 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		if err != nil {
 			return nil, nil, err
 		}
+
+		err = btrfsCheckBackupFormatVersion(optimizedHeader.FormatVersion)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Populate optimized header with pseudo data for unified handling when backup doesn't contain the
@@ -223,6 +473,12 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		})
 	}
 
+	// Check the tarball contains all the subvolumes before receiving any of them.
+	err = d.checkBackupEntries(srcData, unpacker, vol.Volume, srcVolType, srcContentType, srcBackup.Snapshots, optimizedHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Create a temporary directory to unpack the backup into.
 	tmpUnpackDir, err := os.MkdirTemp(GetVolumeMountPath(d.name, vol.volType, ""), "backup.")
 	if err != nil {
@@ -231,6 +487,9 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 
 	defer func() { _ = os.RemoveAll(tmpUnpackDir) }()
 
+	untrack := btrfsTrackTransientPath(tmpUnpackDir)
+	defer untrack()
+
 	err = os.Chmod(tmpUnpackDir, 0100)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed to chmod temporary directory %q: %w", tmpUnpackDir, err)
@@ -256,7 +515,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 			}
 
 			if hdr.Name == srcFile {
-				subVolRecvPath, err := d.receiveSubVolume(tr, targetPath, nil)
+				subVolRecvPath, err := d.receiveSubVolume(tr, targetPath, nil, false)
 				if err != nil {
 					return "", err
 				}
@@ -286,12 +545,7 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 			}
 
 			// Figure out what file we are looking for in the backup file.
-			srcFilePath := filepath.Join("backup", srcFilePrefix+".bin")
-			if subVol.Path != string(filepath.Separator) {
-				// If subvolume is non-root, then we expect the file to be encoded as its original
-				// path with the leading / removed.
-				srcFilePath = filepath.Join("backup", srcFilePrefix+"_"+filesystem.PathNameEncode(strings.TrimPrefix(subVol.Path, string(filepath.Separator)))+".bin")
-			}
+			srcFilePath := btrfsBackupFilePath(srcFilePrefix, subVol.Path)
 
 			// Define where we will move the subvolume after it is unpacked.
 			subVolTargetPath := filepath.Join(v.MountPath(), subVol.Path)
@@ -330,27 +584,13 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		// Restore backup snapshots from oldest to newest.
 		for _, snapName := range srcBackup.Snapshots {
 			// Defend against path traversal attacks.
-			err := instancetype.ValidSnapName(snapName)
+			err := btrfsValidSnapName(snapName)
 			if err != nil {
-				return nil, nil, fmt.Errorf("Invalid snapshot name %q: %w", snapName, err)
+				return nil, nil, err
 			}
 
 			snapVol, _ := vol.NewSnapshot(snapName)
-			snapDir := "snapshots"
-			srcFilePrefix := snapName
-			switch vol.volType {
-			case VolumeTypeVM:
-				snapDir = "virtual-machine-snapshots"
-				if vol.contentType == ContentTypeFS {
-					srcFilePrefix = snapName + "-config"
-				}
-
-			case VolumeTypeCustom:
-				snapDir = "volume-snapshots"
-			}
-
-			srcFilePrefix = filepath.Join(snapDir, srcFilePrefix)
-			err = unpackVolume(snapVol, srcFilePrefix)
+			err = unpackVolume(snapVol, btrfsBackupFilePrefix(srcVolType, srcContentType, snapName))
 			if err != nil {
 				return nil, nil, err
 			}
@@ -358,24 +598,16 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 	}
 
 	// Extract main volume.
-	srcFilePrefix := "container"
-	switch vol.volType {
-	case VolumeTypeVM:
-		if vol.contentType == ContentTypeFS {
-			srcFilePrefix = "virtual-machine-config"
-		} else {
-			srcFilePrefix = "virtual-machine"
-		}
-
-	case VolumeTypeCustom:
-		srcFilePrefix = "volume"
-	}
-
-	err = unpackVolume(vol.Volume, srcFilePrefix)
+	err = unpackVolume(vol.Volume, btrfsBackupFilePrefix(srcVolType, srcContentType, ""))
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// When deferring the quota, it is only established once all subvolumes are in place rather than as soon
+	// as the main volume is, so the remaining subvolumes aren't moved and updated under an active limit.
+	quotaSize := restoreQuotaSize(vol.Volume, optimizedHeader.Volume)
+	deferQuota := shared.IsTrue(d.config["btrfs.quota.defer_restore"])
+
 	for _, copyOp := range copyOps {
 		err = d.setSubvolumeReadonlyProperty(copyOp.src, false)
 		if err != nil {
@@ -390,14 +622,44 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		if err != nil {
 			return nil, nil, err
 		}
+
+		// The config volume of a VM shares its subvolume with the root disk file, which doesn't belong
+		// in a volume of another type.
+		if srcVolType == VolumeTypeVM && vol.volType != VolumeTypeVM {
+			err = os.Remove(filepath.Join(copyOp.dest, genericVolumeDiskFile))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, nil, err
+			}
+		}
+
+		if quotaSize != "" && !deferQuota && copyOp.dest == vol.MountPath() {
+			err = d.SetVolumeQuota(vol.Volume, quotaSize, false, op)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Reapply the volume's settings if included in the backup (older backups don't have them).
+	if optimizedHeader.Volume != nil {
+		err = d.applyVolumeSettings(vol.Volume, optimizedHeader.Volume)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Restore readonly property on subvolumes that need it.
+	writableSubvolumes := shared.IsTrue(d.config["btrfs.restore.writable_subvolumes"])
 	for _, subVol := range optimizedHeader.Subvolumes {
 		if !subVol.Readonly {
 			continue // All subvolumes are made writable during unpack process so we can skip these.
 		}
 
+		if writableSubvolumes && subVol.Snapshot == "" && subVol.Path != string(filepath.Separator) {
+			d.logger.Debug("Leaving subvolume writable", logger.Ctx{"name": vol.name, "path": subVol.Path})
+			continue
+		}
+
 		v := vol.Volume
 		if subVol.Snapshot != "" {
 			v, _ = vol.NewSnapshot(subVol.Snapshot)
@@ -411,6 +673,14 @@ func (d *btrfs) CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, sr
 		}
 	}
 
+	if quotaSize != "" && deferQuota {
+		d.logger.Debug("Applying deferred quota", logger.Ctx{"name": vol.name, "size": quotaSize})
+		err = d.SetVolumeQuota(vol.Volume, quotaSize, false, op)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	revert.Success()
 	return nil, revertHook, nil
 }
@@ -421,6 +691,15 @@ func (d *btrfs) createVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInc
 	revert := revert.New()
 	defer revert.Fail()
 
+	for _, snapVol := range vol.Snapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(snapVol.name)
+
+		err := btrfsValidSnapName(snapName)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Scan source for subvolumes (so we can apply the readonly properties on the new volume).
 	subVols, err := d.getSubvolumesMetaData(srcVol.Volume)
 	if err != nil {
@@ -429,6 +708,15 @@ func (d *btrfs) createVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInc
 
 	target := vol.MountPath()
 
+	if !refresh {
+		releaseLimit, err := d.checkVolumeLimit(vol.Volume)
+		if err != nil {
+			return err
+		}
+
+		defer releaseLimit()
+	}
+
 	// In case of refresh first delete the main volume.
 	if refresh {
 		err := d.deleteSubvolume(target, true)
@@ -461,6 +749,27 @@ func (d *btrfs) createVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInc
 		}
 	}
 
+	// Instances can only use raw disks, so convert the disk of an image volume kept in qcow2 format.
+	qcow2Path := filepath.Join(target, btrfsQcow2DiskFile)
+	if vol.volType != VolumeTypeImage && IsContentBlock(vol.contentType) && shared.PathExists(qcow2Path) {
+		err = d.convertBlockFile(qcow2Path, "qcow2", filepath.Join(target, genericVolumeDiskFile), "raw")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Encrypt the disk when creating an encrypted volume from an unencrypted one, such as an image.
+	if btrfsEncrypted(vol.Volume) != btrfsEncrypted(srcVol.Volume) {
+		if !btrfsEncrypted(vol.Volume) {
+			return fmt.Errorf("Cannot create an unencrypted copy of an encrypted volume: %w", ErrNotSupported)
+		}
+
+		err = d.encryptBlockFile(vol.Volume)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Resize volume to the size specified. Only uses volume "size" property and does not use pool/defaults
 	// to give the caller more control over the size being used.
 	err = d.SetVolumeQuota(vol.Volume, vol.config["size"], false, op)
@@ -474,6 +783,19 @@ func (d *btrfs) createVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInc
 		return err
 	}
 
+	err = d.copyVolumeSnapshots(vol, srcVol, refresh, revert, op)
+	if err != nil {
+		return err
+	}
+
+	revert.Success()
+	return nil
+}
+
+// copyVolumeSnapshots copies the snapshots of srcVol that are requested in vol.Snapshots.
+// When refreshing, snapshots which already exist on the target volume are skipped.
+func (d *btrfs) copyVolumeSnapshots(vol VolumeCopy, srcVol VolumeCopy, refresh bool, revert *revert.Reverter, op *operations.Operation) error {
+	var err error
 	var snapshots []string
 
 	// Get snapshot list if copying snapshots.
@@ -540,35 +862,197 @@ func (d *btrfs) createVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInc
 		}
 	}
 
-	revert.Success()
 	return nil
 }
 
-// CreateVolumeFromCopy provides same-pool volume copying functionality.
-func (d *btrfs) CreateVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInconsistent bool, op *operations.Operation) error {
-	return d.createVolumeFromCopy(vol, srcVol, allowInconsistent, false, op)
-}
+// refreshVMBlockVolume refreshes the config files and root disk file of an existing VM block volume, by syncing
+// the config files and reflinking the raw disk file from the source volume. Unlike createVolumeFromCopy this
+// keeps the target's subvolume, so the snapshots taken of it remain intact.
+func (d *btrfs) refreshVMBlockVolume(vol VolumeCopy, srcVol VolumeCopy, refreshSnapshots []string, op *operations.Operation) error {
+	revert := revert.New()
+	defer revert.Fail()
 
-// CreateVolumeFromMigration creates a volume being sent via a migration.
-func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteCloser, volTargetArgs migration.VolumeTargetArgs, preFiller *VolumeFiller, op *operations.Operation) error {
-	// Handle simple rsync and block_and_rsync through generic.
-	if volTargetArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || volTargetArgs.MigrationType.FSType == migration.MigrationFSType_BLOCK_AND_RSYNC {
-		_, err := genericVFSCreateVolumeFromMigration(d, nil, vol, conn, volTargetArgs, preFiller, op)
-		return err
-	} else if volTargetArgs.MigrationType.FSType != migration.MigrationFSType_BTRFS {
-		return ErrNotSupported
+	// Sync the config files, leaving the root disk file to be reflinked below.
+	bwlimit := d.config["rsync.bwlimit"]
+	_, err := rsync.LocalCopy(srcVol.MountPath(), vol.MountPath(), bwlimit, true, "--exclude", genericVolumeDiskFile)
+	if err != nil {
+		return fmt.Errorf("Failed to rsync volume: %w", err)
 	}
 
-	var migrationHeader BTRFSMetaDataHeader
+	// Both disk files are resolved explicitly as the source may be an image volume kept in qcow2 format,
+	// which can't be reflinked into a raw disk file.
+	srcDiskPath := filepath.Join(srcVol.MountPath(), genericVolumeDiskFile)
+	diskPath := filepath.Join(vol.MountPath(), genericVolumeDiskFile)
 
-	// List of subvolumes to be synced. This is sent back to the source.
-	var syncSubvolumes []BTRFSSubVolume
+	d.logger.Debug("Refreshing block volume using reflink", logger.Ctx{"name": vol.name, "srcPath": srcDiskPath, "path": diskPath})
 
-	// Inspect negotiated features to see if we are expecting to get a metadata migration header frame.
-	if slices.Contains(volTargetArgs.MigrationType.Features, migration.BTRFSFeatureMigrationHeader) {
-		buf, err := io.ReadAll(conn)
+	// Keep the current disk file until the refresh has succeeded, so it can be restored on failure.
+	oldDiskPath := diskPath + ".old"
+	err = os.Rename(diskPath, oldDiskPath)
+	if err != nil {
+		return fmt.Errorf("Failed renaming %q to %q: %w", diskPath, oldDiskPath, err)
+	}
+
+	revert.Add(func() { _ = os.Rename(oldDiskPath, diskPath) })
+
+	err = btrfsReflinkFile(srcDiskPath, diskPath)
+	if err != nil {
+		return err
+	}
+
+	// The reflinked file has the size of the source disk, so resize it to the size specified. Only uses
+	// volume "size" property and does not use pool/defaults to give the caller more control over the size
+	// being used.
+	err = d.SetVolumeQuota(vol.Volume, vol.config["size"], false, op)
+	if err != nil {
+		return err
+	}
+
+	// Only copy the snapshots which are missing on the target.
+	if len(refreshSnapshots) > 0 {
+		err = d.copyVolumeSnapshots(vol, srcVol, true, revert, op)
 		if err != nil {
-			return fmt.Errorf("Failed reading BTRFS migration header: %w", err)
+			return err
+		}
+	}
+
+	err = os.Remove(oldDiskPath)
+	if err != nil {
+		return fmt.Errorf("Failed removing %q: %w", oldDiskPath, err)
+	}
+
+	revert.Success()
+	return nil
+}
+
+// CreateVolumeFromCopy provides same-pool volume copying functionality.
+func (d *btrfs) CreateVolumeFromCopy(vol VolumeCopy, srcVol VolumeCopy, allowInconsistent bool, op *operations.Operation) error {
+	return d.createVolumeFromCopy(vol, srcVol, allowInconsistent, false, op)
+}
+
+// CreateVolumesFromImage creates the target volumes from an image volume in one pass, such as when creating
+// many instances from the same image. Each target is a writable snapshot of the image's subvolume with its own
+// quota applied, so it shares the image's data until modified but is otherwise independent of the image and of
+// the other targets. If any target fails, the targets created so far are deleted.
+func (d *btrfs) CreateVolumesFromImage(image Volume, targets []Volume, op *operations.Operation) error {
+	if image.volType != VolumeTypeImage {
+		return fmt.Errorf("Volume %q isn't an image", image.name)
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	for _, target := range targets {
+		if target.contentType != image.contentType {
+			return fmt.Errorf("Volume %q has content type %q, which doesn't match the image's %q", target.name, target.contentType, image.contentType)
+		}
+
+		if shared.PathExists(target.MountPath()) {
+			return fmt.Errorf("Volume %q already exists", target.name)
+		}
+
+		err := d.createVolumeFromCopy(NewVolumeCopy(target), NewVolumeCopy(image), false, false, op)
+		if err != nil {
+			return fmt.Errorf("Failed creating volume %q from image: %w", target.name, err)
+		}
+
+		revert.Add(func() { _ = d.deleteVolume(target, op) })
+	}
+
+	revert.Success()
+	return nil
+}
+
+// ImageReferences returns the names of the instance volumes created from the image volume, which are found by
+// following the parent UUIDs of their subvolumes back to the image's subvolume. Instance volumes restored from
+// their own snapshots are still included, but those which were fully copied (for example by migration or a
+// copy from another pool) no longer reference the image and aren't.
+func (d *btrfs) ImageReferences(imageVol Volume) ([]string, error) {
+	if imageVol.volType != VolumeTypeImage {
+		return nil, errors.New("Volume must be an image")
+	}
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", imageVol.MountPath())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	imageUUID := btrfsSnapshotUUIDInfo("", output).UUID
+	if imageUUID == "" {
+		return nil, fmt.Errorf("Failed to find UUID of image volume %q", imageVol.name)
+	}
+
+	poolMountPath := GetPoolMountPath(d.name)
+
+	output, err = shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "list", "-q", "-u", poolMountPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing subvolumes: %w", err)
+	}
+
+	names := []string{}
+
+	for _, listPath := range btrfsSubvolumeDescendants(output, imageUUID) {
+		relPath, found := d.poolRelativeSubvolumePath(listPath)
+		if !found {
+			continue
+		}
+
+		// Only consider the main subvolume of instance volumes, skipping their snapshots, nested subvolumes
+		// and the temporary subvolumes of ongoing operations.
+		parts := strings.Split(relPath, "/")
+		if len(parts) != 2 || (parts[0] != BaseDirectories[VolumeTypeContainer][0] && parts[0] != BaseDirectories[VolumeTypeVM][0]) {
+			continue
+		}
+
+		_, isVolume := btrfsClassifySubvolume(relPath)
+		if !isVolume || slices.Contains(names, parts[1]) {
+			continue
+		}
+
+		names = append(names, parts[1])
+	}
+
+	return names, nil
+}
+
+// CreateVolumeFromMigration creates a volume being sent via a migration.
+func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteCloser, volTargetArgs migration.VolumeTargetArgs, preFiller *VolumeFiller, op *operations.Operation) error {
+	d.reportMigrationTransport(vol.Volume, volTargetArgs.MigrationType, op)
+
+	for _, snapName := range volTargetArgs.Snapshots {
+		err := btrfsValidSnapName(snapName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Handle simple rsync and block_and_rsync through generic.
+	if volTargetArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || volTargetArgs.MigrationType.FSType == migration.MigrationFSType_BLOCK_AND_RSYNC {
+		_, err := genericVFSCreateVolumeFromMigration(d, nil, vol, conn, volTargetArgs, preFiller, op)
+		return err
+	} else if volTargetArgs.MigrationType.FSType != migration.MigrationFSType_BTRFS {
+		return ErrNotSupported
+	}
+
+	if !volTargetArgs.Refresh {
+		releaseLimit, err := d.checkVolumeLimit(vol.Volume)
+		if err != nil {
+			return err
+		}
+
+		defer releaseLimit()
+	}
+
+	var migrationHeader BTRFSMetaDataHeader
+
+	// List of subvolumes to be synced. This is sent back to the source.
+	var syncSubvolumes []BTRFSSubVolume
+
+	// Inspect negotiated features to see if we are expecting to get a metadata migration header frame.
+	if slices.Contains(volTargetArgs.MigrationType.Features, migration.BTRFSFeatureMigrationHeader) {
+		buf, err := btrfsReadMigrationHeader(conn, d.migrationHeaderTimeout())
+		if err != nil {
+			return fmt.Errorf("Failed reading BTRFS migration header: %w", err)
 		}
 
 		err = json.Unmarshal(buf, &migrationHeader)
@@ -606,6 +1090,9 @@ func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteClose
 		// Map of local subvolumes with their received UUID.
 		localSubvolumes := make(map[string]string)
 
+		// Whether any snapshot exists on both sides, in which case all subvolumes are sent as differences.
+		haveParent := false
+
 		for _, snap := range snapshots {
 			snapVol, _ := vol.NewSnapshot(snap)
 
@@ -614,6 +1101,12 @@ func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteClose
 				return err
 			}
 
+			// The received UUID of a marked snapshot can't be relied on, so it's transferred again.
+			if btrfsIncrementalDisabled(snapVol.MountPath()) {
+				d.logger.Warn("Snapshot has no valid received UUID, transferring it in full", logger.Ctx{"name": snapVol.name})
+				receivedUUID = ""
+			}
+
 			localSubvolumes[snap] = receivedUUID
 		}
 
@@ -622,6 +1115,7 @@ func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteClose
 			receivedUUID, ok := localSubvolumes[migrationSnap.Snapshot]
 			// Skip this snapshot as it exists on both the source and target, and has the same GUID.
 			if ok && receivedUUID == migrationSnap.UUID {
+				haveParent = true
 				continue
 			}
 
@@ -629,7 +1123,13 @@ func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteClose
 				volTargetArgs.Snapshots = append(volTargetArgs.Snapshots, migrationSnap.Snapshot)
 			}
 
-			syncSubvolumes = append(syncSubvolumes, BTRFSSubVolume{Path: migrationSnap.Path, Snapshot: migrationSnap.Snapshot, UUID: migrationSnap.UUID})
+			syncSubvolumes = append(syncSubvolumes, BTRFSSubVolume{Path: migrationSnap.Path, Snapshot: migrationSnap.Snapshot, UUID: migrationSnap.UUID, Size: migrationSnap.Size, ExclusiveSize: migrationSnap.ExclusiveSize})
+		}
+
+		// Reject the migration before anything is sent if there isn't enough space to receive it.
+		err = d.checkMigrationSpace(vol.Volume, syncSubvolumes, haveParent)
+		if err != nil {
+			return err
 		}
 
 		migrationHeader = BTRFSMetaDataHeader{Subvolumes: syncSubvolumes}
@@ -652,6 +1152,12 @@ func (d *btrfs) CreateVolumeFromMigration(vol VolumeCopy, conn io.ReadWriteClose
 		d.logger.Debug("Sent BTRFS migration meta data header", logger.Ctx{"name": vol.name, "header": migrationHeader})
 	} else {
 		syncSubvolumes = migrationHeader.Subvolumes
+
+		// Reject the migration before anything is received if there isn't enough space to receive it.
+		err := d.checkMigrationSpace(vol.Volume, syncSubvolumes, false)
+		if err != nil {
+			return err
+		}
 	}
 
 	return d.createVolumeFromMigrationOptimized(vol.Volume, conn, volTargetArgs, preFiller, syncSubvolumes, op)
@@ -696,7 +1202,7 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 			subVolTargetPath := filepath.Join(v.MountPath(), subVol.Path)
 			d.logger.Debug("Receiving volume", logger.Ctx{"name": v.name, "receivePath": receivePath, "path": subVolTargetPath})
 
-			subVolRecvPath, err := d.receiveSubVolume(conn, receivePath, wrapper)
+			subVolRecvPath, err := d.receiveSubVolume(conn, receivePath, wrapper, true)
 			if err != nil {
 				return err
 			}
@@ -733,6 +1239,9 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 
 	defer func() { _ = os.RemoveAll(tmpVolumesMountPoint) }()
 
+	untrack := btrfsTrackTransientPath(tmpVolumesMountPoint)
+	defer untrack()
+
 	err = os.Chmod(tmpVolumesMountPoint, 0100)
 	if err != nil {
 		return fmt.Errorf("Failed to chmod %q: %w", tmpVolumesMountPoint, err)
@@ -759,11 +1268,59 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 	}
 
 	// Receive main volume.
+	mainCopyOps := len(copyOps)
 	err = receiveVolume(vol, tmpVolumesMountPoint)
 	if err != nil {
 		return err
 	}
 
+	// A volume sent while in use is followed by differential sends of the changes made meanwhile, first in
+	// pre-copy rounds and then in the final sync once it's no longer in use. Each is received into its own
+	// directory as the subvolumes have the same names, and replaces the previous one which was its parent.
+	if volTargetArgs.Live && slices.Contains(volTargetArgs.MigrationType.Features, migration.BTRFSFeatureMultiSync) {
+		receiveRound := func(name string) error {
+			prevCopyOps := slices.Clone(copyOps[mainCopyOps:])
+			copyOps = copyOps[:mainCopyOps]
+
+			err := receiveVolume(vol, filepath.Join(tmpVolumesMountPoint, name))
+			if err != nil {
+				return err
+			}
+
+			for _, op := range prevCopyOps {
+				err = d.deleteSubvolume(op.src, true)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+		for round := 1; ; round++ {
+			more, err := btrfsReadPreCopyFrame(conn, d.migrationHeaderTimeout())
+			if err != nil {
+				return err
+			}
+
+			if !more {
+				break
+			}
+
+			err = receiveRound("round." + strconv.Itoa(round))
+			if err != nil {
+				return err
+			}
+		}
+
+		d.logger.Debug("Receiving final sync of volume", logger.Ctx{"name": vol.name})
+
+		err = receiveRound("final")
+		if err != nil {
+			return err
+		}
+	}
+
 	if volTargetArgs.Refresh {
 		// Delete main volume after receiving it.
 		err = d.deleteSubvolume(vol.MountPath(), true)
@@ -793,9 +1350,9 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 		// incremental streams (error: "cannot find parent subvolume").
 		// Setting the "Received UUID" field to the value of the received subvolume (before making
 		// it rw) solves this issue.
-		err = setReceivedUUID(op.dest, op.receivedUUID)
+		err = d.setReceivedUUIDChecked(op.dest, op.receivedUUID)
 		if err != nil {
-			return fmt.Errorf("Failed setting received UUID: %w", err)
+			return err
 		}
 	}
 
@@ -818,6 +1375,37 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 		}
 	}
 
+	// Compare the content of the received volume with the hash computed by the source.
+	if volTargetArgs.VerifyContent {
+		buf, err := io.ReadAll(conn)
+		if err != nil {
+			return fmt.Errorf("Failed reading BTRFS content hash: %w", err)
+		}
+
+		hash, err := d.contentHash(vol.MountPath())
+		if err != nil {
+			return err
+		}
+
+		if string(buf) != hash {
+			return fmt.Errorf("Content of migrated volume %q doesn't match source (source hash %q, target hash %q)", vol.name, string(buf), hash)
+		}
+
+		d.logger.Debug("Verified BTRFS content hash", logger.Ctx{"name": vol.name, "hash": hash})
+
+		if op != nil {
+			_ = op.ExtendMetadata(map[string]any{"fs_verification": "sha256:" + hash})
+		}
+	}
+
+	// Received subvolumes keep the compression of the source, unless asked to recompress them.
+	if shared.IsTrue(d.config["btrfs.compression.recompress"]) {
+		err = d.recompressVolume(vol)
+		if err != nil {
+			return err
+		}
+	}
+
 	if vol.contentType == ContentTypeFS {
 		// Apply the size limit.
 		err = d.SetVolumeQuota(vol, vol.ConfigSize(), false, op)
@@ -832,12 +1420,26 @@ func (d *btrfs) createVolumeFromMigrationOptimized(vol Volume, conn io.ReadWrite
 
 // RefreshVolume provides same-pool volume and specific snapshots syncing functionality.
 func (d *btrfs) RefreshVolume(vol VolumeCopy, srcVol VolumeCopy, refreshSnapshots []string, allowInconsistent bool, op *operations.Operation) error {
+	// Refresh VM block volumes in place if the source has a raw disk file to reflink.
+	if vol.IsVMBlock() && shared.PathExists(vol.MountPath()) && shared.PathExists(filepath.Join(srcVol.MountPath(), genericVolumeDiskFile)) {
+		return d.refreshVMBlockVolume(vol, srcVol, refreshSnapshots, op)
+	}
+
 	return d.createVolumeFromCopy(vol, srcVol, allowInconsistent, true, op)
 }
 
 // DeleteVolume deletes a volume of the storage device. If any snapshots of the volume remain then
 // this function will return an error.
 func (d *btrfs) DeleteVolume(vol Volume, op *operations.Operation) error {
+	err := d.deleteVolume(vol, op)
+	d.emitEvent(BTRFSEventVolumeDeleted, vol, err)
+
+	return err
+}
+
+// deleteVolume deletes a volume of the storage device, returning an error if any snapshots of the volume remain.
+// This is also used to revert partially created volumes, for which no event is emitted.
+func (d *btrfs) deleteVolume(vol Volume, op *operations.Operation) error {
 	// Check that we don't have snapshots.
 	snapshots, err := d.VolumeSnapshots(vol, op)
 	if err != nil {
@@ -860,6 +1462,12 @@ func (d *btrfs) DeleteVolume(vol Volume, op *operations.Operation) error {
 		return nil
 	}
 
+	// Make sure the disk file of an encrypted volume isn't in use anymore.
+	err = d.luksClose(vol)
+	if err != nil {
+		return err
+	}
+
 	// Delete the volume (and any subvolumes).
 	err = d.deleteSubvolume(volPath, true)
 	if err != nil {
@@ -868,7 +1476,7 @@ func (d *btrfs) DeleteVolume(vol Volume, op *operations.Operation) error {
 
 	// Although the volume snapshot directory should already be removed, lets remove it here
 	// to just in case the top-level directory is left.
-	err = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, volName)
+	err = d.deleteParentSnapshotDir(vol.volType, volName)
 	if err != nil {
 		return err
 	}
@@ -878,16 +1486,109 @@ func (d *btrfs) DeleteVolume(vol Volume, op *operations.Operation) error {
 
 // HasVolume indicates whether a specific volume exists on the storage pool.
 func (d *btrfs) HasVolume(vol Volume) (bool, error) {
-	return genericVFSHasVolume(vol)
+	exists, err := genericVFSHasVolume(vol)
+	if err != nil || !exists {
+		return exists, err
+	}
+
+	// A volume whose fill was interrupted is incomplete, so report it as missing to have it created again.
+	// Creating the volume removes what is left of it first.
+	_, interrupted := btrfsFillInterrupted(vol.MountPath())
+	if interrupted {
+		d.logger.Warn("Ignoring volume left by interrupted fill", logger.Ctx{"name": vol.name})
+		return false, nil
+	}
+
+	return true, nil
 }
 
 // ValidateVolume validates the supplied volume config.
 func (d *btrfs) ValidateVolume(vol Volume, removeUnknownKeys bool) error {
-	return d.validateVolume(vol, nil, removeUnknownKeys)
+	rules := map[string]func(value string) error{
+		// lxdmeta:generate(entities=storage-btrfs; group=volume-conf; key=btrfs.snapshots.disable)
+		// When enabled, snapshots of the volume can't be created, which guarantees that writes to the
+		// volume never incur copy-on-write overhead because of shared extents.
+		// Non-optimized backups and migrations of the volume then read from the volume directly instead
+		// of from a temporary snapshot, so they may not be consistent if the volume is in use.
+		// ---
+		//  type: bool
+		//  defaultdesc: `false`
+		//  shortdesc: Whether snapshots of the volume are disabled
+		//  scope: global
+		"btrfs.snapshots.disable": validate.Optional(validate.IsBool),
+		// lxdmeta:generate(entities=storage-btrfs; group=volume-conf; key=btrfs.snapshots.min_interval)
+		// Minimum number of seconds between snapshots of the volume. Snapshots requested sooner after the
+		// creation of the latest snapshot are refused, to protect the pool from runaway snapshot creation.
+		// ---
+		//  type: integer
+		//  shortdesc: Minimum time between snapshots of the volume
+		//  scope: global
+		"btrfs.snapshots.min_interval": validate.Optional(validate.IsUint32),
+		// lxdmeta:generate(entities=storage-btrfs; group=volume-conf; key=btrfs.backup.snapshot_exclude)
+		// Snapshots of the volume whose name matches this shell pattern (for example, `snap*`) aren't
+		// included in backups of the volume.
+		// ---
+		//  type: string
+		//  shortdesc: Pattern of the names of snapshots to exclude from backups
+		//  scope: global
+		"btrfs.backup.snapshot_exclude": validate.Optional(btrfsValidateSnapshotPattern),
+		// lxdmeta:generate(entities=storage-btrfs; group=volume-conf; key=btrfs.backup.snapshot_limit)
+		// Only the newest snapshots of the volume, up to this number, are included in backups of the volume.
+		// Backups leaving out older snapshots are recorded as partial-history backups.
+		// Set to `0` for no limit.
+		// ---
+		//  type: integer
+		//  defaultdesc: `0`
+		//  shortdesc: Maximum number of snapshots to include in backups
+		//  scope: global
+		"btrfs.backup.snapshot_limit": validate.Optional(validate.IsUint32),
+	}
+
+	if vol.volType == VolumeTypeCustom && vol.contentType == ContentTypeFS {
+		// lxdmeta:generate(entities=storage-btrfs; group=volume-conf; key=btrfs.readonly)
+		// This sets the `ro` property on the subvolume of the volume.
+		// The option can only be changed while the volume isn't in use by any instance.
+		// ---
+		//  type: bool
+		//  condition: custom volume with content type `filesystem`
+		//  defaultdesc: `false`
+		//  shortdesc: Whether the volume's subvolume is read-only
+		//  scope: global
+		rules["btrfs.readonly"] = validate.Optional(validate.IsBool)
+	}
+
+	if vol.volType == VolumeTypeVM || (vol.volType == VolumeTypeCustom && vol.contentType == ContentTypeBlock) {
+		// lxdmeta:generate(entities=storage-btrfs; group=volume-conf; key=btrfs.block.encryption)
+		// When enabled, the volume's disk is stored in a LUKS container which is opened with the key file
+		// set in {config:option}`storage-btrfs-pool-conf:btrfs.block.encryption.key_file` while the volume
+		// is in use. This requires `cryptsetup` and can only be set when creating the volume.
+		// ---
+		//  type: bool
+		//  condition: virtual machine or custom volume with content type `block`
+		//  defaultdesc: `false`
+		//  shortdesc: Whether the volume's disk is encrypted
+		//  scope: global
+		rules["btrfs.block.encryption"] = validate.Optional(validate.IsBool)
+	}
+
+	return d.validateVolume(vol, rules, removeUnknownKeys)
 }
 
 // UpdateVolume applies config changes to the volume.
 func (d *btrfs) UpdateVolume(vol Volume, changedConfig map[string]string) error {
+	_, encryptionChanged := changedConfig["btrfs.block.encryption"]
+	if encryptionChanged {
+		return errors.New("Encryption can only be set when creating the volume")
+	}
+
+	newReadonly, readonlyChanged := changedConfig["btrfs.readonly"]
+	if readonlyChanged {
+		err := d.setVolumeReadonly(vol, shared.IsTrue(newReadonly))
+		if err != nil {
+			return err
+		}
+	}
+
 	newSize, sizeChanged := changedConfig["size"]
 	if sizeChanged {
 		err := d.SetVolumeQuota(vol, newSize, false, nil)
@@ -899,411 +1600,1922 @@ func (d *btrfs) UpdateVolume(vol Volume, changedConfig map[string]string) error
 	return nil
 }
 
-// GetVolumeUsage returns the disk space used by the volume.
-func (d *btrfs) GetVolumeUsage(vol Volume) (int64, error) {
-	// Attempt to get the qgroup information.
-	_, usage, err := d.getQGroup(vol.MountPath())
+// setVolumeReadonly sets the readonly property on the volume's subvolume.
+// As the subvolume is shared by all users of the volume, this is refused with ErrInUse while it is mounted.
+func (d *btrfs) setVolumeReadonly(vol Volume, readonly bool) error {
+	unlock, err := vol.MountLock()
 	if err != nil {
-		if err == errBtrfsNoQuota {
-			return -1, ErrNotSupported
-		}
+		return err
+	}
 
-		return -1, err
+	defer unlock()
+
+	if vol.MountInUse() {
+		return fmt.Errorf("Cannot change %q while volume is in use: %w", "btrfs.readonly", ErrInUse)
 	}
 
-	return usage, nil
+	return d.setSubvolumeReadonlyProperty(vol.MountPath(), readonly)
 }
 
-// SetVolumeQuota applies a size limit on volume.
-// Does nothing if supplied with an empty/zero size for block volumes, and for filesystem volumes removes quota.
-func (d *btrfs) SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool, op *operations.Operation) error {
-	// Convert to bytes.
-	sizeBytes, err := units.ParseByteSizeString(size)
+// FreezeVolume makes the volume and all of its snapshots read-only, for example to prepare it for archival.
+// Snapshots are normally read-only already, so this mostly matters for the volume itself. Either all of them
+// are made read-only or none. The volume can't be frozen while it is mounted, and snapshots of a frozen volume
+// are refused until it is thawed with ThawVolume. Nested subvolumes are left as they are.
+func (d *btrfs) FreezeVolume(vol Volume, op *operations.Operation) error {
+	if vol.IsSnapshot() {
+		return errors.New("Volume must not be a snapshot")
+	}
+
+	unlock, err := d.lockFreeze(vol, "freeze")
 	if err != nil {
 		return err
 	}
 
-	// For VM block files, resize the file if needed.
-	if vol.contentType == ContentTypeBlock {
-		// Do nothing if size isn't specified.
-		if sizeBytes <= 0 {
-			return nil
-		}
+	defer unlock()
+
+	snapshots, err := d.volumeSnapshotsSorted(vol, op)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(snapshots)+1)
+	for _, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+		paths = append(paths, snapVol.MountPath())
+	}
+
+	// Freeze the volume itself last, as that is what marks it as frozen.
+	paths = append(paths, vol.MountPath())
 
-		rootBlockPath, err := d.GetVolumeDiskPath(vol)
+	revert := revert.New()
+	defer revert.Fail()
+
+	for _, path := range paths {
+		readonly, err := btrfsSubvolumeReadonlyFlag(path)
 		if err != nil {
 			return err
 		}
 
-		// Pass VolumeTypeImage as unsupported resize type, as if the image volume doesn't match the
-		// requested size and allowUnsafeResize=false, this needs to be rejected back to caller as
-		// ErrNotSupported so that the caller can take the appropriate action. In the case of optimized
-		// image volumes, this will cause the image volume to be deleted and regenerated with the new size.
-		// In other cases this is probably a bug and the operation should fail anyway.
-		resized, err := ensureVolumeBlockFile(vol, rootBlockPath, sizeBytes, allowUnsafeResize, VolumeTypeImage)
-		if err != nil {
-			return err
+		if readonly {
+			continue
 		}
 
-		// Move the GPT alt header to end of disk if needed and resize has taken place (not needed in
-		// unsafe resize mode as it is expected the caller will do all necessary post resize actions
-		// themselves).
-		if vol.IsVMBlock() && resized && !allowUnsafeResize {
-			err = d.moveGPTAltHeader(rootBlockPath)
-			if err != nil {
-				return err
-			}
+		err = d.setSubvolumeReadonlyProperty(path, true)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		revert.Add(func() { _ = d.setSubvolumeReadonlyProperty(path, false) })
 	}
 
-	// For non-VM block volumes, set filesystem quota.
-	volPath := vol.MountPath()
+	revert.Success()
+	return nil
+}
 
-	// Try to locate an existing quota group.
-	qgroup, _, err := d.getQGroup(volPath)
-	if err != nil && !d.state.OS.RunningInUserNS {
-		// If quotas are disabled, attempt to enable them.
-		if err == errBtrfsNoQuota {
-			if sizeBytes <= 0 {
-				// Nothing to do if the quota is being removed and we don't currently have quota.
-				return nil
-			}
+// ThawVolume makes a volume frozen by FreezeVolume writable again. Its snapshots are left read-only as they are
+// expected to be. Nothing is done if the volume isn't frozen.
+func (d *btrfs) ThawVolume(vol Volume, op *operations.Operation) error {
+	if vol.IsSnapshot() {
+		return errors.New("Volume must not be a snapshot")
+	}
 
-			path := GetPoolMountPath(d.name)
+	unlock, err := d.lockFreeze(vol, "thaw")
+	if err != nil {
+		return err
+	}
 
-			_, err = shared.RunCommandContext(context.TODO(), "btrfs", "quota", "enable", path)
-			if err != nil {
-				return err
-			}
-
-			// Try again.
-			qgroup, _, err = d.getQGroup(volPath)
-		}
-
-		// If there's no qgroup, attempt to create one.
-		if err == errBtrfsNoQGroup {
-			// Find the volume ID.
-			var output string
-			output, err = shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", volPath)
-			if err != nil {
-				return fmt.Errorf("Failed to get subvol information: %w", err)
-			}
+	defer unlock()
 
-			id := ""
-			for line := range strings.SplitSeq(output, "\n") {
-				_, value, found := strings.Cut(line, "Subvolume ID:")
-				if found {
-					id = strings.TrimSpace(value)
-					break
-				}
-			}
+	frozen, err := d.volumeFrozen(vol)
+	if err != nil {
+		return err
+	}
 
-			if id == "" {
-				return fmt.Errorf("Failed to find subvolume id for %q", volPath)
-			}
+	if !frozen {
+		return nil
+	}
 
-			// Create a qgroup.
-			_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "create", "0/"+id, volPath)
-			if err != nil {
-				return err
-			}
+	return d.setSubvolumeReadonlyProperty(vol.MountPath(), false)
+}
 
-			// Try to get the qgroup again.
-			qgroup, _, err = d.getQGroup(volPath)
+// GetVolumeUsage returns the disk space used by the volume.
+func (d *btrfs) GetVolumeUsage(vol Volume) (int64, error) {
+	// Attempt to get the qgroup information.
+	usage, err := d.getQGroupUsage(vol.MountPath())
+	if err != nil {
+		if err == errBtrfsNoQuota {
+			return -1, ErrNotSupported
 		}
 
-		if err != nil {
-			return err
-		}
+		return -1, err
 	}
 
-	// Modify the limit.
-	if sizeBytes > 0 {
-		// Custom handling for filesystem volume associated with a VM.
-		if vol.volType == VolumeTypeVM && shared.PathExists(filepath.Join(volPath, genericVolumeDiskFile)) {
-			// Get the size of the VM image.
-			blockSize, err := block.DiskSizeBytes(filepath.Join(volPath, genericVolumeDiskFile))
-			if err != nil {
-				return err
-			}
-
-			// Add that to the requested filesystem size (to ignore it from the quota).
-			sizeBytes += blockSize
-			d.logger.Debug("Accounting for VM image file size", logger.Ctx{"sizeBytes": sizeBytes})
-		}
+	return usage, nil
+}
 
-		// Apply the limit to referenced data in qgroup.
-		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", strconv.FormatInt(sizeBytes, 10), qgroup, volPath)
-		if err != nil {
-			return err
-		}
+// StatVolume returns whether the volume exists together with its usage (as returned by GetVolumeUsage) and the
+// limit of its qgroup, for callers which need both and poll many volumes. The usage and limit come from the
+// cached qgroup table of the pool, so that this usually doesn't run any external command.
+// The usage and limit are -1 if the volume doesn't exist or quotas aren't enabled, and the limit is -1 if the
+// volume has no quota.
+func (d *btrfs) StatVolume(vol Volume) (bool, int64, int64, error) {
+	exists, err := genericVFSHasVolume(vol)
+	if err != nil || !exists {
+		return false, -1, -1, err
+	}
 
-		// Remove any former exclusive data limit.
-		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", "-e", "none", qgroup, volPath)
-		if err != nil {
-			return err
-		}
-	} else if qgroup != "" {
-		// Remove all limits.
-		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", "none", qgroup, volPath)
-		if err != nil {
-			return err
+	usage, err := d.getQGroupSizes(vol.MountPath())
+	if err != nil {
+		if err == errBtrfsNoQuota {
+			return true, -1, -1, nil
 		}
 
-		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", "-e", "none", qgroup, volPath)
-		if err != nil {
-			return err
-		}
+		return true, -1, -1, err
 	}
 
-	return nil
-}
-
-// GetVolumeDiskPath returns the location and file format of a disk volume.
-func (d *btrfs) GetVolumeDiskPath(vol Volume) (string, error) {
-	return genericVFSGetVolumeDiskPath(vol)
-}
-
-// ListVolumes returns a list of LXD volumes in storage pool.
-func (d *btrfs) ListVolumes() ([]Volume, error) {
-	return genericVFSListVolumes(d)
+	return true, usage.exclusive, usage.limit, nil
 }
 
-// MountVolume simulates mounting a volume.
-func (d *btrfs) MountVolume(vol Volume, op *operations.Operation) error {
-	unlock, err := vol.MountLock()
+// GetNestedSubvolumeUsage returns the referenced usage of each subvolume of the volume, keyed by its path
+// relative to the volume ("/" being the volume's own subvolume). The usage of a subvolume doesn't include
+// that of the subvolumes nested in it. Subvolumes without a quota group have a usage of -1.
+// Returns ErrNotSupported if quotas aren't enabled.
+func (d *btrfs) GetNestedSubvolumeUsage(vol Volume) (map[string]int64, error) {
+	subVols, err := d.getSubvolumesMetaData(vol)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer unlock()
-
-	// Don't attempt to modify the permission of an existing custom volume root.
-	// A user inside the instance may have modified this and we don't want to reset it on restart.
-	if !shared.PathExists(vol.MountPath()) || vol.volType != VolumeTypeCustom {
-		err := vol.EnsureMountPath()
-		if err != nil {
-			return err
+	usage := make(map[string]int64, len(subVols))
+	for _, subVol := range subVols {
+		sizes, err := d.getQGroupSizes(filepath.Join(vol.MountPath(), subVol.Path))
+		if err == errBtrfsNoQuota {
+			return nil, ErrNotSupported
+		} else if err == errBtrfsNoQGroup {
+			usage[subVol.Path] = -1
+			continue
+		} else if err != nil {
+			return nil, err
 		}
+
+		usage[subVol.Path] = sizes.referenced
 	}
 
-	vol.MountRefCountIncrement() // From here on it is up to caller to call UnmountVolume() when done.
-	return nil
+	return usage, nil
 }
 
-// UnmountVolume simulates unmounting a volume.
-// As driver doesn't have volumes to unmount it returns false indicating the volume was already unmounted.
-func (d *btrfs) UnmountVolume(vol Volume, keepBlockDev bool, op *operations.Operation) (bool, error) {
-	unlock, err := vol.MountLock()
+// GetSubvolumeCompression returns the compression property of each subvolume of the volume, keyed by its path
+// relative to the volume ("/" being the volume's own subvolume). Subvolumes without a compression property are
+// included with an empty value. This is the compression new data is written with, regardless of how the data
+// already in the subvolume was compressed.
+func (d *btrfs) GetSubvolumeCompression(vol Volume) (map[string]string, error) {
+	subVols, err := d.getSubvolumesMetaData(vol)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	defer unlock()
-
-	refCount := vol.MountRefCountDecrement()
-	if refCount > 0 {
-		d.logger.Debug("Skipping unmount as in use", logger.Ctx{"volName": vol.name, "refCount": refCount})
-		return false, ErrInUse
+	compression := make(map[string]string, len(subVols))
+	for _, subVol := range subVols {
+		compression[subVol.Path], err = btrfsGetCompressionProperty(filepath.Join(vol.MountPath(), subVol.Path))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return false, nil
+	return compression, nil
 }
 
-// RenameVolume renames a volume and its snapshots.
-func (d *btrfs) RenameVolume(vol Volume, newVolName string, op *operations.Operation) error {
-	return genericVFSRenameVolume(d, vol, newVolName, op)
-}
+// ExplainVolumeUsage details how the space used by the volume is accounted, to help understand why its usage
+// differs from the sum of the sizes of its files. The qgroup figures require quotas and count copy-on-write
+// extents which are partially overwritten in full, the file figures come from "btrfs filesystem du" and the
+// compression figures require the compsize tool. Missing figures are -1 with a note explaining why.
+func (d *btrfs) ExplainVolumeUsage(vol Volume) (UsageBreakdown, error) {
+	breakdown := UsageBreakdown{Referenced: -1, Exclusive: -1, Shared: -1, Uncompressed: -1, Compressed: -1}
+	volPath := vol.MountPath()
 
-// readonlySnapshot creates a readonly snapshot.
-// Returns a revert fail function that can be used to undo this function if a subsequent step fails.
-func (d *btrfs) readonlySnapshot(vol Volume) (string, revert.Hook, error) {
-	revert := revert.New()
-	defer revert.Fail()
+	usage, err := d.getQGroupSizes(volPath)
+	if err == nil {
+		breakdown.Referenced = usage.referenced
+		breakdown.Exclusive = usage.exclusive
+		breakdown.Shared = usage.referenced - usage.exclusive
+	} else if err == errBtrfsNoQuota {
+		breakdown.Notes = append(breakdown.Notes, "Referenced, exclusive and shared usage require quotas to be enabled on the pool")
+	} else {
+		return UsageBreakdown{}, err
+	}
 
-	sourcePath := vol.MountPath()
-	poolPath := GetPoolMountPath(d.name)
-	tmpDir, err := os.MkdirTemp(poolPath, "backup.")
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "filesystem", "du", "-s", "--raw", volPath)
 	if err != nil {
-		return "", nil, err
+		return UsageBreakdown{}, fmt.Errorf("Failed getting file usage of %q: %w", volPath, err)
 	}
 
-	revert.Add(func() {
-		_ = os.RemoveAll(tmpDir)
-	})
-
-	err = os.Chmod(tmpDir, 0100)
+	breakdown.FilesTotal, breakdown.FilesExclusive, breakdown.FilesShared, err = btrfsParseFilesystemDu(output)
 	if err != nil {
-		return "", nil, err
+		return UsageBreakdown{}, err
 	}
 
-	mountPath := filepath.Join(tmpDir, vol.name)
-
-	cleanup, err := d.snapshotSubvolume(sourcePath, mountPath, true)
+	_, err = exec.LookPath("compsize")
 	if err != nil {
-		return "", nil, err
+		breakdown.Notes = append(breakdown.Notes, "Compression figures require the compsize tool")
+		return breakdown, nil
 	}
 
-	if cleanup != nil {
-		revert.Add(cleanup)
+	output, err = shared.RunCommandContext(context.TODO(), "compsize", "-b", volPath)
+	if err != nil {
+		// compsize fails if the volume doesn't contain any regular file data.
+		breakdown.Notes = append(breakdown.Notes, fmt.Sprintf("Failed getting compression figures: %v", err))
+		return breakdown, nil
 	}
 
-	err = d.setSubvolumeReadonlyProperty(mountPath, true)
+	breakdown.Compressed, breakdown.Uncompressed, err = btrfsParseCompsize(output)
 	if err != nil {
-		return "", nil, err
+		return UsageBreakdown{}, err
 	}
 
-	d.logger.Debug("Created read-only backup snapshot", logger.Ctx{"sourcePath": sourcePath, "path": mountPath})
-
-	cleanup = revert.Clone().Fail
-	revert.Success()
-	return mountPath, cleanup, nil
+	return breakdown, nil
 }
 
-// MigrateVolume sends a volume for migration.
-func (d *btrfs) MigrateVolume(vol VolumeCopy, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, op *operations.Operation) error {
-	// Handle simple rsync and block_and_rsync through generic.
-	if volSrcArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || volSrcArgs.MigrationType.FSType == migration.MigrationFSType_BLOCK_AND_RSYNC {
-		// If volume is filesystem type and is not already a snapshot, create a fast snapshot to ensure migration is consistent.
-		// TODO add support for temporary snapshots of block volumes here.
-		if vol.contentType == ContentTypeFS && !vol.IsSnapshot() {
-			snapshotPath, cleanup, err := d.readonlySnapshot(vol.Volume)
-			if err != nil {
-				return err
-			}
-
-			// Clean up the snapshot.
-			defer cleanup()
+// GetVolumeProvisioningStats returns the logical size of the disk of a block volume, as configured, and the
+// number of bytes physically allocated to it. Extents shared with snapshots are included in the allocated bytes.
+// Returns ErrNotSupported for filesystem volumes.
+func (d *btrfs) GetVolumeProvisioningStats(vol Volume) (int64, int64, error) {
+	if vol.contentType != ContentTypeBlock {
+		return -1, -1, ErrNotSupported
+	}
 
-			// Set the path of the volume to the path of the fast snapshot so the migration reads from there instead.
-			vol.mountCustomPath = snapshotPath
-		}
+	diskPath := d.volumeDiskFile(vol)
 
-		return genericVFSMigrateVolume(d, d.state, vol, conn, volSrcArgs, op)
-	} else if volSrcArgs.MigrationType.FSType != migration.MigrationFSType_BTRFS {
-		return ErrNotSupported
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		return -1, -1, fmt.Errorf("Failed getting size of %q: %w", diskPath, err)
 	}
 
-	// Handle btrfs send/receive migration.
-	if volSrcArgs.MultiSync || volSrcArgs.FinalSync {
-		// This is not needed if the migration is performed using btrfs send/receive.
-		return errors.New("MultiSync should not be used with optimized migration")
+	allocated, err := btrfsAllocatedBytes(diskPath)
+	if err != nil {
+		return -1, -1, err
 	}
 
-	var snapshots []string
-	var err error
+	return fi.Size(), allocated, nil
+}
 
-	if !volSrcArgs.VolumeOnly {
-		// Generate restoration header, containing info on the subvolumes and how they should be restored.
-		snapshots, err = d.volumeSnapshotsSorted(vol.Volume, op)
+// GetVolumeFragmentation returns an estimate of the fragmentation of the volume, between 0 (not fragmented)
+// and 1 (every extent in a separate place), as a signal of when defragmenting the volume is warranted.
+// It is worked out from the extents of the root disk file of block volumes and of all files of filesystem
+// volumes, so doesn't depend on quotas.
+func (d *btrfs) GetVolumeFragmentation(vol Volume) (float64, error) {
+	if vol.contentType == ContentTypeBlock {
+		diskPath := d.volumeDiskFile(vol)
+
+		extents, err := btrfsFileExtents(diskPath)
 		if err != nil {
-			return err
+			return -1, err
 		}
-	}
 
-	migrationHeader, err := d.restorationHeader(vol.Volume, snapshots)
-	if err != nil {
-		return err
+		return btrfsFragmentation(btrfsFragments(extents)), nil
 	}
 
-	// If we haven't negotiated subvolume support, check if we have any subvolumes in source and fail,
-	// otherwise we would end up not materialising all of the source's files on the target.
-	if !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureMigrationHeader) || !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureSubvolumes) {
-		for _, subVol := range migrationHeader.Subvolumes {
-			if subVol.Path != string(filepath.Separator) {
-				return errors.New("Subvolumes detected in source but target does not support receiving subvolumes")
-			}
-		}
-	}
+	var totalRuns, totalMinRuns int
 
-	// Send metadata migration header frame with subvolume info if we have negotiated that feature.
-	if slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureMigrationHeader) {
-		headerJSON, err := json.Marshal(migrationHeader)
+	err := filepath.WalkDir(vol.MountPath(), func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("Failed encoding BTRFS migration header: %w", err)
+			return err
 		}
 
-		_, err = conn.Write(headerJSON)
-		if err != nil {
-			return fmt.Errorf("Failed sending BTRFS migration header: %w", err)
+		if !entry.Type().IsRegular() {
+			return nil
 		}
 
-		err = conn.Close() // End the frame.
+		extents, err := btrfsFileExtents(path)
 		if err != nil {
-			return fmt.Errorf("Failed closing BTRFS migration header frame: %w", err)
+			return err
 		}
 
-		d.logger.Debug("Sent migration meta data header", logger.Ctx{"name": vol.name})
+		runs, minRuns := btrfsFragments(extents)
+		totalRuns += runs
+		totalMinRuns += minRuns
+
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("Failed getting fragmentation of volume %q: %w", vol.name, err)
 	}
 
-	if volSrcArgs.Refresh && slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureSubvolumeUUIDs) {
-		migrationHeader = &BTRFSMetaDataHeader{}
+	return btrfsFragmentation(totalRuns, totalMinRuns), nil
+}
 
-		buf, err := io.ReadAll(conn)
+// DumpVolumeDiagnostics gathers the btrfs state of the volume as JSON for bug reports: its subvolumes, qgroup
+// usage and limit, space usage and compression, snapshots, the pool's mount options and a fragmentation
+// estimate. Failing to gather a section doesn't fail the dump, the error is included in it instead.
+func (d *btrfs) DumpVolumeDiagnostics(vol Volume) ([]byte, error) {
+	diag := VolumeDiagnostics{Volume: vol.name, Fragmentation: -1, Errors: map[string]string{}}
+	volPath := vol.MountPath()
+
+	if !d.isSubvolume(volPath) {
+		return nil, fmt.Errorf("Volume %q not found", vol.name)
+	}
+
+	subvolumes, err := d.getSubvolumesMetaData(vol)
+	if err != nil {
+		diag.Errors["subvolumes"] = err.Error()
+	} else {
+		diag.Subvolumes = subvolumes
+	}
+
+	qgroupID, limit, err := d.getQGroupLimit(volPath)
+	if err == nil {
+		usage, err := d.getQGroupSizes(volPath)
 		if err != nil {
-			return fmt.Errorf("Failed reading BTRFS migration header: %w", err)
+			usage = btrfsQGroupUsage{referenced: -1, exclusive: -1}
+			diag.Errors["qgroup"] = err.Error()
 		}
 
-		err = json.Unmarshal(buf, &migrationHeader)
+		diag.QGroup = &QGroupDiagnostics{ID: qgroupID, Referenced: usage.referenced, Exclusive: usage.exclusive, Limit: limit}
+	} else {
+		diag.Errors["qgroup"] = err.Error()
+	}
+
+	usage, err := d.ExplainVolumeUsage(vol)
+	if err != nil {
+		diag.Errors["usage"] = err.Error()
+	} else {
+		diag.Usage = &usage
+	}
+
+	if !vol.IsSnapshot() {
+		snapshots, err := d.volumeSnapshotsSorted(vol, nil)
 		if err != nil {
-			return fmt.Errorf("Failed decoding BTRFS migration header: %w", err)
+			diag.Errors["snapshots"] = err.Error()
 		}
 
-		d.logger.Debug("Received BTRFS migration meta data header", logger.Ctx{"name": vol.name})
-
-		volSrcArgs.Snapshots = []string{}
+		for _, snapName := range snapshots {
+			snapVol, _ := vol.NewSnapshot(snapName)
 
-		// Override volSrcArgs.Snapshots to only include snapshots which need to be sent.
-		for _, snap := range migrationHeader.Subvolumes {
-			if snap.Path == "/" && snap.Snapshot != "" {
-				volSrcArgs.Snapshots = append(volSrcArgs.Snapshots, snap.Snapshot)
+			output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", snapVol.MountPath())
+			if err == nil {
+				var snapDiag SnapshotDiagnostics
+				snapDiag, err = btrfsSnapshotDiagnostics(snapName, output)
+				if err == nil {
+					diag.Snapshots = append(diag.Snapshots, snapDiag)
+					continue
+				}
 			}
+
+			// Keyed by snapshot so that the failures of all snapshots are kept.
+			diag.Errors["snapshots/"+snapName] = fmt.Sprintf("Failed getting snapshot %q: %v", snapName, err)
 		}
 	}
 
-	return d.migrateVolumeOptimized(vol.Volume, conn, volSrcArgs, migrationHeader.Subvolumes, op)
+	mountOptions, err := d.GetEffectiveMountOptions()
+	if err != nil {
+		diag.Errors["mount_options"] = err.Error()
+	} else {
+		diag.MountOptions = mountOptions
+	}
+
+	fragmentation, err := d.GetVolumeFragmentation(vol)
+	if err != nil {
+		diag.Errors["fragmentation"] = err.Error()
+	} else {
+		diag.Fragmentation = fragmentation
+	}
+
+	return json.Marshal(diag)
 }
 
-func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, subvolumes []BTRFSSubVolume, op *operations.Operation) error {
+// GetVolumeGeneration returns the generation of the volume's subvolume.
+// The generation increases whenever the subvolume is modified, so comparing it to the generation recorded
+// at the time of the last backup is a cheap way to find whether the volume has changed since.
+func (d *btrfs) GetVolumeGeneration(vol Volume) (uint64, error) {
+	return d.getSubvolumeGeneration(vol.MountPath())
+}
+
+// VolumeChangedSince returns whether the volume was modified after the given generation (as previously
+// returned by GetVolumeGeneration).
+func (d *btrfs) VolumeChangedSince(vol Volume, generation uint64) (bool, error) {
+	current, err := d.GetVolumeGeneration(vol)
+	if err != nil {
+		return false, err
+	}
+
+	return current > generation, nil
+}
+
+// GetVolumeDriftSinceSnapshot estimates how much data was written to the volume since the given snapshot was
+// taken, to help decide whether a new snapshot is worth keeping. If the snapshot was taken of the volume's
+// current subvolume, the extents written since the snapshot's generation are counted. Otherwise the exclusive
+// qgroup usage of the volume is used, which is only the data written since the snapshot for its latest
+// snapshot. Returns ErrNotSupported if neither applies.
+func (d *btrfs) GetVolumeDriftSinceSnapshot(vol Volume, snapName string) (int64, error) {
+	snapVol, err := vol.NewSnapshot(snapName)
+	if err != nil {
+		return -1, err
+	}
+
+	volPath := vol.MountPath()
+	snapPath := snapVol.MountPath()
+
+	if !d.isSubvolume(snapPath) {
+		return -1, fmt.Errorf("Snapshot %q of volume %q not found", snapName, vol.name)
+	}
+
+	volInfo, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", volPath)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	snapInfo, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", snapPath)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	volUUID, _ := btrfsSubvolumeShowField(volInfo, "UUID")
+	parentUUID, _ := btrfsSubvolumeShowField(snapInfo, "Parent UUID")
+	value, _ := btrfsSubvolumeShowField(snapInfo, "Gen at creation")
+	generation, err := strconv.ParseUint(value, 10, 64)
+
+	if volUUID != "" && volUUID != "-" && parentUUID == volUUID && err == nil {
+		// The data of the snapshot's own transaction is part of the snapshot, so only count later ones.
+		output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "find-new", volPath, strconv.FormatUint(generation+1, 10))
+		if err != nil {
+			return -1, fmt.Errorf("Failed listing changed files of %q: %w", volPath, err)
+		}
+
+		return btrfsFindNewFileSize(output, "")
+	}
+
+	snapshots, err := d.volumeSnapshotsSorted(vol, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(snapshots) == 0 || snapshots[len(snapshots)-1] != snapName {
+		return -1, fmt.Errorf("Drift can only be estimated from quotas for the latest snapshot: %w", ErrNotSupported)
+	}
+
+	usage, err := d.getQGroupSizes(volPath)
+	if err != nil {
+		if errors.Is(err, errBtrfsNoQuota) || errors.Is(err, errBtrfsNoQGroup) {
+			return -1, fmt.Errorf("Estimating the drift of volume %q requires quotas as the snapshot wasn't taken of its current subvolume: %w", vol.name, ErrNotSupported)
+		}
+
+		return -1, err
+	}
+
+	return usage.exclusive, nil
+}
+
+// CheckAndRepairReadonlyFlags compares the read-only flags of the volume's subvolumes to what LXD expects, for
+// pools left in an inconsistent state by a crash or manual intervention. The subvolumes of images and snapshots,
+// and of custom volumes with btrfs.readonly enabled, must be read-only. A description of each discrepancy is
+// returned and if apply is true, the discrepancies are also repaired.
+func (d *btrfs) CheckAndRepairReadonlyFlags(vol Volume, apply bool) ([]string, error) {
+	if !btrfsExpectReadonly(vol) {
+		return nil, nil
+	}
+
+	subVols, err := d.getSubvolumesMetaData(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	var discrepancies []string
+
+	// Nested subvolumes keep the flag they had when the volume was created, so only the root one is checked.
+	for _, subVol := range subVols {
+		if subVol.Path != string(filepath.Separator) || subVol.Readonly {
+			continue
+		}
+
+		discrepancies = append(discrepancies, fmt.Sprintf("Subvolume of volume %q is writable but should be read-only", vol.name))
+
+		if apply {
+			err = d.setSubvolumeReadonlyProperty(vol.MountPath(), true)
+			if err != nil {
+				return discrepancies, err
+			}
+		}
+	}
+
+	return discrepancies, nil
+}
+
+// SetVolumeQuota applies a size limit on volume.
+// Does nothing if supplied with an empty/zero size for block volumes, and for filesystem volumes removes quota.
+func (d *btrfs) SetVolumeQuota(vol Volume, size string, allowUnsafeResize bool, op *operations.Operation) error {
+	// Any cached usage may no longer reflect the qgroups once the quota has been changed.
+	defer d.invalidateQGroupTable()
+
+	// Convert to bytes.
+	sizeBytes, err := units.ParseByteSizeString(size)
+	if err != nil {
+		return err
+	}
+
+	// For VM block files, resize the file if needed.
+	if vol.contentType == ContentTypeBlock {
+		// Do nothing if size isn't specified.
+		if sizeBytes <= 0 {
+			return nil
+		}
+
+		rootBlockPath, format, err := d.volumeDiskPathFormat(vol)
+		if err != nil {
+			return err
+		}
+
+		// Image volumes kept in qcow2 format can't be resized, so have them regenerated if the size differs.
+		if format == "qcow2" {
+			virtualSize, err := d.qcow2VirtualSize(rootBlockPath)
+			if err != nil {
+				return err
+			}
+
+			if virtualSize != sizeBytes {
+				return fmt.Errorf("Cannot resize qcow2 image volume: %w", ErrNotSupported)
+			}
+
+			return nil
+		}
+
+		// The disk file of encrypted volumes also holds the LUKS header in front of the volume's data.
+		diskPath := rootBlockPath
+		if btrfsEncrypted(vol) {
+			diskPath = filepath.Join(vol.MountPath(), genericVolumeDiskFile)
+			sizeBytes += btrfsLUKSHeaderSize
+		}
+
+		oldSizeBytes, err := block.DiskSizeBytes(diskPath)
+		if err != nil {
+			return err
+		}
+
+		// Pass VolumeTypeImage as unsupported resize type, as if the image volume doesn't match the
+		// requested size and allowUnsafeResize=false, this needs to be rejected back to caller as
+		// ErrNotSupported so that the caller can take the appropriate action. In the case of optimized
+		// image volumes, this will cause the image volume to be deleted and regenerated with the new size.
+		// In other cases this is probably a bug and the operation should fail anyway.
+		resized, err := ensureVolumeBlockFile(vol, diskPath, sizeBytes, allowUnsafeResize, VolumeTypeImage)
+		if err != nil {
+			return err
+		}
+
+		if btrfsEncrypted(vol) && resized {
+			err = d.luksResize(vol)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The quota of the VM's filesystem volume includes the size of the root disk file, so keep it in
+		// line with the new size.
+		if vol.volType == VolumeTypeVM && resized {
+			newSizeBytes, err := block.DiskSizeBytes(diskPath)
+			if err != nil {
+				return err
+			}
+
+			err = d.updateVMFilesystemQuota(vol.MountPath(), newSizeBytes-oldSizeBytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Move the GPT alt header to end of disk if needed and resize has taken place (not needed in
+		// unsafe resize mode as it is expected the caller will do all necessary post resize actions
+		// themselves).
+		if vol.IsVMBlock() && resized && !allowUnsafeResize {
+			// The decrypted device of encrypted volumes needs to be open to access the disk.
+			if btrfsEncrypted(vol) {
+				opened, err := d.luksOpen(vol)
+				if err != nil {
+					return err
+				}
+
+				if opened {
+					defer func() { _ = d.luksClose(vol) }()
+				}
+			}
+
+			err = d.moveGPTAltHeader(rootBlockPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// For non-VM block volumes, set filesystem quota.
+	volPath := vol.MountPath()
+
+	// Try to locate an existing quota group.
+	qgroup, _, err := d.getQGroup(volPath)
+	if err != nil && !d.state.OS.RunningInUserNS {
+		// If quotas are disabled, attempt to enable them.
+		if err == errBtrfsNoQuota {
+			if sizeBytes <= 0 {
+				// Nothing to do if the quota is being removed and we don't currently have quota.
+				return nil
+			}
+
+			err = d.enableQuota()
+			if err != nil {
+				return err
+			}
+
+			// Try again.
+			qgroup, _, err = d.getQGroup(volPath)
+		}
+
+		// If there's no qgroup, attempt to create one.
+		if err == errBtrfsNoQGroup {
+			qgroup, err = d.createQGroup(volPath)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Modify the limit.
+	if sizeBytes > 0 {
+		// Custom handling for filesystem volume associated with a VM.
+		if vol.volType == VolumeTypeVM {
+			sizeBytes, err = vmFilesystemQuotaSize(volPath, sizeBytes)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Apply the limit to referenced data in qgroup.
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", strconv.FormatInt(sizeBytes, 10), qgroup, volPath)
+		if err != nil {
+			return err
+		}
+
+		// Remove any former exclusive data limit.
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", "-e", "none", qgroup, volPath)
+		if err != nil {
+			return err
+		}
+	} else if qgroup != "" {
+		// Remove all limits.
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", "none", qgroup, volPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = shared.RunCommandContext(context.TODO(), "btrfs", "qgroup", "limit", "-e", "none", qgroup, volPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CanShrinkVolume returns whether the volume can be resized to newSize without SetVolumeQuota rejecting it or
+// the volume ending up over its quota, along with the minimum size the volume can be set to.
+// Block volumes are reported conservatively as their current size, as the space used within them isn't known.
+func (d *btrfs) CanShrinkVolume(vol Volume, newSize string) (bool, int64, error) {
+	sizeBytes, err := units.ParseByteSizeString(newSize)
+	if err != nil {
+		return false, -1, err
+	}
+
+	if vol.contentType == ContentTypeBlock {
+		rootBlockPath, format, err := d.volumeDiskPathFormat(vol)
+		if err != nil {
+			return false, -1, err
+		}
+
+		var minSizeBytes int64
+		if format == "qcow2" {
+			minSizeBytes, err = d.qcow2VirtualSize(rootBlockPath)
+		} else if btrfsEncrypted(vol) {
+			minSizeBytes, err = block.DiskSizeBytes(filepath.Join(vol.MountPath(), genericVolumeDiskFile))
+			minSizeBytes -= btrfsLUKSHeaderSize
+		} else {
+			minSizeBytes, err = block.DiskSizeBytes(rootBlockPath)
+		}
+
+		if err != nil {
+			return false, -1, err
+		}
+
+		// Compare the size the disk file would be resized to.
+		if sizeBytes > 0 {
+			sizeBytes = d.roundVolumeBlockSizeBytes(vol, sizeBytes)
+		}
+
+		return sizeBytes <= 0 || sizeBytes >= minSizeBytes, minSizeBytes, nil
+	}
+
+	// The quota limits the data referenced by the subvolume.
+	volPath := vol.MountPath()
+	usage, err := d.getQGroupSizes(volPath)
+	if err != nil {
+		if err == errBtrfsNoQuota {
+			return false, -1, ErrNotSupported
+		}
+
+		return false, -1, err
+	}
+
+	minSizeBytes := usage.referenced
+
+	// The root disk file of a VM isn't counted towards the size of its filesystem volume.
+	if vol.volType == VolumeTypeVM {
+		blockSize, err := vmFilesystemQuotaSize(volPath, 0)
+		if err != nil {
+			return false, -1, err
+		}
+
+		minSizeBytes = max(minSizeBytes-blockSize, 0)
+	}
+
+	// Removing the quota is always possible.
+	return sizeBytes <= 0 || sizeBytes >= minSizeBytes, minSizeBytes, nil
+}
+
+// RepairVolumeQuota re-establishes the quota group of a volume after it was lost, for example after quotas
+// were disabled and enabled again outside of LXD, and reapplies the volume's configured size limit.
+func (d *btrfs) RepairVolumeQuota(vol Volume, op *operations.Operation) error {
+	volPath := vol.MountPath()
+
+	_, _, err := d.getQGroup(volPath)
+	if err == errBtrfsNoQuota {
+		err = d.enableQuota()
+		if err != nil {
+			return err
+		}
+
+		_, _, err = d.getQGroup(volPath)
+	}
+
+	if err == errBtrfsNoQGroup {
+		_, err = d.createQGroup(volPath)
+		if err != nil {
+			return err
+		}
+
+		// A quota group created for an existing subvolume only accounts for new writes until rescanned.
+		// Simple quotas don't support (nor need) rescanning.
+		if !shared.IsTrue(d.config["btrfs.quota.simple"]) {
+			_, err = shared.RunCommandContext(d.state.ShutdownCtx, "btrfs", "quota", "rescan", "-w", GetPoolMountPath(d.name))
+			if err != nil {
+				return fmt.Errorf("Failed rescanning quotas: %w", err)
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// Block volumes don't have a quota limit applied to them.
+	if vol.contentType != ContentTypeFS {
+		return nil
+	}
+
+	return d.SetVolumeQuota(vol, vol.ConfigSize(), false, op)
+}
+
+// GetVolumeDiskPath returns the location and file format of a disk volume.
+func (d *btrfs) GetVolumeDiskPath(vol Volume) (string, error) {
+	diskPath, err := genericVFSGetVolumeDiskPath(vol)
+	if err != nil {
+		return "", err
+	}
+
+	// Encrypted volumes are used through the decrypted device, which is open while the volume is mounted.
+	if btrfsEncrypted(vol) {
+		return filepath.Join("/dev/mapper", d.luksMappingName(vol)), nil
+	}
+
+	return diskPath, nil
+}
+
+// DefragmentBlockFile defragments the root disk file of a block volume rather than the whole subvolume.
+// The nodatacow attribute of the disk file is checked again afterwards, as rewriting the extents must not
+// have changed it.
+func (d *btrfs) DefragmentBlockFile(vol Volume, op *operations.Operation) error {
+	if vol.contentType != ContentTypeBlock {
+		return ErrNotSupported
+	}
+
+	rootBlockPath := d.volumeDiskFile(vol)
+
+	noDataCOW, err := btrfsIsNoDataCOW(rootBlockPath)
+	if err != nil {
+		return err
+	}
+
+	d.logger.Debug("Defragmenting block volume file", logger.Ctx{"name": vol.name, "path": rootBlockPath, "extentSize": btrfsDefragBlockFileExtentSize})
+
+	_, err = shared.RunCommandContext(d.state.ShutdownCtx, "btrfs", "filesystem", "defragment", "-t", btrfsDefragBlockFileExtentSize, rootBlockPath)
+	if err != nil {
+		return fmt.Errorf("Failed defragmenting %q: %w", rootBlockPath, err)
+	}
+
+	if noDataCOW {
+		stillNoDataCOW, err := btrfsIsNoDataCOW(rootBlockPath)
+		if err != nil {
+			return err
+		}
+
+		if !stillNoDataCOW {
+			return fmt.Errorf("Defragmenting %q cleared its nodatacow attribute", rootBlockPath)
+		}
+	}
+
+	return nil
+}
+
+// ExportVolumeAsQcow2 writes the root disk of a block volume to w in qcow2 format.
+// The disk is converted from a read-only snapshot so that the volume can remain in use during the export,
+// unless snapshots are disabled for the volume.
+func (d *btrfs) ExportVolumeAsQcow2(vol Volume, w io.Writer, op *operations.Operation) error {
+	if vol.contentType != ContentTypeBlock {
+		return fmt.Errorf("Exporting as qcow2 is only supported for block volumes: %w", ErrNotSupported)
+	}
+
+	srcPath, format, err := d.volumeDiskPathFormat(vol)
+	if err != nil {
+		return err
+	}
+
+	if btrfsSnapshotsDisabled(vol) {
+		d.logger.Warn("Snapshots are disabled for volume, export may be inconsistent if the volume is in use", logger.Ctx{"name": vol.name})
+	} else {
+		snapshotPath, cleanup, err := d.readonlySnapshot(vol)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+
+		srcPath = filepath.Join(snapshotPath, genericVolumeDiskFile)
+		if format == "qcow2" {
+			srcPath = filepath.Join(snapshotPath, btrfsQcow2DiskFile)
+		}
+	}
+
+	// The qcow2 format can't be written to a pipe, so convert into a temporary file.
+	poolPath := GetPoolMountPath(d.name)
+	tmpDir, err := os.MkdirTemp(poolPath, "backup.")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory under %q: %w", poolPath, err)
+	}
+
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	untrack := btrfsTrackTransientPath(tmpDir)
+	defer untrack()
+
+	err = os.Chmod(tmpDir, 0100)
+	if err != nil {
+		return fmt.Errorf("Failed to chmod %q: %w", tmpDir, err)
+	}
+
+	qcow2Path := filepath.Join(tmpDir, vol.name+".qcow2")
+
+	var tracker *ioprogress.ProgressTracker
+	if op != nil {
+		tracker = migration.ProgressTracker(op, "fs_progress", vol.name)
+	}
+
+	d.logger.Debug("Converting block volume to qcow2", logger.Ctx{"name": vol.name, "srcPath": srcPath, "dstPath": qcow2Path})
+
+	cmd := []string{
+		"nice", "-n19", // Run with low priority to reduce CPU impact on other processes.
+		"qemu-img", "convert", "-p", "-f", format, "-O", "qcow2", srcPath, qcow2Path,
+	}
+
+	_, err = apparmor.QemuImg(d.state.OS, cmd, srcPath, qcow2Path, tracker)
+	if err != nil {
+		return fmt.Errorf("Failed converting %q to qcow2: %w", srcPath, err)
+	}
+
+	f, err := os.Open(qcow2Path)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return fmt.Errorf("Failed writing qcow2 image: %w", err)
+	}
+
+	return nil
+}
+
+// StreamVolumeContents writes the contents of the volume to w, without any of the metadata of a backup. This is
+// a plain tar of the files of filesystem volumes and the raw disk image of block volumes.
+// The contents are read from a read-only snapshot so that the volume can remain in use, unless snapshots are
+// disabled for the volume.
+func (d *btrfs) StreamVolumeContents(vol Volume, w io.Writer, op *operations.Operation) error {
+	srcPath := vol.MountPath()
+
+	// Snapshots are read-only already so are read from directly.
+	if !vol.IsSnapshot() && btrfsSnapshotsDisabled(vol) {
+		d.logger.Warn("Snapshots are disabled for volume, contents may be inconsistent if the volume is in use", logger.Ctx{"name": vol.name})
+	} else if !vol.IsSnapshot() {
+		snapshotPath, cleanup, err := d.readonlySnapshot(vol)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+
+		srcPath = snapshotPath
+	}
+
+	var tracker *ioprogress.ProgressTracker
+	if op != nil {
+		tracker = migration.ProgressTracker(op, "fs_progress", vol.name)
+	}
+
+	progressWriter := &ioprogress.ProgressWriter{WriteCloser: btrfsNopWriteCloser{w}, Tracker: tracker}
+
+	if vol.contentType == ContentTypeBlock {
+		diskPath := filepath.Join(srcPath, genericVolumeDiskFile)
+
+		f, err := os.Open(diskPath)
+		if err != nil {
+			return fmt.Errorf("Error opening file for reading %q: %w", diskPath, err)
+		}
+
+		defer func() { _ = f.Close() }()
+
+		if tracker != nil {
+			fi, err := f.Stat()
+			if err == nil {
+				tracker.Length = fi.Size()
+			}
+		}
+
+		_, err = io.Copy(progressWriter, f)
+		if err != nil {
+			return fmt.Errorf("Failed writing disk image of %q: %w", vol.name, err)
+		}
+
+		return nil
+	}
+
+	tarWriter := instancewriter.NewInstanceTarWriter(progressWriter, nil)
+
+	err := filepath.Walk(srcPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("Error walking file %q: %w", path, err)
+		}
+
+		name := "." + strings.TrimPrefix(path, srcPath)
+
+		err = tarWriter.WriteFile(name, path, fi, false)
+		if err != nil {
+			return fmt.Errorf("Error adding %q as %q to tarball: %w", path, name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
+
+// ListVolumes returns a list of LXD volumes in storage pool.
+func (d *btrfs) ListVolumes() ([]Volume, error) {
+	return genericVFSListVolumes(d)
+}
+
+// MountVolume simulates mounting a volume.
+func (d *btrfs) MountVolume(vol Volume, op *operations.Operation) error {
+	unlock, err := vol.MountLock()
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	// Don't attempt to modify the permission of an existing custom volume root.
+	// A user inside the instance may have modified this and we don't want to reset it on restart.
+	if !shared.PathExists(vol.MountPath()) || vol.volType != VolumeTypeCustom {
+		err := vol.EnsureMountPath()
+		if err != nil {
+			return err
+		}
+	}
+
+	if btrfsEncrypted(vol) {
+		_, err = d.luksOpen(vol)
+		if err != nil {
+			return err
+		}
+	}
+
+	vol.MountRefCountIncrement() // From here on it is up to caller to call UnmountVolume() when done.
+	return nil
+}
+
+// UnmountVolume simulates unmounting a volume.
+// As driver doesn't have volumes to unmount it returns false indicating the volume was already unmounted.
+func (d *btrfs) UnmountVolume(vol Volume, keepBlockDev bool, op *operations.Operation) (bool, error) {
+	unlock, err := vol.MountLock()
+	if err != nil {
+		return false, err
+	}
+
+	defer unlock()
+
+	refCount := vol.MountRefCountDecrement()
+	if refCount > 0 {
+		d.logger.Debug("Skipping unmount as in use", logger.Ctx{"volName": vol.name, "refCount": refCount})
+		return false, ErrInUse
+	}
+
+	if btrfsEncrypted(vol) && !keepBlockDev {
+		err = d.luksClose(vol)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// RenameVolume renames a volume and its snapshots.
+func (d *btrfs) RenameVolume(vol Volume, newVolName string, op *operations.Operation) error {
+	// Snapshots are created in a directory named after the volume, so a rename landing while one is being
+	// created or deleted could leave it behind in the old directory. The config and disk volumes of a VM share
+	// their subvolume, so the snapshots of both are checked.
+	contentTypes := []ContentType{vol.contentType}
+	if vol.volType == VolumeTypeVM {
+		contentTypes = []ContentType{ContentTypeFS, ContentTypeBlock}
+	}
+
+	//revive:disable:defer Allow defer inside a loop.
+	for _, contentType := range contentTypes {
+		unlock := locking.TryLock(d.snapshotsLockName(vol.volType, contentType, vol.name))
+		if unlock == nil {
+			return fmt.Errorf("Cannot rename volume %q while a snapshot operation is in progress: %w", vol.name, ErrInUse)
+		}
+
+		defer unlock()
+	}
+
+	return genericVFSRenameVolume(d, vol, newVolName, op)
+}
+
+// SwapVolumes exchanges the subvolumes of two volumes of the same type, so that each volume has the data of
+// the other, such as to promote a prepared volume in place of another. The exchange is done in a single
+// atomic rename, so each volume has either its own or the other's data even if interrupted. The quota and the
+// compression and nodatacow settings stay with each volume rather than moving with the data, so they are
+// applied again afterwards. The snapshots of the volumes aren't exchanged, so each volume's snapshots now hold
+// the history of the other volume's current data. Neither volume can be in use.
+func (d *btrfs) SwapVolumes(volA Volume, volB Volume, op *operations.Operation) error {
+	if volA.IsSnapshot() || volB.IsSnapshot() {
+		return errors.New("Volumes must not be snapshots")
+	}
+
+	if volA.volType != volB.volType || volA.contentType != volB.contentType {
+		return fmt.Errorf("Cannot swap volume %q with volume %q of a different type", volA.name, volB.name)
+	}
+
+	if volA.name == volB.name {
+		return fmt.Errorf("Cannot swap volume %q with itself", volA.name)
+	}
+
+	// Take the locks in a consistent order so concurrent swaps of the same volumes can't deadlock.
+	vols := []Volume{volA, volB}
+	if vols[0].name > vols[1].name {
+		vols[0], vols[1] = vols[1], vols[0]
+	}
+
+	//revive:disable:defer Allow defer inside a loop.
+	for _, vol := range vols {
+		unlock, err := vol.MountLock()
+		if err != nil {
+			return err
+		}
+
+		defer unlock()
+
+		if vol.MountInUse() {
+			return fmt.Errorf("Cannot swap volume %q while it is in use: %w", vol.name, ErrInUse)
+		}
+
+		// The config and disk volumes of a VM share their subvolume, so the snapshots of both are checked.
+		contentTypes := []ContentType{vol.contentType}
+		if vol.volType == VolumeTypeVM {
+			contentTypes = []ContentType{ContentTypeFS, ContentTypeBlock}
+		}
+
+		for _, contentType := range contentTypes {
+			unlockSnapshots := locking.TryLock(d.snapshotsLockName(vol.volType, contentType, vol.name))
+			if unlockSnapshots == nil {
+				return fmt.Errorf("Cannot swap volume %q while a snapshot operation is in progress: %w", vol.name, ErrInUse)
+			}
+
+			defer unlockSnapshots()
+		}
+
+		if !d.isSubvolume(vol.MountPath()) {
+			return fmt.Errorf("Volume %q doesn't exist", vol.name)
+		}
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	settings := make([]*BTRFSVolumeSettings, 0, len(vols))
+	for _, vol := range vols {
+		volSettings, err := d.volumeSettings(vol)
+		if err != nil {
+			return err
+		}
+
+		settings = append(settings, volSettings)
+	}
+
+	reapplySettings := func() error {
+		for i, vol := range vols {
+			err := d.resetVolumeSettings(vol, settings[i])
+			if err != nil {
+				return err
+			}
+
+			quotaVol, hasQuota := btrfsQuotaVolume(vol)
+			if hasQuota {
+				err = d.SetVolumeQuota(quotaVol, quotaVol.ConfigSize(), false, op)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	err := btrfsExchangePaths(volA.MountPath(), volB.MountPath())
+	if err != nil {
+		return err
+	}
+
+	revert.Add(func() {
+		_ = btrfsExchangePaths(volA.MountPath(), volB.MountPath())
+		_ = reapplySettings()
+	})
+
+	err = reapplySettings()
+	if err != nil {
+		return err
+	}
+
+	d.logger.Debug("Swapped volumes", logger.Ctx{"volA": volA.name, "volB": volB.name})
+
+	revert.Success()
+	return nil
+}
+
+// readonlySnapshot creates a readonly snapshot.
+// Returns a revert fail function that can be used to undo this function if a subsequent step fails.
+func (d *btrfs) readonlySnapshot(vol Volume) (string, revert.Hook, error) {
+	revert := revert.New()
+	defer revert.Fail()
+
+	sourcePath := vol.MountPath()
+	poolPath := GetPoolMountPath(d.name)
+	tmpDir, err := os.MkdirTemp(poolPath, "backup.")
+	if err != nil {
+		return "", nil, err
+	}
+
+	revert.Add(func() {
+		_ = os.RemoveAll(tmpDir)
+	})
+
+	revert.Add(btrfsTrackTransientPath(tmpDir))
+
+	err = os.Chmod(tmpDir, 0100)
+	if err != nil {
+		return "", nil, err
+	}
+
+	mountPath := filepath.Join(tmpDir, vol.name)
+
+	cleanup, err := d.snapshotSubvolume(sourcePath, mountPath, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cleanup != nil {
+		revert.Add(cleanup)
+	}
+
+	err = d.setSubvolumeReadonlyProperty(mountPath, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	d.logger.Debug("Created read-only backup snapshot", logger.Ctx{"sourcePath": sourcePath, "path": mountPath})
+
+	cleanup = revert.Clone().Fail
+	revert.Success()
+	return mountPath, cleanup, nil
+}
+
+// VolumeMigration is a volume to send for migration together with its connection and arguments.
+type VolumeMigration struct {
+	Vol  VolumeCopy
+	Conn io.ReadWriteCloser
+	Args *migration.VolumeSourceArgs
+}
+
+// MigrateVolumes sends several volumes for migration concurrently, each over its own connection, at most
+// btrfsMigrateConcurrentVolumes at a time to avoid thrashing the disks. Each volume is sent as by MigrateVolume,
+// so that volumes sent with rsync are read from their own temporary snapshot.
+func (d *btrfs) MigrateVolumes(migrations []VolumeMigration, op *operations.Operation) error {
+	g := errgroup.Group{}
+	g.SetLimit(btrfsMigrateConcurrentVolumes)
+
+	for _, m := range migrations {
+		g.Go(func() error {
+			err := d.MigrateVolume(m.Vol, m.Conn, m.Args, op)
+			if err != nil {
+				return fmt.Errorf("Failed migrating volume %q: %w", m.Vol.name, err)
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// MigrateVolume sends a volume for migration.
+func (d *btrfs) MigrateVolume(vol VolumeCopy, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, op *operations.Operation) error {
+	d.emitEvent(BTRFSEventMigrationStarted, vol.Volume, nil)
+
+	err := d.migrateVolume(vol, conn, volSrcArgs, op)
+	d.emitEvent(BTRFSEventMigrationFinished, vol.Volume, err)
+
+	return err
+}
+
+// migrateVolume sends a volume for migration.
+func (d *btrfs) migrateVolume(vol VolumeCopy, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, op *operations.Operation) error {
+	d.reportMigrationTransport(vol.Volume, volSrcArgs.MigrationType, op)
+
+	// Handle simple rsync and block_and_rsync through generic.
+	if volSrcArgs.MigrationType.FSType == migration.MigrationFSType_RSYNC || volSrcArgs.MigrationType.FSType == migration.MigrationFSType_BLOCK_AND_RSYNC {
+		// If volume is filesystem type and is not already a snapshot, create a fast snapshot to ensure migration is consistent.
+		// TODO add support for temporary snapshots of block volumes here.
+		if vol.contentType == ContentTypeFS && !vol.IsSnapshot() && btrfsSnapshotsDisabled(vol.Volume) {
+			d.logger.Warn("Snapshots are disabled for volume, migration may be inconsistent if the volume is in use", logger.Ctx{"name": vol.name})
+		} else if vol.contentType == ContentTypeFS && !vol.IsSnapshot() {
+			snapshotPath, cleanup, err := d.readonlySnapshot(vol.Volume)
+			if err != nil {
+				return err
+			}
+
+			// Clean up the snapshot.
+			defer cleanup()
+
+			// Set the path of the volume to the path of the fast snapshot so the migration reads from there instead.
+			vol.mountCustomPath = snapshotPath
+		}
+
+		return genericVFSMigrateVolume(d, d.state, vol, conn, volSrcArgs, op)
+	} else if volSrcArgs.MigrationType.FSType != migration.MigrationFSType_BTRFS {
+		return ErrNotSupported
+	}
+
+	// Handle btrfs send/receive migration.
+	if (volSrcArgs.MultiSync || volSrcArgs.FinalSync) && !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureMultiSync) {
+		// This is not needed if the migration is performed using btrfs send/receive.
+		return errors.New("MultiSync should not be used with optimized migration")
+	}
+
+	// The final sync only sends the changes to the volume since the last pre-copy round. The target receives
+	// the subvolumes listed in the header it received before the pre-copy rounds, so the same list is used.
+	if volSrcArgs.FinalSync {
+		state, ok := volSrcArgs.Data.(*btrfsMultiSyncState)
+		if !ok {
+			return fmt.Errorf("No previous multi sync of volume %q to finish", vol.name)
+		}
+
+		return d.migrateVolumeOptimized(vol.Volume, conn, volSrcArgs, state.subvolumes, op)
+	}
+
+	var snapshots []string
+	var err error
+
+	if !volSrcArgs.VolumeOnly {
+		// Generate restoration header, containing info on the subvolumes and how they should be restored.
+		snapshots, err = d.volumeSnapshotsSorted(vol.Volume, op)
+		if err != nil {
+			return err
+		}
+	}
+
+	migrationHeader, err := d.restorationHeader(vol.Volume, snapshots)
+	if err != nil {
+		return err
+	}
+
+	// Include the subvolume sizes so the target can reject the migration early if it lacks the space.
+	d.setMigrationSizes(vol.Volume, migrationHeader)
+
+	// If we haven't negotiated subvolume support, check if we have any subvolumes in source and fail,
+	// otherwise we would end up not materialising all of the source's files on the target.
+	if !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureMigrationHeader) || !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureSubvolumes) {
+		for _, subVol := range migrationHeader.Subvolumes {
+			if subVol.Path != string(filepath.Separator) {
+				return errors.New("Subvolumes detected in source but target does not support receiving subvolumes")
+			}
+		}
+	}
+
+	// Send metadata migration header frame with subvolume info if we have negotiated that feature.
+	if slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureMigrationHeader) {
+		headerJSON, err := json.Marshal(migrationHeader)
+		if err != nil {
+			return fmt.Errorf("Failed encoding BTRFS migration header: %w", err)
+		}
+
+		_, err = conn.Write(headerJSON)
+		if err != nil {
+			return fmt.Errorf("Failed sending BTRFS migration header: %w", err)
+		}
+
+		err = conn.Close() // End the frame.
+		if err != nil {
+			return fmt.Errorf("Failed closing BTRFS migration header frame: %w", err)
+		}
+
+		d.logger.Debug("Sent migration meta data header", logger.Ctx{"name": vol.name})
+	}
+
+	if volSrcArgs.Refresh && slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureSubvolumeUUIDs) {
+		migrationHeader = &BTRFSMetaDataHeader{}
+
+		buf, err := btrfsReadMigrationHeader(conn, d.migrationHeaderTimeout())
+		if err != nil {
+			return fmt.Errorf("Failed reading BTRFS migration header: %w", err)
+		}
+
+		err = json.Unmarshal(buf, &migrationHeader)
+		if err != nil {
+			return fmt.Errorf("Failed decoding BTRFS migration header: %w", err)
+		}
+
+		d.logger.Debug("Received BTRFS migration meta data header", logger.Ctx{"name": vol.name})
+
+		volSrcArgs.Snapshots = []string{}
+
+		// Override volSrcArgs.Snapshots to only include snapshots which need to be sent.
+		for _, snap := range migrationHeader.Subvolumes {
+			if snap.Path == "/" && snap.Snapshot != "" {
+				volSrcArgs.Snapshots = append(volSrcArgs.Snapshots, snap.Snapshot)
+			}
+		}
+	}
+
+	return d.migrateVolumeOptimized(vol.Volume, conn, volSrcArgs, migrationHeader.Subvolumes, op)
+}
+
+// migrateVolumeOptimized sends the volume and its snapshots to conn using btrfs send, sending each of them as a
+// difference to the previous one where possible.
+//
+// Block volumes are sent the same way rather than by tracking the changed extents of their disk file. A
+// differential send (btrfs send -p) already compares the extents of the disk file with those of the parent
+// snapshot and only sends the extents that changed, so refreshing a VM whose guest wrote 100MB transfers roughly
+// 100MB. Tracking the changed extents separately (for example with find-new) would find the same extents, so it
+// isn't done.
+func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volSrcArgs *migration.VolumeSourceArgs, subvolumes []BTRFSSubVolume, op *operations.Operation) error {
+	// Highest send stream protocol version used, recorded to help diagnose interoperability issues.
+	var sendProto uint32
+
+	// Count the data sent to tell when the pre-copy rounds of a multi sync migration have converged.
+	counter := &btrfsCountingConn{ReadWriteCloser: conn}
+	conn = counter
+
 	// sendVolume sends a volume and its subvolumes (if negotiated subvolumes feature) to recipient.
 	sendVolume := func(v Volume, sourcePrefix string, parentPrefix string) error {
 		snapName := "" // Default to empty (sending main volume) from migrationHeader.Subvolumes.
 
-		// Detect if we are sending a snapshot by comparing to main volume name.
+		// Detect if we are sending a snapshot by comparing to main volume name.
+		// We can't only use IsSnapshot() as the main vol may itself be a snapshot.
+		if v.IsSnapshot() && v.name != vol.name {
+			_, snapName, _ = api.GetParentAndSnapshotName(v.name)
+		}
+
+		// Setup progress tracking.
+		var wrapper *ioprogress.ProgressTracker
+		if volSrcArgs.TrackProgress {
+			wrapper = migration.ProgressTracker(op, "fs_progress", v.name)
+		}
+
+		sentVols := 0
+
+		// Gather the state of the subvolumes of the volume and its parent once rather than for each subvolume.
+		sourceStates, err := d.subvolumeStates(sourcePrefix)
+		if err != nil {
+			return err
+		}
+
+		parentStates := map[string]bool{}
+		if parentPrefix != "" {
+			parentStates, err = d.subvolumeStates(parentPrefix)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Send volume (and any subvolumes if supported) to target.
+		//revive:disable:defer Allow defer inside a loop.
+		for _, subVolume := range subvolumes {
+			if subVolume.Snapshot != snapName {
+				continue // Only sending subvolumes related to snapshot name (empty for main vol).
+			}
+
+			if subVolume.Path != string(filepath.Separator) && !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureSubvolumes) {
+				continue // Skip sending subvolumes of volume if subvolumes feature not negotiated.
+			}
+
+			// Detect if parent subvolume exists, and if so use it for differential.
+			parentPath := ""
+			parentReadonly, parentFound := parentStates[subVolume.Path]
+			if parentFound {
+				parentPath = filepath.Join(parentPrefix, subVolume.Path)
+
+				// Set parent subvolume readonly if needed so we can send the subvolume.
+				if !parentReadonly {
+					err := d.setSubvolumeReadonlyProperty(parentPath, true)
+					if err != nil {
+						return err
+					}
+
+					defer func() { _ = d.setSubvolumeReadonlyProperty(parentPath, false) }()
+				}
+			}
+
+			// Set subvolume readonly if needed so we can send it.
+			sourcePath := filepath.Join(sourcePrefix, subVolume.Path)
+			if !sourceStates[subVolume.Path] {
+				err := d.setSubvolumeReadonlyProperty(sourcePath, true)
+				if err != nil {
+					return err
+				}
+
+				defer func() { _ = d.setSubvolumeReadonlyProperty(sourcePath, false) }()
+			}
+
+			d.logger.Debug("Sending subvolume", logger.Ctx{"name": v.name, "source": sourcePath, "parent": parentPath, "path": subVolume.Path})
+			proto, err := d.sendSubvolume(sourcePath, parentPath, conn, wrapper)
+			if err != nil {
+				return fmt.Errorf("Failed sending volume %v:%s: %w", v.name, subVolume.Path, err)
+			}
+
+			sendProto = max(sendProto, proto)
+			sentVols++
+		}
+
+		// Ensure we found and sent at least root subvolume of the volume requested.
+		if sentVols < 1 {
+			return fmt.Errorf("No matching subvolume(s) for %q found in subvolumes list", v.name)
+		}
+
+		return nil
+	}
+
+	// Transfer the snapshots (and any subvolumes if supported) to target first.
+	lastVolPath := "" // Used as parent for differential transfers.
+
+	if !vol.IsSnapshot() && !volSrcArgs.VolumeOnly && !volSrcArgs.FinalSync {
+		snapshots, err := vol.Snapshots(op)
+		if err != nil {
+			return err
+		}
+
+		if volSrcArgs.Refresh {
+			for i, snap := range snapshots {
+				if i == 0 {
+					continue
+				}
+
+				_, snapName, _ := api.GetParentAndSnapshotName(snap.name)
+
+				if len(volSrcArgs.Snapshots) > 0 && snapName == volSrcArgs.Snapshots[0] {
+					lastVolPath = snapshots[i-1].MountPath()
+					break
+				}
+			}
+		}
+
+		for _, snapName := range volSrcArgs.Snapshots {
+			snapVol, _ := vol.NewSnapshot(snapName)
+			err := sendVolume(snapVol, snapVol.MountPath(), lastVolPath)
+			if err != nil {
+				return err
+			}
+
+			lastVolPath = snapVol.MountPath()
+		}
+
+		// If no snapshots are to be copied (because they are on the target already), but snapshots
+		// exist on the source, use the latest snapshot as the parent in order to speed up
+		// optimized refresh.
+		if volSrcArgs.Refresh && len(volSrcArgs.Snapshots) == 0 && len(snapshots) > 0 {
+			lastVolPath = snapshots[len(snapshots)-1].MountPath()
+		}
+	}
+
+	// The temporary directory and read-only snapshots of a multi sync migration are kept until its final sync.
+	var cleanup *revert.Reverter
+	var tmpVolumesMountPoint string
+	var err error
+
+	if volSrcArgs.FinalSync {
+		state, ok := volSrcArgs.Data.(*btrfsMultiSyncState)
+		if !ok {
+			return fmt.Errorf("No previous multi sync of volume %q to finish", vol.name)
+		}
+
+		cleanup = revert.New()
+		cleanup.Add(state.Cleanup)
+		tmpVolumesMountPoint = filepath.Dir(state.sendSnapshotPrefix)
+		lastVolPath = state.sendSnapshotPrefix
+	} else {
+		// Get instances directory (e.g. /var/lib/lxd/storage-pools/btrfs/containers).
+		instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+
+		// Create a temporary directory which will act as the parent directory of the read-only snapshot.
+		tmpVolumesMountPoint, err = os.MkdirTemp(instancesPath, "migration.")
+		if err != nil {
+			return fmt.Errorf("Failed to create temporary directory under %q: %w", instancesPath, err)
+		}
+
+		cleanup = revert.New()
+		cleanup.Add(func() { _ = os.RemoveAll(tmpVolumesMountPoint) })
+		cleanup.Add(btrfsTrackTransientPath(tmpVolumesMountPoint))
+		cleanup.Add(func() { d.deleteSubvolumesIn(tmpVolumesMountPoint) })
+
+		err = os.Chmod(tmpVolumesMountPoint, 0100)
+		if err != nil {
+			cleanup.Fail()
+			return fmt.Errorf("Failed to chmod %q: %w", tmpVolumesMountPoint, err)
+		}
+	}
+
+	defer cleanup.Fail()
+
+	// Make recursive read-only snapshot of the subvolume as writable subvolumes cannot be sent.
+	migrationSendSnapshotPrefix := filepath.Join(tmpVolumesMountPoint, ".migration-send")
+	if volSrcArgs.FinalSync {
+		migrationSendSnapshotPrefix += ".final"
+	}
+
+	_, err = d.snapshotSubvolume(vol.MountPath(), migrationSendSnapshotPrefix, true)
+	if err != nil {
+		return err
+	}
+
+	if volSrcArgs.FinalSync {
+		err = d.checkMultiSyncLayout(vol, migrationSendSnapshotPrefix, subvolumes)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Send main volume (and any subvolumes if supported) to target.
+	sent := counter.written
+	err = sendVolume(vol, migrationSendSnapshotPrefix, lastVolPath)
+	if err != nil {
+		return err
+	}
+
+	// Send the changes made while the volume was being sent until they're small enough for the final sync
+	// to be quick. The final sync then sends the changes since the last round.
+	if volSrcArgs.MultiSync && !volSrcArgs.FinalSync {
+		for round := 1; btrfsPreCopyMore(round, counter.written-sent); round++ {
+			parentPrefix := migrationSendSnapshotPrefix
+			migrationSendSnapshotPrefix = filepath.Join(tmpVolumesMountPoint, fmt.Sprintf(".migration-send.%d", round))
+			_, err = d.snapshotSubvolume(vol.MountPath(), migrationSendSnapshotPrefix, true)
+			if err != nil {
+				return err
+			}
+
+			err = d.checkMultiSyncLayout(vol, migrationSendSnapshotPrefix, subvolumes)
+			if err != nil {
+				return err
+			}
+
+			err = btrfsWritePreCopyFrame(conn, true)
+			if err != nil {
+				return err
+			}
+
+			sent = counter.written
+			err = sendVolume(vol, migrationSendSnapshotPrefix, parentPrefix)
+			if err != nil {
+				return err
+			}
+
+			d.logger.Debug("Sent pre-copy round", logger.Ctx{"name": vol.name, "round": round, "size": counter.written - sent})
+
+			err = d.deleteSubvolume(parentPrefix, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = btrfsWritePreCopyFrame(conn, false)
+		if err != nil {
+			return err
+		}
+
+		state := &btrfsMultiSyncState{
+			sendSnapshotPrefix: migrationSendSnapshotPrefix,
+			subvolumes:         slices.DeleteFunc(slices.Clone(subvolumes), func(subVol BTRFSSubVolume) bool { return subVol.Snapshot != "" }),
+			cleanup:            cleanup.Clone(),
+		}
+
+		volSrcArgs.Data = state
+		volSrcArgs.DataCleanup = state.Cleanup
+		cleanup.Success()
+
+		d.logger.Debug("Completed BTRFS pre-copy of volume", logger.Ctx{"name": vol.name})
+
+		return nil
+	}
+
+	// Send a hash of the volume's content so the target can check it received the same data.
+	if volSrcArgs.VerifyContent {
+		hash, err := d.contentHash(migrationSendSnapshotPrefix)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.Write([]byte(hash))
+		if err != nil {
+			return fmt.Errorf("Failed sending BTRFS content hash: %w", err)
+		}
+
+		err = conn.Close() // End the frame.
+		if err != nil {
+			return fmt.Errorf("Failed closing BTRFS content hash frame: %w", err)
+		}
+
+		d.logger.Debug("Sent BTRFS content hash", logger.Ctx{"name": vol.name, "hash": hash})
+	}
+
+	d.logger.Debug("Completed BTRFS optimized migration", logger.Ctx{"name": vol.name, "sendProto": sendProto, "features": volSrcArgs.MigrationType.Features})
+
+	if op != nil {
+		_ = op.ExtendMetadata(map[string]any{"send_proto": sendProto, "features": volSrcArgs.MigrationType.Features})
+	}
+
+	return nil
+}
+
+// BackupVolume copies a volume (and optionally its snapshots) to a specified target path.
+// The tarball is compressed by the caller with the backup's compression algorithm (including any level, such
+// as "zstd -19"), which is detected again on restore, so the volume files are added uncompressed.
+func (d *btrfs) BackupVolume(vol VolumeCopy, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots []string, op *operations.Operation) error {
+	err := d.backupVolume(vol, tarWriter, optimized, snapshots, op)
+	d.emitEvent(BTRFSEventBackupFinished, vol.Volume, err)
+
+	return err
+}
+
+// FilterBackupSnapshots returns the snapshots, ordered from oldest to newest, that backups of the volume include.
+// The snapshots matching btrfs.backup.snapshot_exclude are left out, and only the newest snapshots are kept if
+// limited by btrfs.backup.snapshot_limit, in which case the backup has a partial history.
+func (d *btrfs) FilterBackupSnapshots(vol Volume, snapshots []string) ([]string, bool) {
+	snapshots = btrfsFilterSnapshots(snapshots, vol.config["btrfs.backup.snapshot_exclude"])
+	includedSnapshots := btrfsLimitSnapshots(snapshots, vol.config["btrfs.backup.snapshot_limit"])
+
+	return includedSnapshots, len(includedSnapshots) < len(snapshots)
+}
+
+// backupVolume copies a volume (and optionally its snapshots) to a specified target path.
+// The snapshots are expected to have been filtered by FilterBackupSnapshots.
+func (d *btrfs) backupVolume(vol VolumeCopy, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots []string, op *operations.Operation) error {
+	// Handle the non-optimized tarballs through the generic packer.
+	if !optimized {
+		// Because the generic backup method will not take a consistent backup if files are being modified
+		// as they are copied to the tarball, as BTRFS allows us to take a quick snapshot without impacting
+		// the parent volume we do so here to ensure the backup taken is consistent.
+		if vol.contentType == ContentTypeFS && btrfsSnapshotsDisabled(vol.Volume) {
+			d.logger.Warn("Snapshots are disabled for volume, backup may be inconsistent if the volume is in use", logger.Ctx{"name": vol.name})
+		} else if vol.contentType == ContentTypeFS {
+			snapshotPath, cleanup, err := d.readonlySnapshot(vol.Volume)
+			if err != nil {
+				return err
+			}
+
+			// Clean up the snapshot.
+			defer cleanup()
+
+			// Set the path of the volume to the path of the fast snapshot so the migration reads from there instead.
+			vol.mountCustomPath = snapshotPath
+		}
+
+		return genericVFSBackupVolume(d, vol, tarWriter, snapshots, op)
+	}
+
+	// Optimized backup.
+
+	if len(snapshots) > 0 {
+		// Check requested snapshot match those in storage.
+		err := d.CheckVolumeSnapshots(vol.Volume, vol.Snapshots, op)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Generate driver restoration header.
+	optimizedHeader, err := d.restorationHeader(vol.Volume, snapshots)
+	if err != nil {
+		return err
+	}
+
+	// Include the volume's settings so that they can be restored without LXD's database.
+	optimizedHeader.Volume, err = d.volumeSettings(vol.Volume)
+	if err != nil {
+		return err
+	}
+
+	optimizedHeader.FormatVersion = btrfsBackupFormatVersion
+
+	// Record whether older snapshots are left out of the backup, as is done in the backup index.
+	allSnapshots := make([]string, 0, len(vol.Snapshots))
+	for _, snapVol := range vol.Snapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(snapVol.name)
+		allSnapshots = append(allSnapshots, snapName)
+	}
+
+	_, optimizedHeader.PartialHistory = d.FilterBackupSnapshots(vol.Volume, allSnapshots)
+
+	// Fail early if the volume files are expected to exceed the working space limit.
+	workingSpace, err := d.backupWorkingSpace()
+	if err != nil {
+		return err
+	}
+
+	if workingSpace.limit > 0 {
+		sizesHeader := BTRFSMetaDataHeader{Subvolumes: slices.Clone(optimizedHeader.Subvolumes)}
+		d.setMigrationSizes(vol.Volume, &sizesHeader)
+
+		peakSize := btrfsBackupPeakSize(sizesHeader.Subvolumes)
+		if peakSize > workingSpace.limit {
+			return fmt.Errorf("Backup needs an estimated %s of working space, which exceeds btrfs.backup.working_dir_limit of %s", units.GetByteSizeStringIEC(peakSize, 2), units.GetByteSizeStringIEC(workingSpace.limit, 2))
+		}
+	}
+
+	// Convert to YAML.
+	optimizedHeaderYAML, err := yaml.Marshal(&optimizedHeader)
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(optimizedHeaderYAML)
+
+	indexFileInfo := instancewriter.FileInfo{
+		FileName:    "backup/optimized_header.yaml",
+		FileSize:    int64(len(optimizedHeaderYAML)),
+		FileMode:    0644,
+		FileModTime: time.Now(),
+	}
+
+	// Write to tarball.
+	err = tarWriter.WriteFileFromReader(r, &indexFileInfo)
+	if err != nil {
+		return err
+	}
+
+	// Stop sending subvolumes if the backup operation is cancelled.
+	ctx, cancel := d.operationContext(op)
+	defer cancel()
+
+	// sendToFile sends a subvolume to a temporary file and returns its path.
+	// The caller is responsible for removing the file.
+	sendToFile := func(path string, parent string, fileName string) (string, error) {
+		// Prepare btrfs send arguments.
+		args := []string{"send"}
+		if parent != "" {
+			args = append(args, "-p", parent)
+		}
+
+		args = append(args, path)
+
+		// Create temporary file to store output of btrfs send.
+		tmpFile, err := os.CreateTemp(workingSpace.path, backup.WorkingDirPrefix+"_btrfs")
+		if err != nil {
+			return "", fmt.Errorf("Failed to open temporary file for BTRFS backup: %w", err)
+		}
+
+		revert := revert.New()
+		defer revert.Fail()
+
+		tmpFileWriter := &btrfsBackupWorkingSpaceWriter{w: tmpFile, space: workingSpace}
+
+		revert.Add(func() {
+			_ = os.Remove(tmpFile.Name())
+			workingSpace.Release(tmpFileWriter.written)
+		})
+
+		defer func() { _ = tmpFile.Close() }()
+
+		// Write the subvolume to the file.
+		d.logger.Debug("Generating optimized volume file", logger.Ctx{"sourcePath": path, "parent": parent, "file": tmpFile.Name(), "name": fileName})
+		verifier := &btrfsSendStreamVerifier{}
+		err = shared.RunCommandWithFds(ctx, nil, io.MultiWriter(tmpFileWriter, verifier), "btrfs", args...)
+		if err != nil {
+			return "", err
+		}
+
+		// Don't add a partially written stream to the backup.
+		err = verifier.Verify()
+		if err != nil {
+			return "", fmt.Errorf("Failed generating optimized volume file for %q: %w", path, err)
+		}
+
+		err = tmpFile.Close()
+		if err != nil {
+			return "", err
+		}
+
+		revert.Success()
+
+		return tmpFile.Name(), nil
+	}
+
+	// addFile adds a file generated by sendToFile to the backup file.
+	addFile := func(tmpFilePath string, fileName string) error {
+		// Get info (importantly size) of the generated file for tarball header.
+		tmpFileInfo, err := os.Lstat(tmpFilePath)
+		if err != nil {
+			return err
+		}
+
+		return tarWriter.WriteFile(fileName, tmpFilePath, tmpFileInfo, false)
+	}
+
+	// addVolume adds a volume and its subvolumes to backup file.
+	addVolume := func(v Volume, sourcePrefix string, parentPrefix string, fileNamePrefix string) error {
+		snapName := "" // Default to empty (sending main volume) from migrationHeader.Subvolumes.
+
+		// Detect if we are adding a snapshot by comparing to main volume name.
 		// We can't only use IsSnapshot() as the main vol may itself be a snapshot.
 		if v.IsSnapshot() && v.name != vol.name {
 			_, snapName, _ = api.GetParentAndSnapshotName(v.name)
 		}
 
-		// Setup progress tracking.
-		var wrapper *ioprogress.ProgressTracker
-		if volSrcArgs.TrackProgress {
-			wrapper = migration.ProgressTracker(op, "fs_progress", v.name)
+		// Subvolumes to send, in the order they are added to the backup file.
+		type subVolumeSend struct {
+			path       string
+			sourcePath string
+			parentPath string
+			fileName   string
+			tmpFile    string
 		}
 
-		sentVols := 0
+		sends := []*subVolumeSend{}
 
-		// Send volume (and any subvolumes if supported) to target.
-		//revive:disable:defer Allow defer inside a loop.
-		for _, subVolume := range subvolumes {
-			if subVolume.Snapshot != snapName {
-				continue // Only sending subvolumes related to snapshot name (empty for main vol).
+		// Gather the state of the subvolumes of the volume and its parent once rather than for each subvolume.
+		sourceStates, err := d.subvolumeStates(sourcePrefix)
+		if err != nil {
+			return err
+		}
+
+		parentStates := map[string]bool{}
+		if parentPrefix != "" {
+			parentStates, err = d.subvolumeStates(parentPrefix)
+			if err != nil {
+				return err
 			}
+		}
 
-			if subVolume.Path != string(filepath.Separator) && !slices.Contains(volSrcArgs.MigrationType.Features, migration.BTRFSFeatureSubvolumes) {
-				continue // Skip sending subvolumes of volume if subvolumes feature not negotiated.
+		// Add volume (and any subvolumes if supported) to backup file.
+		for _, subVolume := range optimizedHeader.Subvolumes {
+			if subVolume.Snapshot != snapName {
+				continue // Only add subvolumes related to snapshot name (empty for main vol).
 			}
 
 			// Detect if parent subvolume exists, and if so use it for differential.
 			parentPath := ""
-			if parentPrefix != "" && d.isSubvolume(filepath.Join(parentPrefix, subVolume.Path)) {
+			parentReadonly, parentFound := parentStates[subVolume.Path]
+			if parentFound {
 				parentPath = filepath.Join(parentPrefix, subVolume.Path)
 
-				// Set parent subvolume readonly if needed so we can send the subvolume.
-				if !btrfsSubVolumeIsRo(parentPath) {
-					err := d.setSubvolumeReadonlyProperty(parentPath, true)
+				// Set parent subvolume readonly if needed so we can add the subvolume.
+				if !parentReadonly {
+					err = d.setSubvolumeReadonlyProperty(parentPath, true)
 					if err != nil {
 						return err
 					}
@@ -1312,10 +3524,10 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 				}
 			}
 
-			// Set subvolume readonly if needed so we can send it.
+			// Set subvolume readonly if needed so we can add it.
 			sourcePath := filepath.Join(sourcePrefix, subVolume.Path)
-			if !btrfsSubVolumeIsRo(sourcePath) {
-				err := d.setSubvolumeReadonlyProperty(sourcePath, true)
+			if !sourceStates[subVolume.Path] {
+				err = d.setSubvolumeReadonlyProperty(sourcePath, true)
 				if err != nil {
 					return err
 				}
@@ -1323,396 +3535,635 @@ func (d *btrfs) migrateVolumeOptimized(vol Volume, conn io.ReadWriteCloser, volS
 				defer func() { _ = d.setSubvolumeReadonlyProperty(sourcePath, false) }()
 			}
 
-			d.logger.Debug("Sending subvolume", logger.Ctx{"name": v.name, "source": sourcePath, "parent": parentPath, "path": subVolume.Path})
-			err := d.sendSubvolume(sourcePath, parentPath, conn, wrapper)
-			if err != nil {
-				return fmt.Errorf("Failed sending volume %v:%s: %w", v.name, subVolume.Path, err)
-			}
+			// Default to no subvolume name for root subvolume to maintain backwards compatibility
+			// with earlier optimized dump format. Although restoring this backup file on an earlier
+			// system will not restore the subvolumes stored inside the backup.
+			subVolName := ""
+			if subVolume.Path != string(filepath.Separator) {
+				// Encode the path of the subvolume (without the leading /) into the filename so
+				// that we find the file from the optimized header's Path field on restore.
+				subVolName = "_" + filesystem.PathNameEncode(strings.TrimPrefix(subVolume.Path, string(filepath.Separator)))
+			}
+
+			sends = append(sends, &subVolumeSend{
+				path:       subVolume.Path,
+				sourcePath: sourcePath,
+				parentPath: parentPath,
+				fileName:   filepath.Join("backup", fileNamePrefix+subVolName+".bin"),
+			})
+		}
+
+		// Ensure we found at least root subvolume of the volume requested.
+		if len(sends) < 1 {
+			return fmt.Errorf("No matching subvolume(s) for %q found in subvolumes list", v.name)
+		}
+
+		// Remove the temporary files once added to the backup file (or on failure).
+		defer func() {
+			for _, send := range sends {
+				if send.tmpFile == "" {
+					continue
+				}
+
+				tmpFileInfo, err := os.Lstat(send.tmpFile)
+				if err == nil {
+					workingSpace.Release(tmpFileInfo.Size())
+				}
+
+				_ = os.Remove(send.tmpFile)
+			}
+		}()
+
+		// The subvolumes of a volume don't depend on each other so they can be sent concurrently.
+		// Their parents are in the previously added snapshot, which is complete at this point.
+		g := errgroup.Group{}
+		g.SetLimit(btrfsBackupConcurrentSends)
+
+		for _, send := range sends {
+			g.Go(func() error {
+				tmpFile, err := sendToFile(send.sourcePath, send.parentPath, send.fileName)
+				if err != nil {
+					return fmt.Errorf("Failed adding volume %v:%s: %w", v.name, send.path, err)
+				}
+
+				send.tmpFile = tmpFile
+
+				return nil
+			})
+		}
+
+		err = g.Wait()
+		if err != nil {
+			return err
+		}
+
+		// Add the files in the order of the subvolumes list, which is the order they are restored in.
+		for _, send := range sends {
+			err = addFile(send.tmpFile, send.fileName)
+			if err != nil {
+				return fmt.Errorf("Failed adding volume %v:%s: %w", v.name, send.path, err)
+			}
+		}
+
+		return nil
+	}
+
+	// Backup snapshots if populated.
+	lastVolPath := "" // Used as parent for differential exports.
+	for _, snapName := range snapshots {
+		snapVol, _ := vol.NewSnapshot(snapName)
+
+		// Make a binary btrfs backup.
+		snapDir := "snapshots"
+		fileName := snapName
+		switch vol.volType {
+		case VolumeTypeVM:
+			snapDir = "virtual-machine-snapshots"
+			if vol.contentType == ContentTypeFS {
+				fileName = snapName + "-config"
+			}
+
+		case VolumeTypeCustom:
+			snapDir = "volume-snapshots"
+		}
+
+		fileNamePrefix := filepath.Join(snapDir, fileName)
+		err := addVolume(snapVol, snapVol.MountPath(), lastVolPath, fileNamePrefix)
+		if err != nil {
+			return err
+		}
+
+		lastVolPath = snapVol.MountPath()
+	}
+
+	// Make a temporary copy of the instance.
+	sourceVolume := vol.MountPath()
+	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+
+	tmpInstanceMntPoint, err := os.MkdirTemp(instancesPath, "backup.")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory under %q: %w", instancesPath, err)
+	}
+
+	defer func() { _ = os.RemoveAll(tmpInstanceMntPoint) }()
+
+	untrack := btrfsTrackTransientPath(tmpInstanceMntPoint)
+	defer untrack()
+
+	err = os.Chmod(tmpInstanceMntPoint, 0100)
+	if err != nil {
+		return fmt.Errorf("Failed to chmod %q: %w", tmpInstanceMntPoint, err)
+	}
+
+	// Create the read-only snapshot.
+	targetVolume := tmpInstanceMntPoint + "/.backup"
+	_, err = d.snapshotSubvolume(sourceVolume, targetVolume, true)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = d.deleteSubvolume(targetVolume, true) }()
+
+	err = d.setSubvolumeReadonlyProperty(targetVolume, true)
+	if err != nil {
+		return err
+	}
+
+	// Dump the instance to a file.
+	fileNamePrefix := "container"
+	switch vol.volType {
+	case VolumeTypeVM:
+		if vol.contentType == ContentTypeFS {
+			fileNamePrefix = "virtual-machine-config"
+		} else {
+			fileNamePrefix = "virtual-machine"
+		}
+
+	case VolumeTypeCustom:
+		fileNamePrefix = "volume"
+	}
+
+	err = addVolume(vol.Volume, targetVolume, lastVolPath, fileNamePrefix)
+	if err != nil {
+		return err
+	}
+
+	// Ensure snapshot sub volumes are removed.
+	err = d.deleteSubvolume(targetVolume, true)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MeasureBackupVolume returns the exact size an optimized backup of the volume and the given snapshots would
+// add to the backup tarball (before any compression), without storing it. The backup is generated as by
+// BackupVolume but written to a writer which only counts its size, so it takes as long and needs the same
+// working space as a real backup.
+func (d *btrfs) MeasureBackupVolume(vol VolumeCopy, snapshots []string, op *operations.Operation) (int64, error) {
+	counter := &btrfsCountingWriter{}
+	tarWriter := instancewriter.NewInstanceTarWriter(counter, nil)
+
+	err := d.backupVolume(vol, tarWriter, true, snapshots, op)
+	if err != nil {
+		return -1, err
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return -1, err
+	}
+
+	return counter.written, nil
+}
+
+// RecommendBackupMode returns whether an optimized backup of the volume and its snapshots is recommended over
+// a generic one, along with the reason so that operators can decide whether to override it. The snapshots
+// left out of backups by the volume's config are left out of the estimate too. The sizes are estimated from
+// the qgroup usage, so the recommendation is only based on the volume's structure without quotas.
+func (d *btrfs) RecommendBackupMode(vol VolumeCopy) (bool, string, error) {
+	snapshots := make([]string, 0, len(vol.Snapshots))
+	for _, snapVol := range vol.Snapshots {
+		_, snapName, _ := api.GetParentAndSnapshotName(snapVol.name)
+		snapshots = append(snapshots, snapName)
+	}
+
+	snapshots, _ = d.FilterBackupSnapshots(vol.Volume, snapshots)
+
+	header, err := d.restorationHeader(vol.Volume, snapshots)
+	if err != nil {
+		return false, "", err
+	}
+
+	d.setMigrationSizes(vol.Volume, header)
 
-			sentVols++
-		}
+	optimized, reason := btrfsRecommendBackupMode(header.Subvolumes)
 
-		// Ensure we found and sent at least root subvolume of the volume requested.
-		if sentVols < 1 {
-			return fmt.Errorf("No matching subvolume(s) for %q found in subvolumes list", v.name)
-		}
+	return optimized, reason, nil
+}
 
-		return nil
-	}
+// CreateVolumeSnapshot creates a snapshot of a volume.
+func (d *btrfs) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
+	return d.createVolumeSnapshot(snapVol, nil, nil, op)
+}
 
-	// Transfer the snapshots (and any subvolumes if supported) to target first.
-	lastVolPath := "" // Used as parent for differential transfers.
+// CreateVolumeSnapshotWithFreeze creates a snapshot of a volume while the filesystems using it are frozen.
+// A snapshot of a VM's disk file on its own is only crash consistent, so the caller can supply a freeze function
+// which quiesces the guest's filesystems (for example through the guest agent) and returns a function to thaw
+// them again. The filesystems are only frozen while the snapshot is taken and are thawed even if it fails.
+func (d *btrfs) CreateVolumeSnapshotWithFreeze(snapVol Volume, freeze func() (func() error, error), op *operations.Operation) error {
+	return d.createVolumeSnapshot(snapVol, nil, freeze, op)
+}
 
-	if !vol.IsSnapshot() && !volSrcArgs.VolumeOnly {
-		snapshots, err := vol.Snapshots(op)
+// CreateVolumeSnapshotWithLabels creates a snapshot of a volume and stamps it with the supplied labels.
+// The labels are stored as extended attributes on the root of the snapshot's subvolume, so they are kept
+// with the data when the snapshot is sent to another pool using the optimized migration or backup format.
+func (d *btrfs) CreateVolumeSnapshotWithLabels(snapVol Volume, labels map[string]string, op *operations.Operation) error {
+	for name := range labels {
+		err := validate.IsDeviceName(name)
 		if err != nil {
-			return err
+			return fmt.Errorf("Invalid snapshot label name %q: %w", name, err)
 		}
+	}
 
-		if volSrcArgs.Refresh {
-			for i, snap := range snapshots {
-				if i == 0 {
-					continue
-				}
+	return d.createVolumeSnapshot(snapVol, labels, nil, op)
+}
 
-				_, snapName, _ := api.GetParentAndSnapshotName(snap.name)
+// GetVolumeSnapshotLabels returns the labels the snapshot was created with.
+func (d *btrfs) GetVolumeSnapshotLabels(snapVol Volume) (map[string]string, error) {
+	xattrs, err := shared.GetAllXattr(snapVol.MountPath())
+	if err != nil {
+		return nil, err
+	}
 
-				if len(volSrcArgs.Snapshots) > 0 && snapName == volSrcArgs.Snapshots[0] {
-					lastVolPath = snapshots[i-1].MountPath()
-					break
-				}
-			}
+	labels := map[string]string{}
+	for key, value := range xattrs {
+		name, found := strings.CutPrefix(key, btrfsSnapshotLabelXattrPrefix)
+		if found {
+			labels[name] = value
 		}
+	}
 
-		for _, snapName := range volSrcArgs.Snapshots {
-			snapVol, _ := vol.NewSnapshot(snapName)
-			err := sendVolume(snapVol, snapVol.MountPath(), lastVolPath)
-			if err != nil {
-				return err
-			}
+	return labels, nil
+}
 
-			lastVolPath = snapVol.MountPath()
-		}
+// createVolumeSnapshot creates a snapshot of a volume with the given labels.
+// If freeze is set, it is called right before the snapshot is taken and the returned function right after.
+func (d *btrfs) createVolumeSnapshot(snapVol Volume, labels map[string]string, freeze func() (func() error, error), op *operations.Operation) (err error) {
+	defer func() { d.emitEvent(BTRFSEventSnapshotCreated, snapVol, err) }()
 
-		// If no snapshots are to be copied (because they are on the target already), but snapshots
-		// exist on the source, use the latest snapshot as the parent in order to speed up
-		// optimized refresh.
-		if volSrcArgs.Refresh && len(volSrcArgs.Snapshots) == 0 && len(snapshots) > 0 {
-			lastVolPath = snapshots[len(snapshots)-1].MountPath()
-		}
+	parentName, snapName, _ := api.GetParentAndSnapshotName(snapVol.name)
+
+	err = btrfsValidSnapName(snapName)
+	if err != nil {
+		return err
 	}
 
-	// Get instances directory (e.g. /var/lib/lxd/storage-pools/btrfs/containers).
-	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+	if btrfsSnapshotsDisabled(snapVol) {
+		return fmt.Errorf("Snapshots are disabled for volume %q", parentName)
+	}
 
-	// Create a temporary directory which will act as the parent directory of the read-only snapshot.
-	tmpVolumesMountPoint, err := os.MkdirTemp(instancesPath, "migration.")
+	// Throttle before taking the lock so that other snapshot operations on the volume aren't blocked while
+	// waiting, and before freezing so that the guest isn't kept frozen while waiting.
+	err = d.throttleSnapshot(GetVolumeMountPath(d.name, snapVol.volType, parentName), op)
 	if err != nil {
-		return fmt.Errorf("Failed to create temporary directory under %q: %w", instancesPath, err)
+		return err
 	}
 
-	defer func() { _ = os.RemoveAll(tmpVolumesMountPoint) }()
+	unlock, err := d.snapshotsLock(snapVol.volType, snapVol.contentType, parentName)
+	if err != nil {
+		return err
+	}
 
-	err = os.Chmod(tmpVolumesMountPoint, 0100)
+	defer unlock()
+
+	err = d.checkNotFrozen(snapVol)
 	if err != nil {
-		return fmt.Errorf("Failed to chmod %q: %w", tmpVolumesMountPoint, err)
+		return err
 	}
 
-	// Make recursive read-only snapshot of the subvolume as writable subvolumes cannot be sent.
-	migrationSendSnapshotPrefix := filepath.Join(tmpVolumesMountPoint, ".migration-send")
-	_, err = d.snapshotSubvolume(vol.MountPath(), migrationSendSnapshotPrefix, true)
+	err = d.checkSnapshotInterval(snapVol)
 	if err != nil {
 		return err
 	}
 
-	defer func() { _ = d.deleteSubvolume(migrationSendSnapshotPrefix, true) }()
+	if freeze == nil {
+		_, err = d.snapshotVolume(snapVol, labels)
+		return err
+	}
 
-	// Send main volume (and any subvolumes if supported) to target.
-	return sendVolume(vol, migrationSendSnapshotPrefix, lastVolPath)
-}
+	unfreeze, err := freeze()
+	if err != nil {
+		return fmt.Errorf("Failed freezing filesystems of volume %q: %w", parentName, err)
+	}
 
-// BackupVolume copies a volume (and optionally its snapshots) to a specified target path.
-// This driver does not support optimized backups.
-func (d *btrfs) BackupVolume(vol VolumeCopy, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots []string, op *operations.Operation) error {
-	// Handle the non-optimized tarballs through the generic packer.
-	if !optimized {
-		// Because the generic backup method will not take a consistent backup if files are being modified
-		// as they are copied to the tarball, as BTRFS allows us to take a quick snapshot without impacting
-		// the parent volume we do so here to ensure the backup taken is consistent.
-		if vol.contentType == ContentTypeFS {
-			snapshotPath, cleanup, err := d.readonlySnapshot(vol.Volume)
-			if err != nil {
-				return err
-			}
+	cleanup, err := d.snapshotVolume(snapVol, labels)
 
-			// Clean up the snapshot.
-			defer cleanup()
+	unfreezeErr := unfreeze()
+	if unfreezeErr != nil {
+		unfreezeErr = fmt.Errorf("Failed unfreezing filesystems of volume %q: %w", parentName, unfreezeErr)
+	}
 
-			// Set the path of the volume to the path of the fast snapshot so the migration reads from there instead.
-			vol.mountCustomPath = snapshotPath
-		}
+	if err != nil {
+		return errors.Join(err, unfreezeErr)
+	}
 
-		return genericVFSBackupVolume(d, vol, tarWriter, snapshots, op)
+	// Failing to thaw leaves the guest stuck, so the whole snapshot is failed for the caller to handle it.
+	if unfreezeErr != nil {
+		cleanup()
+		return unfreezeErr
 	}
 
-	// Optimized backup.
+	return nil
+}
 
-	if len(snapshots) > 0 {
-		// Check requested snapshot match those in storage.
-		err := d.CheckVolumeSnapshots(vol.Volume, vol.Snapshots, op)
-		if err != nil {
-			return err
-		}
+// snapshotVolume creates a snapshot of a volume with the given labels and returns a hook which deletes it again.
+// The caller must hold the snapshots lock of the volume.
+func (d *btrfs) snapshotVolume(snapVol Volume, labels map[string]string) (revert.Hook, error) {
+	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
+	srcPath := GetVolumeMountPath(d.name, snapVol.volType, parentName)
+	snapPath := snapVol.MountPath()
+
+	if shared.PathExists(snapPath) {
+		return nil, fmt.Errorf("Snapshot %q already exists", snapVol.name)
 	}
 
-	// Generate driver restoration header.
-	optimizedHeader, err := d.restorationHeader(vol.Volume, snapshots)
+	// Create the parent directory.
+	err := createParentSnapshotDirIfMissing(d.name, snapVol.volType, parentName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Convert to YAML.
-	optimizedHeaderYAML, err := yaml.Marshal(&optimizedHeader)
+	revert := revert.New()
+	defer revert.Fail()
+
+	cleanup, err := d.snapshotSubvolume(srcPath, snapPath, true)
 	if err != nil {
-		return err
+		return nil, d.diagnoseSpaceError(srcPath, err)
 	}
 
-	r := bytes.NewReader(optimizedHeaderYAML)
+	if cleanup != nil {
+		revert.Add(cleanup)
+	}
 
-	indexFileInfo := instancewriter.FileInfo{
-		FileName:    "backup/optimized_header.yaml",
-		FileSize:    int64(len(optimizedHeaderYAML)),
-		FileMode:    0644,
-		FileModTime: time.Now(),
+	// Labels need to be set before the snapshot is made readonly.
+	err = setSnapshotLabels(snapPath, labels)
+	if err != nil {
+		return nil, err
 	}
 
-	// Write to tarball.
-	err = tarWriter.WriteFileFromReader(r, &indexFileInfo)
+	err = d.setSubvolumeReadonlyProperty(snapPath, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// sendToFile sends a subvolume to backup file.
-	sendToFile := func(path string, parent string, fileName string) error {
-		// Prepare btrfs send arguments.
-		args := []string{"send"}
-		if parent != "" {
-			args = append(args, "-p", parent)
+	// Set any subvolumes that were readonly in the source also readonly in the snapshot.
+	srcVol := NewVolume(d, d.name, snapVol.volType, snapVol.contentType, parentName, snapVol.config, snapVol.poolConfig)
+	subVols, err := d.getSubvolumesMetaData(srcVol)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subVol := range subVols {
+		if subVol.Readonly {
+			err = d.setSubvolumeReadonlyProperty(filepath.Join(snapPath, subVol.Path), true)
+			if err != nil {
+				return nil, err
+			}
 		}
+	}
 
-		args = append(args, path)
+	revert.Success()
 
-		// Create temporary file to store output of btrfs send.
-		tmpFile, err := os.CreateTemp(d.state.BackupsStoragePath(), backup.WorkingDirPrefix+"_btrfs")
-		if err != nil {
-			return fmt.Errorf("Failed to open temporary file for BTRFS backup: %w", err)
+	return func() {
+		_ = d.deleteSubvolume(snapPath, true)
+		_ = deleteParentSnapshotDirIfEmpty(d.name, snapVol.volType, parentName)
+	}, nil
+}
+
+// CreateVolumeSnapshotSet creates the snapshots of several volumes as a unit, such as the snapshots of the
+// config and disk volumes of a VM. The snapshots of all volumes are locked first and then taken back to back to
+// keep the time skew between them minimal. If any of the snapshots fails then all of them are removed again.
+func (d *btrfs) CreateVolumeSnapshotSet(snapVols []Volume, op *operations.Operation) error {
+	// The config and disk volumes of a VM share a subvolume, so each subvolume is only snapshotted once.
+	snapPaths := map[string]bool{}
+	lockVols := map[string]Volume{}
+	toSnapshot := make([]Volume, 0, len(snapVols))
+
+	for _, snapVol := range snapVols {
+		if !snapVol.IsSnapshot() {
+			return fmt.Errorf("Volume %q is not a snapshot", snapVol.name)
 		}
 
-		defer func() { _ = tmpFile.Close() }()
-		defer func() { _ = os.Remove(tmpFile.Name()) }()
+		parentName, snapName, _ := api.GetParentAndSnapshotName(snapVol.name)
 
-		// Write the subvolume to the file.
-		d.logger.Debug("Generating optimized volume file", logger.Ctx{"sourcePath": path, "parent": parent, "file": tmpFile.Name(), "name": fileName})
-		err = shared.RunCommandWithFds(d.state.ShutdownCtx, nil, tmpFile, "btrfs", args...)
+		err := btrfsValidSnapName(snapName)
 		if err != nil {
 			return err
 		}
 
-		// Get info (importantly size) of the generated file for tarball header.
-		tmpFileInfo, err := os.Lstat(tmpFile.Name())
-		if err != nil {
-			return err
+		if btrfsSnapshotsDisabled(snapVol) {
+			return fmt.Errorf("Snapshots are disabled for volume %q", parentName)
 		}
 
-		err = tarWriter.WriteFile(fileName, tmpFile.Name(), tmpFileInfo, false)
-		if err != nil {
-			return err
+		if snapPaths[snapVol.MountPath()] {
+			continue
 		}
 
-		return tmpFile.Close()
+		snapPaths[snapVol.MountPath()] = true
+		toSnapshot = append(toSnapshot, snapVol)
+		lockVols[d.snapshotsLockName(snapVol.volType, snapVol.contentType, parentName)] = snapVol
 	}
 
-	// addVolume adds a volume and its subvolumes to backup file.
-	addVolume := func(v Volume, sourcePrefix string, parentPrefix string, fileNamePrefix string) error {
-		snapName := "" // Default to empty (sending main volume) from migrationHeader.Subvolumes.
+	// Throttle the set as a whole so that its snapshots are still taken back to back. This is done before
+	// taking the locks so that other snapshot operations on the volumes aren't blocked while waiting.
+	if len(toSnapshot) > 0 {
+		parentName, _, _ := api.GetParentAndSnapshotName(toSnapshot[0].name)
 
-		// Detect if we are adding a snapshot by comparing to main volume name.
-		// We can't only use IsSnapshot() as the main vol may itself be a snapshot.
-		if v.IsSnapshot() && v.name != vol.name {
-			_, snapName, _ = api.GetParentAndSnapshotName(v.name)
+		err := d.throttleSnapshot(GetVolumeMountPath(d.name, toSnapshot[0].volType, parentName), op)
+		if err != nil {
+			return err
 		}
+	}
 
-		sentVols := 0
-
-		// Add volume (and any subvolumes if supported) to backup file.
-		for _, subVolume := range optimizedHeader.Subvolumes {
-			if subVolume.Snapshot != snapName {
-				continue // Only add subvolumes related to snapshot name (empty for main vol).
-			}
-
-			// Detect if parent subvolume exists, and if so use it for differential.
-			parentPath := ""
-			if parentPrefix != "" && d.isSubvolume(filepath.Join(parentPrefix, subVolume.Path)) {
-				parentPath = filepath.Join(parentPrefix, subVolume.Path)
-
-				// Set parent subvolume readonly if needed so we can add the subvolume.
-				if !btrfsSubVolumeIsRo(parentPath) {
-					err = d.setSubvolumeReadonlyProperty(parentPath, true)
-					if err != nil {
-						return err
-					}
-
-					defer func() { _ = d.setSubvolumeReadonlyProperty(parentPath, false) }()
-				}
-			}
-
-			// Set subvolume readonly if needed so we can add it.
-			sourcePath := filepath.Join(sourcePrefix, subVolume.Path)
-			if !btrfsSubVolumeIsRo(sourcePath) {
-				err = d.setSubvolumeReadonlyProperty(sourcePath, true)
-				if err != nil {
-					return err
-				}
-
-				defer func() { _ = d.setSubvolumeReadonlyProperty(sourcePath, false) }()
-			}
-
-			// Default to no subvolume name for root subvolume to maintain backwards compatibility
-			// with earlier optimized dump format. Although restoring this backup file on an earlier
-			// system will not restore the subvolumes stored inside the backup.
-			subVolName := ""
-			if subVolume.Path != string(filepath.Separator) {
-				// Encode the path of the subvolume (without the leading /) into the filename so
-				// that we find the file from the optimized header's Path field on restore.
-				subVolName = "_" + filesystem.PathNameEncode(strings.TrimPrefix(subVolume.Path, string(filepath.Separator)))
-			}
+	// Take the locks in a consistent order so concurrent sets of overlapping volumes can't deadlock.
+	lockNames := make([]string, 0, len(lockVols))
+	for lockName := range lockVols {
+		lockNames = append(lockNames, lockName)
+	}
 
-			fileName := fileNamePrefix + subVolName + ".bin"
-			err = sendToFile(sourcePath, parentPath, filepath.Join("backup", fileName))
-			if err != nil {
-				return fmt.Errorf("Failed adding volume %v:%s: %w", v.name, subVolume.Path, err)
-			}
+	slices.Sort(lockNames)
 
-			sentVols++
+	unlocks := make([]func(), 0, len(lockNames))
+	defer func() {
+		for _, unlock := range unlocks {
+			unlock()
 		}
+	}()
 
-		// Ensure we found and sent at least root subvolume of the volume requested.
-		if sentVols < 1 {
-			return fmt.Errorf("No matching subvolume(s) for %q found in subvolumes list", v.name)
+	for _, lockName := range lockNames {
+		lockVol := lockVols[lockName]
+		parentName, _, _ := api.GetParentAndSnapshotName(lockVol.name)
+
+		unlock, err := d.snapshotsLock(lockVol.volType, lockVol.contentType, parentName)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		unlocks = append(unlocks, unlock)
 	}
 
-	// Backup snapshots if populated.
-	lastVolPath := "" // Used as parent for differential exports.
-	for _, snapName := range snapshots {
-		snapVol, _ := vol.NewSnapshot(snapName)
-
-		// Make a binary btrfs backup.
-		snapDir := "snapshots"
-		fileName := snapName
-		switch vol.volType {
-		case VolumeTypeVM:
-			snapDir = "virtual-machine-snapshots"
-			if vol.contentType == ContentTypeFS {
-				fileName = snapName + "-config"
-			}
-
-		case VolumeTypeCustom:
-			snapDir = "volume-snapshots"
+	for _, snapVol := range toSnapshot {
+		err := d.checkNotFrozen(snapVol)
+		if err != nil {
+			return err
 		}
+	}
 
-		fileNamePrefix := filepath.Join(snapDir, fileName)
-		err := addVolume(snapVol, snapVol.MountPath(), lastVolPath, fileNamePrefix)
+	// Set up the revert after the locks so the snapshots are removed before the locks are released.
+	revert := revert.New()
+	defer revert.Fail()
+
+	for _, snapVol := range toSnapshot {
+		cleanup, err := d.snapshotVolume(snapVol, nil)
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed creating snapshot %q: %w", snapVol.name, err)
 		}
 
-		lastVolPath = snapVol.MountPath()
+		revert.Add(cleanup)
 	}
 
-	// Make a temporary copy of the instance.
-	sourceVolume := vol.MountPath()
-	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+	revert.Success()
+	return nil
+}
 
-	tmpInstanceMntPoint, err := os.MkdirTemp(instancesPath, "backup.")
+// ImportSnapshotStream receives a single btrfs send stream from r as a new snapshot of an existing volume.
+// If parentSnap is provided, it must be an existing snapshot of the volume which the stream is incremental to.
+// Otherwise the stream must not be incremental.
+func (d *btrfs) ImportSnapshotStream(vol Volume, snapName string, r io.Reader, parentSnap string, op *operations.Operation) error {
+	if vol.IsSnapshot() {
+		return errors.New("Volume must not be a snapshot")
+	}
+
+	// Defend against path traversal attacks.
+	err := btrfsValidSnapName(snapName)
 	if err != nil {
-		return fmt.Errorf("Failed to create temporary directory under %q: %w", instancesPath, err)
+		return err
 	}
 
-	defer func() { _ = os.RemoveAll(tmpInstanceMntPoint) }()
+	if parentSnap != "" {
+		err = btrfsValidSnapName(parentSnap)
+		if err != nil {
+			return fmt.Errorf("Invalid parent snapshot: %w", err)
+		}
+	}
 
-	err = os.Chmod(tmpInstanceMntPoint, 0100)
+	snapVol, err := vol.NewSnapshot(snapName)
 	if err != nil {
-		return fmt.Errorf("Failed to chmod %q: %w", tmpInstanceMntPoint, err)
+		return err
 	}
 
-	// Create the read-only snapshot.
-	targetVolume := tmpInstanceMntPoint + "/.backup"
-	_, err = d.snapshotSubvolume(sourceVolume, targetVolume, true)
+	unlock, err := d.snapshotsLock(vol.volType, vol.contentType, vol.name)
 	if err != nil {
 		return err
 	}
 
-	defer func() { _ = d.deleteSubvolume(targetVolume, true) }()
+	defer unlock()
 
-	err = d.setSubvolumeReadonlyProperty(targetVolume, true)
+	snapPath := snapVol.MountPath()
+	if shared.PathExists(snapPath) {
+		return fmt.Errorf("Snapshot %q already exists", snapVol.name)
+	}
+
+	// The parent is looked up by "btrfs receive" using the UUID recorded in the stream, which could match any
+	// subvolume on the pool. So check that the stream refers to the parent snapshot (by its received UUID, or
+	// its own UUID if it wasn't received) and that a stream without a parent snapshot isn't incremental.
+	streamParentUUID, r, err := btrfsReadStreamParentUUID(r)
 	if err != nil {
 		return err
 	}
 
-	// Dump the instance to a file.
-	fileNamePrefix := "container"
-	switch vol.volType {
-	case VolumeTypeVM:
-		if vol.contentType == ContentTypeFS {
-			fileNamePrefix = "virtual-machine-config"
-		} else {
-			fileNamePrefix = "virtual-machine"
+	if parentSnap != "" {
+		parentVol, err := vol.NewSnapshot(parentSnap)
+		if err != nil {
+			return err
 		}
 
-	case VolumeTypeCustom:
-		fileNamePrefix = "volume"
+		if !shared.PathExists(parentVol.MountPath()) {
+			return fmt.Errorf("Parent snapshot %q not found", parentVol.name)
+		}
+
+		output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", parentVol.MountPath())
+		if err != nil {
+			return fmt.Errorf("Failed getting information of parent snapshot %q: %w", parentVol.name, err)
+		}
+
+		parentUUID, reason := btrfsSendParentUUID(output)
+		if reason != "" {
+			return fmt.Errorf("Parent snapshot %q can't be used: %s", parentVol.name, reason)
+		}
+
+		ownUUID, _ := btrfsSubvolumeShowField(output, "UUID")
+		if streamParentUUID == "" {
+			return fmt.Errorf("Stream isn't incremental to parent snapshot %q", parentVol.name)
+		}
+
+		if streamParentUUID != parentUUID && streamParentUUID != ownUUID {
+			return fmt.Errorf("Stream is incremental to subvolume %q rather than to parent snapshot %q (%s)", streamParentUUID, parentVol.name, parentUUID)
+		}
+	} else if streamParentUUID != "" {
+		return fmt.Errorf("Stream is incremental to subvolume %q but no parent snapshot was given", streamParentUUID)
 	}
 
-	err = addVolume(vol.Volume, targetVolume, lastVolPath, fileNamePrefix)
+	revert := revert.New()
+	defer revert.Fail()
+
+	err = createParentSnapshotDirIfMissing(d.name, vol.volType, vol.name)
 	if err != nil {
 		return err
 	}
 
-	// Ensure snapshot sub volumes are removed.
-	err = d.deleteSubvolume(targetVolume, true)
+	revert.Add(func() { _ = deleteParentSnapshotDirIfEmpty(d.name, vol.volType, vol.name) })
+
+	// Receive into a temporary directory so that a partially received subvolume can't be mistaken for
+	// the snapshot.
+	instancesPath := GetVolumeMountPath(d.name, vol.volType, "")
+	tmpVolumesMountPoint, err := os.MkdirTemp(instancesPath, "migration.")
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed to create temporary directory under %q: %w", instancesPath, err)
 	}
 
-	return nil
-}
+	defer func() {
+		// Remove anything left behind by a failed receive.
+		entries, _ := os.ReadDir(tmpVolumesMountPoint)
+		for _, entry := range entries {
+			_ = d.deleteSubvolume(filepath.Join(tmpVolumesMountPoint, entry.Name()), true)
+		}
 
-// CreateVolumeSnapshot creates a snapshot of a volume.
-func (d *btrfs) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
-	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
-	srcPath := GetVolumeMountPath(d.name, snapVol.volType, parentName)
-	snapPath := snapVol.MountPath()
+		_ = os.RemoveAll(tmpVolumesMountPoint)
+	}()
 
-	// Create the parent directory.
-	err := createParentSnapshotDirIfMissing(d.name, snapVol.volType, parentName)
+	untrack := btrfsTrackTransientPath(tmpVolumesMountPoint)
+	defer untrack()
+
+	err = os.Chmod(tmpVolumesMountPoint, 0100)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed to chmod %q: %w", tmpVolumesMountPoint, err)
 	}
 
-	revert := revert.New()
-	defer revert.Fail()
+	var tracker *ioprogress.ProgressTracker
+	if op != nil {
+		tracker = migration.ProgressTracker(op, "fs_progress", snapVol.name)
+	}
 
-	cleanup, err := d.snapshotSubvolume(srcPath, snapPath, true)
+	d.logger.Debug("Receiving snapshot stream", logger.Ctx{"name": snapVol.name, "parent": parentSnap, "receivePath": tmpVolumesMountPoint})
+
+	subVolRecvPath, err := d.receiveSubVolume(r, tmpVolumesMountPoint, tracker, false)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed receiving snapshot %q: %w", snapVol.name, err)
 	}
 
-	if cleanup != nil {
-		revert.Add(cleanup)
+	receivedVol := Volume{
+		pool:            d.name,
+		mountCustomPath: subVolRecvPath,
 	}
 
-	err = d.setSubvolumeReadonlyProperty(snapPath, true)
+	// The "Received UUID" field is set by "btrfs receive" and is what allows future incremental streams
+	// to find this snapshot as their parent. Unlike in the migration case the subvolume is kept readonly
+	// (like all snapshots), which preserves the field when moving it to its final location.
+	UUID, err := d.getSubVolumeReceivedUUID(receivedVol)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed getting UUID: %w", err)
 	}
 
-	// Set any subvolumes that were readonly in the source also readonly in the snapshot.
-	srcVol := NewVolume(d, d.name, snapVol.volType, snapVol.contentType, parentName, snapVol.config, snapVol.poolConfig)
-	subVols, err := d.getSubvolumesMetaData(srcVol)
-	if err != nil {
-		return err
+	if UUID == "" {
+		return fmt.Errorf("Received snapshot %q has no received UUID", snapVol.name)
 	}
 
-	for _, subVol := range subVols {
-		if subVol.Readonly {
-			err = d.setSubvolumeReadonlyProperty(filepath.Join(snapPath, subVol.Path), true)
-			if err != nil {
-				return err
-			}
-		}
+	err = os.Rename(subVolRecvPath, snapPath)
+	if err != nil {
+		return err
 	}
 
 	revert.Success()
@@ -1723,16 +4174,24 @@ func (d *btrfs) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) e
 // must be bare names and should not be in the format "volume/snapshot".
 func (d *btrfs) DeleteVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
 	snapPath := snapVol.MountPath()
+	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
+
+	// Prevent the parent snapshot directory from being removed while a snapshot is being created in it.
+	unlock, err := d.snapshotsLock(snapVol.volType, snapVol.contentType, parentName)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
 
 	// Delete the snapshot.
-	err := d.deleteSubvolume(snapPath, true)
+	err = d.deleteSubvolume(snapPath, true)
 	if err != nil {
 		return err
 	}
 
 	// Remove the parent snapshot directory if this is the last snapshot being removed.
-	parentName, _, _ := api.GetParentAndSnapshotName(snapVol.name)
-	err = deleteParentSnapshotDirIfEmpty(d.name, snapVol.volType, parentName)
+	err = d.deleteParentSnapshotDir(snapVol.volType, parentName)
 	if err != nil {
 		return err
 	}
@@ -1760,15 +4219,84 @@ func (d *btrfs) MountVolumeSnapshot(snapVol Volume, op *operations.Operation) er
 		}
 	}
 
+	revert := revert.New()
+	defer revert.Fail()
+
 	_, err = mountReadOnly(snapPath, snapPath)
 	if err != nil {
 		return err
 	}
 
+	revert.Add(func() { _, _ = forceUnmount(snapPath) })
+
+	// Encrypted snapshots are used through their decrypted device, as returned by GetVolumeDiskPath.
+	if btrfsEncrypted(snapVol) {
+		_, err = d.luksOpen(snapVol)
+		if err != nil {
+			return err
+		}
+	}
+
 	snapVol.MountRefCountIncrement() // From here on it is up to caller to call UnmountVolumeSnapshot() when done.
+	revert.Success()
 	return nil
 }
 
+// MountSnapshotWritable creates an ephemeral writable snapshot of snapVol and returns its path together with a
+// cleanup function that deletes it again. Any changes made below the returned path are discarded on cleanup.
+// Ephemeral snapshots left behind by a crash are removed the next time the pool is mounted.
+func (d *btrfs) MountSnapshotWritable(snapVol Volume, op *operations.Operation) (string, func(), error) {
+	if !snapVol.IsSnapshot() {
+		return "", nil, fmt.Errorf("Volume %q is not a snapshot", snapVol.name)
+	}
+
+	revert := revert.New()
+	defer revert.Fail()
+
+	tmpDir, err := os.MkdirTemp(GetPoolMountPath(d.name), btrfsEphemeralSnapshotPrefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to create temporary directory: %w", err)
+	}
+
+	revert.Add(func() { _ = os.RemoveAll(tmpDir) })
+
+	untrack := btrfsTrackTransientPath(tmpDir)
+	revert.Add(untrack)
+
+	err = os.Chmod(tmpDir, 0100)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to chmod %q: %w", tmpDir, err)
+	}
+
+	_, snapName, _ := api.GetParentAndSnapshotName(snapVol.name)
+	mountPath := filepath.Join(tmpDir, snapName)
+
+	// Snapshots of a readonly subvolume are writable unless explicitly made readonly.
+	cleanup, err := d.snapshotSubvolume(snapVol.MountPath(), mountPath, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cleanup != nil {
+		revert.Add(cleanup)
+	}
+
+	d.logger.Debug("Created ephemeral writable snapshot", logger.Ctx{"name": snapVol.name, "path": mountPath})
+
+	revert.Success()
+	return mountPath, func() {
+		defer untrack()
+
+		err := d.deleteSubvolume(mountPath, true)
+		if err != nil {
+			d.logger.Warn("Failed deleting ephemeral snapshot", logger.Ctx{"path": mountPath, "err": err})
+			return
+		}
+
+		_ = os.RemoveAll(tmpDir)
+	}, nil
+}
+
 // UnmountVolumeSnapshot removes the read-only mount placed on top of a snapshot.
 func (d *btrfs) UnmountVolumeSnapshot(snapVol Volume, op *operations.Operation) (bool, error) {
 	unlock, err := snapVol.MountLock()
@@ -1784,10 +4312,91 @@ func (d *btrfs) UnmountVolumeSnapshot(snapVol Volume, op *operations.Operation)
 		return false, ErrInUse
 	}
 
+	if btrfsEncrypted(snapVol) {
+		err = d.luksClose(snapVol)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	snapPath := snapVol.MountPath()
 	return forceUnmount(snapPath)
 }
 
+// HasVolumeSnapshot returns whether the named snapshot of the volume exists, by checking for its subvolume
+// directly rather than listing all snapshots of the volume.
+func (d *btrfs) HasVolumeSnapshot(vol Volume, snapName string) (bool, error) {
+	err := instancetype.ValidSnapName(snapName)
+	if err != nil {
+		return false, fmt.Errorf("Invalid snapshot name %q: %w", snapName, err)
+	}
+
+	snapPath := GetVolumeMountPath(d.name, vol.volType, GetSnapshotVolumeName(vol.name, snapName))
+
+	_, err = os.Lstat(snapPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("Failed checking snapshot %q: %w", snapPath, err)
+	}
+
+	return d.isSubvolume(snapPath), nil
+}
+
+// SyncVolume commits all changes to the volume to disk. Btrfs commits the changes to all subvolumes of a
+// filesystem in a single transaction, so this flushes the whole pool.
+func (d *btrfs) SyncVolume(vol Volume) error {
+	_, err := shared.RunCommandContext(d.state.ShutdownCtx, "btrfs", "filesystem", "sync", vol.MountPath())
+	if err != nil {
+		return fmt.Errorf("Failed syncing volume %q: %w", vol.name, err)
+	}
+
+	return nil
+}
+
+// IsVolumeFlushed returns whether all changes to the volume have been committed to disk. This is a best effort
+// answer: the generation of the subvolume is only updated when a transaction is committed, so any items of its
+// tree written in a later (or the running) transaction mean there are uncommitted changes. Writes to files
+// update their inodes in the running transaction, but data written through memory mappings may not be
+// seen until it is written back. Nested subvolumes aren't checked.
+func (d *btrfs) IsVolumeFlushed(vol Volume) (bool, error) {
+	generation, err := d.getSubvolumeGeneration(vol.MountPath())
+	if err != nil {
+		return false, err
+	}
+
+	changed, err := btrfsSubvolumeChangedSince(vol.MountPath(), generation)
+	if err != nil {
+		return false, err
+	}
+
+	return !changed, nil
+}
+
+// GetSubvolumePath returns the path of the volume's subvolume as btrfs sees it, relative to the top level
+// subvolume of the filesystem. This includes btrfs.subvolume_prefix or the location of the pool's source
+// within an existing filesystem, and can be used with btrfs commands which take a subvolume path rather than
+// a mount path.
+func (d *btrfs) GetSubvolumePath(vol Volume) (string, error) {
+	if !d.isSubvolume(vol.MountPath()) {
+		return "", fmt.Errorf("Volume %q doesn't exist", vol.name)
+	}
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", vol.MountPath())
+	if err != nil {
+		return "", fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	path := btrfsSubvolumeShowPath(output)
+	if path == "" {
+		return "", fmt.Errorf("Failed to find subvolume path of volume %q", vol.name)
+	}
+
+	return path, nil
+}
+
 // VolumeSnapshots returns a list of snapshots for the volume (in no particular order).
 func (d *btrfs) VolumeSnapshots(vol Volume, op *operations.Operation) ([]string, error) {
 	return genericVFSVolumeSnapshots(d, vol, op)
@@ -1815,35 +4424,152 @@ func (d *btrfs) volumeSnapshotsSorted(vol Volume, op *operations.Operation) ([]s
 			continue
 		}
 
-		if !strings.HasPrefix(fields[8], snapshotPrefix) {
+		relPath, found := d.poolRelativeSubvolumePath(fields[8])
+		if !found {
+			continue
+		}
+
+		snapName, found := strings.CutPrefix(relPath, snapshotPrefix)
+		if !found {
 			continue
 		}
 
 		// Exclude subvolumes of snapshots
-		if strings.Contains(strings.TrimPrefix(fields[8], snapshotPrefix), "/") {
+		if strings.Contains(snapName, "/") {
 			continue
 		}
 
-		snapshotNames = append(snapshotNames, filepath.Base(fields[8]))
+		snapshotNames = append(snapshotNames, snapName)
 	}
 
 	return snapshotNames, nil
 }
 
+// IsValidSendParent checks whether a snapshot can be used as the parent of an incremental send ("btrfs send -p").
+// Returns the UUID by which the target identifies the parent, or a reason why the snapshot can't be used.
+func (d *btrfs) IsValidSendParent(snapVol Volume) (bool, string, error) {
+	if !snapVol.IsSnapshot() {
+		return false, "", errors.New("Volume must be a snapshot")
+	}
+
+	snapPath := snapVol.MountPath()
+	if !d.isSubvolume(snapPath) {
+		return false, "Snapshot is not a subvolume", nil
+	}
+
+	output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", snapPath)
+	if err != nil {
+		return false, "", fmt.Errorf("Failed to get subvol information: %w", err)
+	}
+
+	parentUUID, reason := btrfsSendParentUUID(output)
+	if reason != "" {
+		return false, reason, nil
+	}
+
+	if btrfsIncrementalDisabled(snapPath) {
+		return false, "Snapshot's received UUID couldn't be set when it was received", nil
+	}
+
+	return true, parentUUID, nil
+}
+
+// GetSnapshotParentChain returns the UUIDs of the volume's snapshots in the order they were created, followed by
+// those of the volume itself. This is the lineage incremental sends rely on to find parents on the target.
+func (d *btrfs) GetSnapshotParentChain(vol Volume) ([]SnapshotUUIDInfo, error) {
+	snapshots, err := d.volumeSnapshotsSorted(vol, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := make([]SnapshotUUIDInfo, 0, len(snapshots)+1)
+
+	for _, snapName := range append(snapshots, "") {
+		path := vol.MountPath()
+		if snapName != "" {
+			snapVol, _ := vol.NewSnapshot(snapName)
+			path = snapVol.MountPath()
+		}
+
+		output, err := shared.RunCommandContext(context.TODO(), "btrfs", "subvolume", "show", path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get subvol information: %w", err)
+		}
+
+		chain = append(chain, btrfsSnapshotUUIDInfo(snapName, output))
+	}
+
+	return chain, nil
+}
+
+// GetIncrementalBackupPlan returns the sends needed to bring a backup of the volume holding the snapshot since up
+// to date, in the order they must be applied. The chain is that of optimized backups: each snapshot is sent as
+// the difference to the previous one, and the volume last as the difference to its latest snapshot. If since
+// is empty or can't be used as a parent, the plan starts with a full send of the oldest snapshot. Only the
+// snapshots included in backups of the volume are planned, see FilterBackupSnapshots.
+func (d *btrfs) GetIncrementalBackupPlan(vol Volume, since string) ([]BackupStep, error) {
+	snapshots, err := d.volumeSnapshotsSorted(vol, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, _ = d.FilterBackupSnapshots(vol, snapshots)
+
+	if since != "" && slices.Contains(snapshots, since) {
+		snapVol, _ := vol.NewSnapshot(since)
+
+		valid, reason, err := d.IsValidSendParent(snapVol)
+		if err != nil {
+			return nil, err
+		}
+
+		if !valid {
+			d.logger.Debug("Planning full backup as snapshot can't be used as parent", logger.Ctx{"name": vol.name, "snapshot": since, "reason": reason})
+			since = ""
+		}
+	}
+
+	return btrfsIncrementalBackupPlan(snapshots, since), nil
+}
+
 // RestoreVolume restores a volume from a snapshot.
 func (d *btrfs) RestoreVolume(vol Volume, snapVol Volume, op *operations.Operation) error {
+	err := d.restoreVolume(vol, snapVol, op)
+	d.emitEvent(BTRFSEventVolumeRestored, vol, err)
+
+	return err
+}
+
+// restoreVolume restores a volume from a snapshot.
+func (d *btrfs) restoreVolume(vol Volume, snapVol Volume, op *operations.Operation) error {
 	revert := revert.New()
 	defer revert.Fail()
 
 	_, snapshotName, _ := api.GetParentAndSnapshotName(snapVol.name)
 	srcVol := NewVolume(d, d.name, vol.volType, vol.contentType, GetSnapshotVolumeName(vol.name, snapshotName), vol.config, vol.poolConfig)
 
+	if d.config["btrfs.restore_method"] == "diff" {
+		err := d.restoreVolumeDiff(vol, srcVol)
+		if err == nil {
+			return nil
+		}
+
+		// Replacing the volume gives the correct result regardless of how far the in place restore got.
+		d.logger.Debug("Falling back to replacing volume for restore", logger.Ctx{"name": vol.name, "snapshot": snapshotName, "err": err})
+	}
+
 	// Scan source for subvolumes (so we can apply the readonly properties on the restored snapshot).
 	subVols, err := d.getSubvolumesMetaData(srcVol)
 	if err != nil {
 		return err
 	}
 
+	// Refuse the restore before the volume is moved aside if it can't complete.
+	err = d.checkRestoreSpace(vol, len(subVols))
+	if err != nil {
+		return err
+	}
+
 	target := vol.MountPath()
 
 	// Create a backup so we can revert.
@@ -1855,6 +4581,9 @@ func (d *btrfs) RestoreVolume(vol Volume, snapVol Volume, op *operations.Operati
 
 	revert.Add(func() { _ = os.Rename(backupSubvolume, target) })
 
+	untrack := btrfsTrackTransientPath(backupSubvolume)
+	defer untrack()
+
 	// Restore the snapshot.
 	cleanup, err := d.snapshotSubvolume(srcVol.MountPath(), target, true)
 	if err != nil {
@@ -423,6 +423,12 @@ func (d *common) BackupVolume(vol VolumeCopy, tarWriter *instancewriter.Instance
 	return ErrNotSupported
 }
 
+// FilterBackupSnapshots returns the snapshots, ordered from oldest to newest, that backups of the volume include.
+// Also returns whether older snapshots are left out, in which case the backup has a partial history.
+func (d *common) FilterBackupSnapshots(vol Volume, snapshots []string) ([]string, bool) {
+	return snapshots, false
+}
+
 // CreateVolumeSnapshot creates a new snapshot.
 func (d *common) CreateVolumeSnapshot(snapVol Volume, op *operations.Operation) error {
 	return ErrNotSupported
@@ -548,6 +548,11 @@ func genericVFSBackupVolume(d Driver, vol VolumeCopy, tarWriter *instancewriter.
 						return fmt.Errorf("Error walking file during export: %q: %w", srcPath, err)
 					}
 
+					// Stop packing the volume if the backup operation was cancelled.
+					if op != nil && op.Context().Err() != nil {
+						return fmt.Errorf("Backup cancelled: %w", op.Context().Err())
+					}
+
 					name := filepath.Join(prefix, strings.TrimPrefix(srcPath, mountPath))
 
 					// Write the file to the tarball with ignoreGrowth enabled so that if the
@@ -110,5 +110,6 @@ type Driver interface {
 
 	// Backup.
 	BackupVolume(vol VolumeCopy, tarWriter *instancewriter.InstanceTarWriter, optimized bool, snapshots []string, op *operations.Operation) error
+	FilterBackupSnapshots(vol Volume, snapshots []string) ([]string, bool)
 	CreateVolumeFromBackup(vol VolumeCopy, srcBackup backup.Info, srcData io.ReadSeeker, op *operations.Operation) (VolumePostHook, revert.Hook, error)
 }
@@ -1846,6 +1846,8 @@ func storagePoolVolumeTypePostMigration(state *state.State, r *http.Request, req
 		return response.InternalError(err)
 	}
 
+	ws.verifyContent = req.VerifyContent
+
 	resources := map[string][]api.URL{}
 	srcVolParentName, srcVolSnapName, srcIsSnapshot := api.GetParentAndSnapshotName(volumeName)
 	if srcIsSnapshot {
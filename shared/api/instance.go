@@ -151,6 +151,12 @@ type InstancePost struct {
 	//
 	// API extension: override_snapshot_profiles_on_copy
 	OverrideSnapshotProfiles bool `json:"override_snapshot_profiles" yaml:"override_snapshot_profiles"`
+
+	// Whether the target should verify a content hash of the transferred volumes (migration only)
+	// Example: false
+	//
+	// API extension: migration_verify_content
+	VerifyContent bool `json:"verify_content" yaml:"verify_content"`
 }
 
 // InstancePostTarget represents the migration target host and operation.
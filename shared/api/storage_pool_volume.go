@@ -75,6 +75,12 @@ type StorageVolumePost struct {
 	//
 	// API extension: cluster_internal_custom_volume_copy
 	Source StorageVolumeSource `json:"source" yaml:"source"`
+
+	// Whether the target should verify a content hash of the transferred volume (migration only)
+	// Example: false
+	//
+	// API extension: migration_verify_content
+	VerifyContent bool `json:"verify_content" yaml:"verify_content"`
 }
 
 // StorageVolumePostTarget represents the migration target host and operation
@@ -451,6 +451,33 @@ var APIExtensions = []string{
 	"networks_all_projects",
 	"clustering_restore_skip_mode",
 	"disk_io_threads_virtiofsd",
+	"storage_btrfs_subvolume_prefix",
+	"storage_btrfs_quota_simple",
+	"storage_btrfs_readonly",
+	"storage_btrfs_max_concurrent_fills",
+	"storage_btrfs_snapshots_disable",
+	"storage_btrfs_quota_defer_restore",
+	"storage_btrfs_block_format",
+	"storage_btrfs_restore_bandwidth_limit",
+	"storage_btrfs_block_encryption",
+	"storage_btrfs_backup_working_dir",
+	"storage_btrfs_max_volumes",
+	"storage_btrfs_delete_mode",
+	"storage_btrfs_restore_method",
+	"storage_btrfs_restore_writable_subvolumes",
+	"storage_btrfs_migration_ioprio",
+	"storage_btrfs_compression",
+	"storage_btrfs_seed",
+	"storage_btrfs_qgroup_parent",
+	"storage_btrfs_snapshot_exclude",
+	"storage_btrfs_migration_header_timeout",
+	"storage_btrfs_snapshots_min_interval",
+	"storage_btrfs_compression_recompress",
+	"storage_btrfs_backup_snapshot_limit",
+	"storage_btrfs_snapshots_strict_cleanup",
+	"storage_btrfs_snapshots_throttle",
+	"storage_btrfs_migration_nested_loop_rsync",
+	"migration_verify_content",
 }
 
 // APIExtensionsCount returns the number of available API extensions.